@@ -22,6 +22,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"go.uber.org/zap"
@@ -62,14 +63,7 @@ func (c *Helm) TemplateLocalChart(ctx context.Context, appName, appDir, namespac
 		args = append(args, fmt.Sprintf("--namespace=%s", namespace))
 	}
 
-	if opts != nil {
-		for _, v := range opts.ValueFiles {
-			args = append(args, "-f", v)
-		}
-		for k, v := range opts.SetFiles {
-			args = append(args, "--set-file", fmt.Sprintf("%s=%s", k, v))
-		}
-	}
+	args = append(args, helmValuesArgs(opts)...)
 
 	var stdout, stderr bytes.Buffer
 	cmd := exec.CommandContext(ctx, c.execPath, args...)
@@ -141,14 +135,7 @@ func (c *Helm) TemplateRemoteChart(ctx context.Context, appName, appDir, namespa
 		args = append(args, fmt.Sprintf("--namespace=%s", namespace))
 	}
 
-	if opts != nil {
-		for _, v := range opts.ValueFiles {
-			args = append(args, "-f", v)
-		}
-		for k, v := range opts.SetFiles {
-			args = append(args, "--set-file", fmt.Sprintf("%s=%s", k, v))
-		}
-	}
+	args = append(args, helmValuesArgs(opts)...)
 
 	c.logger.Info(fmt.Sprintf("start templating a chart from Helm repository for application %s", appName),
 		zap.Any("args", args),
@@ -183,3 +170,32 @@ func (c *Helm) TemplateRemoteChart(ctx context.Context, appName, appDir, namespa
 	}
 	return executor()
 }
+
+// helmValuesArgs returns the arguments for specifying the values in the given options.
+// The values given inline are placed last to take precedence over the value files.
+func helmValuesArgs(opts *config.InputHelmOptions) []string {
+	if opts == nil {
+		return nil
+	}
+
+	var args []string
+	for _, v := range opts.ValueFiles {
+		args = append(args, "-f", v)
+	}
+	for _, k := range sortedKeys(opts.SetFiles) {
+		args = append(args, "--set-file", fmt.Sprintf("%s=%s", k, opts.SetFiles[k]))
+	}
+	for _, k := range sortedKeys(opts.SetValues) {
+		args = append(args, "--set", fmt.Sprintf("%s=%s", k, opts.SetValues[k]))
+	}
+	return args
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
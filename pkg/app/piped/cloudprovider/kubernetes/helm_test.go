@@ -22,8 +22,10 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
 
 	"github.com/pipe-cd/pipe/pkg/app/piped/toolregistry"
+	"github.com/pipe-cd/pipe/pkg/config"
 )
 
 func TestTemplateLocalChart(t *testing.T) {
@@ -73,3 +75,81 @@ func TestTemplateLocalChart_WithNamespace(t *testing.T) {
 		require.Equal(t, namespace, metadata["namespace"])
 	}
 }
+
+func TestTemplateLocalChart_WithValues(t *testing.T) {
+	var (
+		ctx       = context.Background()
+		appName   = "testapp"
+		appDir    = "testdata"
+		chartPath = "testchart"
+	)
+
+	// TODO: Preinstall a helm version inside CI runner to avoid installing.
+	helmPath, _, err := toolregistry.DefaultRegistry().Helm(ctx, "")
+	require.NoError(t, err)
+
+	helm := NewHelm("", helmPath, zap.NewNop())
+	out, err := helm.TemplateLocalChart(ctx, appName, appDir, "testnamespace", chartPath, &config.InputHelmOptions{
+		ReleaseName: "testrelease",
+		ValueFiles:  []string{"testchart-values/values-override.yaml"},
+		SetValues: map[string]string{
+			"image.tag": "v0.2.0",
+		},
+	})
+	require.NoError(t, err)
+
+	manifests, err := ParseManifests(out)
+	require.NoError(t, err)
+	deployments := make([]Manifest, 0, 1)
+	for _, m := range manifests {
+		if m.Key.Kind == KindDeployment {
+			deployments = append(deployments, m)
+		}
+	}
+	require.Equal(t, 1, len(deployments))
+	assert.Equal(t, "testrelease-testchart", deployments[0].Key.Name)
+	assert.Equal(t, "testnamespace", deployments[0].Key.Namespace)
+
+	// The inline values take precedence over the value files.
+	d := &appsv1.Deployment{}
+	err = deployments[0].ConvertToStructuredObject(d)
+	require.NoError(t, err)
+	assert.Equal(t, "gcr.io/pipecd/helloworld:v0.2.0", d.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestTemplateLocalChart_Failure(t *testing.T) {
+	ctx := context.Background()
+
+	// TODO: Preinstall a helm version inside CI runner to avoid installing.
+	helmPath, _, err := toolregistry.DefaultRegistry().Helm(ctx, "")
+	require.NoError(t, err)
+
+	helm := NewHelm("", helmPath, zap.NewNop())
+	_, err = helm.TemplateLocalChart(ctx, "testapp", "testdata", "", "testchart", &config.InputHelmOptions{
+		ValueFiles: []string{"not-found.yaml"},
+	})
+	require.Error(t, err)
+	// The error output of helm must be included.
+	assert.Contains(t, err.Error(), "not-found.yaml")
+}
+
+func TestHelmValuesArgs(t *testing.T) {
+	args := helmValuesArgs(&config.InputHelmOptions{
+		ValueFiles: []string{"values.yaml", "values-prod.yaml"},
+		SetFiles: map[string]string{
+			"config": "config.yaml",
+		},
+		SetValues: map[string]string{
+			"image.tag":    "v1.0.0",
+			"replicaCount": "3",
+		},
+	})
+	assert.Equal(t, []string{
+		"-f", "values.yaml",
+		"-f", "values-prod.yaml",
+		"--set-file", "config=config.yaml",
+		"--set", "image.tag=v1.0.0",
+		"--set", "replicaCount=3",
+	}, args)
+	assert.Empty(t, helmValuesArgs(nil))
+}
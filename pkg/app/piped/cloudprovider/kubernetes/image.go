@@ -0,0 +1,99 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// The paths to the pod spec of each workload kind.
+var podSpecPaths = map[string][]string{
+	KindDeployment:  {"spec", "template", "spec"},
+	KindStatefulSet: {"spec", "template", "spec"},
+	KindDaemonSet:   {"spec", "template", "spec"},
+	KindReplicaSet:  {"spec", "template", "spec"},
+	KindJob:         {"spec", "template", "spec"},
+	KindCronJob:     {"spec", "jobTemplate", "spec", "template", "spec"},
+	KindPod:         {"spec"},
+}
+
+// overrideImages replaces the tag or digest of the container images of all workloads
+// in the given manifests. The overrides are keyed by the image name without tag and digest,
+// e.g. "gcr.io/pipecd/helloworld", and the values are either a tag, e.g. "v0.2.0",
+// or a digest, e.g. "sha256:...". The containers using the other images are left as they are.
+func overrideImages(manifests []Manifest, overrides map[string]string) error {
+	for i := range manifests {
+		path, ok := podSpecPaths[manifests[i].Key.Kind]
+		if !ok {
+			continue
+		}
+		for _, field := range []string{"initContainers", "containers"} {
+			fieldPath := append(append([]string{}, path...), field)
+			if err := overrideContainerImages(manifests[i].u, fieldPath, overrides); err != nil {
+				return fmt.Errorf("unable to override images of %s: %w", manifests[i].Key.ReadableString(), err)
+			}
+		}
+	}
+	return nil
+}
+
+func overrideContainerImages(u *unstructured.Unstructured, path []string, overrides map[string]string) error {
+	containers, ok, err := unstructured.NestedSlice(u.Object, path...)
+	if err != nil || !ok {
+		return err
+	}
+	changed := false
+	for _, c := range containers {
+		container, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		image, ok := container["image"].(string)
+		if !ok {
+			continue
+		}
+		name := imageName(image)
+		override, ok := overrides[name]
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(override, "sha256:") {
+			container["image"] = name + "@" + override
+		} else {
+			container["image"] = name + ":" + override
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return unstructured.SetNestedSlice(u.Object, containers, path...)
+}
+
+// imageName returns the given image reference without its tag and digest,
+// e.g. "gcr.io/pipecd/helloworld" for "gcr.io/pipecd/helloworld:v0.1.0".
+// The port of the registry host, e.g. "localhost:5000/helloworld", is kept.
+func imageName(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestOverrideImages(t *testing.T) {
+	manifests, err := ParseManifests(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: init
+        image: gcr.io/pipecd/init:v0.1.0
+      containers:
+      - name: helloworld
+        image: gcr.io/pipecd/helloworld:v0.1.0
+      - name: sidecar
+        image: gcr.io/pipecd/sidecar:v0.1.0
+---
+apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: cron
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: job
+            image: gcr.io/pipecd/init@sha256:0000
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  image: gcr.io/pipecd/helloworld:v0.1.0
+`)
+	require.NoError(t, err)
+
+	err = overrideImages(manifests, map[string]string{
+		"gcr.io/pipecd/helloworld": "v0.2.0",
+		"gcr.io/pipecd/init":       "sha256:1111",
+	})
+	require.NoError(t, err)
+
+	images := func(m Manifest, path ...string) []string {
+		containers, _, err := unstructured.NestedSlice(m.u.Object, path...)
+		require.NoError(t, err)
+		images := make([]string, 0, len(containers))
+		for _, c := range containers {
+			images = append(images, c.(map[string]interface{})["image"].(string))
+		}
+		return images
+	}
+	assert.Equal(t, []string{"gcr.io/pipecd/init@sha256:1111"}, images(manifests[0], "spec", "template", "spec", "initContainers"))
+	assert.Equal(t, []string{"gcr.io/pipecd/helloworld:v0.2.0", "gcr.io/pipecd/sidecar:v0.1.0"}, images(manifests[0], "spec", "template", "spec", "containers"))
+	assert.Equal(t, []string{"gcr.io/pipecd/init@sha256:1111"}, images(manifests[1], "spec", "jobTemplate", "spec", "template", "spec", "containers"))
+
+	data, _, err := unstructured.NestedString(manifests[2].u.Object, "data", "image")
+	require.NoError(t, err)
+	assert.Equal(t, "gcr.io/pipecd/helloworld:v0.1.0", data)
+}
+
+func TestImageName(t *testing.T) {
+	testcases := []struct {
+		image    string
+		expected string
+	}{
+		{image: "nginx", expected: "nginx"},
+		{image: "nginx:1.19", expected: "nginx"},
+		{image: "gcr.io/pipecd/helloworld:v0.1.0", expected: "gcr.io/pipecd/helloworld"},
+		{image: "gcr.io/pipecd/helloworld@sha256:0000", expected: "gcr.io/pipecd/helloworld"},
+		{image: "gcr.io/pipecd/helloworld:v0.1.0@sha256:0000", expected: "gcr.io/pipecd/helloworld"},
+		{image: "localhost:5000/helloworld", expected: "localhost:5000/helloworld"},
+		{image: "localhost:5000/helloworld:v0.1.0", expected: "localhost:5000/helloworld"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.image, func(t *testing.T) {
+			assert.Equal(t, tc.expected, imageName(tc.image))
+		})
+	}
+}
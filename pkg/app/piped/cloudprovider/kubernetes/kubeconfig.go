@@ -0,0 +1,53 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// loadKubeConfig builds the REST config for the cluster of the given context in the given kubeconfig file.
+// Empty path means the kubeconfig is loaded by the default rules, e.g. from $KUBECONFIG,
+// and empty context means the current context of the kubeconfig is used.
+func loadKubeConfig(path, context string) (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = path
+
+	raw, err := rules.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig %q (%v)", path, err)
+	}
+	if context != "" {
+		if _, ok := raw.Contexts[context]; !ok {
+			names := make([]string, 0, len(raw.Contexts))
+			for name := range raw.Contexts {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("context %q was not found in kubeconfig %q, available contexts: [%s]", context, path, strings.Join(names, ", "))
+		}
+	}
+
+	cfg, err := clientcmd.NewNonInteractiveClientConfig(*raw, context, &clientcmd.ConfigOverrides{}, rules).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build the client config from kubeconfig %q (%v)", path, err)
+	}
+	return cfg, nil
+}
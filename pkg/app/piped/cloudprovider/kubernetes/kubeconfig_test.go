@@ -0,0 +1,69 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadKubeConfig(t *testing.T) {
+	const path = "testdata/kubeconfig/config"
+
+	testcases := []struct {
+		name           string
+		context        string
+		expectedHost   string
+		expectedToken  string
+		expectedErrMsg string
+	}{
+		{
+			name:          "current context",
+			expectedHost:  "https://dev.example.com",
+			expectedToken: "dev-token",
+		},
+		{
+			name:          "specified context",
+			context:       "prod",
+			expectedHost:  "https://prod.example.com",
+			expectedToken: "prod-token",
+		},
+		{
+			name:           "unknown context",
+			context:        "staging",
+			expectedErrMsg: `context "staging" was not found in kubeconfig "testdata/kubeconfig/config", available contexts: [dev, prod]`,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := loadKubeConfig(path, tc.context)
+			if tc.expectedErrMsg != "" {
+				require.Error(t, err)
+				assert.Equal(t, tc.expectedErrMsg, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedHost, cfg.Host)
+			assert.Equal(t, tc.expectedToken, cfg.BearerToken)
+		})
+	}
+}
+
+func TestLoadKubeConfigMissingFile(t *testing.T) {
+	_, err := loadKubeConfig("testdata/kubeconfig/not-found", "")
+	assert.Error(t, err)
+}
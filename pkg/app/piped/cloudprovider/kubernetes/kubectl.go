@@ -21,47 +21,268 @@ import (
 	"os/exec"
 	"strings"
 
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
 )
 
+// The field manager used by piped while applying manifests server-side
+// when no other one was configured.
+const defaultFieldManager = "piped"
+
 type Kubectl struct {
 	version  string
 	execPath string
 	config   *rest.Config
+	// The kubeconfig file and the context in it used to connect to the cluster.
+	// Empty means the default ones of kubectl are used.
+	kubeConfigPath string
+	kubeContext    string
+	// The field manager used while applying manifests server-side.
+	fieldManager string
+}
+
+type KubectlOption func(*Kubectl)
+
+// WithKubeConfig makes kubectl connect to the cluster of the given context
+// in the given kubeconfig file.
+func WithKubeConfig(path, context string, config *rest.Config) KubectlOption {
+	return func(c *Kubectl) {
+		c.kubeConfigPath = path
+		c.kubeContext = context
+		c.config = config
+	}
+}
+
+// WithFieldManager makes kubectl use the given field manager while applying manifests server-side
+// instead of the default one, e.g. to not conflict with the other piped instances.
+func WithFieldManager(name string) KubectlOption {
+	return func(c *Kubectl) {
+		c.fieldManager = name
+	}
 }
 
-func NewKubectl(version, path string) *Kubectl {
-	return &Kubectl{
-		version:  version,
-		execPath: path,
+func NewKubectl(version, path string, opts ...KubectlOption) *Kubectl {
+	c := &Kubectl{
+		version:      version,
+		execPath:     path,
+		fieldManager: defaultFieldManager,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ApplyAction represents the action kubectl took on a resource while applying.
+type ApplyAction string
+
+const (
+	ApplyActionCreated    ApplyAction = "created"
+	ApplyActionConfigured ApplyAction = "configured"
+	ApplyActionUnchanged  ApplyAction = "unchanged"
+	// Server-side apply does not tell whether the resource was created or configured.
+	ApplyActionServerSideApplied ApplyAction = "serverside-applied"
+	// The resource was not applied since its live state already matched the manifest.
+	ApplyActionSkipped ApplyAction = "skipped"
+)
+
+// ApplyResult represents the result of applying a resource.
+type ApplyResult struct {
+	// The resource in the form of kubectl output, e.g. "deployment.apps/simple".
+	Resource string
+	Action   ApplyAction
 }
 
-func (c *Kubectl) Apply(ctx context.Context, namespace string, manifest Manifest) (err error) {
+// Apply applies the given manifest and returns the action taken on the resource.
+// Empty action is returned when kubectl did not report it.
+func (c *Kubectl) Apply(ctx context.Context, namespace string, manifest Manifest) (ApplyAction, error) {
+	results, err := c.ApplyAll(ctx, namespace, []Manifest{manifest})
+	if err != nil || len(results) == 0 {
+		return "", err
+	}
+	return results[0].Action, nil
+}
+
+// ApplyAll applies all of the given manifests at once by passing them through stdin
+// and returns the action taken on each resource.
+func (c *Kubectl) ApplyAll(ctx context.Context, namespace string, manifests []Manifest) (results []ApplyResult, err error) {
+	defer func() {
+		metricsKubectlCalled(c.version, "apply", err == nil)
+	}()
+
+	var data bytes.Buffer
+	for i, m := range manifests {
+		b, err := m.YamlBytes()
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			data.WriteString("---\n")
+		}
+		data.Write(b)
+	}
+
+	args := c.makeArgs(namespace, "apply", "-f", "-")
+
+	cmd := exec.CommandContext(ctx, c.execPath, args...)
+	cmd.Stdin = &data
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply: %s (%v)", string(out), err)
+	}
+	return parseApplyResults(string(out)), nil
+}
+
+// parseApplyResults parses the output lines of kubectl apply such as "deployment.apps/simple configured".
+// The lines not reporting the result of a resource, e.g. warnings, are ignored.
+func parseApplyResults(out string) []ApplyResult {
+	var results []ApplyResult
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.Contains(fields[0], "/") {
+			continue
+		}
+		switch action := ApplyAction(fields[1]); action {
+		case ApplyActionCreated, ApplyActionConfigured, ApplyActionUnchanged, ApplyActionServerSideApplied:
+			results = append(results, ApplyResult{
+				Resource: fields[0],
+				Action:   action,
+			})
+		}
+	}
+	return results
+}
+
+// ServerSideApply applies the given manifest by using Kubernetes server-side apply
+// with piped as the field manager. ErrApplyConflict is returned when some fields
+// are owned by the other managers.
+func (c *Kubectl) ServerSideApply(ctx context.Context, namespace string, manifest Manifest) (ApplyAction, error) {
+	return c.serverSideApply(ctx, namespace, manifest, false)
+}
+
+// ForceServerSideApply applies the given manifest by using Kubernetes server-side apply
+// while taking the ownership of the fields owned by the other managers.
+func (c *Kubectl) ForceServerSideApply(ctx context.Context, namespace string, manifest Manifest) (ApplyAction, error) {
+	return c.serverSideApply(ctx, namespace, manifest, true)
+}
+
+func (c *Kubectl) serverSideApply(ctx context.Context, namespace string, manifest Manifest, force bool) (action ApplyAction, err error) {
 	defer func() {
 		metricsKubectlCalled(c.version, "apply", err == nil)
 	}()
 
 	data, err := manifest.YamlBytes()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	args := make([]string, 0, 5)
-	if namespace != "" {
-		args = append(args, "-n", namespace)
+	args := c.makeArgs(namespace, "apply", "--server-side", "--field-manager="+c.fieldManager)
+	if force {
+		args = append(args, "--force-conflicts")
 	}
-	args = append(args, "apply", "-f", "-")
+	args = append(args, "-f", "-")
 
 	cmd := exec.CommandContext(ctx, c.execPath, args...)
 	r := bytes.NewReader(data)
 	cmd.Stdin = r
 
 	out, err := cmd.CombinedOutput()
+	if strings.Contains(string(out), "Apply failed with") {
+		return "", fmt.Errorf("failed to apply: %s, (%w), %v", string(out), ErrApplyConflict, err)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to apply: %s (%v)", string(out), err)
+		return "", fmt.Errorf("failed to apply: %s (%v)", string(out), err)
 	}
-	return nil
+	if results := parseApplyResults(string(out)); len(results) > 0 {
+		return results[0].Action, nil
+	}
+	return "", nil
+}
+
+// parseApplyConflicts returns the conflicting fields reported in the given output of server-side apply.
+// kubectl reports a single conflict at the end of the line, e.g. `conflict with "manager" using v1: .data.key`,
+// and multiple conflicts in the following lines, e.g. `- .spec.replicas`.
+func parseApplyConflicts(out string) []string {
+	var fields []string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "- .") {
+			fields = append(fields, strings.TrimPrefix(line, "- "))
+			continue
+		}
+		i := strings.Index(line, "conflict with ")
+		if i < 0 {
+			continue
+		}
+		if j := strings.Index(line[i:], ": ."); j >= 0 {
+			fields = append(fields, line[i+j+2:])
+		}
+	}
+	return fields
+}
+
+// ServerSideApplyDryRun runs server-side apply without persisting the given manifest
+// and returns the resulting object as it would be stored in the cluster.
+func (c *Kubectl) ServerSideApplyDryRun(ctx context.Context, namespace string, manifest Manifest) (m Manifest, err error) {
+	defer func() {
+		metricsKubectlCalled(c.version, "apply-dry-run", err == nil)
+	}()
+
+	data, err := manifest.YamlBytes()
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	args := c.makeArgs(namespace, "apply", "--server-side", "--field-manager="+c.fieldManager, "--dry-run=server", "-o", "yaml", "-f", "-")
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.execPath, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if strings.Contains(stderr.String(), "Apply failed with") {
+		return Manifest{}, fmt.Errorf("failed to apply: %s, (%w), %v", stderr.String(), ErrApplyConflict, err)
+	}
+	if err != nil && isInvalidManifestOutput(stderr.String()) {
+		return Manifest{}, fmt.Errorf("%w: %s", ErrInvalidManifest, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to apply: %s (%v)", stderr.String(), err)
+	}
+
+	manifests, err := ParseManifests(string(out))
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to parse the dry-run result of %s (%v)", manifest.Key.ReadableString(), err)
+	}
+	if len(manifests) != 1 {
+		return Manifest{}, fmt.Errorf("unexpected number of manifests in the dry-run result of %s: %d", manifest.Key.ReadableString(), len(manifests))
+	}
+	return manifests[0], nil
+}
+
+// The messages printed by kubectl when the manifest was rejected by the schema validation,
+// e.g. a field of the wrong type, an unknown field or a missing required one.
+var invalidManifestMessages = []string{
+	"is invalid",
+	"failed to create typed patch object",
+	"cannot be handled as",
+	"strict decoding error",
+	"validationerror",
+}
+
+// isInvalidManifestOutput reports whether the given output of kubectl
+// indicates that the manifest does not match the schema of the cluster.
+func isInvalidManifestOutput(out string) bool {
+	msg := strings.ToLower(out)
+	for _, m := range invalidManifestMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *Kubectl) Delete(ctx context.Context, namespace string, r ResourceKey) (err error) {
@@ -69,11 +290,7 @@ func (c *Kubectl) Delete(ctx context.Context, namespace string, r ResourceKey) (
 		metricsKubectlCalled(c.version, "delete", err == nil)
 	}()
 
-	args := make([]string, 0, 5)
-	if namespace != "" {
-		args = append(args, "-n", namespace)
-	}
-	args = append(args, "delete", r.Kind, r.Name)
+	args := c.makeArgs(namespace, "delete", r.Kind, r.Name)
 
 	cmd := exec.CommandContext(ctx, c.execPath, args...)
 	out, err := cmd.CombinedOutput()
@@ -86,3 +303,112 @@ func (c *Kubectl) Delete(ctx context.Context, namespace string, r ResourceKey) (
 	}
 	return nil
 }
+
+func (c *Kubectl) Get(ctx context.Context, namespace string, r ResourceKey) (m Manifest, err error) {
+	defer func() {
+		metricsKubectlCalled(c.version, "get", err == nil)
+	}()
+
+	args := c.makeArgs(namespace, "get", r.Kind, r.Name, "-o", "yaml")
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.execPath, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+
+	if strings.Contains(stderr.String(), "(NotFound)") {
+		return Manifest{}, fmt.Errorf("failed to get: %s, (%w), %v", stderr.String(), ErrNotFound, err)
+	}
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to get: %s, %v", stderr.String(), err)
+	}
+
+	manifests, err := ParseManifests(string(out))
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to parse the manifest of %s (%v)", r.ReadableString(), err)
+	}
+	if len(manifests) != 1 {
+		return Manifest{}, fmt.Errorf("unexpected number of manifests for %s: %d", r.ReadableString(), len(manifests))
+	}
+	return manifests[0], nil
+}
+
+// List returns the manifests of all resources of the given kind
+// matching the given label selector.
+func (c *Kubectl) List(ctx context.Context, namespace, kind, selector string) (ms []Manifest, err error) {
+	defer func() {
+		metricsKubectlCalled(c.version, "list", err == nil)
+	}()
+
+	args := c.makeArgs(namespace, "get", kind, "-l", selector, "-o", "yaml")
+	return c.list(ctx, kind, args)
+}
+
+// ListEvents returns the events involving the given resource.
+func (c *Kubectl) ListEvents(ctx context.Context, namespace string, r ResourceKey) (ms []Manifest, err error) {
+	defer func() {
+		metricsKubectlCalled(c.version, "list-events", err == nil)
+	}()
+
+	selector := fmt.Sprintf("involvedObject.kind=%s,involvedObject.name=%s", r.Kind, r.Name)
+	args := c.makeArgs(namespace, "get", "events", "--field-selector", selector, "-o", "yaml")
+	return c.list(ctx, "events", args)
+}
+
+// Run runs kubectl with the given arguments against the configured cluster
+// and returns its combined output, e.g. for "rollout restart deployment/simple".
+// The given namespace is used unless the arguments specify another one.
+func (c *Kubectl) Run(ctx context.Context, namespace string, args []string) (out []byte, err error) {
+	defer func() {
+		metricsKubectlCalled(c.version, "run", err == nil)
+	}()
+
+	cmd := exec.CommandContext(ctx, c.execPath, c.makeArgs(namespace, args...)...)
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("failed to run kubectl %s: %s, %v", strings.Join(args, " "), string(out), err)
+	}
+	return out, nil
+}
+
+func (c *Kubectl) list(ctx context.Context, kind string, args []string) ([]Manifest, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.execPath, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list: %s, %v", stderr.String(), err)
+	}
+
+	data, err := yaml.YAMLToJSON(out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the list of %s (%v)", kind, err)
+	}
+	list := &unstructured.UnstructuredList{}
+	if err := list.UnmarshalJSON(data); err != nil {
+		return nil, fmt.Errorf("failed to parse the list of %s (%v)", kind, err)
+	}
+
+	ms := make([]Manifest, 0, len(list.Items))
+	for i := range list.Items {
+		item := &list.Items[i]
+		ms = append(ms, MakeManifest(MakeResourceKey(item), item))
+	}
+	return ms, nil
+}
+
+// makeArgs returns the flags specifying the target cluster and namespace
+// followed by the given arguments.
+func (c *Kubectl) makeArgs(namespace string, args ...string) []string {
+	out := make([]string, 0, len(args)+6)
+	if c.kubeConfigPath != "" {
+		out = append(out, "--kubeconfig", c.kubeConfigPath)
+	}
+	if c.kubeContext != "" {
+		out = append(out, "--context", c.kubeContext)
+	}
+	if namespace != "" {
+		out = append(out, "-n", namespace)
+	}
+	return append(out, args...)
+}
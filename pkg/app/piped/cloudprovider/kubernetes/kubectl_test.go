@@ -0,0 +1,413 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// makeFakeKubectl creates a script recording its arguments and stdin
+// into the given directory and exiting with the given output and code.
+func makeFakeKubectl(t *testing.T, dir, out string, code int) string {
+	script := fmt.Sprintf(`#!/bin/sh
+printf '%%s\n' "$*" > %s
+cat > %s
+echo '%s'
+exit %d
+`, filepath.Join(dir, "args"), filepath.Join(dir, "stdin"), out, code)
+	path := filepath.Join(dir, "kubectl")
+	err := ioutil.WriteFile(path, []byte(script), 0700)
+	require.NoError(t, err)
+	return path
+}
+
+func TestKubectlServerSideApply(t *testing.T) {
+	manifests, err := ParseManifests(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: simple
+data:
+  key: value
+`)
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name         string
+		opts         []KubectlOption
+		force        bool
+		out          string
+		code         int
+		expectedErr  error
+		expectedArgs string
+	}{
+		{
+			name:         "successfully applied",
+			out:          "configmap/simple serverside-applied",
+			expectedArgs: "-n test-ns apply --server-side --field-manager=piped -f -\n",
+		},
+		{
+			name:         "conflicted",
+			out:          `error: Apply failed with 1 conflict: conflict with "kubectl-client-side-apply" using v1: .data.key`,
+			code:         1,
+			expectedErr:  ErrApplyConflict,
+			expectedArgs: "-n test-ns apply --server-side --field-manager=piped -f -\n",
+		},
+		{
+			name:         "forced",
+			force:        true,
+			out:          "configmap/simple serverside-applied",
+			expectedArgs: "-n test-ns apply --server-side --field-manager=piped --force-conflicts -f -\n",
+		},
+		{
+			name:         "configured field manager",
+			opts:         []KubectlOption{WithFieldManager("piped-production")},
+			out:          "configmap/simple serverside-applied",
+			expectedArgs: "-n test-ns apply --server-side --field-manager=piped-production -f -\n",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "kubectl")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			kubectl := NewKubectl("", makeFakeKubectl(t, dir, tc.out, tc.code), tc.opts...)
+			if tc.force {
+				_, err = kubectl.ForceServerSideApply(context.Background(), "test-ns", manifests[0])
+			} else {
+				_, err = kubectl.ServerSideApply(context.Background(), "test-ns", manifests[0])
+			}
+			if tc.expectedErr != nil {
+				assert.True(t, errors.Is(err, tc.expectedErr))
+			} else {
+				assert.NoError(t, err)
+			}
+
+			args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedArgs, string(args))
+
+			stdin, err := ioutil.ReadFile(filepath.Join(dir, "stdin"))
+			require.NoError(t, err)
+			applied, err := ParseManifests(string(stdin))
+			require.NoError(t, err)
+			require.Equal(t, 1, len(applied))
+			assert.Equal(t, manifests[0].Key, applied[0].Key)
+		})
+	}
+}
+
+func TestKubectlList(t *testing.T) {
+	out := `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: simple-1
+    namespace: test-ns
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: simple-2
+    namespace: test-ns
+`
+	dir, err := ioutil.TempDir("", "kubectl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	kubectl := NewKubectl("", makeFakeKubectl(t, dir, out, 0))
+	manifests, err := kubectl.List(context.Background(), "test-ns", KindPod, "app=simple")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(manifests))
+	assert.Equal(t, "simple-1", manifests[0].Key.Name)
+	assert.Equal(t, KindPod, manifests[1].Key.Kind)
+	assert.Equal(t, "simple-2", manifests[1].Key.Name)
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	assert.Equal(t, "-n test-ns get Pod -l app=simple -o yaml\n", string(args))
+}
+
+func TestKubectlServerSideApplyDryRun(t *testing.T) {
+	manifests, err := ParseManifests(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: simple
+data:
+  key: value
+`)
+	require.NoError(t, err)
+
+	out := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: simple
+  namespace: test-ns
+  resourceVersion: "1"
+data:
+  key: value
+`
+	dir, err := ioutil.TempDir("", "kubectl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	kubectl := NewKubectl("", makeFakeKubectl(t, dir, out, 0))
+	applied, err := kubectl.ServerSideApplyDryRun(context.Background(), "test-ns", manifests[0])
+	require.NoError(t, err)
+	assert.Equal(t, "simple", applied.Key.Name)
+	assert.Equal(t, "test-ns", applied.Key.Namespace)
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	assert.Equal(t, "-n test-ns apply --server-side --field-manager=piped --dry-run=server -o yaml -f -\n", string(args))
+}
+
+func TestKubectlServerSideApplyDryRunInvalidManifest(t *testing.T) {
+	manifests, err := ParseManifests(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+spec:
+  replicas: two
+`)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "kubectl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	script := `#!/bin/sh
+cat > /dev/null
+echo 'error: failed to create typed patch object (test-ns/simple; apps/v1, Kind=Deployment): .spec.replicas: expected numeric (int or float), got string' >&2
+exit 1
+`
+	path := filepath.Join(dir, "kubectl")
+	err = ioutil.WriteFile(path, []byte(script), 0700)
+	require.NoError(t, err)
+
+	kubectl := NewKubectl("", path)
+	_, err = kubectl.ServerSideApplyDryRun(context.Background(), "test-ns", manifests[0])
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrInvalidManifest))
+	assert.Contains(t, err.Error(), ".spec.replicas: expected numeric (int or float), got string")
+}
+
+func TestIsInvalidManifestOutput(t *testing.T) {
+	testcases := []struct {
+		name     string
+		out      string
+		expected bool
+	}{
+		{
+			name:     "wrong field type",
+			out:      "error: failed to create typed patch object (default/simple; apps/v1, Kind=Deployment): .spec.replicas: expected numeric (int or float), got string",
+			expected: true,
+		},
+		{
+			name:     "missing required field",
+			out:      `The Deployment "simple" is invalid: spec.template.spec.containers: Required value`,
+			expected: true,
+		},
+		{
+			name:     "unknown field",
+			out:      `Error from server (BadRequest): error when creating "STDIN": Deployment in version "v1" cannot be handled as a Deployment: strict decoding error: unknown field "spec.foo"`,
+			expected: true,
+		},
+		{
+			name:     "forbidden",
+			out:      `Error from server (Forbidden): deployments.apps "simple" is forbidden: User "piped" cannot patch resource "deployments"`,
+			expected: false,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, isInvalidManifestOutput(tc.out))
+		})
+	}
+}
+
+func TestKubectlWithKubeConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubectl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg, err := loadKubeConfig("testdata/kubeconfig/config", "prod")
+	require.NoError(t, err)
+
+	kubectl := NewKubectl("", makeFakeKubectl(t, dir, "", 0), WithKubeConfig("testdata/kubeconfig/config", "prod", cfg))
+	err = kubectl.Delete(context.Background(), "test-ns", ResourceKey{Kind: KindDeployment, Name: "simple"})
+	require.NoError(t, err)
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	assert.Equal(t, "--kubeconfig testdata/kubeconfig/config --context prod -n test-ns delete Deployment simple\n", string(args))
+}
+
+func TestKubectlRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubectl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg, err := loadKubeConfig("testdata/kubeconfig/config", "prod")
+	require.NoError(t, err)
+
+	kubectl := NewKubectl("", makeFakeKubectl(t, dir, "deployment.apps/simple restarted", 0), WithKubeConfig("testdata/kubeconfig/config", "prod", cfg))
+	out, err := kubectl.Run(context.Background(), "test-ns", []string{"rollout", "restart", "deployment/simple"})
+	require.NoError(t, err)
+	assert.Equal(t, "deployment.apps/simple restarted\n", string(out))
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	assert.Equal(t, "--kubeconfig testdata/kubeconfig/config --context prod -n test-ns rollout restart deployment/simple\n", string(args))
+
+	kubectl = NewKubectl("", makeFakeKubectl(t, dir, "error: deployments.apps \"unknown\" not found", 1))
+	out, err = kubectl.Run(context.Background(), "test-ns", []string{"rollout", "restart", "deployment/unknown"})
+	require.Error(t, err)
+	assert.Contains(t, string(out), "not found")
+}
+
+func TestKubectlListEvents(t *testing.T) {
+	out := `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Event
+  metadata:
+    name: simple-1.1234
+    namespace: test-ns
+  type: Warning
+  reason: BackOff
+  message: Back-off restarting failed container
+`
+	dir, err := ioutil.TempDir("", "kubectl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	kubectl := NewKubectl("", makeFakeKubectl(t, dir, out, 0))
+	events, err := kubectl.ListEvents(context.Background(), "test-ns", ResourceKey{Kind: KindPod, Name: "simple-1"})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(events))
+	assert.Equal(t, "simple-1.1234", events[0].Key.Name)
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	assert.Equal(t, "-n test-ns get events --field-selector involvedObject.kind=Pod,involvedObject.name=simple-1 -o yaml\n", string(args))
+}
+
+func TestKubectlApplyAll(t *testing.T) {
+	manifests, err := ParseManifests(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: simple
+data:
+  key: value
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+spec:
+  replicas: 2
+`)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "kubectl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	out := `configmap/simple unchanged
+deployment.apps/simple configured`
+	kubectl := NewKubectl("", makeFakeKubectl(t, dir, out, 0), WithKubeConfig("testdata/kubeconfig/config", "prod", nil))
+	results, err := kubectl.ApplyAll(context.Background(), "test-ns", manifests)
+	require.NoError(t, err)
+	assert.Equal(t, []ApplyResult{
+		{Resource: "configmap/simple", Action: ApplyActionUnchanged},
+		{Resource: "deployment.apps/simple", Action: ApplyActionConfigured},
+	}, results)
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	require.NoError(t, err)
+	assert.Equal(t, "--kubeconfig testdata/kubeconfig/config --context prod -n test-ns apply -f -\n", string(args))
+
+	// All manifests must be piped into kubectl.
+	stdin, err := ioutil.ReadFile(filepath.Join(dir, "stdin"))
+	require.NoError(t, err)
+	piped, err := ParseManifests(string(stdin))
+	require.NoError(t, err)
+	require.Equal(t, 2, len(piped))
+	assert.Equal(t, manifests[0].Key, piped[0].Key)
+	assert.Equal(t, manifests[1].Key, piped[1].Key)
+}
+
+func TestParseApplyResults(t *testing.T) {
+	out := `namespace/test-ns created
+Warning: kubectl apply should be used on resource created by either kubectl create --save-config or kubectl apply
+service/simple configured
+deployment.apps/simple unchanged
+configmap/simple serverside-applied
+`
+	assert.Equal(t, []ApplyResult{
+		{Resource: "namespace/test-ns", Action: ApplyActionCreated},
+		{Resource: "service/simple", Action: ApplyActionConfigured},
+		{Resource: "deployment.apps/simple", Action: ApplyActionUnchanged},
+		{Resource: "configmap/simple", Action: ApplyActionServerSideApplied},
+	}, parseApplyResults(out))
+	assert.Empty(t, parseApplyResults(""))
+}
+
+func TestParseApplyConflicts(t *testing.T) {
+	testcases := []struct {
+		name     string
+		out      string
+		expected []string
+	}{
+		{
+			name:     "single conflict",
+			out:      `error: Apply failed with 1 conflict: conflict with "kubectl-client-side-apply" using v1: .data.key`,
+			expected: []string{".data.key"},
+		},
+		{
+			name: "multiple conflicts",
+			out: `error: Apply failed with 2 conflicts: conflicts with "horizontal-pod-autoscaler" using apps/v1:
+- .spec.replicas
+- .spec.template.spec.containers[name="helloworld"].resources
+Please review the fields above--they currently have other managers.`,
+			expected: []string{".spec.replicas", `.spec.template.spec.containers[name="helloworld"].resources`},
+		},
+		{
+			name: "no conflict",
+			out:  "configmap/simple serverside-applied",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, parseApplyConflicts(tc.out))
+		})
+	}
+}
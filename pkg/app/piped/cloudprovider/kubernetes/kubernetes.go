@@ -20,10 +20,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 
+	"github.com/pipe-cd/pipe/pkg/app/piped/diff"
 	"github.com/pipe-cd/pipe/pkg/app/piped/toolregistry"
 	"github.com/pipe-cd/pipe/pkg/config"
 	"github.com/pipe-cd/pipe/pkg/git"
@@ -31,6 +34,12 @@ import (
 
 var (
 	ErrNotFound = errors.New("not found")
+	// ErrApplyConflict is returned when the server-side apply conflicted
+	// with the fields managed by other field managers.
+	ErrApplyConflict = errors.New("apply conflict")
+	// ErrInvalidManifest is returned when the manifest was rejected
+	// by the schema validation of the cluster.
+	ErrInvalidManifest = errors.New("invalid manifest")
 )
 
 const (
@@ -68,10 +77,25 @@ type ManifestLoader interface {
 type Applier interface {
 	// Apply does applying application manifests by using the tool specified in Input.
 	Apply(ctx context.Context) error
-	// ApplyManifest does applying the given manifest.
-	ApplyManifest(ctx context.Context, manifest Manifest) error
+	// ApplyManifest does applying the given manifest
+	// and returns the action taken on the resource.
+	ApplyManifest(ctx context.Context, manifest Manifest) (ApplyAction, error)
+	// DryRunApplyManifest applies the given manifest in server-side dry-run mode
+	// and returns the resulting object without persisting it.
+	// ErrInvalidManifest is returned when the manifest does not match the schema of the cluster.
+	DryRunApplyManifest(ctx context.Context, manifest Manifest) (Manifest, error)
 	// Delete deletes the given resource from Kubernetes cluster.
 	Delete(ctx context.Context, key ResourceKey) error
+	// GetManifest returns the live manifest of the given resource from Kubernetes cluster.
+	GetManifest(ctx context.Context, key ResourceKey) (Manifest, error)
+	// ListManifests returns the live manifests of all resources of the given kind
+	// in the given namespace whose labels match all of the given ones.
+	ListManifests(ctx context.Context, namespace, kind string, labels map[string]string) ([]Manifest, error)
+	// ListEvents returns the live manifests of the events involving the given resource.
+	ListEvents(ctx context.Context, key ResourceKey) ([]Manifest, error)
+	// RunKubectl runs kubectl with the given arguments against the cluster and namespace
+	// of the application and returns its combined output.
+	RunKubectl(ctx context.Context, args []string) ([]byte, error)
 }
 
 type gitClient interface {
@@ -98,6 +122,7 @@ type provider struct {
 	templatingMethod TemplatingMethod
 	initOnce         sync.Once
 	initErr          error
+	namespaceEnsured bool
 }
 
 func init() {
@@ -135,8 +160,22 @@ func (p *provider) init(ctx context.Context) {
 
 	p.templatingMethod = determineTemplatingMethod(p.input, p.appDir)
 
+	// Connect to the cluster specified by the deployment configuration instead of the default one.
+	var kubectlOpts []KubectlOption
+	if p.input.KubeConfigPath != "" || p.input.KubeContext != "" {
+		cfg, err := loadKubeConfig(p.input.KubeConfigPath, p.input.KubeContext)
+		if err != nil {
+			p.initErr = err
+			return
+		}
+		kubectlOpts = append(kubectlOpts, WithKubeConfig(p.input.KubeConfigPath, p.input.KubeContext, cfg))
+	}
+	if p.input.FieldManager != "" {
+		kubectlOpts = append(kubectlOpts, WithFieldManager(p.input.FieldManager))
+	}
+
 	// We need kubectl for all templating methods.
-	p.kubectl, p.initErr = p.findKubectl(ctx, p.input.KubectlVersion)
+	p.kubectl, p.initErr = p.findKubectl(ctx, p.input.KubectlVersion, kubectlOpts...)
 	if p.initErr != nil {
 		return
 	}
@@ -219,22 +258,247 @@ func (p *provider) LoadManifests(ctx context.Context) (manifests []Manifest, err
 		err = fmt.Errorf("unsupport templating method %v", p.templatingMethod)
 	}
 
+	if err == nil && p.input.ForceNamespace && p.input.Namespace != "" {
+		overrideNamespace(manifests, p.input.Namespace)
+	}
+	if err == nil && len(p.input.ImageOverrides) > 0 {
+		err = overrideImages(manifests, p.input.ImageOverrides)
+	}
 	return
 }
 
 // Apply does applying application manifests by using the tool specified in Input.
 func (p *provider) Apply(ctx context.Context) error {
+	manifests, err := p.LoadManifests(ctx)
+	if err != nil {
+		return err
+	}
+	if err := p.ensureNamespace(ctx); err != nil {
+		return err
+	}
+
+	// Server-side apply reports conflicts per resource so the manifests are applied one by one.
+	if p.input.ServerSideApply {
+		for _, m := range manifests {
+			m := m
+			err := retryOnTransientAPIError(ctx, p.logger, func() error {
+				_, err := p.serverSideApply(ctx, m)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var results []ApplyResult
+	err = retryOnTransientAPIError(ctx, p.logger, func() (err error) {
+		results, err = p.kubectl.ApplyAll(ctx, p.input.Namespace, manifests)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		p.logger.Info("applied resource",
+			zap.String("resource", r.Resource),
+			zap.String("action", string(r.Action)),
+		)
+	}
 	return nil
 }
 
-// ApplyManifest does applying the given manifest.
-func (p *provider) ApplyManifest(ctx context.Context, manifest Manifest) error {
+// ApplyManifest does applying the given manifest
+// and returns the action taken on the resource.
+func (p *provider) ApplyManifest(ctx context.Context, manifest Manifest) (action ApplyAction, err error) {
 	p.initOnce.Do(func() { p.init(ctx) })
 	if p.initErr != nil {
-		return p.initErr
+		return "", p.initErr
+	}
+	if err := p.ensureNamespace(ctx); err != nil {
+		return "", err
+	}
+	if p.input.IncrementalApply {
+		unchanged, err := p.isUnchanged(ctx, manifest)
+		if err != nil {
+			return "", err
+		}
+		if unchanged {
+			return ApplyActionSkipped, nil
+		}
+	}
+
+	err = retryOnTransientAPIError(ctx, p.logger, func() (err error) {
+		if p.input.ServerSideApply {
+			action, err = p.serverSideApply(ctx, manifest)
+			return err
+		}
+		action, err = p.kubectl.Apply(ctx, p.input.Namespace, manifest)
+		return err
+	})
+	return action, err
+}
+
+// annotationLastAppliedConfig is the annotation where kubectl apply stores the applied manifest.
+const annotationLastAppliedConfig = "kubectl.kubernetes.io/last-applied-configuration"
+
+// isUnchanged reports whether the given manifest is the same as the one last applied to its resource
+// and the live state of the resource still matches it.
+// The keys only existing in the live manifest, such as the status and the defaults populated
+// by the server, and the commit hash changing at every deployment are not treated as changes,
+// while the keys removed from the manifest are detected by comparing with the last applied one.
+// The resources which were not applied by kubectl apply are always treated as changed
+// since there is no last applied one to compare with.
+// See isUnchangedOnServer for how the resources are checked when server-side apply is used.
+func (p *provider) isUnchanged(ctx context.Context, manifest Manifest) (bool, error) {
+	var live Manifest
+	err := retryOnTransientAPIError(ctx, p.logger, func() (err error) {
+		live, err = p.kubectl.Get(ctx, p.namespaceOf(manifest.Key), manifest.Key)
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to get the live manifest of %s (%w)", manifest.Key.ReadableString(), err)
+	}
+	if p.input.ServerSideApply {
+		return p.isUnchangedOnServer(ctx, manifest, live)
+	}
+
+	lastApplied, ok := live.GetAnnotations()[annotationLastAppliedConfig]
+	if !ok {
+		return false, nil
+	}
+	lastManifests, err := ParseManifests(lastApplied)
+	if err != nil || len(lastManifests) != 1 {
+		p.logger.Warn("unable to parse the last applied configuration",
+			zap.String("resource", manifest.Key.ReadableString()),
+			zap.Error(err),
+		)
+		return false, nil
+	}
+
+	var (
+		desired = manifest.Duplicate(manifest.Key.Name)
+		last    = lastManifests[0]
+	)
+	live = live.Duplicate(live.Key.Name)
+	for _, m := range []Manifest{desired, last, live} {
+		removeCommitHash(m)
+	}
+	// kubectl records the namespace given by the flag into the last applied one.
+	if desired.u.GetNamespace() == "" {
+		last.u.SetNamespace("")
+	}
+
+	result, err := Diff(desired, last)
+	if err != nil {
+		return false, fmt.Errorf("unable to diff %s (%w)", manifest.Key.ReadableString(), err)
+	}
+	if result.HasDiff() {
+		return false, nil
+	}
+
+	// The live state might have been modified since the last apply.
+	result, err = Diff(desired, live, diff.WithIgnoreAddingMapKeys())
+	if err != nil {
+		return false, fmt.Errorf("unable to diff %s (%w)", manifest.Key.ReadableString(), err)
+	}
+	return !result.HasDiff(), nil
+}
+
+// isUnchangedOnServer reports whether applying the given manifest by server-side apply
+// would change nothing but the commit hash of the given live resource.
+// The result is computed by the server in dry-run mode, so the keys removed from the manifest
+// are detected as well as long as they were applied by the same field manager.
+// The manifest is treated as changed when the dry-run fails, e.g. due to a conflict,
+// to let the actual apply handle it.
+func (p *provider) isUnchangedOnServer(ctx context.Context, manifest Manifest, live Manifest) (bool, error) {
+	var applied Manifest
+	err := retryOnTransientAPIError(ctx, p.logger, func() (err error) {
+		applied, err = p.kubectl.ServerSideApplyDryRun(ctx, p.input.Namespace, manifest)
+		return err
+	})
+	if err != nil {
+		p.logger.Info("unable to check the changes of the resource by server-side dry-run",
+			zap.String("resource", manifest.Key.ReadableString()),
+			zap.Error(err),
+		)
+		return false, nil
+	}
+
+	live = live.Duplicate(live.Key.Name)
+	for _, m := range []Manifest{applied, live} {
+		removeCommitHash(m)
+		removeServerPopulatedFields(m)
 	}
+	result, err := Diff(live, applied)
+	if err != nil {
+		return false, fmt.Errorf("unable to diff %s (%w)", manifest.Key.ReadableString(), err)
+	}
+	return !result.HasDiff(), nil
+}
+
+// serverPopulatedMetadataFields are the metadata fields updated by the server
+// whenever the resource is modified, even only its commit hash.
+var serverPopulatedMetadataFields = []string{
+	"managedFields",
+	"resourceVersion",
+	"generation",
+}
+
+// removeServerPopulatedFields removes the status and the metadata fields updated
+// by the server from the given manifest.
+func removeServerPopulatedFields(m Manifest) {
+	unstructured.RemoveNestedField(m.u.Object, "status")
+	for _, f := range serverPopulatedMetadataFields {
+		unstructured.RemoveNestedField(m.u.Object, "metadata", f)
+	}
+}
+
+// removeCommitHash removes the commit hash from the labels and the annotations of the given manifest.
+func removeCommitHash(m Manifest) {
+	if labels := m.u.GetLabels(); labels != nil {
+		delete(labels, LabelCommitHash)
+		if len(labels) == 0 {
+			labels = nil
+		}
+		m.u.SetLabels(labels)
+	}
+	if annotations := m.u.GetAnnotations(); annotations != nil {
+		delete(annotations, LabelCommitHash)
+		if len(annotations) == 0 {
+			annotations = nil
+		}
+		m.u.SetAnnotations(annotations)
+	}
+}
 
-	return p.kubectl.Apply(ctx, p.input.Namespace, manifest)
+// serverSideApply applies the given manifest by using server-side apply.
+// When some fields are owned by the other managers, the apply is re-issued
+// to take their ownership only if forceConflicts was configured.
+func (p *provider) serverSideApply(ctx context.Context, manifest Manifest) (ApplyAction, error) {
+	action, err := p.kubectl.ServerSideApply(ctx, p.input.Namespace, manifest)
+	if !errors.Is(err, ErrApplyConflict) || !p.input.ForceConflicts {
+		return action, err
+	}
+
+	p.logger.Info("taking the ownership of the conflicting fields by forcing server-side apply",
+		zap.String("resource", manifest.Key.ReadableString()),
+		zap.Strings("fields", parseApplyConflicts(err.Error())),
+	)
+	return p.kubectl.ForceServerSideApply(ctx, p.input.Namespace, manifest)
+}
+
+func (p *provider) DryRunApplyManifest(ctx context.Context, manifest Manifest) (Manifest, error) {
+	p.initOnce.Do(func() { p.init(ctx) })
+	if p.initErr != nil {
+		return Manifest{}, p.initErr
+	}
+
+	return p.kubectl.ServerSideApplyDryRun(ctx, p.input.Namespace, manifest)
 }
 
 // Delete deletes the given resource from Kubernetes cluster.
@@ -244,10 +508,73 @@ func (p *provider) Delete(ctx context.Context, k ResourceKey) (err error) {
 		return p.initErr
 	}
 
-	return p.kubectl.Delete(ctx, p.input.Namespace, k)
+	return p.kubectl.Delete(ctx, p.namespaceOf(k), k)
+}
+
+// GetManifest returns the live manifest of the given resource from Kubernetes cluster.
+func (p *provider) GetManifest(ctx context.Context, k ResourceKey) (Manifest, error) {
+	p.initOnce.Do(func() { p.init(ctx) })
+	if p.initErr != nil {
+		return Manifest{}, p.initErr
+	}
+
+	return p.kubectl.Get(ctx, p.namespaceOf(k), k)
+}
+
+func (p *provider) ListManifests(ctx context.Context, namespace, kind string, labels map[string]string) ([]Manifest, error) {
+	p.initOnce.Do(func() { p.init(ctx) })
+	if p.initErr != nil {
+		return nil, p.initErr
+	}
+
+	if p.input.Namespace != "" {
+		namespace = p.input.Namespace
+	}
+	return p.kubectl.List(ctx, namespace, kind, makeLabelSelector(labels))
+}
+
+func (p *provider) ListEvents(ctx context.Context, k ResourceKey) ([]Manifest, error) {
+	p.initOnce.Do(func() { p.init(ctx) })
+	if p.initErr != nil {
+		return nil, p.initErr
+	}
+
+	return p.kubectl.ListEvents(ctx, p.namespaceOf(k), k)
+}
+
+// namespaceOf returns the namespace where the given resource lives.
+// The namespace of the application takes precedence since the manifests are applied to it,
+// otherwise they are applied to the namespace specified in each of them.
+func (p *provider) namespaceOf(k ResourceKey) string {
+	if p.input.Namespace != "" {
+		return p.input.Namespace
+	}
+	return k.Namespace
+}
+
+// RunKubectl runs kubectl with the given arguments against the cluster and namespace
+// of the application and returns its combined output.
+func (p *provider) RunKubectl(ctx context.Context, args []string) ([]byte, error) {
+	p.initOnce.Do(func() { p.init(ctx) })
+	if p.initErr != nil {
+		return nil, p.initErr
+	}
+
+	return p.kubectl.Run(ctx, p.input.Namespace, args)
+}
+
+// makeLabelSelector builds an equality-based label selector
+// in a deterministic order, e.g. "app=simple,pipecd.dev/variant=primary".
+func makeLabelSelector(labels map[string]string) string {
+	keys := sortedKeys(labels)
+	selectors := make([]string, 0, len(keys))
+	for _, k := range keys {
+		selectors = append(selectors, k+"="+labels[k])
+	}
+	return strings.Join(selectors, ",")
 }
 
-func (p *provider) findKubectl(ctx context.Context, version string) (*Kubectl, error) {
+func (p *provider) findKubectl(ctx context.Context, version string, opts ...KubectlOption) (*Kubectl, error) {
 	path, installed, err := toolregistry.DefaultRegistry().Kubectl(ctx, version)
 	if err != nil {
 		return nil, fmt.Errorf("no kubectl %s (%v)", version, err)
@@ -255,7 +582,7 @@ func (p *provider) findKubectl(ctx context.Context, version string) (*Kubectl, e
 	if installed {
 		p.logger.Info(fmt.Sprintf("kubectl %s has just been installed because of no pre-installed binary for that version", version))
 	}
-	return NewKubectl(version, path), nil
+	return NewKubectl(version, path, opts...), nil
 }
 
 func (p *provider) findKustomize(ctx context.Context, version string) (*Kustomize, error) {
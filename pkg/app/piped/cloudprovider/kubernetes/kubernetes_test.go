@@ -15,13 +15,22 @@
 package kubernetes
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 
 	"github.com/pipe-cd/pipe/pkg/app/piped/toolregistry"
+	"github.com/pipe-cd/pipe/pkg/config"
 )
 
 func TestMain(m *testing.M) {
@@ -32,3 +41,455 @@ func TestMain(m *testing.M) {
 	}
 	os.Exit(m.Run())
 }
+
+func TestMakeLabelSelector(t *testing.T) {
+	assert.Equal(t, "", makeLabelSelector(nil))
+	assert.Equal(t, "app=simple", makeLabelSelector(map[string]string{"app": "simple"}))
+	assert.Equal(t, "app=simple,pipecd.dev/variant=primary", makeLabelSelector(map[string]string{
+		"pipecd.dev/variant": "primary",
+		"app":                "simple",
+	}))
+}
+
+func TestProviderApplyManifestForceConflicts(t *testing.T) {
+	manifests, err := ParseManifests(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: simple
+data:
+  key: value
+`)
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name           string
+		forceConflicts bool
+		expectedErr    error
+		expectedCalls  string
+	}{
+		{
+			name:          "conflict without the option",
+			expectedErr:   ErrApplyConflict,
+			expectedCalls: "-n test-ns apply --server-side --field-manager=piped -f -\n",
+		},
+		{
+			name:           "forced apply with the option",
+			forceConflicts: true,
+			expectedCalls:  "-n test-ns apply --server-side --field-manager=piped -f -\n-n test-ns apply --server-side --field-manager=piped --force-conflicts -f -\n",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "kubectl")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			// The fake kubectl reports a conflict unless it is forced.
+			script := fmt.Sprintf(`#!/bin/sh
+printf '%%s\n' "$*" >> %s
+cat > /dev/null
+case "$*" in
+*--force-conflicts*)
+  echo 'configmap/simple serverside-applied'
+  ;;
+*)
+  echo 'error: Apply failed with 1 conflict: conflict with "kubectl-client-side-apply" using v1: .data.key'
+  exit 1
+  ;;
+esac
+`, filepath.Join(dir, "calls"))
+			path := filepath.Join(dir, "kubectl")
+			require.NoError(t, ioutil.WriteFile(path, []byte(script), 0700))
+
+			p := &provider{
+				input: config.KubernetesDeploymentInput{
+					Namespace:       "test-ns",
+					ServerSideApply: true,
+					ForceConflicts:  tc.forceConflicts,
+				},
+				kubectl: NewKubectl("", path),
+				logger:  zap.NewNop(),
+			}
+			p.initOnce.Do(func() {})
+
+			_, err = p.ApplyManifest(context.Background(), manifests[0])
+			if tc.expectedErr != nil {
+				assert.True(t, errors.Is(err, tc.expectedErr))
+			} else {
+				assert.NoError(t, err)
+			}
+
+			calls, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedCalls, string(calls))
+		})
+	}
+}
+
+func TestProviderApplyManifestIncremental(t *testing.T) {
+	manifests, err := ParseManifests(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unchanged
+  labels:
+    pipecd.dev/commit-hash: new-commit
+  annotations:
+    pipecd.dev/commit-hash: new-commit
+data:
+  key: value
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: changed
+  labels:
+    pipecd.dev/commit-hash: new-commit
+  annotations:
+    pipecd.dev/commit-hash: new-commit
+data:
+  key: new-value
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: label-removed
+  labels:
+    pipecd.dev/commit-hash: new-commit
+  annotations:
+    pipecd.dev/commit-hash: new-commit
+data:
+  key: value
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: modified
+  labels:
+    pipecd.dev/commit-hash: new-commit
+  annotations:
+    pipecd.dev/commit-hash: new-commit
+data:
+  key: value
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: server-side-applied
+  labels:
+    pipecd.dev/commit-hash: new-commit
+  annotations:
+    pipecd.dev/commit-hash: new-commit
+data:
+  key: value
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: added
+data:
+  key: value
+`)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "kubectl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The live states differ from the last applied ones only in the commit hash and the fields
+	// populated by the server, except the modified one. The label-removed one still has the label
+	// which was removed from its manifest, and the server-side-applied one has no last applied one.
+	lives := []struct {
+		name        string
+		data        string
+		teamLabel   bool
+		lastApplied bool
+	}{
+		{name: "unchanged", data: "value", lastApplied: true},
+		{name: "changed", data: "value", lastApplied: true},
+		{name: "label-removed", data: "value", teamLabel: true, lastApplied: true},
+		{name: "modified", data: "modified-value", lastApplied: true},
+		{name: "server-side-applied", data: "value"},
+	}
+	for _, l := range lives {
+		var labels, lastAppliedLabels, annotations string
+		if l.teamLabel {
+			labels = "\n    team: a"
+			lastAppliedLabels = `,"team":"a"`
+		}
+		if l.lastApplied {
+			annotations = fmt.Sprintf(`
+    kubectl.kubernetes.io/last-applied-configuration: '{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"%s","namespace":"test-ns","labels":{"pipecd.dev/commit-hash":"old-commit"%s},"annotations":{"pipecd.dev/commit-hash":"old-commit"}},"data":{"key":"value"}}'`, l.name, lastAppliedLabels)
+		}
+		live := fmt.Sprintf(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+  namespace: test-ns
+  resourceVersion: "10"
+  labels:
+    pipecd.dev/commit-hash: old-commit%s
+  annotations:
+    pipecd.dev/commit-hash: old-commit%s
+data:
+  key: %s
+`, l.name, labels, annotations, l.data)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, l.name+".yaml"), []byte(live), 0600))
+	}
+
+	// The fake kubectl returns the live manifests above and records the applied resources.
+	script := fmt.Sprintf(`#!/bin/sh
+dir=%s
+case "$*" in
+*" get "*)
+  name=$(echo "$*" | sed 's/.* get [^ ]* \([^ ]*\).*/\1/')
+  if [ -f "$dir/$name.yaml" ]; then
+    cat "$dir/$name.yaml"
+  else
+    echo "Error from server (NotFound): configmaps \"$name\" not found" >&2
+    exit 1
+  fi
+  ;;
+*" apply "*)
+  name=$(sed -n 's/^  name: //p' | head -n 1)
+  echo "$name" >> "$dir/applied"
+  echo "configmap/$name configured"
+  ;;
+esac
+`, dir)
+	path := filepath.Join(dir, "kubectl")
+	require.NoError(t, ioutil.WriteFile(path, []byte(script), 0700))
+
+	p := &provider{
+		input: config.KubernetesDeploymentInput{
+			Namespace:        "test-ns",
+			IncrementalApply: true,
+		},
+		kubectl: NewKubectl("", path),
+		logger:  zap.NewNop(),
+	}
+	p.initOnce.Do(func() {})
+
+	actions := make([]ApplyAction, 0, len(manifests))
+	for _, m := range manifests {
+		action, err := p.ApplyManifest(context.Background(), m)
+		require.NoError(t, err)
+		actions = append(actions, action)
+	}
+	assert.Equal(t, []ApplyAction{
+		ApplyActionSkipped,
+		ApplyActionConfigured,
+		ApplyActionConfigured,
+		ApplyActionConfigured,
+		ApplyActionConfigured,
+		ApplyActionConfigured,
+	}, actions)
+
+	applied, err := ioutil.ReadFile(filepath.Join(dir, "applied"))
+	require.NoError(t, err)
+	assert.Equal(t, "changed\nlabel-removed\nmodified\nserver-side-applied\nadded\n", string(applied))
+}
+
+func TestProviderApplyManifestIncrementalServerSide(t *testing.T) {
+	makeManifest := func(name, commit, data, extra string) string {
+		return fmt.Sprintf(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+  namespace: test-ns
+  labels:
+    pipecd.dev/commit-hash: %s%s
+  annotations:
+    pipecd.dev/commit-hash: %s
+data:
+  key: %s
+`, name, commit, extra, commit, data)
+	}
+	const serverPopulated = `
+  resourceVersion: "%s"
+  managedFields:
+  - manager: piped
+    operation: Apply
+    time: "%s"`
+
+	manifests, err := ParseManifests(strings.Join([]string{
+		makeManifest("unchanged", "new-commit", "value", ""),
+		makeManifest("changed", "new-commit", "new-value", ""),
+		makeManifest("label-removed", "new-commit", "value", ""),
+		makeManifest("added", "new-commit", "value", ""),
+	}, "---\n"))
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "kubectl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The results of the server-side dry-run differ from the live states in the commit hash
+	// and the fields updated by the server, except the changed one and the label-removed one
+	// whose label was removed from its manifest.
+	objects := []struct {
+		name   string
+		live   string
+		dryRun string
+	}{
+		{
+			name:   "unchanged",
+			live:   makeManifest("unchanged", "old-commit", "value", fmt.Sprintf(serverPopulated, "10", "2020-01-01T00:00:00Z")),
+			dryRun: makeManifest("unchanged", "new-commit", "value", fmt.Sprintf(serverPopulated, "11", "2020-01-02T00:00:00Z")),
+		},
+		{
+			name:   "changed",
+			live:   makeManifest("changed", "old-commit", "value", ""),
+			dryRun: makeManifest("changed", "new-commit", "new-value", ""),
+		},
+		{
+			name:   "label-removed",
+			live:   makeManifest("label-removed", "old-commit", "value", "\n    team: a"),
+			dryRun: makeManifest("label-removed", "new-commit", "value", ""),
+		},
+	}
+	for _, o := range objects {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, o.name+".yaml"), []byte(o.live), 0600))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, o.name+".dry-run.yaml"), []byte(o.dryRun), 0600))
+	}
+
+	// The fake kubectl returns the live states and the dry-run results above
+	// and records the applied resources.
+	script := fmt.Sprintf(`#!/bin/sh
+dir=%s
+case "$*" in
+*" get "*)
+  name=$(echo "$*" | sed 's/.* get [^ ]* \([^ ]*\).*/\1/')
+  if [ -f "$dir/$name.yaml" ]; then
+    cat "$dir/$name.yaml"
+  else
+    echo "Error from server (NotFound): configmaps \"$name\" not found" >&2
+    exit 1
+  fi
+  ;;
+*--dry-run=server*)
+  name=$(sed -n 's/^  name: //p' | head -n 1)
+  cat "$dir/$name.dry-run.yaml"
+  ;;
+*" apply "*)
+  name=$(sed -n 's/^  name: //p' | head -n 1)
+  echo "$name" >> "$dir/applied"
+  echo "configmap/$name serverside-applied"
+  ;;
+esac
+`, dir)
+	path := filepath.Join(dir, "kubectl")
+	require.NoError(t, ioutil.WriteFile(path, []byte(script), 0700))
+
+	p := &provider{
+		input: config.KubernetesDeploymentInput{
+			Namespace:        "test-ns",
+			ServerSideApply:  true,
+			IncrementalApply: true,
+		},
+		kubectl: NewKubectl("", path),
+		logger:  zap.NewNop(),
+	}
+	p.initOnce.Do(func() {})
+
+	actions := make([]ApplyAction, 0, len(manifests))
+	for _, m := range manifests {
+		action, err := p.ApplyManifest(context.Background(), m)
+		require.NoError(t, err)
+		actions = append(actions, action)
+	}
+	assert.Equal(t, []ApplyAction{
+		ApplyActionSkipped,
+		ApplyActionServerSideApplied,
+		ApplyActionServerSideApplied,
+		ApplyActionServerSideApplied,
+	}, actions)
+
+	applied, err := ioutil.ReadFile(filepath.Join(dir, "applied"))
+	require.NoError(t, err)
+	assert.Equal(t, "changed\nlabel-removed\nadded\n", string(applied))
+}
+
+func TestProviderLookupNamespace(t *testing.T) {
+	manifests, err := ParseManifests(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+  namespace: foo
+`)
+	require.NoError(t, err)
+	key := manifests[0].Key
+
+	testcases := []struct {
+		name          string
+		namespace     string
+		expectedCalls string
+	}{
+		{
+			name:      "namespace of the resource",
+			namespace: "",
+			expectedCalls: `-n foo get Deployment simple -o yaml
+-n foo get Pod -l app=simple -o yaml
+-n foo get events --field-selector involvedObject.kind=Deployment,involvedObject.name=simple -o yaml
+-n foo delete Deployment simple
+`,
+		},
+		{
+			name:      "namespace of the application",
+			namespace: "test-ns",
+			expectedCalls: `-n test-ns get Deployment simple -o yaml
+-n test-ns get Pod -l app=simple -o yaml
+-n test-ns get events --field-selector involvedObject.kind=Deployment,involvedObject.name=simple -o yaml
+-n test-ns delete Deployment simple
+`,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "kubectl")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			// The fake kubectl records the calls and returns the resource or an empty list.
+			script := fmt.Sprintf(`#!/bin/sh
+printf '%%s\n' "$*" >> %s
+case "$*" in
+*" get Deployment "*)
+  printf 'apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: simple\n  namespace: foo\n'
+  ;;
+*" get "*)
+  printf 'apiVersion: v1\nkind: List\nitems: []\n'
+  ;;
+esac
+`, filepath.Join(dir, "calls"))
+			path := filepath.Join(dir, "kubectl")
+			require.NoError(t, ioutil.WriteFile(path, []byte(script), 0700))
+
+			p := &provider{
+				input: config.KubernetesDeploymentInput{
+					Namespace: tc.namespace,
+				},
+				kubectl: NewKubectl("", path),
+				logger:  zap.NewNop(),
+			}
+			p.initOnce.Do(func() {})
+
+			ctx := context.Background()
+			live, err := p.GetManifest(ctx, key)
+			require.NoError(t, err)
+			assert.Equal(t, key, live.Key)
+
+			_, err = p.ListManifests(ctx, key.Namespace, KindPod, map[string]string{"app": "simple"})
+			require.NoError(t, err)
+			_, err = p.ListEvents(ctx, key)
+			require.NoError(t, err)
+			require.NoError(t, p.Delete(ctx, key))
+
+			calls, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedCalls, string(calls))
+		})
+	}
+}
@@ -82,6 +82,31 @@ func (m Manifest) GetAnnotations() map[string]string {
 	return m.u.GetAnnotations()
 }
 
+// AddLabels adds or overrides the given labels
+// while keeping the other existing ones as they are.
+func (m Manifest) AddLabels(labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+
+	cur := m.u.GetLabels()
+	if cur == nil {
+		cur = make(map[string]string, len(labels))
+	}
+	for k, v := range labels {
+		cur[k] = v
+	}
+	m.u.SetLabels(cur)
+}
+
+func (m Manifest) GetLabels() map[string]string {
+	return m.u.GetLabels()
+}
+
+func (m Manifest) GetFinalizers() []string {
+	return m.u.GetFinalizers()
+}
+
 func (m Manifest) GetNestedStringMap(fields ...string) (map[string]string, error) {
 	sm, _, err := unstructured.NestedStringMap(m.u.Object, fields...)
 	if err != nil {
@@ -208,7 +233,7 @@ func LoadPlainYAMLManifests(dir string, names []string, configFileName string) (
 		path := filepath.Join(dir, name)
 		ms, err := LoadManifestsFromYAMLFile(path)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load maninifest at %s (%w)", path, err)
+			return nil, fmt.Errorf("failed to load manifests (%w)", err)
 		}
 		manifests = append(manifests, ms...)
 	}
@@ -221,25 +246,41 @@ func LoadManifestsFromYAMLFile(path string) ([]Manifest, error) {
 	if err != nil {
 		return nil, err
 	}
-	return ParseManifests(string(data))
+	manifests, err := ParseManifests(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifests in %s: %w", path, err)
+	}
+	return manifests, nil
 }
 
+// ParseManifests parses the given YAML or JSON data which may contain multiple documents.
+// The empty documents, e.g. containing only comments, are ignored.
 func ParseManifests(data string) ([]Manifest, error) {
 	const separator = "\n---"
 	var (
 		parts     = strings.Split(data, separator)
 		manifests = make([]Manifest, 0, len(parts))
 	)
+	// The data may start with the separator.
+	parts[0] = strings.TrimPrefix(strings.TrimSpace(parts[0]), "---")
 
-	for _, part := range parts {
+	for i, part := range parts {
 		//	Ignore all the cases where no content between separator.
 		part = strings.TrimSpace(part)
 		if len(part) == 0 {
 			continue
 		}
+		js, err := yaml.YAMLToJSON([]byte(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid document at index %d: %w", i, err)
+		}
+		// The document contains only comments.
+		if string(js) == "null" {
+			continue
+		}
 		var obj unstructured.Unstructured
-		if err := yaml.Unmarshal([]byte(part), &obj); err != nil {
-			return nil, err
+		if err := obj.UnmarshalJSON(js); err != nil {
+			return nil, fmt.Errorf("invalid document at index %d: %w", i, err)
 		}
 		manifests = append(manifests, Manifest{
 			Key: MakeResourceKey(&obj),
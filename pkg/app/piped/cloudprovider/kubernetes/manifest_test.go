@@ -0,0 +1,113 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadManifestsFromYAMLFile(t *testing.T) {
+	testcases := []struct {
+		name         string
+		path         string
+		expectedKeys []string
+		expectedErr  string
+	}{
+		{
+			name: "multiple documents",
+			path: "testdata/manifests/multi-documents.yaml",
+			expectedKeys: []string{
+				"v1:Service:default:simple",
+				"apps/v1:Deployment:default:simple",
+			},
+		},
+		{
+			name:         "separators only",
+			path:         "testdata/manifests/separators-only.yaml",
+			expectedKeys: []string{},
+		},
+		{
+			name:         "json",
+			path:         "testdata/manifests/service.json",
+			expectedKeys: []string{"v1:Service:default:json"},
+		},
+		{
+			name:        "malformed",
+			path:        "testdata/manifests/malformed.yaml",
+			expectedErr: "failed to parse manifests in testdata/manifests/malformed.yaml: invalid document at index 1",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			manifests, err := LoadManifestsFromYAMLFile(tc.path)
+			if tc.expectedErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+
+			keys := make([]string, 0, len(manifests))
+			for _, m := range manifests {
+				keys = append(keys, m.Key.String())
+			}
+			assert.Equal(t, tc.expectedKeys, keys)
+		})
+	}
+}
+
+func TestLoadPlainYAMLManifests(t *testing.T) {
+	manifests, err := LoadPlainYAMLManifests("testdata/manifests", []string{"multi-documents.yaml", "service.json"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(manifests))
+
+	// The error must name the offending file.
+	_, err = LoadPlainYAMLManifests("testdata/manifests", nil, "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "malformed.yaml")
+}
+
+func TestAddLabels(t *testing.T) {
+	manifests, err := ParseManifests(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: with-labels
+  labels:
+    app: simple
+    pipecd.dev/commit-hash: old-hash
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: without-labels
+`)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(manifests))
+
+	for _, m := range manifests {
+		m.AddLabels(map[string]string{"pipecd.dev/commit-hash": "new-hash"})
+	}
+	assert.Equal(t, map[string]string{
+		"app":                    "simple",
+		"pipecd.dev/commit-hash": "new-hash",
+	}, manifests[0].GetLabels())
+	assert.Equal(t, map[string]string{
+		"pipecd.dev/commit-hash": "new-hash",
+	}, manifests[1].GetLabels())
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// ensureNamespace creates the target namespace with the management label when it does not exist yet.
+// Nothing is changed on the existing one since it might be managed by the others.
+func (p *provider) ensureNamespace(ctx context.Context) error {
+	if !p.input.CreateNamespace || p.input.Namespace == "" || p.namespaceEnsured {
+		return nil
+	}
+
+	m := makeNamespaceManifest(p.input.Namespace)
+	_, err := p.kubectl.Get(ctx, "", m.Key)
+	if err == nil {
+		p.namespaceEnsured = true
+		return nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	p.logger.Info("creating the namespace since it does not exist", zap.String("namespace", p.input.Namespace))
+	if _, err := p.kubectl.Apply(ctx, "", m); err != nil {
+		return fmt.Errorf("failed to create namespace %s: %w", p.input.Namespace, err)
+	}
+	p.namespaceEnsured = true
+	return nil
+}
+
+func makeNamespaceManifest(name string) Manifest {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion("v1")
+	u.SetKind(KindNamespace)
+	u.SetName(name)
+	u.SetLabels(map[string]string{
+		LabelManagedBy: ManagedByPiped,
+	})
+	return MakeManifest(ResourceKey{
+		APIVersion: "v1",
+		Kind:       KindNamespace,
+		Name:       name,
+	}, u)
+}
+
+// overrideNamespace sets the given namespace to all namespaced resources in the given manifests.
+// Cluster-scoped resources, including the custom resources defined as cluster-scoped
+// by a CustomResourceDefinition in the same manifests, are left as they are.
+func overrideNamespace(manifests []Manifest, namespace string) {
+	clusterScopedCustomKinds := findClusterScopedCustomKinds(manifests)
+	for i := range manifests {
+		k := manifests[i].Key
+		if k.IsClusterScoped() {
+			continue
+		}
+		if _, ok := clusterScopedCustomKinds[k.Kind]; ok {
+			continue
+		}
+		manifests[i].u.SetNamespace(namespace)
+		manifests[i].Key.Namespace = namespace
+	}
+}
+
+// findClusterScopedCustomKinds returns the kinds of the custom resources
+// defined as cluster-scoped by the CustomResourceDefinitions in the given manifests.
+func findClusterScopedCustomKinds(manifests []Manifest) map[string]struct{} {
+	kinds := make(map[string]struct{})
+	for _, m := range manifests {
+		if m.Key.Kind != KindCustomResourceDefinition {
+			continue
+		}
+		scope, _, _ := unstructured.NestedString(m.u.Object, "spec", "scope")
+		if scope != "Cluster" {
+			continue
+		}
+		if kind, _, _ := unstructured.NestedString(m.u.Object, "spec", "names", "kind"); kind != "" {
+			kinds[kind] = struct{}{}
+		}
+	}
+	return kinds
+}
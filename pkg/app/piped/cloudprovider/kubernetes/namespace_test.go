@@ -0,0 +1,187 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/pipe-cd/pipe/pkg/config"
+)
+
+func TestOverrideNamespace(t *testing.T) {
+	manifests, err := ParseManifests(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: without-namespace
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: wrong-namespace
+  namespace: wrong
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: target
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: cluster-role
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: clusterfoos.example.com
+spec:
+  group: example.com
+  scope: Cluster
+  names:
+    kind: ClusterFoo
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: foos.example.com
+spec:
+  group: example.com
+  scope: Namespaced
+  names:
+    kind: Foo
+---
+apiVersion: example.com/v1
+kind: ClusterFoo
+metadata:
+  name: cluster-foo
+---
+apiVersion: example.com/v1
+kind: Foo
+metadata:
+  name: foo
+  namespace: wrong
+`)
+	require.NoError(t, err)
+
+	overrideNamespace(manifests, "target")
+
+	expected := map[string]string{
+		"without-namespace":       "target",
+		"wrong-namespace":         "target",
+		"target":                  "",
+		"cluster-role":            "",
+		"clusterfoos.example.com": "",
+		"foos.example.com":        "",
+		"cluster-foo":             "",
+		"foo":                     "target",
+	}
+	require.Equal(t, len(expected), len(manifests))
+	for _, m := range manifests {
+		assert.Equal(t, expected[m.Key.Name], m.u.GetNamespace(), m.Key.Name)
+		if expected[m.Key.Name] != "" {
+			assert.Equal(t, "target", m.Key.Namespace, m.Key.Name)
+		}
+	}
+}
+
+func TestIsClusterScoped(t *testing.T) {
+	assert.True(t, ResourceKey{Kind: KindNamespace}.IsClusterScoped())
+	assert.True(t, ResourceKey{Kind: "ClusterRole"}.IsClusterScoped())
+	assert.True(t, ResourceKey{Kind: KindCustomResourceDefinition}.IsClusterScoped())
+	assert.False(t, ResourceKey{Kind: KindDeployment}.IsClusterScoped())
+	assert.False(t, ResourceKey{Kind: "Role"}.IsClusterScoped())
+}
+
+func TestProviderEnsureNamespace(t *testing.T) {
+	testcases := []struct {
+		name            string
+		createNamespace bool
+		exists          bool
+		expectedCalls   string
+		expectedApplied string
+	}{
+		{
+			name:          "disabled",
+			expectedCalls: "",
+		},
+		{
+			name:            "create if missing",
+			createNamespace: true,
+			expectedCalls:   "get Namespace test-ns -o yaml\napply -f -\n",
+			expectedApplied: "apiVersion: v1\nkind: Namespace\nmetadata:\n  labels:\n    pipecd.dev/managed-by: piped\n  name: test-ns\n",
+		},
+		{
+			name:            "already exists",
+			createNamespace: true,
+			exists:          true,
+			expectedCalls:   "get Namespace test-ns -o yaml\n",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "kubectl")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			// The fake kubectl records its arguments and the applied manifests.
+			getResult := `echo 'Error from server (NotFound): namespaces "test-ns" not found' >&2
+  exit 1`
+			if tc.exists {
+				getResult = `printf 'apiVersion: v1\nkind: Namespace\nmetadata:\n  name: test-ns\n'`
+			}
+			script := fmt.Sprintf(`#!/bin/sh
+printf '%%s\n' "$*" >> %s
+case "$*" in
+get*)
+  %s
+  ;;
+apply*)
+  cat >> %s
+  echo 'namespace/test-ns created'
+  ;;
+esac
+`, filepath.Join(dir, "calls"), getResult, filepath.Join(dir, "applied"))
+			path := filepath.Join(dir, "kubectl")
+			require.NoError(t, ioutil.WriteFile(path, []byte(script), 0700))
+
+			p := &provider{
+				input: config.KubernetesDeploymentInput{
+					Namespace:       "test-ns",
+					CreateNamespace: tc.createNamespace,
+				},
+				kubectl: NewKubectl("", path),
+				logger:  zap.NewNop(),
+			}
+			require.NoError(t, p.ensureNamespace(context.Background()))
+			// The namespace is checked only once.
+			require.NoError(t, p.ensureNamespace(context.Background()))
+
+			calls, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+			assert.Equal(t, tc.expectedCalls, string(calls))
+			applied, _ := ioutil.ReadFile(filepath.Join(dir, "applied"))
+			assert.Equal(t, tc.expectedApplied, string(applied))
+		})
+	}
+}
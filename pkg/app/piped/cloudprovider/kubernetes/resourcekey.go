@@ -58,24 +58,49 @@ var builtInApiVersions = map[string]struct{}{
 }
 
 const (
-	KindDeployment            = "Deployment"
-	KindStatefulSet           = "StatefulSet"
-	KindDaemonSet             = "DaemonSet"
-	KindReplicaSet            = "ReplicaSet"
-	KindPod                   = "Pod"
-	KindJob                   = "Job"
-	KindCronJob               = "CronJob"
-	KindConfigMap             = "ConfigMap"
-	KindSecret                = "Secret"
-	KindPersistentVolume      = "PersistentVolume"
-	KindPersistentVolumeClaim = "PersistentVolumeClaim"
-	KindService               = "Service"
-	KindIngress               = "Ingress"
-	KindServiceAccount        = "ServiceAccount"
+	KindDeployment               = "Deployment"
+	KindStatefulSet              = "StatefulSet"
+	KindDaemonSet                = "DaemonSet"
+	KindReplicaSet               = "ReplicaSet"
+	KindPod                      = "Pod"
+	KindJob                      = "Job"
+	KindCronJob                  = "CronJob"
+	KindConfigMap                = "ConfigMap"
+	KindSecret                   = "Secret"
+	KindPersistentVolume         = "PersistentVolume"
+	KindPersistentVolumeClaim    = "PersistentVolumeClaim"
+	KindService                  = "Service"
+	KindIngress                  = "Ingress"
+	KindServiceAccount           = "ServiceAccount"
+	KindNamespace                = "Namespace"
+	KindCustomResourceDefinition = "CustomResourceDefinition"
+	KindHorizontalPodAutoscaler  = "HorizontalPodAutoscaler"
 
 	DefaultNamespace = "default"
 )
 
+// clusterScopedKinds contains the builtin kinds whose resources do not belong to any namespace.
+var clusterScopedKinds = map[string]struct{}{
+	KindNamespace:                    {},
+	KindPersistentVolume:             {},
+	KindCustomResourceDefinition:     {},
+	"APIService":                     {},
+	"CertificateSigningRequest":      {},
+	"ClusterRole":                    {},
+	"ClusterRoleBinding":             {},
+	"CSIDriver":                      {},
+	"CSINode":                        {},
+	"IngressClass":                   {},
+	"MutatingWebhookConfiguration":   {},
+	"Node":                           {},
+	"PodSecurityPolicy":              {},
+	"PriorityClass":                  {},
+	"RuntimeClass":                   {},
+	"StorageClass":                   {},
+	"ValidatingWebhookConfiguration": {},
+	"VolumeAttachment":               {},
+}
+
 type APIVersionKind struct {
 	APIVersion string
 	Kind       string
@@ -172,6 +197,13 @@ func (k ResourceKey) IsSecret() bool {
 	return true
 }
 
+// IsClusterScoped reports whether the resource is a builtin one not belonging to any namespace.
+// The scope of custom resources can only be known from their CustomResourceDefinition.
+func (k ResourceKey) IsClusterScoped() bool {
+	_, ok := clusterScopedKinds[k.Kind]
+	return ok
+}
+
 // IsLess reports whether the key should sort before the given key.
 func (k ResourceKey) IsLess(a ResourceKey) bool {
 	if k.APIVersion < a.APIVersion {
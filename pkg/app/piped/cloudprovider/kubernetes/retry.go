@@ -0,0 +1,79 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/pipe-cd/pipe/pkg/backoff"
+)
+
+// The maximum number of attempts to apply manifests while transient API errors occur.
+const applyMaxAttempts = 4
+
+// applyBackoff returns the backoff used between the attempts to apply manifests.
+var applyBackoff = func() backoff.Backoff {
+	return backoff.NewExponential(time.Second, 10*time.Second)
+}
+
+// kubectl reports the reason of the failed API request in its output,
+// e.g. "Error from server (Conflict): error when applying patch: ...".
+var apiErrorReasonRegex = regexp.MustCompile(`Error from server \((\w+)\)`)
+
+// isTransientAPIError checks whether the given error was caused by a transient API error
+// which may not happen again, such as a conflict on optimistic concurrency,
+// a server timeout or a rate limiting.
+// The conflicts of server-side apply are not transient since they need to be resolved explicitly.
+func isTransientAPIError(err error) bool {
+	if err == nil || errors.Is(err, ErrApplyConflict) {
+		return false
+	}
+	if apierrors.IsConflict(err) || apierrors.IsServerTimeout(err) || apierrors.IsTooManyRequests(err) {
+		return true
+	}
+	m := apiErrorReasonRegex.FindStringSubmatch(err.Error())
+	if len(m) != 2 {
+		return false
+	}
+	switch metav1.StatusReason(m[1]) {
+	case metav1.StatusReasonConflict, metav1.StatusReasonServerTimeout, metav1.StatusReasonTooManyRequests:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryOnTransientAPIError calls the given function until it succeeds,
+// fails with a non-transient error or the number of attempts reaches applyMaxAttempts.
+func retryOnTransientAPIError(ctx context.Context, logger *zap.Logger, f func() error) (err error) {
+	retry := backoff.NewRetry(applyMaxAttempts, applyBackoff())
+	for retry.WaitNext(ctx) {
+		if err = f(); !isTransientAPIError(err) {
+			return err
+		}
+		logger.Warn("retrying after a transient api error",
+			zap.Int("calls", retry.Calls()),
+			zap.Error(err),
+		)
+	}
+	return err
+}
@@ -0,0 +1,202 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/pipe-cd/pipe/pkg/backoff"
+	"github.com/pipe-cd/pipe/pkg/config"
+)
+
+func TestIsTransientAPIError(t *testing.T) {
+	resource := schema.GroupResource{Group: "apps", Resource: "deployments"}
+	testcases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name:     "conflict",
+			err:      apierrors.NewConflict(resource, "simple", errors.New("the object has been modified")),
+			expected: true,
+		},
+		{
+			name:     "server timeout",
+			err:      apierrors.NewServerTimeout(resource, "patch", 1),
+			expected: true,
+		},
+		{
+			name:     "too many requests",
+			err:      apierrors.NewTooManyRequests("too many requests", 1),
+			expected: true,
+		},
+		{
+			name: "not found",
+			err:  apierrors.NewNotFound(resource, "simple"),
+		},
+		{
+			name:     "conflict reported by kubectl",
+			err:      fmt.Errorf(`failed to apply: Error from server (Conflict): error when applying patch: Operation cannot be fulfilled on deployments.apps "simple": the object has been modified (exit status 1)`),
+			expected: true,
+		},
+		{
+			name:     "too many requests reported by kubectl",
+			err:      fmt.Errorf("failed to apply: Error from server (TooManyRequests): the server has received too many requests (exit status 1)"),
+			expected: true,
+		},
+		{
+			name: "invalid manifest reported by kubectl",
+			err:  fmt.Errorf(`failed to apply: Error from server (Invalid): Deployment.apps "simple" is invalid (exit status 1)`),
+		},
+		{
+			name: "server-side apply conflict",
+			err:  fmt.Errorf("failed to apply: Error from server (Conflict): Apply failed with 1 conflict, (%w)", ErrApplyConflict),
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, isTransientAPIError(tc.err))
+		})
+	}
+}
+
+func TestRetryOnTransientAPIError(t *testing.T) {
+	applyBackoff = func() backoff.Backoff {
+		return backoff.NewConstant(time.Millisecond)
+	}
+	defer func() {
+		applyBackoff = func() backoff.Backoff {
+			return backoff.NewExponential(time.Second, 10*time.Second)
+		}
+	}()
+
+	resource := schema.GroupResource{Group: "apps", Resource: "deployments"}
+	testcases := []struct {
+		name          string
+		errs          []error
+		expectedErr   bool
+		expectedCalls int
+	}{
+		{
+			name:          "succeeded at once",
+			errs:          []error{nil},
+			expectedCalls: 1,
+		},
+		{
+			name:          "succeeded after a transient error",
+			errs:          []error{apierrors.NewConflict(resource, "simple", errors.New("modified")), nil},
+			expectedCalls: 2,
+		},
+		{
+			name:          "failed with a non-transient error",
+			errs:          []error{apierrors.NewNotFound(resource, "simple"), nil},
+			expectedErr:   true,
+			expectedCalls: 1,
+		},
+		{
+			name: "failed after the max attempts",
+			errs: []error{
+				apierrors.NewServerTimeout(resource, "patch", 1),
+				apierrors.NewServerTimeout(resource, "patch", 1),
+				apierrors.NewServerTimeout(resource, "patch", 1),
+				apierrors.NewServerTimeout(resource, "patch", 1),
+				nil,
+			},
+			expectedErr:   true,
+			expectedCalls: applyMaxAttempts,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int
+			err := retryOnTransientAPIError(context.Background(), zap.NewNop(), func() error {
+				err := tc.errs[calls]
+				calls++
+				return err
+			})
+			assert.Equal(t, tc.expectedErr, err != nil)
+			assert.Equal(t, tc.expectedCalls, calls)
+		})
+	}
+}
+
+func TestProviderApplyManifestRetry(t *testing.T) {
+	applyBackoff = func() backoff.Backoff {
+		return backoff.NewConstant(time.Millisecond)
+	}
+	defer func() {
+		applyBackoff = func() backoff.Backoff {
+			return backoff.NewExponential(time.Second, 10*time.Second)
+		}
+	}()
+
+	manifests, err := ParseManifests(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: simple
+data:
+  key: value
+`)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "kubectl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The fake kubectl fails with a conflict at the first call only.
+	calls := filepath.Join(dir, "calls")
+	script := fmt.Sprintf(`#!/bin/sh
+cat > /dev/null
+if [ ! -f %s ]; then
+  touch %s
+  echo 'Error from server (Conflict): error when applying patch: Operation cannot be fulfilled on configmaps "simple": the object has been modified'
+  exit 1
+fi
+echo 'configmap/simple configured'
+`, calls, calls)
+	path := filepath.Join(dir, "kubectl")
+	require.NoError(t, ioutil.WriteFile(path, []byte(script), 0700))
+
+	p := &provider{
+		input: config.KubernetesDeploymentInput{
+			Namespace: "test-ns",
+		},
+		kubectl: NewKubectl("", path),
+		logger:  zap.NewNop(),
+	}
+	p.initOnce.Do(func() {})
+
+	action, err := p.ApplyManifest(context.Background(), manifests[0])
+	assert.NoError(t, err)
+	assert.Equal(t, ApplyActionConfigured, action)
+}
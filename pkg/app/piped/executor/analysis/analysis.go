@@ -121,7 +121,7 @@ func (e *Executor) Execute(sig executor.StopSignal) model.StageStatus {
 		}
 		eg.Go(func() error {
 			e.LogPersister.Infof("[%s] Start analysis for %s", analyzer.id, analyzer.providerType)
-			return analyzer.run(ctx)
+			return analyzer.Run(ctx)
 		})
 	}
 	// Run analyses with logging providers.
@@ -134,7 +134,7 @@ func (e *Executor) Execute(sig executor.StopSignal) model.StageStatus {
 		}
 		eg.Go(func() error {
 			e.LogPersister.Infof("[%s] Start analysis for %s", analyzer.id, analyzer.providerType)
-			return analyzer.run(ctx)
+			return analyzer.Run(ctx)
 		})
 	}
 	// Run analyses with http providers.
@@ -146,7 +146,7 @@ func (e *Executor) Execute(sig executor.StopSignal) model.StageStatus {
 		}
 		eg.Go(func() error {
 			e.LogPersister.Infof("[%s] Start analysis for %s", analyzer.id, analyzer.providerType)
-			return analyzer.run(ctx)
+			return analyzer.Run(ctx)
 		})
 	}
 
@@ -192,7 +192,7 @@ func (e *Executor) retrievePreviousElapsedTime() time.Duration {
 	return et
 }
 
-func (e *Executor) newAnalyzerForMetrics(i int, templatable *config.TemplatableAnalysisMetrics, templateCfg *config.AnalysisTemplateSpec, factory *metrics.Factory) (*analyzer, error) {
+func (e *Executor) newAnalyzerForMetrics(i int, templatable *config.TemplatableAnalysisMetrics, templateCfg *config.AnalysisTemplateSpec, factory *metrics.Factory) (*Analyzer, error) {
 	cfg, err := e.getMetricsConfig(templatable, templateCfg, templatable.Template.Args)
 	if err != nil {
 		return nil, err
@@ -202,13 +202,13 @@ func (e *Executor) newAnalyzerForMetrics(i int, templatable *config.TemplatableA
 		return nil, err
 	}
 	id := fmt.Sprintf("metrics-%d", i)
-	return newAnalyzer(id, provider.Type(), func(ctx context.Context) (bool, error) {
+	return NewAnalyzer(id, provider.Type(), func(ctx context.Context) (bool, error) {
 		e.LogPersister.Infof("[%s] Run query against %s: %q", id, provider.Type(), cfg.Query)
 		return provider.RunQuery(ctx, cfg.Query, cfg.Expected)
 	}, time.Duration(cfg.Interval), cfg.FailureLimit, e.Logger, e.LogPersister), nil
 }
 
-func (e *Executor) newAnalyzerForLog(i int, templatable *config.TemplatableAnalysisLog, templateCfg *config.AnalysisTemplateSpec, factory *log.Factory) (*analyzer, error) {
+func (e *Executor) newAnalyzerForLog(i int, templatable *config.TemplatableAnalysisLog, templateCfg *config.AnalysisTemplateSpec, factory *log.Factory) (*Analyzer, error) {
 	cfg, err := e.getLogConfig(templatable, templateCfg, templatable.Template.Args)
 	if err != nil {
 		return nil, err
@@ -218,20 +218,20 @@ func (e *Executor) newAnalyzerForLog(i int, templatable *config.TemplatableAnaly
 		return nil, err
 	}
 	id := fmt.Sprintf("log-%d", i)
-	return newAnalyzer(id, provider.Type(), func(ctx context.Context) (bool, error) {
+	return NewAnalyzer(id, provider.Type(), func(ctx context.Context) (bool, error) {
 		e.LogPersister.Infof("[%s] Run query against %s: %q", id, provider.Type(), cfg.Query)
 		return provider.RunQuery(ctx, cfg.Query)
 	}, time.Duration(cfg.Interval), cfg.FailureLimit, e.Logger, e.LogPersister), nil
 }
 
-func (e *Executor) newAnalyzerForHTTP(i int, templatable *config.TemplatableAnalysisHTTP, templateCfg *config.AnalysisTemplateSpec) (*analyzer, error) {
+func (e *Executor) newAnalyzerForHTTP(i int, templatable *config.TemplatableAnalysisHTTP, templateCfg *config.AnalysisTemplateSpec) (*Analyzer, error) {
 	cfg, err := e.getHTTPConfig(templatable, templateCfg, templatable.Template.Args)
 	if err != nil {
 		return nil, err
 	}
 	provider := httpprovider.NewProvider(time.Duration(cfg.Timeout))
 	id := fmt.Sprintf("http-%d", i)
-	return newAnalyzer(id, provider.Type(), func(ctx context.Context) (bool, error) {
+	return NewAnalyzer(id, provider.Type(), func(ctx context.Context) (bool, error) {
 		e.LogPersister.Infof("[%s] Start running query against %s: %s %s", id, provider.Type(), cfg.Method, cfg.URL)
 		return provider.Run(ctx, cfg)
 	}, time.Duration(cfg.Interval), cfg.FailureLimit, e.Logger, e.LogPersister), nil
@@ -10,8 +10,8 @@ import (
 	"github.com/pipe-cd/pipe/pkg/app/piped/executor"
 )
 
-// analyzer contains a query for an analysis provider.
-type analyzer struct {
+// Analyzer contains a query for an analysis provider.
+type Analyzer struct {
 	id           string
 	providerType string
 	runQuery     func(ctx context.Context) (bool, error)
@@ -23,12 +23,13 @@ type analyzer struct {
 	logPersister executor.LogPersister
 }
 
-func newAnalyzer(id string, providerType string, runQuery func(ctx context.Context) (bool, error), interval time.Duration, failureLimit int, logger *zap.Logger, logPersister executor.LogPersister) *analyzer {
+// NewAnalyzer creates a new Analyzer running the given query.
+func NewAnalyzer(id string, providerType string, runQuery func(ctx context.Context) (bool, error), interval time.Duration, failureLimit int, logger *zap.Logger, logPersister executor.LogPersister) *Analyzer {
 	l := logger.With(
 		zap.String("analyzer-id", id),
 		zap.String("provider-type", providerType),
 	)
-	return &analyzer{
+	return &Analyzer{
 		id:           id,
 		providerType: providerType,
 		runQuery:     runQuery,
@@ -39,9 +40,9 @@ func newAnalyzer(id string, providerType string, runQuery func(ctx context.Conte
 	}
 }
 
-// run starts an analysis which runs the query at the given interval, until the context is done.
+// Run starts an analysis which runs the query at the given interval, until the context is done.
 // It returns an error when the number of failures exceeds the the failureLimit.
-func (a *analyzer) run(ctx context.Context) error {
+func (a *Analyzer) Run(ctx context.Context) error {
 	ticker := time.NewTicker(a.interval)
 	defer ticker.Stop()
 
@@ -51,6 +52,10 @@ func (a *analyzer) run(ctx context.Context) error {
 		case <-ticker.C:
 			reason := ""
 			success, err := a.runQuery(ctx)
+			if err != nil && ctx.Err() != nil {
+				// The query was cancelled since the analysis has been ended.
+				return nil
+			}
 			if err != nil {
 				// The failure of the query itself is treated as a failure.
 				reason = fmt.Sprintf("failed to run query: %s", err.Error())
@@ -70,7 +75,7 @@ func (a *analyzer) run(ctx context.Context) error {
 			}
 
 			if failureCount > a.failureLimit {
-				return fmt.Errorf("anslysis '%s' failed because the failure number exceeded the failure limit (%d)", a.id, a.failureLimit)
+				return fmt.Errorf("analysis '%s' failed because the failure number exceeded the failure limit (%d)", a.id, a.failureLimit)
 			}
 		case <-ctx.Done():
 			return nil
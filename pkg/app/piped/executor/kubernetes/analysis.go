@@ -0,0 +1,106 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/pipe-cd/pipe/pkg/app/piped/analysisprovider/metrics"
+	"github.com/pipe-cd/pipe/pkg/app/piped/executor"
+	"github.com/pipe-cd/pipe/pkg/app/piped/executor/analysis"
+	"github.com/pipe-cd/pipe/pkg/config"
+)
+
+const (
+	// The duration while the metrics are sampled when it was not configured.
+	defaultAnalysisDuration = 5 * time.Minute
+	// The interval between queries of a metric when it was not configured.
+	defaultAnalysisInterval = time.Minute
+)
+
+// metricsProviderFinder returns the metrics provider registered in piped with the given name.
+type metricsProviderFinder func(name string) (metrics.Provider, error)
+
+// findMetricsProvider returns the metrics provider of the analysis provider configured in piped with the given name.
+func (e *deployExecutor) findMetricsProvider(name string) (metrics.Provider, error) {
+	cfg, ok := e.PipedConfig.GetAnalysisProvider(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown provider name %s", name)
+	}
+	return metrics.NewFactory(e.Logger).NewProvider(&cfg)
+}
+
+// analyzeMetrics runs the queries of the given analysis at their interval until its duration elapses.
+// An error is returned as soon as the results of a query are not expected more times than its failure limit.
+func analyzeMetrics(ctx context.Context, cfg config.K8sCanaryAnalysis, findProvider metricsProviderFinder, logger *zap.Logger, lp executor.LogPersister) error {
+	duration := cfg.Duration.Duration()
+	if duration <= 0 {
+		duration = defaultAnalysisDuration
+	}
+
+	// All providers are checked before starting to fail fast on misconfiguration.
+	analyzers := make([]*analysis.Analyzer, 0, len(cfg.Metrics))
+	for i := range cfg.Metrics {
+		m := cfg.Metrics[i]
+		provider, err := findProvider(m.Provider)
+		if err != nil {
+			return fmt.Errorf("unable to find the metrics provider for %q (%w)", m.Query, err)
+		}
+		interval := m.Interval.Duration()
+		if interval <= 0 {
+			interval = defaultAnalysisInterval
+		}
+		id := fmt.Sprintf("metrics-%d", i)
+		analyzers = append(analyzers, analysis.NewAnalyzer(id, provider.Type(), func(ctx context.Context) (bool, error) {
+			lp.Infof("[%s] Run query against %s: %q", id, provider.Type(), m.Query)
+			return runMetricsQuery(ctx, m, provider)
+		}, interval, m.FailureLimit, logger, lp))
+	}
+
+	lp.Infof("Start analyzing %d metrics for %v", len(cfg.Metrics), duration)
+	analysisCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	eg, egCtx := errgroup.WithContext(analysisCtx)
+	for _, a := range analyzers {
+		a := a
+		eg.Go(func() error {
+			return a.Run(egCtx)
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	// The analysis is not regarded as successful when it was stopped before its duration elapsed.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func runMetricsQuery(ctx context.Context, cfg config.AnalysisMetrics, provider metrics.Provider) (bool, error) {
+	if timeout := cfg.Timeout.Duration(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return provider.RunQuery(ctx, cfg.Query, cfg.Expected)
+}
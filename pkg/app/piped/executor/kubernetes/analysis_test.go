@@ -0,0 +1,188 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/pipe-cd/pipe/pkg/app/piped/analysisprovider/metrics"
+	"github.com/pipe-cd/pipe/pkg/config"
+)
+
+type fakeMetricsProvider struct {
+	// The results of the queries keyed by the query.
+	results map[string][]bool
+	err     error
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (p *fakeMetricsProvider) Type() string { return "fake" }
+
+func (p *fakeMetricsProvider) RunQuery(_ context.Context, query string, _ config.AnalysisExpected) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.calls == nil {
+		p.calls = make(map[string]int)
+	}
+	i := p.calls[query]
+	p.calls[query]++
+	if p.err != nil {
+		return false, p.err
+	}
+	results := p.results[query]
+	if i >= len(results) {
+		return results[len(results)-1], nil
+	}
+	return results[i], nil
+}
+
+func (p *fakeMetricsProvider) callCount(query string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls[query]
+}
+
+func TestAnalyzeMetrics(t *testing.T) {
+	analysis := config.K8sCanaryAnalysis{
+		Duration: config.Duration(100 * time.Millisecond),
+		Metrics: []config.AnalysisMetrics{
+			{
+				Provider:     "prometheus",
+				Query:        "error-rate",
+				Interval:     config.Duration(5 * time.Millisecond),
+				FailureLimit: 1,
+			},
+			{
+				Provider: "prometheus",
+				Query:    "latency",
+				Interval: config.Duration(5 * time.Millisecond),
+			},
+		},
+	}
+
+	testcases := []struct {
+		name        string
+		provider    *fakeMetricsProvider
+		expectedErr string
+	}{
+		{
+			name: "all metrics within the expected ranges",
+			provider: &fakeMetricsProvider{
+				results: map[string][]bool{
+					"error-rate": {true},
+					"latency":    {true},
+				},
+			},
+		},
+		{
+			name: "failures within the failure limit",
+			provider: &fakeMetricsProvider{
+				results: map[string][]bool{
+					"error-rate": {true, false, true},
+					"latency":    {true},
+				},
+			},
+		},
+		{
+			name: "failures exceeding the failure limit",
+			provider: &fakeMetricsProvider{
+				results: map[string][]bool{
+					"error-rate": {true, false, false},
+					"latency":    {true},
+				},
+			},
+			expectedErr: "analysis 'metrics-0' failed because the failure number exceeded the failure limit (1)",
+		},
+		{
+			name: "metric out of the expected range with no failure limit",
+			provider: &fakeMetricsProvider{
+				results: map[string][]bool{
+					"error-rate": {true},
+					"latency":    {false},
+				},
+			},
+			expectedErr: "analysis 'metrics-1' failed because the failure number exceeded the failure limit (0)",
+		},
+		{
+			name: "failed to run queries",
+			provider: &fakeMetricsProvider{
+				err: errors.New("unavailable"),
+			},
+			expectedErr: "analysis 'metrics-1' failed because the failure number exceeded the failure limit (0)",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			findProvider := func(name string) (metrics.Provider, error) {
+				assert.Equal(t, "prometheus", name)
+				return tc.provider, nil
+			}
+			err := analyzeMetrics(context.Background(), analysis, findProvider, zap.NewNop(), &fakeLogPersister{})
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+				// The metrics were sampled during the whole duration.
+				assert.Greater(t, tc.provider.callCount("error-rate"), 3)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, tc.expectedErr, err.Error())
+		})
+	}
+}
+
+func TestAnalyzeMetricsUnknownProvider(t *testing.T) {
+	analysis := config.K8sCanaryAnalysis{
+		Metrics: []config.AnalysisMetrics{
+			{Provider: "unknown", Query: "error-rate"},
+		},
+	}
+	findProvider := func(name string) (metrics.Provider, error) {
+		return nil, errors.New("unknown provider name unknown")
+	}
+	err := analyzeMetrics(context.Background(), analysis, findProvider, zap.NewNop(), &fakeLogPersister{})
+	require.Error(t, err)
+	assert.Equal(t, `unable to find the metrics provider for "error-rate" (unknown provider name unknown)`, err.Error())
+}
+
+func TestAnalyzeMetricsStopped(t *testing.T) {
+	analysis := config.K8sCanaryAnalysis{
+		Duration: config.Duration(time.Minute),
+		Metrics: []config.AnalysisMetrics{
+			{Provider: "prometheus", Query: "error-rate", Interval: config.Duration(5 * time.Millisecond)},
+		},
+	}
+	provider := &fakeMetricsProvider{
+		results: map[string][]bool{"error-rate": {true}},
+	}
+	findProvider := func(name string) (metrics.Provider, error) {
+		return provider, nil
+	}
+
+	// The analysis is not successful when the stage was stopped before the duration elapsed.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := analyzeMetrics(ctx, analysis, findProvider, zap.NewNop(), &fakeLogPersister{})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
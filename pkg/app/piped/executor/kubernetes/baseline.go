@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
 	"github.com/pipe-cd/pipe/pkg/app/piped/executor"
@@ -30,6 +31,9 @@ const (
 	addedBaselineResourcesMetadataKey = "baseline-resources"
 )
 
+// failedResourcesCleanupTimeout is the maximum duration to remove the resources applied by a failed rollout.
+const failedResourcesCleanupTimeout = time.Minute
+
 func (e *deployExecutor) ensureBaselineRollout(ctx context.Context) model.StageStatus {
 	var (
 		runningCommit = e.Deployment.RunningCommitHash
@@ -60,7 +64,7 @@ func (e *deployExecutor) ensureBaselineRollout(ctx context.Context) model.StageS
 		return model.StageStatus_STAGE_FAILURE
 	}
 
-	// Add builtin annotations for tracking application live state.
+	// Add builtin annotations and labels for tracking application live state.
 	addBuiltinAnnontations(
 		baselineManifests,
 		baselineVariant,
@@ -68,22 +72,24 @@ func (e *deployExecutor) ensureBaselineRollout(ctx context.Context) model.StageS
 		e.PipedConfig.PipedID,
 		e.Deployment.ApplicationId,
 	)
+	addBuiltinLabels(baselineManifests, runningCommit, e.Deployment.ApplicationId)
 
 	// Store added resource keys into metadata for cleaning later.
-	addedResources := make([]string, 0, len(baselineManifests))
-	for _, m := range baselineManifests {
-		addedResources = append(addedResources, m.Key.String())
-	}
-	metadata := strings.Join(addedResources, ",")
-	err = e.MetadataStore.Set(ctx, addedBaselineResourcesMetadataKey, metadata)
-	if err != nil {
+	if err := storeAddedResources(ctx, e.MetadataStore, addedBaselineResourcesMetadataKey, baselineManifests); err != nil {
 		e.LogPersister.Errorf("Unable to save deployment metadata (%v)", err)
 		return model.StageStatus_STAGE_FAILURE
 	}
 
 	// Start rolling out the resources for BASELINE variant.
 	e.LogPersister.Info("Start rolling out BASELINE variant...")
-	if err := applyManifests(ctx, e.provider, baselineManifests, e.deployCfg.Input.Namespace, e.LogPersister); err != nil {
+	if _, err := applyManifests(ctx, e.provider, baselineManifests, e.deployCfg.Input.Namespace, e.LogPersister); err != nil {
+		e.removeFailedBaselineResources(baselineManifests)
+		return model.StageStatus_STAGE_FAILURE
+	}
+
+	// Wait until the BASELINE workloads are ready to serve.
+	if err := waitForRollouts(ctx, e.provider, baselineManifests, e.deployCfg.HealthCheck, defaultRolloutTimeout, e.LogPersister); err != nil {
+		e.removeFailedBaselineResources(baselineManifests)
 		return model.StageStatus_STAGE_FAILURE
 	}
 
@@ -91,18 +97,55 @@ func (e *deployExecutor) ensureBaselineRollout(ctx context.Context) model.StageS
 	return model.StageStatus_STAGE_SUCCESS
 }
 
+// removeFailedBaselineResources removes the resources of BASELINE variant which might have been applied
+// by the failed rollout to not leave them running. This is best-effort so the failures are only logged.
+// It does not use the context of the stage since the rollout might have failed because
+// the stage was cancelled or timed out.
+func (e *deployExecutor) removeFailedBaselineResources(manifests []provider.Manifest) {
+	ctx, cancel := context.WithTimeout(context.Background(), failedResourcesCleanupTimeout)
+	defer cancel()
+
+	e.LogPersister.Info("Start removing the resources of BASELINE variant applied by the failed rollout")
+	resources := make([]string, 0, len(manifests))
+	for _, m := range manifests {
+		resources = append(resources, m.Key.String())
+	}
+	if err := removeBaselineResources(ctx, e.provider, resources, e.LogPersister); err != nil {
+		e.LogPersister.Errorf("Unable to remove baseline resources: %v", err)
+	}
+}
+
 func (e *deployExecutor) ensureBaselineClean(ctx context.Context) model.StageStatus {
-	value, ok := e.MetadataStore.Get(addedBaselineResourcesMetadataKey)
-	if !ok {
-		e.LogPersister.Error("Unable to determine the applied BASELINE resources")
+	options := e.StageConfig.K8sBaselineCleanStageOptions
+	if options == nil {
+		e.LogPersister.Errorf("Malformed configuration for stage %s", e.Stage.Name)
+		return model.StageStatus_STAGE_FAILURE
+	}
+
+	resources, err := loadAddedResources(e.MetadataStore, addedBaselineResourcesMetadataKey)
+	if err != nil {
+		e.LogPersister.Errorf("Unable to determine the applied BASELINE resources (%v)", err)
 		return model.StageStatus_STAGE_FAILURE
 	}
 
-	resources := strings.Split(value, ",")
 	if err := removeBaselineResources(ctx, e.provider, resources, e.LogPersister); err != nil {
 		e.LogPersister.Errorf("Unable to remove baseline resources: %v", err)
 		return model.StageStatus_STAGE_FAILURE
 	}
+
+	if options.WaitForDeletion {
+		keys := make([]provider.ResourceKey, 0, len(resources))
+		for _, r := range resources {
+			// The undecodable keys were already reported while removing.
+			if key, err := provider.DecodeResourceKey(r); err == nil {
+				keys = append(keys, key)
+			}
+		}
+		if err := waitForDeletion(ctx, e.provider, keys, deletionTimeout(options.DeletionTimeout), e.LogPersister); err != nil {
+			e.LogPersister.Errorf("Failed while waiting for the baseline resources to be deleted (%v)", err)
+			return model.StageStatus_STAGE_FAILURE
+		}
+	}
 	return model.StageStatus_STAGE_SUCCESS
 }
 
@@ -112,9 +155,9 @@ func (e *deployExecutor) generateBaselineManifests(manifests []provider.Manifest
 		suffix = opts.Suffix
 	}
 
-	workloads := findWorkloadManifests(manifests, e.deployCfg.Workloads)
-	if len(workloads) == 0 {
-		return nil, fmt.Errorf("unable to find any workload manifests for BASELINE variant")
+	workloads, err := findBaselineWorkloads(manifests, opts.Workloads, e.deployCfg.Workloads)
+	if err != nil {
+		return nil, err
 	}
 
 	var baselineManifests []provider.Manifest
@@ -137,15 +180,10 @@ func (e *deployExecutor) generateBaselineManifests(manifests []provider.Manifest
 		baselineManifests = append(baselineManifests, generatedServices...)
 	}
 
-	// Generate new workload manifests for VANARY variant.
-	// The generated ones will mount to the new ConfigMaps and Secrets.
-	replicasCalculator := func(cur *int32) int32 {
-		if cur == nil {
-			return 1
-		}
-		num := opts.Replicas.Calculate(int(*cur), 1)
-		return int32(num)
-	}
+	// Generate new workload manifests for BASELINE variant.
+	// Because BASELINE is a scaled-down copy of the running PRIMARY
+	// the generated ones keep mounting the ConfigMaps and Secrets of PRIMARY.
+	replicasCalculator := makeVariantReplicasCalculator(opts.Replicas)
 	generatedWorkloads, err := generateVariantWorkloadManifests(workloads, nil, nil, baselineVariant, suffix, replicasCalculator)
 	if err != nil {
 		return nil, err
@@ -155,6 +193,38 @@ func (e *deployExecutor) generateBaselineManifests(manifests []provider.Manifest
 	return baselineManifests, nil
 }
 
+// findBaselineWorkloads returns the workloads to be mirrored by BASELINE variant.
+// The ones referenced by the stage options take precedence over the ones of the application.
+// When neither was specified, the only Deployment is used since mirroring all of them
+// would not be intended in the applications containing multiple Deployments.
+func findBaselineWorkloads(manifests []provider.Manifest, stageRefs, appRefs []config.K8sResourceReference) ([]provider.Manifest, error) {
+	refs := stageRefs
+	if len(refs) == 0 {
+		refs = appRefs
+	}
+	if len(refs) > 0 {
+		for _, ref := range refs {
+			if len(findWorkloadManifests(manifests, []config.K8sResourceReference{ref})) == 0 {
+				return nil, fmt.Errorf("unable to find any workload manifests for BASELINE variant: kind=%q, name=%q", ref.Kind, ref.Name)
+			}
+		}
+		return findWorkloadManifests(manifests, refs), nil
+	}
+
+	deployments := findManifests(provider.KindDeployment, "", manifests)
+	switch len(deployments) {
+	case 0:
+		return nil, fmt.Errorf("unable to find any workload manifests for BASELINE variant")
+	case 1:
+		return deployments, nil
+	}
+	names := make([]string, 0, len(deployments))
+	for _, d := range deployments {
+		names = append(names, d.Key.Name)
+	}
+	return nil, fmt.Errorf("unable to determine the workload for BASELINE variant from %d Deployments (%s), specify it by the workloads field", len(deployments), strings.Join(names, ", "))
+}
+
 func removeBaselineResources(ctx context.Context, applier provider.Applier, resources []string, lp executor.LogPersister) error {
 	if len(resources) == 0 {
 		return nil
@@ -0,0 +1,552 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes/providertest"
+	"github.com/pipe-cd/pipe/pkg/app/piped/executor"
+	"github.com/pipe-cd/pipe/pkg/cache/cachetest"
+	"github.com/pipe-cd/pipe/pkg/config"
+	"github.com/pipe-cd/pipe/pkg/model"
+)
+
+func TestEnsureBaselineRollout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	rolloutCheckInterval = time.Millisecond
+	defer func() {
+		rolloutCheckInterval = 5 * time.Second
+	}()
+
+	runningManifests, err := provider.ParseManifests(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: simple
+  template:
+    metadata:
+      labels:
+        app: simple
+`)
+	require.NoError(t, err)
+
+	makeLiveBaseline := func(available int) provider.Manifest {
+		manifests, err := provider.ParseManifests(fmt.Sprintf(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple-baseline
+spec:
+  replicas: 1
+status:
+  replicas: 1
+  updatedReplicas: 1
+  availableReplicas: %d
+`, available))
+		require.NoError(t, err)
+		return manifests[0]
+	}
+
+	baselineKey := provider.ResourceKey{
+		APIVersion: "apps/v1",
+		Kind:       provider.KindDeployment,
+		Namespace:  "default",
+		Name:       "simple-baseline",
+	}
+
+	testcases := []struct {
+		name     string
+		provider func() provider.Provider
+		want     model.StageStatus
+	}{
+		{
+			name: "failed to apply manifests",
+			provider: func() provider.Provider {
+				p := providertest.NewMockProvider(ctrl)
+				p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyAction(""), fmt.Errorf("error"))
+				// The resources must be removed even though applying failed since they might have been created.
+				p.EXPECT().Delete(gomock.Any(), baselineKey).Return(provider.ErrNotFound)
+				return p
+			},
+			want: model.StageStatus_STAGE_FAILURE,
+		},
+		{
+			name: "failed to check the readiness",
+			provider: func() provider.Provider {
+				p := providertest.NewMockProvider(ctrl)
+				p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyActionConfigured, nil)
+				p.EXPECT().GetManifest(gomock.Any(), gomock.Any()).Return(provider.Manifest{}, fmt.Errorf("error"))
+				// The applied resources must be removed.
+				p.EXPECT().Delete(gomock.Any(), baselineKey).Return(nil)
+				return p
+			},
+			want: model.StageStatus_STAGE_FAILURE,
+		},
+		{
+			name: "successfully rolled out after becoming available",
+			provider: func() provider.Provider {
+				p := providertest.NewMockProvider(ctrl)
+				p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, m provider.Manifest) (provider.ApplyAction, error) {
+					// Only the scaled-down BASELINE variant must be applied.
+					assert.Equal(t, "simple-baseline", m.Key.Name)
+					return provider.ApplyActionConfigured, nil
+				})
+				gomock.InOrder(
+					p.EXPECT().GetManifest(gomock.Any(), gomock.Any()).Return(makeLiveBaseline(0), nil),
+					p.EXPECT().GetManifest(gomock.Any(), gomock.Any()).Return(makeLiveBaseline(1), nil),
+				)
+				return p
+			},
+			want: model.StageStatus_STAGE_SUCCESS,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := cachetest.NewMockCache(ctrl)
+			c.EXPECT().Get(gomock.Any()).Return(runningManifests, nil)
+
+			e := &deployExecutor{
+				Input: executor.Input{
+					Deployment: &model.Deployment{
+						RunningCommitHash: "running-commit",
+					},
+					Stage: &model.PipelineStage{},
+					StageConfig: config.PipelineStage{
+						K8sBaselineRolloutStageOptions: &config.K8sBaselineRolloutStageOptions{},
+						K8sBaselineCleanStageOptions:   &config.K8sBaselineCleanStageOptions{},
+					},
+					AppManifestsCache: c,
+					LogPersister:      &fakeLogPersister{},
+					MetadataStore:     &fakeMetadataStore{},
+					PipedConfig:       &config.PipedSpec{},
+					Logger:            zap.NewNop(),
+				},
+				provider:  tc.provider(),
+				deployCfg: &config.KubernetesDeploymentSpec{},
+			}
+			got := e.ensureBaselineRollout(context.Background())
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestEnsureBaselineRolloutCleanupAfterStageDeadline(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	rolloutCheckInterval = time.Millisecond
+	defer func() {
+		rolloutCheckInterval = 5 * time.Second
+	}()
+
+	runningManifests, err := provider.ParseManifests(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: simple
+  template:
+    metadata:
+      labels:
+        app: simple
+`)
+	require.NoError(t, err)
+
+	liveBaseline := parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple-baseline
+spec:
+  replicas: 1
+status:
+  replicas: 1
+  updatedReplicas: 1
+  availableReplicas: 0
+`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := cachetest.NewMockCache(ctrl)
+	c.EXPECT().Get(gomock.Any()).Return(runningManifests, nil)
+
+	p := providertest.NewMockProvider(ctrl)
+	p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyActionConfigured, nil)
+	// The stage deadline passes while waiting for the BASELINE workload to be ready.
+	p.EXPECT().GetManifest(gomock.Any(), liveBaseline.Key).DoAndReturn(func(_ context.Context, _ provider.ResourceKey) (provider.Manifest, error) {
+		cancel()
+		return liveBaseline, nil
+	})
+	// The applied resources must still be removed with a context which is not done.
+	p.EXPECT().Delete(gomock.Any(), liveBaseline.Key).DoAndReturn(func(ctx context.Context, _ provider.ResourceKey) error {
+		assert.NoError(t, ctx.Err())
+		return nil
+	})
+
+	e := &deployExecutor{
+		Input: executor.Input{
+			Deployment: &model.Deployment{
+				RunningCommitHash: "running-commit",
+			},
+			Stage: &model.PipelineStage{},
+			StageConfig: config.PipelineStage{
+				K8sBaselineRolloutStageOptions: &config.K8sBaselineRolloutStageOptions{},
+			},
+			AppManifestsCache: c,
+			LogPersister:      &fakeLogPersister{},
+			MetadataStore:     &fakeMetadataStore{},
+			PipedConfig:       &config.PipedSpec{},
+			Logger:            zap.NewNop(),
+		},
+		provider:  p,
+		deployCfg: &config.KubernetesDeploymentSpec{},
+	}
+	got := e.ensureBaselineRollout(ctx)
+	assert.Equal(t, model.StageStatus_STAGE_FAILURE, got)
+}
+
+func TestBaselineRolloutAndClean(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	rolloutCheckInterval = time.Millisecond
+	defer func() {
+		rolloutCheckInterval = 5 * time.Second
+	}()
+
+	runningManifests, err := provider.ParseManifests(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: simple
+  template:
+    metadata:
+      labels:
+        app: simple
+`)
+	require.NoError(t, err)
+
+	liveBaseline := parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple-baseline
+spec:
+  replicas: 1
+status:
+  replicas: 1
+  updatedReplicas: 1
+  availableReplicas: 1
+`)
+
+	newExecutor := func(stage model.Stage, p provider.Provider, store executor.MetadataStore) *deployExecutor {
+		c := cachetest.NewMockCache(ctrl)
+		c.EXPECT().Get(gomock.Any()).Return(runningManifests, nil).AnyTimes()
+
+		return &deployExecutor{
+			Input: executor.Input{
+				Deployment: &model.Deployment{
+					RunningCommitHash: "running-commit",
+				},
+				Stage: &model.PipelineStage{
+					Name: stage.String(),
+				},
+				StageConfig: config.PipelineStage{
+					K8sBaselineRolloutStageOptions: &config.K8sBaselineRolloutStageOptions{},
+					K8sBaselineCleanStageOptions:   &config.K8sBaselineCleanStageOptions{},
+				},
+				AppManifestsCache: c,
+				LogPersister:      &fakeLogPersister{},
+				MetadataStore:     store,
+				PipedConfig:       &config.PipedSpec{},
+				Logger:            zap.NewNop(),
+			},
+			provider:  p,
+			deployCfg: &config.KubernetesDeploymentSpec{},
+		}
+	}
+
+	t.Run("clean before rollout", func(t *testing.T) {
+		p := providertest.NewMockProvider(ctrl)
+		e := newExecutor(model.StageK8sBaselineClean, p, &fakeValuesMetadataStore{})
+		got := e.ensureBaselineClean(context.Background())
+		assert.Equal(t, model.StageStatus_STAGE_FAILURE, got)
+	})
+
+	t.Run("clean the resources added by rollout", func(t *testing.T) {
+		// Each stage is handled by its own executor so only the metadata store is shared between them.
+		store := &fakeValuesMetadataStore{}
+
+		p := providertest.NewMockProvider(ctrl)
+		p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyActionConfigured, nil)
+		p.EXPECT().GetManifest(gomock.Any(), gomock.Any()).Return(liveBaseline, nil)
+		got := newExecutor(model.StageK8sBaselineRollout, p, store).ensureBaselineRollout(context.Background())
+		require.Equal(t, model.StageStatus_STAGE_SUCCESS, got)
+
+		p = providertest.NewMockProvider(ctrl)
+		p.EXPECT().Delete(gomock.Any(), liveBaseline.Key).Return(nil)
+		got = newExecutor(model.StageK8sBaselineClean, p, store).ensureBaselineClean(context.Background())
+		assert.Equal(t, model.StageStatus_STAGE_SUCCESS, got)
+	})
+
+	t.Run("wait for the resources to be deleted", func(t *testing.T) {
+		rolloutCheckInterval = time.Millisecond
+		defer func() { rolloutCheckInterval = 5 * time.Second }()
+
+		store := &fakeValuesMetadataStore{}
+
+		p := providertest.NewMockProvider(ctrl)
+		p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyActionConfigured, nil)
+		p.EXPECT().GetManifest(gomock.Any(), gomock.Any()).Return(liveBaseline, nil)
+		got := newExecutor(model.StageK8sBaselineRollout, p, store).ensureBaselineRollout(context.Background())
+		require.Equal(t, model.StageStatus_STAGE_SUCCESS, got)
+
+		p = providertest.NewMockProvider(ctrl)
+		gomock.InOrder(
+			p.EXPECT().Delete(gomock.Any(), liveBaseline.Key).Return(nil),
+			p.EXPECT().GetManifest(gomock.Any(), liveBaseline.Key).Return(liveBaseline, nil).Times(2),
+			p.EXPECT().GetManifest(gomock.Any(), liveBaseline.Key).Return(provider.Manifest{}, provider.ErrNotFound),
+		)
+		e := newExecutor(model.StageK8sBaselineClean, p, store)
+		e.StageConfig.K8sBaselineCleanStageOptions.WaitForDeletion = true
+		got = e.ensureBaselineClean(context.Background())
+		assert.Equal(t, model.StageStatus_STAGE_SUCCESS, got)
+	})
+}
+
+func TestGenerateBaselineManifests(t *testing.T) {
+	manifests, err := provider.ParseManifests(`
+apiVersion: v1
+kind: Service
+metadata:
+  name: simple
+spec:
+  type: NodePort
+  selector:
+    app: simple
+  ports:
+  - port: 9085
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+spec:
+  replicas: 10
+  selector:
+    matchLabels:
+      app: simple
+  template:
+    metadata:
+      labels:
+        app: simple
+`)
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name             string
+		opts             config.K8sBaselineRolloutStageOptions
+		expectedName     string
+		expectedReplicas int32
+		expectedService  bool
+	}{
+		{
+			name:             "default options",
+			expectedName:     "simple-baseline",
+			expectedReplicas: 1,
+		},
+		{
+			name: "custom suffix and percentage replicas",
+			opts: config.K8sBaselineRolloutStageOptions{
+				Suffix:   "stable",
+				Replicas: config.Replicas{Number: 20, IsPercentage: true},
+			},
+			expectedName:     "simple-stable",
+			expectedReplicas: 2,
+		},
+		{
+			name: "fixed replicas",
+			opts: config.K8sBaselineRolloutStageOptions{
+				Replicas: config.Replicas{Number: 3},
+			},
+			expectedName:     "simple-baseline",
+			expectedReplicas: 3,
+		},
+		{
+			name: "percentage replicas rounded up",
+			opts: config.K8sBaselineRolloutStageOptions{
+				Replicas: config.Replicas{Number: 15, IsPercentage: true},
+			},
+			expectedName:     "simple-baseline",
+			expectedReplicas: 2,
+		},
+		{
+			name: "with service",
+			opts: config.K8sBaselineRolloutStageOptions{
+				CreateService: true,
+			},
+			expectedName:     "simple-baseline",
+			expectedReplicas: 1,
+			expectedService:  true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &deployExecutor{
+				deployCfg: &config.KubernetesDeploymentSpec{},
+			}
+			generated, err := e.generateBaselineManifests(manifests, tc.opts)
+			require.NoError(t, err)
+
+			workloads := findManifests(provider.KindDeployment, "", generated)
+			require.Equal(t, 1, len(workloads))
+			d := &appsv1.Deployment{}
+			err = workloads[0].ConvertToStructuredObject(d)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedName, d.Name)
+			assert.Equal(t, tc.expectedReplicas, *d.Spec.Replicas)
+			assert.Equal(t, map[string]string{"app": "simple", variantLabel: baselineVariant}, d.Spec.Selector.MatchLabels)
+			assert.Equal(t, map[string]string{"app": "simple", variantLabel: baselineVariant}, d.Spec.Template.Labels)
+			assert.NoError(t, checkVariantSelectorInWorkload(workloads[0], baselineVariant))
+
+			services := findManifests(provider.KindService, "", generated)
+			if !tc.expectedService {
+				assert.Empty(t, services)
+				return
+			}
+			require.Equal(t, 1, len(services))
+			s := &corev1.Service{}
+			err = services[0].ConvertToStructuredObject(s)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedName, s.Name)
+			assert.Equal(t, corev1.ServiceTypeClusterIP, s.Spec.Type)
+			assert.Equal(t, map[string]string{"app": "simple", variantLabel: baselineVariant}, s.Spec.Selector)
+		})
+	}
+
+	// The loaded manifests must not be modified.
+	assert.Equal(t, "simple", manifests[1].Key.Name)
+}
+
+func TestFindBaselineWorkloads(t *testing.T) {
+	manifests, err := provider.ParseManifests(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: frontend
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: backend
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: database
+`)
+	require.NoError(t, err)
+	var (
+		frontend = manifests[0]
+		backend  = manifests[1]
+		database = manifests[2]
+	)
+
+	testcases := []struct {
+		name      string
+		manifests []provider.Manifest
+		stageRefs []config.K8sResourceReference
+		appRefs   []config.K8sResourceReference
+		expected  []provider.Manifest
+		expectErr bool
+	}{
+		{
+			name:      "the only deployment by default",
+			manifests: []provider.Manifest{frontend, database},
+			expected:  []provider.Manifest{frontend},
+		},
+		{
+			name:      "ambiguous deployments",
+			manifests: manifests,
+			expectErr: true,
+		},
+		{
+			name:      "no deployment",
+			manifests: []provider.Manifest{database},
+			expectErr: true,
+		},
+		{
+			name:      "selected by stage options",
+			manifests: manifests,
+			stageRefs: []config.K8sResourceReference{{Name: "backend"}},
+			expected:  []provider.Manifest{backend},
+		},
+		{
+			name:      "selected by application",
+			manifests: manifests,
+			appRefs:   []config.K8sResourceReference{{Kind: "StatefulSet", Name: "database"}},
+			expected:  []provider.Manifest{database},
+		},
+		{
+			name:      "stage options take precedence over application",
+			manifests: manifests,
+			stageRefs: []config.K8sResourceReference{{Name: "frontend"}},
+			appRefs:   []config.K8sResourceReference{{Name: "backend"}},
+			expected:  []provider.Manifest{frontend},
+		},
+		{
+			name:      "selected workload not found",
+			manifests: manifests,
+			stageRefs: []config.K8sResourceReference{{Name: "frontend"}, {Name: "unknown"}},
+			expectErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			workloads, err := findBaselineWorkloads(tc.manifests, tc.stageRefs, tc.appRefs)
+			assert.Equal(t, tc.expectErr, err != nil)
+			assert.Equal(t, tc.expected, workloads)
+		})
+	}
+}
@@ -17,7 +17,6 @@ package kubernetes
 import (
 	"context"
 	"fmt"
-	"strings"
 
 	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
 	"github.com/pipe-cd/pipe/pkg/app/piped/executor"
@@ -65,7 +64,7 @@ func (e *deployExecutor) ensureCanaryRollout(ctx context.Context) model.StageSta
 		return model.StageStatus_STAGE_FAILURE
 	}
 
-	// Add builtin annotations for tracking application live state.
+	// Add builtin annotations and labels for tracking application live state.
 	addBuiltinAnnontations(
 		canaryManifests,
 		canaryVariant,
@@ -73,37 +72,45 @@ func (e *deployExecutor) ensureCanaryRollout(ctx context.Context) model.StageSta
 		e.PipedConfig.PipedID,
 		e.Deployment.ApplicationId,
 	)
+	addBuiltinLabels(canaryManifests, e.commit, e.Deployment.ApplicationId)
 
 	// Store added resource keys into metadata for cleaning later.
-	addedResources := make([]string, 0, len(canaryManifests))
-	for _, m := range canaryManifests {
-		addedResources = append(addedResources, m.Key.String())
-	}
-	metadata := strings.Join(addedResources, ",")
-	err = e.MetadataStore.Set(ctx, addedCanaryResourcesMetadataKey, metadata)
-	if err != nil {
+	if err := storeAddedResources(ctx, e.MetadataStore, addedCanaryResourcesMetadataKey, canaryManifests); err != nil {
 		e.LogPersister.Errorf("Unable to save deployment metadata (%v)", err)
 		return model.StageStatus_STAGE_FAILURE
 	}
 
 	// Start rolling out the resources for CANARY variant.
 	e.LogPersister.Info("Start rolling out CANARY variant...")
-	if err := applyManifests(ctx, e.provider, canaryManifests, e.deployCfg.Input.Namespace, e.LogPersister); err != nil {
+	if _, err := applyManifests(ctx, e.provider, canaryManifests, e.deployCfg.Input.Namespace, e.LogPersister); err != nil {
+		return model.StageStatus_STAGE_FAILURE
+	}
+
+	// Wait until the CANARY workloads are ready to serve.
+	if err := waitForRollouts(ctx, e.provider, canaryManifests, e.deployCfg.HealthCheck, defaultRolloutTimeout, e.LogPersister); err != nil {
 		return model.StageStatus_STAGE_FAILURE
 	}
 
 	e.LogPersister.Success("Successfully rolled out CANARY variant")
+
+	// Make sure that the CANARY variant is healthy enough to be promoted.
+	if options.Analysis != nil {
+		if err := analyzeMetrics(ctx, *options.Analysis, e.findMetricsProvider, e.Logger, e.LogPersister); err != nil {
+			e.LogPersister.Errorf("Analysis of CANARY variant failed (%v)", err)
+			return model.StageStatus_STAGE_FAILURE
+		}
+		e.LogPersister.Success("All metrics of CANARY variant were within the expected ranges")
+	}
 	return model.StageStatus_STAGE_SUCCESS
 }
 
 func (e *deployExecutor) ensureCanaryClean(ctx context.Context) model.StageStatus {
-	value, ok := e.MetadataStore.Get(addedCanaryResourcesMetadataKey)
-	if !ok {
-		e.LogPersister.Error("Unable to determine the applied CANARY resources")
+	resources, err := loadAddedResources(e.MetadataStore, addedCanaryResourcesMetadataKey)
+	if err != nil {
+		e.LogPersister.Errorf("Unable to determine the applied CANARY resources (%v)", err)
 		return model.StageStatus_STAGE_FAILURE
 	}
 
-	resources := strings.Split(value, ",")
 	if err := removeCanaryResources(ctx, e.provider, resources, e.LogPersister); err != nil {
 		e.LogPersister.Errorf("Unable to remove canary resources: %v", err)
 		return model.StageStatus_STAGE_FAILURE
@@ -154,13 +161,7 @@ func (e *deployExecutor) generateCanaryManifests(manifests []provider.Manifest,
 
 	// Generate new workload manifests for CANARY variant.
 	// The generated ones will mount to the new ConfigMaps and Secrets.
-	replicasCalculator := func(cur *int32) int32 {
-		if cur == nil {
-			return 1
-		}
-		num := opts.Replicas.Calculate(int(*cur), 1)
-		return int32(num)
-	}
+	replicasCalculator := makeVariantReplicasCalculator(opts.Replicas)
 	// We don't need to duplicate the workload manifests
 	// because generateVariantWorkloadManifests function is already making a duplicate while decoding.
 	// workloads = duplicateManifests(workloads, suffix)
@@ -178,16 +179,27 @@ func removeCanaryResources(ctx context.Context, applier provider.Applier, resour
 		return nil
 	}
 
-	var (
-		workloadKeys = make([]provider.ResourceKey, 0)
-		serviceKeys  = make([]provider.ResourceKey, 0)
-	)
+	keys := make([]provider.ResourceKey, 0, len(resources))
 	for _, r := range resources {
 		key, err := provider.DecodeResourceKey(r)
 		if err != nil {
 			lp.Errorf("Had an error while decoding CANARY resource key: %s, %v", r, err)
 			continue
 		}
+		keys = append(keys, key)
+	}
+
+	// Make sure that only the resources of CANARY variant will be deleted.
+	keys, err := filterOwnedResources(ctx, applier, keys, variantLabel, canaryVariant, lp)
+	if err != nil {
+		return err
+	}
+
+	var (
+		workloadKeys = make([]provider.ResourceKey, 0)
+		serviceKeys  = make([]provider.ResourceKey, 0)
+	)
+	for _, key := range keys {
 		if key.IsWorkload() {
 			workloadKeys = append(workloadKeys, key)
 		} else {
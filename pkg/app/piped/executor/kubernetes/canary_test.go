@@ -21,7 +21,9 @@ import (
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 
 	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
@@ -160,7 +162,7 @@ func TestEnsureCanaryRollout(t *testing.T) {
 							},
 						}),
 					}, nil)
-					p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(fmt.Errorf("error"))
+					p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyAction(""), fmt.Errorf("error"))
 					return p
 				}(),
 				deployCfg: &config.KubernetesDeploymentSpec{},
@@ -209,7 +211,17 @@ func TestEnsureCanaryRollout(t *testing.T) {
 							},
 						}),
 					}, nil)
-					p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(nil)
+					p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyActionConfigured, nil)
+					p.EXPECT().GetManifest(gomock.Any(), gomock.Any()).Return(parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo-canary
+status:
+  replicas: 1
+  updatedReplicas: 1
+  availableReplicas: 1
+`), nil)
 					return p
 				}(),
 				deployCfg: &config.KubernetesDeploymentSpec{},
@@ -224,3 +236,110 @@ func TestEnsureCanaryRollout(t *testing.T) {
 		})
 	}
 }
+
+func TestGenerateCanaryManifests(t *testing.T) {
+	manifests, err := provider.ParseManifests(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+spec:
+  replicas: 10
+  selector:
+    matchLabels:
+      app: simple
+  template:
+    metadata:
+      labels:
+        app: simple
+`)
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name             string
+		opts             config.K8sCanaryRolloutStageOptions
+		expectedName     string
+		expectedReplicas int32
+	}{
+		{
+			name:             "default options",
+			expectedName:     "simple-canary",
+			expectedReplicas: 1,
+		},
+		{
+			name: "absolute replicas",
+			opts: config.K8sCanaryRolloutStageOptions{
+				Replicas: config.Replicas{Number: 3},
+			},
+			expectedName:     "simple-canary",
+			expectedReplicas: 3,
+		},
+		{
+			name: "custom suffix and percentage replicas",
+			opts: config.K8sCanaryRolloutStageOptions{
+				Suffix:   "new",
+				Replicas: config.Replicas{Number: 50, IsPercentage: true},
+			},
+			expectedName:     "simple-new",
+			expectedReplicas: 5,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &deployExecutor{
+				deployCfg: &config.KubernetesDeploymentSpec{},
+			}
+			generated, err := e.generateCanaryManifests(manifests, tc.opts)
+			require.NoError(t, err)
+			require.Equal(t, 1, len(generated))
+
+			d := &appsv1.Deployment{}
+			require.NoError(t, generated[0].ConvertToStructuredObject(d))
+			assert.Equal(t, tc.expectedName, d.Name)
+			assert.Equal(t, tc.expectedReplicas, *d.Spec.Replicas)
+			assert.Equal(t, canaryVariant, d.Spec.Selector.MatchLabels[variantLabel])
+			assert.Equal(t, canaryVariant, d.Spec.Template.Labels[variantLabel])
+		})
+	}
+
+	// The loaded PRIMARY manifests must be kept as they are.
+	d := &appsv1.Deployment{}
+	require.NoError(t, manifests[0].ConvertToStructuredObject(d))
+	assert.Equal(t, "simple", d.Name)
+	assert.Equal(t, int32(10), *d.Spec.Replicas)
+	assert.Equal(t, map[string]string{"app": "simple"}, d.Spec.Selector.MatchLabels)
+}
+
+func TestRemoveCanaryResources(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	makeLiveDeployment := func(name, variant string) provider.Manifest {
+		return parseManifest(t, fmt.Sprintf(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: %s
+  annotations:
+    pipecd.dev/variant: %s
+`, name, variant))
+	}
+	canary := makeLiveDeployment("simple-canary", canaryVariant)
+	primary := makeLiveDeployment("simple", primaryVariant)
+	deleted := makeLiveDeployment("simple-canary-deleted", canaryVariant)
+
+	p := providertest.NewMockProvider(ctrl)
+	p.EXPECT().GetManifest(gomock.Any(), canary.Key).Return(canary, nil)
+	p.EXPECT().GetManifest(gomock.Any(), primary.Key).Return(primary, nil)
+	p.EXPECT().GetManifest(gomock.Any(), deleted.Key).Return(provider.Manifest{}, provider.ErrNotFound)
+	// Only the resource of CANARY variant must be deleted.
+	p.EXPECT().Delete(gomock.Any(), canary.Key).Return(nil)
+
+	resources := []string{
+		canary.Key.String(),
+		primary.Key.String(),
+		deleted.Key.String(),
+	}
+	err := removeCanaryResources(context.Background(), p, resources, &fakeLogPersister{})
+	assert.NoError(t, err)
+}
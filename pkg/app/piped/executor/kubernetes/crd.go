@@ -0,0 +1,110 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+)
+
+// The interval between checks of the Established condition of CustomResourceDefinitions.
+var crdEstablishedCheckInterval = time.Second
+
+// The maximum duration to wait for a CustomResourceDefinition to be established.
+const defaultCRDEstablishedTimeout = time.Minute
+
+// customResourceDefinition contains the fields of a CustomResourceDefinition
+// needed to check whether it has been established.
+// Both apiextensions.k8s.io/v1 and v1beta1 share these fields.
+type customResourceDefinition struct {
+	Spec struct {
+		Group string `json:"group"`
+		Names struct {
+			Kind string `json:"kind"`
+		} `json:"names"`
+	} `json:"spec"`
+	Status struct {
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+func (d *customResourceDefinition) established() bool {
+	for _, c := range d.Status.Conditions {
+		if c.Type == "Established" {
+			return c.Status == "True"
+		}
+	}
+	return false
+}
+
+// customResourceKind returns the group and kind of the custom resources
+// defined by the given CustomResourceDefinition manifest.
+func customResourceKind(m provider.Manifest) (string, error) {
+	d := &customResourceDefinition{}
+	if err := m.ConvertToStructuredObject(d); err != nil {
+		return "", err
+	}
+	return groupKind(d.Spec.Group, d.Spec.Names.Kind), nil
+}
+
+// resourceGroupKind returns the group and kind of the given resource.
+func resourceGroupKind(k provider.ResourceKey) string {
+	var group string
+	if parts := strings.SplitN(k.APIVersion, "/", 2); len(parts) == 2 {
+		group = parts[0]
+	}
+	return groupKind(group, k.Kind)
+}
+
+func groupKind(group, kind string) string {
+	return fmt.Sprintf("%s.%s", kind, group)
+}
+
+// waitForCRDEstablished polls the live state of the given CustomResourceDefinition
+// until its Established condition becomes true or the timeout elapses.
+func waitForCRDEstablished(ctx context.Context, applier provider.Applier, key provider.ResourceKey, timeout time.Duration) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(crdEstablishedCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		live, err := applier.GetManifest(timeoutCtx, key)
+		if err != nil {
+			return err
+		}
+		d := &customResourceDefinition{}
+		if err := live.ConvertToStructuredObject(d); err != nil {
+			return err
+		}
+		if d.established() {
+			return nil
+		}
+
+		select {
+		case <-timeoutCtx.Done():
+			return fmt.Errorf("%s has not been established: %w", key.ReadableString(), timeoutCtx.Err())
+		case <-ticker.C:
+		}
+	}
+}
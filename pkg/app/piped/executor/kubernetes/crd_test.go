@@ -0,0 +1,135 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes/providertest"
+)
+
+func makeLiveCRD(t *testing.T, established string) provider.Manifest {
+	return parseManifest(t, fmt.Sprintf(`
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: crontabs.example.com
+spec:
+  group: example.com
+  names:
+    kind: CronTab
+    plural: crontabs
+  scope: Namespaced
+status:
+  conditions:
+  - type: NamesAccepted
+    status: "True"
+  - type: Established
+    status: %q
+`, established))
+}
+
+func TestResourceGroupKind(t *testing.T) {
+	crd := makeLiveCRD(t, "True")
+	kind, err := customResourceKind(crd)
+	require.NoError(t, err)
+	assert.Equal(t, "CronTab.example.com", kind)
+
+	assert.Equal(t, kind, resourceGroupKind(provider.ResourceKey{APIVersion: "example.com/v1", Kind: "CronTab"}))
+	assert.Equal(t, "ConfigMap.", resourceGroupKind(provider.ResourceKey{APIVersion: "v1", Kind: "ConfigMap"}))
+}
+
+func TestWaitForCRDEstablished(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	crdEstablishedCheckInterval = time.Millisecond
+	defer func() {
+		crdEstablishedCheckInterval = time.Second
+	}()
+
+	key := makeLiveCRD(t, "True").Key
+
+	t.Run("established after several polls", func(t *testing.T) {
+		p := providertest.NewMockProvider(ctrl)
+		gomock.InOrder(
+			p.EXPECT().GetManifest(gomock.Any(), key).Return(makeLiveCRD(t, "Unknown"), nil),
+			p.EXPECT().GetManifest(gomock.Any(), key).Return(makeLiveCRD(t, "False"), nil),
+			p.EXPECT().GetManifest(gomock.Any(), key).Return(makeLiveCRD(t, "True"), nil),
+		)
+		err := waitForCRDEstablished(context.Background(), p, key, time.Minute)
+		assert.NoError(t, err)
+	})
+
+	t.Run("timed out", func(t *testing.T) {
+		p := providertest.NewMockProvider(ctrl)
+		p.EXPECT().GetManifest(gomock.Any(), key).Return(makeLiveCRD(t, "False"), nil).MinTimes(1)
+		err := waitForCRDEstablished(context.Background(), p, key, 10*time.Millisecond)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	})
+}
+
+func TestApplyManifestsWaitsForCRDEstablished(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	crdEstablishedCheckInterval = time.Millisecond
+	defer func() {
+		crdEstablishedCheckInterval = time.Second
+	}()
+
+	manifests, err := provider.ParseManifests(`
+apiVersion: example.com/v1
+kind: CronTab
+metadata:
+  name: simple
+spec:
+  cronSpec: "* * * * */5"
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: crontabs.example.com
+spec:
+  group: example.com
+  names:
+    kind: CronTab
+    plural: crontabs
+  scope: Namespaced
+`)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(manifests))
+	cr, crd := manifests[0], manifests[1]
+
+	p := providertest.NewMockProvider(ctrl)
+	gomock.InOrder(
+		p.EXPECT().ApplyManifest(gomock.Any(), crd).Return(provider.ApplyActionConfigured, nil),
+		p.EXPECT().GetManifest(gomock.Any(), crd.Key).Return(makeLiveCRD(t, "False"), nil),
+		p.EXPECT().GetManifest(gomock.Any(), crd.Key).Return(makeLiveCRD(t, "True"), nil),
+		p.EXPECT().ApplyManifest(gomock.Any(), cr).Return(provider.ApplyActionConfigured, nil),
+	)
+
+	_, err = applyManifests(context.Background(), p, manifests, "", &fakeLogPersister{})
+	assert.NoError(t, err)
+}
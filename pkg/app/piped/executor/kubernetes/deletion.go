@@ -0,0 +1,85 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/app/piped/executor"
+	"github.com/pipe-cd/pipe/pkg/config"
+)
+
+// The maximum duration to wait for the deleted resources to disappear.
+const defaultDeletionTimeout = 5 * time.Minute
+
+// deletionTimeout returns the configured timeout for waiting for deletion or the default one.
+func deletionTimeout(timeout config.Duration) time.Duration {
+	if timeout <= 0 {
+		return defaultDeletionTimeout
+	}
+	return timeout.Duration()
+}
+
+// waitForDeletion blocks until all of the given resources are removed from the cluster.
+// A deleted resource still having finalizers stays in terminating state until
+// its finalizers are removed, so the pending finalizers are reported while waiting
+// and included in the returned error when the timeout elapses.
+func waitForDeletion(ctx context.Context, applier provider.Applier, keys []provider.ResourceKey, timeout time.Duration, lp executor.LogPersister) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(rolloutCheckInterval)
+	defer ticker.Stop()
+
+	lp.Infof("Waiting for %d resources to be deleted", len(keys))
+	for _, k := range sortResourcesForDelete(keys) {
+		var lastMessage string
+		for {
+			live, err := applier.GetManifest(timeoutCtx, k)
+			if errors.Is(err, provider.ErrNotFound) {
+				lp.Successf("- %s has been deleted", k.ReadableString())
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("unable to check the deletion of %s: %w", k.ReadableString(), err)
+			}
+
+			message := "still exists"
+			if finalizers := live.GetFinalizers(); len(finalizers) > 0 {
+				message = fmt.Sprintf("is waiting for finalizers: %s", strings.Join(finalizers, ", "))
+			}
+			if message != lastMessage {
+				lp.Infof("- %s %s", k.ReadableString(), message)
+				lastMessage = message
+			}
+
+			select {
+			case <-timeoutCtx.Done():
+				return fmt.Errorf("%s %s: %w", k.ReadableString(), message, timeoutCtx.Err())
+			case <-ticker.C:
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes/providertest"
+	"github.com/pipe-cd/pipe/pkg/config"
+)
+
+func TestWaitForDeletion(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	rolloutCheckInterval = time.Millisecond
+	defer func() { rolloutCheckInterval = 5 * time.Second }()
+
+	terminating := parseManifest(t, `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: terminating
+  finalizers:
+  - kubernetes
+`)
+	deleted := provider.ResourceKey{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Namespace:  "default",
+		Name:       "deleted",
+	}
+
+	t.Run("wait until the finalizers are removed", func(t *testing.T) {
+		p := providertest.NewMockProvider(ctrl)
+		gomock.InOrder(
+			p.EXPECT().GetManifest(gomock.Any(), deleted).Return(provider.Manifest{}, provider.ErrNotFound),
+			p.EXPECT().GetManifest(gomock.Any(), terminating.Key).Return(terminating, nil).Times(3),
+			p.EXPECT().GetManifest(gomock.Any(), terminating.Key).Return(provider.Manifest{}, provider.ErrNotFound),
+		)
+		err := waitForDeletion(context.Background(), p, []provider.ResourceKey{terminating.Key, deleted}, time.Second, &fakeLogPersister{})
+		assert.NoError(t, err)
+	})
+
+	t.Run("timeout while the finalizers remain", func(t *testing.T) {
+		p := providertest.NewMockProvider(ctrl)
+		p.EXPECT().GetManifest(gomock.Any(), terminating.Key).Return(terminating, nil).MinTimes(1)
+		err := waitForDeletion(context.Background(), p, []provider.ResourceKey{terminating.Key}, 10*time.Millisecond, &fakeLogPersister{})
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.Contains(t, err.Error(), "is waiting for finalizers: kubernetes")
+	})
+
+	t.Run("failed to get the resource", func(t *testing.T) {
+		p := providertest.NewMockProvider(ctrl)
+		p.EXPECT().GetManifest(gomock.Any(), deleted).Return(provider.Manifest{}, fmt.Errorf("error"))
+		err := waitForDeletion(context.Background(), p, []provider.ResourceKey{deleted}, time.Second, &fakeLogPersister{})
+		assert.Error(t, err)
+	})
+
+	t.Run("no resources", func(t *testing.T) {
+		p := providertest.NewMockProvider(ctrl)
+		err := waitForDeletion(context.Background(), p, nil, time.Second, &fakeLogPersister{})
+		assert.NoError(t, err)
+	})
+}
+
+func TestDeletionTimeout(t *testing.T) {
+	assert.Equal(t, defaultDeletionTimeout, deletionTimeout(0))
+	assert.Equal(t, time.Minute, deletionTimeout(config.Duration(time.Minute)))
+}
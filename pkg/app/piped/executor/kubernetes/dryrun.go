@@ -0,0 +1,246 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/app/piped/executor"
+)
+
+type dryRunAction string
+
+const (
+	dryRunActionCreated    dryRunAction = "created"
+	dryRunActionConfigured dryRunAction = "configured"
+	dryRunActionUnchanged  dryRunAction = "unchanged"
+)
+
+// The metadata fields populated by the server which may change without any change of the manifest.
+var serverPopulatedMetadataFields = []string{
+	"managedFields",
+	"resourceVersion",
+	"generation",
+	"creationTimestamp",
+	"uid",
+	"selfLink",
+}
+
+// dryRunResult represents what would happen to a resource if its manifest was applied.
+type dryRunResult struct {
+	Key    provider.ResourceKey
+	Action dryRunAction
+}
+
+// dryRunApplyManifests applies the given manifests in server-side dry-run mode
+// to find out which resources would be created, configured or left unchanged
+// without persisting anything to the cluster.
+func dryRunApplyManifests(ctx context.Context, applier provider.Applier, manifests []provider.Manifest, lp executor.LogPersister) ([]dryRunResult, error) {
+	lp.Infof("Start applying %d manifests in dry-run mode", len(manifests))
+	results := make([]dryRunResult, 0, len(manifests))
+	for _, m := range manifests {
+		action, err := dryRunApplyManifest(ctx, applier, m)
+		if err != nil {
+			lp.Errorf("Failed to apply manifest in dry-run mode: %s (%v)", m.Key.ReadableString(), err)
+			return nil, err
+		}
+		lp.Successf("- %s would be %s", m.Key.ReadableString(), action)
+		results = append(results, dryRunResult{
+			Key:    m.Key,
+			Action: action,
+		})
+	}
+	return results, nil
+}
+
+// validateManifests validates the given manifests against the schema of the cluster
+// by applying them in server-side dry-run mode without persisting anything.
+// All manifests are validated to report every invalid one at once.
+// The manifests depending on a namespace or a CustomResourceDefinition which will be
+// created while applying them are skipped since the server can not validate them yet.
+// The given namespace is created by piped before applying if it does not exist, it can be empty.
+func validateManifests(ctx context.Context, applier provider.Applier, manifests []provider.Manifest, namespaceToCreate string, lp executor.LogPersister) error {
+	lp.Infof("Start validating %d manifests", len(manifests))
+	unapplied, err := findUnappliedDependencies(ctx, applier, manifests, namespaceToCreate)
+	if err != nil {
+		lp.Errorf("Failed to find the resources which will be created while applying (%v)", err)
+		return err
+	}
+
+	var (
+		invalid   []string
+		validated int
+	)
+	for _, m := range manifests {
+		if reason, ok := unapplied.find(m); ok {
+			lp.Infof("- skipped validating %s because %s", m.Key.ReadableString(), reason)
+			continue
+		}
+		validated++
+		_, err := applier.DryRunApplyManifest(ctx, m)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, provider.ErrInvalidManifest) {
+			lp.Errorf("Failed to validate manifest: %s (%v)", m.Key.ReadableString(), err)
+			return err
+		}
+		lp.Errorf("- %s is invalid (%v)", m.Key.ReadableString(), err)
+		invalid = append(invalid, fmt.Sprintf("%s (%v)", m.Key.ReadableString(), err))
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("%d of %d manifests are invalid: %s", len(invalid), validated, strings.Join(invalid, ", "))
+	}
+	lp.Successf("Successfully validated %d manifests", validated)
+	return nil
+}
+
+// unappliedDependencies contains the resources which do not exist until the manifests are applied.
+type unappliedDependencies struct {
+	// The namespaces keyed by name.
+	namespaces map[string]struct{}
+	// The CustomResourceDefinitions keyed by the group and kind of their custom resources.
+	crds map[string]provider.ResourceKey
+}
+
+// findUnappliedDependencies returns the namespaces and the CustomResourceDefinitions
+// which are created while applying the given manifests.
+func findUnappliedDependencies(ctx context.Context, applier provider.Applier, manifests []provider.Manifest, namespaceToCreate string) (unappliedDependencies, error) {
+	deps := unappliedDependencies{
+		namespaces: make(map[string]struct{}),
+		crds:       make(map[string]provider.ResourceKey),
+	}
+	for _, m := range manifests {
+		switch m.Key.Kind {
+		case provider.KindNamespace:
+			deps.namespaces[m.Key.Name] = struct{}{}
+		case provider.KindCustomResourceDefinition:
+			kind, err := customResourceKind(m)
+			if err != nil {
+				return deps, fmt.Errorf("unable to read the custom resource kind of %s (%w)", m.Key.ReadableString(), err)
+			}
+			deps.crds[kind] = m.Key
+		}
+	}
+
+	if namespaceToCreate == "" {
+		return deps, nil
+	}
+	if _, ok := deps.namespaces[namespaceToCreate]; ok {
+		return deps, nil
+	}
+	_, err := applier.GetManifest(ctx, provider.ResourceKey{
+		APIVersion: "v1",
+		Kind:       provider.KindNamespace,
+		Name:       namespaceToCreate,
+	})
+	if errors.Is(err, provider.ErrNotFound) {
+		deps.namespaces[namespaceToCreate] = struct{}{}
+		return deps, nil
+	}
+	if err != nil {
+		return deps, fmt.Errorf("unable to get namespace %s (%w)", namespaceToCreate, err)
+	}
+	return deps, nil
+}
+
+// find returns the reason why the given manifest depends on the unapplied resources if it does.
+func (d unappliedDependencies) find(m provider.Manifest) (string, bool) {
+	if crd, ok := d.crds[resourceGroupKind(m.Key)]; ok {
+		return fmt.Sprintf("%s has not been applied yet", crd.ReadableString()), true
+	}
+	if _, ok := d.namespaces[m.Key.Namespace]; ok && m.Key.Kind != provider.KindNamespace {
+		return fmt.Sprintf("its namespace %s has not been created yet", m.Key.Namespace), true
+	}
+	return "", false
+}
+
+func dryRunApplyManifest(ctx context.Context, applier provider.Applier, m provider.Manifest) (dryRunAction, error) {
+	live, err := applier.GetManifest(ctx, m.Key)
+	exists := true
+	if errors.Is(err, provider.ErrNotFound) {
+		exists = false
+	} else if err != nil {
+		return "", fmt.Errorf("unable to get the live manifest (%w)", err)
+	}
+
+	applied, err := applier.DryRunApplyManifest(ctx, m)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return dryRunActionCreated, nil
+	}
+
+	if live, err = normalizeServerManifest(live); err != nil {
+		return "", err
+	}
+	if applied, err = normalizeServerManifest(applied); err != nil {
+		return "", err
+	}
+	result, err := provider.Diff(live, applied)
+	if err != nil {
+		return "", err
+	}
+	if result.HasDiff() {
+		return dryRunActionConfigured, nil
+	}
+	return dryRunActionUnchanged, nil
+}
+
+// normalizeServerManifest returns a copy of the given manifest returned by the server
+// without the status, the metadata fields populated by the server and the commit hash
+// which is updated at every deployment even when nothing else is changed.
+func normalizeServerManifest(m provider.Manifest) (provider.Manifest, error) {
+	obj := make(map[string]interface{})
+	if err := m.ConvertToStructuredObject(&obj); err != nil {
+		return m, err
+	}
+	delete(obj, "status")
+	if metadata, ok := obj["metadata"].(map[string]interface{}); ok {
+		for _, f := range serverPopulatedMetadataFields {
+			delete(metadata, f)
+		}
+		for _, f := range []string{"labels", "annotations"} {
+			values, ok := metadata[f].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			delete(values, provider.LabelCommitHash)
+			if len(values) == 0 {
+				delete(metadata, f)
+			}
+		}
+	}
+	return provider.ParseFromStructuredObject(obj)
+}
+
+// summarizeDryRunResults returns a one-line summary of the given results,
+// e.g. "1 created, 2 configured, 3 unchanged".
+func summarizeDryRunResults(results []dryRunResult) string {
+	counts := make(map[dryRunAction]int, 3)
+	for _, r := range results {
+		counts[r.Action]++
+	}
+	return fmt.Sprintf("%d %s, %d %s, %d %s",
+		counts[dryRunActionCreated], dryRunActionCreated,
+		counts[dryRunActionConfigured], dryRunActionConfigured,
+		counts[dryRunActionUnchanged], dryRunActionUnchanged,
+	)
+}
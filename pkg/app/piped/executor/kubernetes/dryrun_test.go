@@ -0,0 +1,263 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes/providertest"
+)
+
+func TestDryRunApplyManifests(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// The manifests are stamped with the builtin annotations and labels at the given commit
+	// as done before applying them.
+	makeConfigMap := func(name, value, resourceVersion, commit string) provider.Manifest {
+		m := parseManifest(t, fmt.Sprintf(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+  resourceVersion: "%s"
+data:
+  key: %s
+`, name, resourceVersion, value))
+		manifests := []provider.Manifest{m}
+		addBuiltinAnnontations(manifests, primaryVariant, commit, "piped-id", "app-id")
+		addBuiltinLabels(manifests, commit, "app-id")
+		return m
+	}
+	var (
+		added     = makeConfigMap("added", "value", "", "new-commit")
+		changed   = makeConfigMap("changed", "new-value", "", "new-commit")
+		unchanged = makeConfigMap("unchanged", "value", "", "new-commit")
+	)
+
+	// Using the strict mock to ensure that nothing is applied or deleted.
+	p := providertest.NewMockProvider(ctrl)
+	p.EXPECT().GetManifest(gomock.Any(), added.Key).Return(provider.Manifest{}, provider.ErrNotFound)
+	p.EXPECT().DryRunApplyManifest(gomock.Any(), added).Return(makeConfigMap("added", "value", "1", "new-commit"), nil)
+	p.EXPECT().GetManifest(gomock.Any(), changed.Key).Return(makeConfigMap("changed", "old-value", "1", "old-commit"), nil)
+	p.EXPECT().DryRunApplyManifest(gomock.Any(), changed).Return(makeConfigMap("changed", "new-value", "2", "new-commit"), nil)
+	// Only the commit hash would be updated.
+	p.EXPECT().GetManifest(gomock.Any(), unchanged.Key).Return(makeConfigMap("unchanged", "value", "1", "old-commit"), nil)
+	p.EXPECT().DryRunApplyManifest(gomock.Any(), unchanged).Return(makeConfigMap("unchanged", "value", "2", "new-commit"), nil)
+
+	results, err := dryRunApplyManifests(context.Background(), p, []provider.Manifest{added, changed, unchanged}, &fakeLogPersister{})
+	require.NoError(t, err)
+	assert.Equal(t, []dryRunResult{
+		{Key: added.Key, Action: dryRunActionCreated},
+		{Key: changed.Key, Action: dryRunActionConfigured},
+		{Key: unchanged.Key, Action: dryRunActionUnchanged},
+	}, results)
+	assert.Equal(t, "1 created, 1 configured, 1 unchanged", summarizeDryRunResults(results))
+}
+
+func TestDryRunApplyManifestsFailure(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := parseManifest(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: simple
+`)
+	p := providertest.NewMockProvider(ctrl)
+	p.EXPECT().GetManifest(gomock.Any(), m.Key).Return(m, nil)
+	p.EXPECT().DryRunApplyManifest(gomock.Any(), m).Return(provider.Manifest{}, provider.ErrApplyConflict)
+
+	_, err := dryRunApplyManifests(context.Background(), p, []provider.Manifest{m}, &fakeLogPersister{})
+	assert.Equal(t, provider.ErrApplyConflict, err)
+}
+
+func TestValidateManifests(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	valid := parseManifest(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: valid
+data:
+  key: value
+`)
+	invalid := parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: invalid
+spec:
+  replicas: two
+`)
+	invalidErr := fmt.Errorf("%w: error: failed to create typed patch object (default/invalid; apps/v1, Kind=Deployment): .spec.replicas: expected numeric (int or float), got string", provider.ErrInvalidManifest)
+
+	// Using the strict mock to ensure that nothing is applied.
+	p := providertest.NewMockProvider(ctrl)
+	p.EXPECT().DryRunApplyManifest(gomock.Any(), valid).Return(valid, nil).Times(2)
+	p.EXPECT().DryRunApplyManifest(gomock.Any(), invalid).Return(provider.Manifest{}, invalidErr)
+
+	err := validateManifests(context.Background(), p, []provider.Manifest{valid}, "", &fakeLogPersister{})
+	require.NoError(t, err)
+
+	// All manifests are validated even after finding an invalid one.
+	err = validateManifests(context.Background(), p, []provider.Manifest{invalid, valid}, "", &fakeLogPersister{})
+	require.Error(t, err)
+	assert.Equal(t, fmt.Sprintf("1 of 2 manifests are invalid: %s (%v)", invalid.Key.ReadableString(), invalidErr), err.Error())
+	assert.Contains(t, err.Error(), ".spec.replicas: expected numeric (int or float), got string")
+}
+
+func TestValidateManifestsFailure(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := parseManifest(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: simple
+`)
+	p := providertest.NewMockProvider(ctrl)
+	p.EXPECT().DryRunApplyManifest(gomock.Any(), m).Return(provider.Manifest{}, provider.ErrApplyConflict)
+
+	err := validateManifests(context.Background(), p, []provider.Manifest{m, m}, "", &fakeLogPersister{})
+	assert.Equal(t, provider.ErrApplyConflict, err)
+}
+
+func TestValidateManifestsWithUnappliedDependencies(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	manifests, err := provider.ParseManifests(`
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: crontabs.stable.example.com
+spec:
+  group: stable.example.com
+  names:
+    kind: CronTab
+---
+apiVersion: stable.example.com/v1
+kind: CronTab
+metadata:
+  name: simple
+  namespace: existing
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: added
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: in-added
+  namespace: added
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: in-created
+  namespace: created
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: in-existing
+  namespace: existing
+`)
+	require.NoError(t, err)
+	var (
+		crd       = manifests[0]
+		namespace = manifests[2]
+		existing  = manifests[5]
+	)
+
+	// Only the resources not depending on the unapplied ones are validated.
+	p := providertest.NewMockProvider(ctrl)
+	p.EXPECT().GetManifest(gomock.Any(), provider.ResourceKey{APIVersion: "v1", Kind: provider.KindNamespace, Name: "created"}).Return(provider.Manifest{}, provider.ErrNotFound)
+	p.EXPECT().DryRunApplyManifest(gomock.Any(), crd).Return(crd, nil)
+	p.EXPECT().DryRunApplyManifest(gomock.Any(), namespace).Return(namespace, nil)
+	p.EXPECT().DryRunApplyManifest(gomock.Any(), existing).Return(existing, nil)
+
+	err = validateManifests(context.Background(), p, manifests, "created", &fakeLogPersister{})
+	require.NoError(t, err)
+
+	// The resources in the namespace created by piped are validated when it already exists.
+	p = providertest.NewMockProvider(ctrl)
+	p.EXPECT().GetManifest(gomock.Any(), provider.ResourceKey{APIVersion: "v1", Kind: provider.KindNamespace, Name: "existing"}).Return(provider.Manifest{}, nil)
+	p.EXPECT().DryRunApplyManifest(gomock.Any(), crd).Return(crd, nil)
+	p.EXPECT().DryRunApplyManifest(gomock.Any(), namespace).Return(namespace, nil)
+	p.EXPECT().DryRunApplyManifest(gomock.Any(), manifests[4]).Return(manifests[4], nil)
+	p.EXPECT().DryRunApplyManifest(gomock.Any(), existing).Return(existing, nil)
+
+	err = validateManifests(context.Background(), p, manifests, "existing", &fakeLogPersister{})
+	require.NoError(t, err)
+}
+
+func TestNormalizeServerManifest(t *testing.T) {
+	m := parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+  labels:
+    app: simple
+    pipecd.dev/commit-hash: commit
+  annotations:
+    pipecd.dev/commit-hash: commit
+  resourceVersion: "10"
+  generation: 2
+  uid: 1234
+  managedFields:
+  - manager: piped
+spec:
+  replicas: 2
+status:
+  replicas: 2
+`)
+	normalized, err := normalizeServerManifest(m)
+	require.NoError(t, err)
+
+	expected := parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+  labels:
+    app: simple
+spec:
+  replicas: 2
+`)
+	result, err := provider.Diff(expected, normalized)
+	require.NoError(t, err)
+	assert.False(t, result.HasDiff())
+
+	// The given manifest must not be changed.
+	status, err := m.GetNestedMap("status")
+	require.NoError(t, err)
+	assert.NotNil(t, status)
+}
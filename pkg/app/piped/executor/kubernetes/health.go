@@ -0,0 +1,191 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/jsonpath"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/config"
+)
+
+const kindEndpoints = "Endpoints"
+
+// healthStatus represents the health of a resource at a point of time.
+type healthStatus struct {
+	healthy bool
+	message string
+}
+
+// healthChecker evaluates the health of the given live resource.
+type healthChecker func(ctx context.Context, applier provider.Applier, live provider.Manifest) (healthStatus, error)
+
+// findHealthChecker returns the checker for the given resource enabled in the given health check configuration.
+// Nil is returned when the resource does not need to be checked.
+func findHealthChecker(key provider.ResourceKey, cfg config.K8sHealthCheck) (healthChecker, error) {
+	switch {
+	case key.Kind == provider.KindService && cfg.Services:
+		return checkServiceHealth, nil
+	case key.Kind == provider.KindIngress && cfg.Ingresses:
+		return checkIngressHealth, nil
+	}
+	for _, c := range cfg.CustomResources {
+		if c.Kind != key.Kind {
+			continue
+		}
+		if c.APIVersion != "" && c.APIVersion != key.APIVersion {
+			continue
+		}
+		return makeCustomResourceHealthChecker(c)
+	}
+	return nil, nil
+}
+
+// waitForHealthy polls the live state of the given resource
+// until the given checker evaluates it as healthy or the timeout elapses.
+func waitForHealthy(ctx context.Context, applier provider.Applier, m provider.Manifest, check healthChecker, timeout time.Duration) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(rolloutCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		live, err := applier.GetManifest(timeoutCtx, m.Key)
+		if err != nil {
+			return err
+		}
+		status, err := check(timeoutCtx, applier, live)
+		if err != nil {
+			return err
+		}
+		if status.healthy {
+			return nil
+		}
+
+		select {
+		case <-timeoutCtx.Done():
+			return fmt.Errorf("%s: %w", status.message, timeoutCtx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkServiceHealth evaluates a Service as healthy when it has at least one ready endpoint.
+// A LoadBalancer Service must have an assigned address as well.
+// Services without selector are always healthy since their endpoints are not managed by Kubernetes.
+func checkServiceHealth(ctx context.Context, applier provider.Applier, live provider.Manifest) (healthStatus, error) {
+	s := &corev1.Service{}
+	if err := live.ConvertToStructuredObject(s); err != nil {
+		return healthStatus{}, err
+	}
+	if s.Spec.Type == corev1.ServiceTypeExternalName || len(s.Spec.Selector) == 0 {
+		return healthStatus{healthy: true}, nil
+	}
+	if s.Spec.Type == corev1.ServiceTypeLoadBalancer && !hasLoadBalancerAddress(s.Status.LoadBalancer) {
+		return healthStatus{message: "no address has been assigned to the load balancer"}, nil
+	}
+
+	key := provider.ResourceKey{
+		APIVersion: "v1",
+		Kind:       kindEndpoints,
+		Namespace:  live.Key.Namespace,
+		Name:       live.Key.Name,
+	}
+	m, err := applier.GetManifest(ctx, key)
+	if errors.Is(err, provider.ErrNotFound) {
+		return healthStatus{message: "no endpoints have been created"}, nil
+	}
+	if err != nil {
+		return healthStatus{}, err
+	}
+
+	e := &corev1.Endpoints{}
+	if err := m.ConvertToStructuredObject(e); err != nil {
+		return healthStatus{}, err
+	}
+	var ready, notReady int
+	for _, subset := range e.Subsets {
+		ready += len(subset.Addresses)
+		notReady += len(subset.NotReadyAddresses)
+	}
+	if ready == 0 {
+		return healthStatus{message: fmt.Sprintf("no ready endpoints, %d endpoints are not ready", notReady)}, nil
+	}
+	return healthStatus{healthy: true}, nil
+}
+
+// checkIngressHealth evaluates an Ingress as healthy when an address has been assigned to it.
+// All API versions of Ingress share the status field.
+func checkIngressHealth(_ context.Context, _ provider.Applier, live provider.Manifest) (healthStatus, error) {
+	ingress := &struct {
+		Status struct {
+			LoadBalancer corev1.LoadBalancerStatus `json:"loadBalancer"`
+		} `json:"status"`
+	}{}
+	if err := live.ConvertToStructuredObject(ingress); err != nil {
+		return healthStatus{}, err
+	}
+	if !hasLoadBalancerAddress(ingress.Status.LoadBalancer) {
+		return healthStatus{message: "no address has been assigned"}, nil
+	}
+	return healthStatus{healthy: true}, nil
+}
+
+// makeCustomResourceHealthChecker returns a checker evaluating a custom resource as healthy
+// when the field at the configured JSONPath has the configured value.
+// The path can be given without the enclosing braces, e.g. status.phase.
+func makeCustomResourceHealthChecker(cfg config.K8sCustomResourceHealthCheck) (healthChecker, error) {
+	path := cfg.Path
+	if !strings.HasPrefix(path, "{") {
+		path = fmt.Sprintf("{.%s}", strings.TrimPrefix(path, "."))
+	}
+	jp := jsonpath.New(cfg.Kind).AllowMissingKeys(true)
+	if err := jp.Parse(path); err != nil {
+		return nil, fmt.Errorf("invalid health check path %q for %s: %w", cfg.Path, cfg.Kind, err)
+	}
+
+	return func(_ context.Context, _ provider.Applier, live provider.Manifest) (healthStatus, error) {
+		var obj map[string]interface{}
+		if err := live.ConvertToStructuredObject(&obj); err != nil {
+			return healthStatus{}, err
+		}
+		var buf bytes.Buffer
+		if err := jp.Execute(&buf, obj); err != nil {
+			return healthStatus{}, fmt.Errorf("unable to evaluate %s (%w)", cfg.Path, err)
+		}
+		if v := buf.String(); v != cfg.Value {
+			return healthStatus{message: fmt.Sprintf("%s is %q instead of %q", cfg.Path, v, cfg.Value)}, nil
+		}
+		return healthStatus{healthy: true}, nil
+	}, nil
+}
+
+func hasLoadBalancerAddress(s corev1.LoadBalancerStatus) bool {
+	for _, i := range s.Ingress {
+		if i.IP != "" || i.Hostname != "" {
+			return true
+		}
+	}
+	return false
+}
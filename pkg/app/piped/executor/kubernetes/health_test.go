@@ -0,0 +1,398 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes/providertest"
+	"github.com/pipe-cd/pipe/pkg/config"
+)
+
+const (
+	healthTestService = `
+apiVersion: v1
+kind: Service
+metadata:
+  name: simple
+spec:
+  selector:
+    app: simple
+  ports:
+  - port: 9085
+`
+	healthTestEndpointsNotReady = `
+apiVersion: v1
+kind: Endpoints
+metadata:
+  name: simple
+subsets:
+- notReadyAddresses:
+  - ip: 10.0.0.1
+`
+	healthTestEndpointsReady = `
+apiVersion: v1
+kind: Endpoints
+metadata:
+  name: simple
+subsets:
+- addresses:
+  - ip: 10.0.0.1
+  notReadyAddresses:
+  - ip: 10.0.0.2
+`
+)
+
+func TestCheckServiceHealth(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	endpointsKey := provider.ResourceKey{
+		APIVersion: "v1",
+		Kind:       "Endpoints",
+		Namespace:  "default",
+		Name:       "simple",
+	}
+
+	testcases := []struct {
+		name            string
+		service         string
+		endpoints       string
+		endpointsErr    error
+		expectedHealthy bool
+		expectedMessage string
+	}{
+		{
+			name:            "no endpoints",
+			service:         healthTestService,
+			endpointsErr:    provider.ErrNotFound,
+			expectedMessage: "no endpoints have been created",
+		},
+		{
+			name:            "no ready endpoints",
+			service:         healthTestService,
+			endpoints:       healthTestEndpointsNotReady,
+			expectedMessage: "no ready endpoints, 1 endpoints are not ready",
+		},
+		{
+			name:            "ready endpoints",
+			service:         healthTestService,
+			endpoints:       healthTestEndpointsReady,
+			expectedHealthy: true,
+		},
+		{
+			name: "load balancer without address",
+			service: `
+apiVersion: v1
+kind: Service
+metadata:
+  name: simple
+spec:
+  type: LoadBalancer
+  selector:
+    app: simple
+status:
+  loadBalancer: {}
+`,
+			expectedMessage: "no address has been assigned to the load balancer",
+		},
+		{
+			name: "service without selector",
+			service: `
+apiVersion: v1
+kind: Service
+metadata:
+  name: simple
+spec:
+  ports:
+  - port: 9085
+`,
+			expectedHealthy: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := providertest.NewMockProvider(ctrl)
+			if tc.endpoints != "" || tc.endpointsErr != nil {
+				var endpoints provider.Manifest
+				if tc.endpoints != "" {
+					endpoints = parseManifest(t, tc.endpoints)
+				}
+				p.EXPECT().GetManifest(gomock.Any(), endpointsKey).Return(endpoints, tc.endpointsErr)
+			}
+
+			status, err := checkServiceHealth(context.Background(), p, parseManifest(t, tc.service))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedHealthy, status.healthy)
+			assert.Equal(t, tc.expectedMessage, status.message)
+		})
+	}
+}
+
+func TestCheckIngressHealth(t *testing.T) {
+	testcases := []struct {
+		name            string
+		ingress         string
+		expectedHealthy bool
+	}{
+		{
+			name: "no address",
+			ingress: `
+apiVersion: networking.k8s.io/v1beta1
+kind: Ingress
+metadata:
+  name: simple
+status:
+  loadBalancer: {}
+`,
+		},
+		{
+			name: "assigned ip",
+			ingress: `
+apiVersion: networking.k8s.io/v1beta1
+kind: Ingress
+metadata:
+  name: simple
+status:
+  loadBalancer:
+    ingress:
+    - ip: 203.0.113.1
+`,
+			expectedHealthy: true,
+		},
+		{
+			name: "assigned hostname",
+			ingress: `
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: simple
+status:
+  loadBalancer:
+    ingress:
+    - hostname: simple.example.com
+`,
+			expectedHealthy: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			status, err := checkIngressHealth(context.Background(), nil, parseManifest(t, tc.ingress))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedHealthy, status.healthy)
+		})
+	}
+}
+
+func TestWaitForRolloutsHealthCheck(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	rolloutCheckInterval = time.Millisecond
+	defer func() {
+		rolloutCheckInterval = 5 * time.Second
+	}()
+
+	service := parseManifest(t, healthTestService)
+	endpointsKey := provider.ResourceKey{
+		APIVersion: "v1",
+		Kind:       "Endpoints",
+		Namespace:  "default",
+		Name:       "simple",
+	}
+
+	t.Run("wait for ready endpoints", func(t *testing.T) {
+		p := providertest.NewMockProvider(ctrl)
+		p.EXPECT().GetManifest(gomock.Any(), service.Key).Return(service, nil).Times(2)
+		gomock.InOrder(
+			p.EXPECT().GetManifest(gomock.Any(), endpointsKey).Return(parseManifest(t, healthTestEndpointsNotReady), nil),
+			p.EXPECT().GetManifest(gomock.Any(), endpointsKey).Return(parseManifest(t, healthTestEndpointsReady), nil),
+		)
+
+		err := waitForRollouts(context.Background(), p, []provider.Manifest{service}, config.K8sHealthCheck{Services: true}, time.Minute, &fakeLogPersister{})
+		assert.NoError(t, err)
+	})
+
+	t.Run("excluded from health check", func(t *testing.T) {
+		p := providertest.NewMockProvider(ctrl)
+		err := waitForRollouts(context.Background(), p, []provider.Manifest{service}, config.K8sHealthCheck{}, time.Minute, &fakeLogPersister{})
+		assert.NoError(t, err)
+	})
+}
+
+func TestCustomResourceHealthChecker(t *testing.T) {
+	makeCluster := func(phase string) provider.Manifest {
+		return parseManifest(t, fmt.Sprintf(`
+apiVersion: postgres-operator.example.com/v1
+kind: PostgresCluster
+metadata:
+  name: simple
+status:
+  phase: %s
+`, phase))
+	}
+
+	testcases := []struct {
+		name            string
+		path            string
+		live            provider.Manifest
+		expectedHealthy bool
+		expectedMessage string
+		expectedErr     bool
+	}{
+		{
+			name:            "expected value",
+			path:            "{.status.phase}",
+			live:            makeCluster("Running"),
+			expectedHealthy: true,
+		},
+		{
+			name:            "path without braces",
+			path:            "status.phase",
+			live:            makeCluster("Running"),
+			expectedHealthy: true,
+		},
+		{
+			name:            "unexpected value",
+			path:            "{.status.phase}",
+			live:            makeCluster("Creating"),
+			expectedMessage: `{.status.phase} is "Creating" instead of "Running"`,
+		},
+		{
+			name: "missing field",
+			path: "{.status.phase}",
+			live: parseManifest(t, `
+apiVersion: postgres-operator.example.com/v1
+kind: PostgresCluster
+metadata:
+  name: simple
+`),
+			expectedMessage: `{.status.phase} is "" instead of "Running"`,
+		},
+		{
+			name:        "invalid path",
+			path:        "{.status.phase",
+			expectedErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			check, err := makeCustomResourceHealthChecker(config.K8sCustomResourceHealthCheck{
+				Kind:  "PostgresCluster",
+				Path:  tc.path,
+				Value: "Running",
+			})
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			status, err := check(context.Background(), nil, tc.live)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedHealthy, status.healthy)
+			assert.Equal(t, tc.expectedMessage, status.message)
+		})
+	}
+}
+
+func TestWaitForRolloutsCustomResourceHealthCheck(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	rolloutCheckInterval = time.Millisecond
+	defer func() {
+		rolloutCheckInterval = 5 * time.Second
+	}()
+
+	makeCluster := func(phase string) provider.Manifest {
+		return parseManifest(t, fmt.Sprintf(`
+apiVersion: postgres-operator.example.com/v1
+kind: PostgresCluster
+metadata:
+  name: simple
+status:
+  phase: %s
+`, phase))
+	}
+	cluster := makeCluster("")
+
+	testcases := []struct {
+		name        string
+		healthCheck config.K8sCustomResourceHealthCheck
+		provider    func() provider.Provider
+		expectedErr bool
+	}{
+		{
+			name: "become ready",
+			healthCheck: config.K8sCustomResourceHealthCheck{
+				Kind:  "PostgresCluster",
+				Path:  "status.phase",
+				Value: "Running",
+			},
+			provider: func() provider.Provider {
+				p := providertest.NewMockProvider(ctrl)
+				gomock.InOrder(
+					p.EXPECT().GetManifest(gomock.Any(), cluster.Key).Return(makeCluster("Creating"), nil),
+					p.EXPECT().GetManifest(gomock.Any(), cluster.Key).Return(makeCluster("Running"), nil),
+				)
+				return p
+			},
+		},
+		{
+			name: "another api version",
+			healthCheck: config.K8sCustomResourceHealthCheck{
+				APIVersion: "postgres-operator.example.com/v2",
+				Kind:       "PostgresCluster",
+				Path:       "status.phase",
+				Value:      "Running",
+			},
+			provider: func() provider.Provider {
+				return providertest.NewMockProvider(ctrl)
+			},
+		},
+		{
+			name: "timed out",
+			healthCheck: config.K8sCustomResourceHealthCheck{
+				Kind:  "PostgresCluster",
+				Path:  "status.phase",
+				Value: "Running",
+			},
+			provider: func() provider.Provider {
+				p := providertest.NewMockProvider(ctrl)
+				p.EXPECT().GetManifest(gomock.Any(), cluster.Key).Return(makeCluster("Creating"), nil).AnyTimes()
+				return p
+			},
+			expectedErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			healthCheck := config.K8sHealthCheck{
+				CustomResources: []config.K8sCustomResourceHealthCheck{tc.healthCheck},
+			}
+			err := waitForRollouts(context.Background(), tc.provider(), []provider.Manifest{cluster}, healthCheck, 50*time.Millisecond, &fakeLogPersister{})
+			assert.Equal(t, tc.expectedErr, err != nil)
+		})
+	}
+}
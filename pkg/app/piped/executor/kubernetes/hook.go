@@ -0,0 +1,84 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"strings"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/app/piped/executor"
+	"github.com/pipe-cd/pipe/pkg/config"
+	"github.com/pipe-cd/pipe/pkg/model"
+)
+
+// ensureWithHooks runs the given stage handler between the pre and post hooks configured for the stage.
+// The stage fails without running the handler when a pre hook fails,
+// and the post hooks are run only when the handler completed successfully.
+func (e *deployExecutor) ensureWithHooks(ctx context.Context, ensure func(context.Context) model.StageStatus) model.StageStatus {
+	pre, post := findStageHooks(e.deployCfg.Hooks, model.Stage(e.Stage.Name))
+
+	if len(pre) > 0 {
+		e.LogPersister.Infof("Start running %d pre-stage hooks", len(pre))
+		if err := runHooks(ctx, e.provider, pre, e.LogPersister); err != nil {
+			return model.StageStatus_STAGE_FAILURE
+		}
+	}
+
+	status := ensure(ctx)
+	if status != model.StageStatus_STAGE_SUCCESS || len(post) == 0 {
+		return status
+	}
+
+	e.LogPersister.Infof("Start running %d post-stage hooks", len(post))
+	if err := runHooks(ctx, e.provider, post, e.LogPersister); err != nil {
+		return model.StageStatus_STAGE_FAILURE
+	}
+	return status
+}
+
+// findStageHooks returns the commands of all hooks configured for the given stage
+// in the order they were configured.
+func findStageHooks(hooks []config.K8sStageHook, stage model.Stage) (pre, post [][]string) {
+	for _, h := range hooks {
+		if h.Stage != stage {
+			continue
+		}
+		pre = append(pre, h.Pre...)
+		post = append(post, h.Post...)
+	}
+	return
+}
+
+// runHooks runs the given kubectl commands in order and logs their output.
+// It stops at the first failing command.
+func runHooks(ctx context.Context, applier provider.Applier, commands [][]string, lp executor.LogPersister) error {
+	for _, args := range commands {
+		command := "kubectl " + strings.Join(args, " ")
+		lp.Infof("Running %s", command)
+		out, err := applier.RunKubectl(ctx, args)
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			if line != "" {
+				lp.Infof("  %s", line)
+			}
+		}
+		if err != nil {
+			lp.Errorf("Failed to run %s (%v)", command, err)
+			return err
+		}
+		lp.Successf("- %s succeeded", command)
+	}
+	return nil
+}
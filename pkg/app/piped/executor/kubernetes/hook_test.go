@@ -0,0 +1,168 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes/providertest"
+	"github.com/pipe-cd/pipe/pkg/app/piped/executor"
+	"github.com/pipe-cd/pipe/pkg/config"
+	"github.com/pipe-cd/pipe/pkg/model"
+)
+
+func TestEnsureWithHooks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	hooks := []config.K8sStageHook{
+		{
+			Stage: model.StageK8sPrimaryRollout,
+			Pre:   [][]string{{"annotate", "deployment/simple", "paused=true"}},
+			Post:  [][]string{{"rollout", "restart", "deployment/simple"}},
+		},
+		{
+			Stage: model.StageK8sCanaryRollout,
+			Pre:   [][]string{{"delete", "job/canary-migration"}},
+		},
+		{
+			Stage: model.StageK8sPrimaryRollout,
+			Post:  [][]string{{"annotate", "deployment/simple", "paused-"}},
+		},
+	}
+
+	testcases := []struct {
+		name           string
+		failedCommand  string
+		stageStatus    model.StageStatus
+		expectedRuns   []string
+		expectedStatus model.StageStatus
+	}{
+		{
+			name:        "all hooks succeeded",
+			stageStatus: model.StageStatus_STAGE_SUCCESS,
+			expectedRuns: []string{
+				"annotate deployment/simple paused=true",
+				"stage",
+				"rollout restart deployment/simple",
+				"annotate deployment/simple paused-",
+			},
+			expectedStatus: model.StageStatus_STAGE_SUCCESS,
+		},
+		{
+			name:          "pre hook failed",
+			failedCommand: "annotate deployment/simple paused=true",
+			stageStatus:   model.StageStatus_STAGE_SUCCESS,
+			expectedRuns: []string{
+				"annotate deployment/simple paused=true",
+			},
+			expectedStatus: model.StageStatus_STAGE_FAILURE,
+		},
+		{
+			name:          "post hook failed",
+			failedCommand: "rollout restart deployment/simple",
+			stageStatus:   model.StageStatus_STAGE_SUCCESS,
+			expectedRuns: []string{
+				"annotate deployment/simple paused=true",
+				"stage",
+				"rollout restart deployment/simple",
+			},
+			expectedStatus: model.StageStatus_STAGE_FAILURE,
+		},
+		{
+			name:        "post hooks skipped since stage failed",
+			stageStatus: model.StageStatus_STAGE_FAILURE,
+			expectedRuns: []string{
+				"annotate deployment/simple paused=true",
+				"stage",
+			},
+			expectedStatus: model.StageStatus_STAGE_FAILURE,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var runs []string
+			p := providertest.NewMockProvider(ctrl)
+			p.EXPECT().RunKubectl(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, args []string) ([]byte, error) {
+				command := strings.Join(args, " ")
+				runs = append(runs, command)
+				if command == tc.failedCommand {
+					return []byte("error: failed"), errors.New("exit status 1")
+				}
+				return []byte("done"), nil
+			}).AnyTimes()
+
+			lp := &recordingLogPersister{}
+			e := &deployExecutor{
+				Input: executor.Input{
+					LogPersister: lp,
+					Stage: &model.PipelineStage{
+						Name: model.StageK8sPrimaryRollout.String(),
+					},
+				},
+				provider: p,
+				deployCfg: &config.KubernetesDeploymentSpec{
+					Hooks: hooks,
+				},
+			}
+			got := e.ensureWithHooks(context.Background(), func(_ context.Context) model.StageStatus {
+				runs = append(runs, "stage")
+				return tc.stageStatus
+			})
+			assert.Equal(t, tc.expectedStatus, got)
+			assert.Equal(t, tc.expectedRuns, runs)
+
+			// The output of the hooks is logged.
+			if tc.failedCommand != "" {
+				assert.Contains(t, lp.infos, "  error: failed")
+				assert.Contains(t, lp.errors, fmt.Sprintf("Failed to run kubectl %s (exit status 1)", tc.failedCommand))
+			} else {
+				assert.Contains(t, lp.infos, "  done")
+			}
+		})
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	errFailed := errors.New("exit status 1")
+	p := providertest.NewMockProvider(ctrl)
+	gomock.InOrder(
+		p.EXPECT().RunKubectl(gomock.Any(), []string{"rollout", "restart", "deployment/simple"}).Return([]byte("deployment.apps/simple restarted\n"), nil),
+		p.EXPECT().RunKubectl(gomock.Any(), []string{"rollout", "status", "deployment/simple"}).Return(nil, errFailed),
+	)
+
+	lp := &recordingLogPersister{}
+	err := runHooks(context.Background(), p, [][]string{
+		{"rollout", "restart", "deployment/simple"},
+		{"rollout", "status", "deployment/simple"},
+		{"rollout", "restart", "deployment/other"},
+	}, lp)
+	assert.Equal(t, errFailed, err)
+	assert.Equal(t, []string{
+		"Running kubectl rollout restart deployment/simple",
+		"  deployment.apps/simple restarted",
+		"Running kubectl rollout status deployment/simple",
+	}, lp.infos)
+}
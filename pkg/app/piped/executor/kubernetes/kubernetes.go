@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 	appsv1 "k8s.io/api/apps/v1"
@@ -36,6 +37,10 @@ const (
 	variantLabel = "pipecd.dev/variant" // Variant name: primary, stage, baseline
 )
 
+// errNoAddedResources is returned when the resources added by a variant rollout stage
+// could not be found in the deployment metadata, e.g. the rollout stage has not been executed yet.
+var errNoAddedResources = errors.New("no added resources were found")
+
 type deployExecutor struct {
 	executor.Input
 
@@ -75,6 +80,7 @@ func Register(r registerer) {
 func (e *deployExecutor) Execute(sig executor.StopSignal) model.StageStatus {
 	ctx := sig.Context()
 	e.commit = e.Deployment.Trigger.Commit.Hash
+	e.Logger = newStageLogger(e.Logger, e.Deployment, e.Stage)
 
 	ds, err := e.TargetDSP.Get(ctx, e.LogPersister)
 	if err != nil {
@@ -88,47 +94,154 @@ func (e *deployExecutor) Execute(sig executor.StopSignal) model.StageStatus {
 		return model.StageStatus_STAGE_FAILURE
 	}
 
-	e.provider = provider.NewProvider(e.Deployment.ApplicationName, ds.AppDir, ds.RepoDir, e.Deployment.GitPath.ConfigFilename, e.deployCfg.Input, e.Logger)
-	e.Logger.Info("start executing kubernetes stage",
-		zap.String("stage-name", e.Stage.Name),
-		zap.String("app-dir", ds.AppDir),
-	)
+	e.provider = &loggingProvider{
+		Provider: provider.NewProvider(e.Deployment.ApplicationName, ds.AppDir, ds.RepoDir, e.Deployment.GitPath.ConfigFilename, e.deployCfg.Input, e.Logger),
+		logger:   e.Logger,
+	}
+	e.Logger.Info("prepared kubernetes stage", zap.String("app-dir", ds.AppDir))
 
 	var (
 		originalStatus = e.Stage.Status
-		status         model.StageStatus
+		ensure         func(context.Context) model.StageStatus
 	)
 
 	switch model.Stage(e.Stage.Name) {
 	case model.StageK8sSync:
-		status = e.ensureSync(ctx)
+		ensure = e.ensureSync
 
 	case model.StageK8sPrimaryRollout:
-		status = e.ensurePrimaryRollout(ctx)
+		ensure = e.ensurePrimaryRollout
 
 	case model.StageK8sCanaryRollout:
-		status = e.ensureCanaryRollout(ctx)
+		ensure = e.ensureCanaryRollout
 
 	case model.StageK8sCanaryClean:
-		status = e.ensureCanaryClean(ctx)
+		ensure = e.ensureCanaryClean
 
 	case model.StageK8sBaselineRollout:
-		status = e.ensureBaselineRollout(ctx)
+		ensure = e.ensureBaselineRollout
 
 	case model.StageK8sBaselineClean:
-		status = e.ensureBaselineClean(ctx)
+		ensure = e.ensureBaselineClean
 
 	case model.StageK8sTrafficRouting:
-		status = e.ensureTrafficRouting(ctx)
+		ensure = e.ensureTrafficRouting
 
 	default:
 		e.LogPersister.Errorf("Unsupported stage %s for kubernetes application", e.Stage.Name)
 		return model.StageStatus_STAGE_FAILURE
 	}
 
+	status := e.ensureStage(ctx, ensure)
 	return executor.DetermineStageStatus(sig.Signal(), originalStatus, status)
 }
 
+// ensureStage runs the given stage handler with the configured timeout and hooks
+// and logs the start and the end of the stage.
+func (e *deployExecutor) ensureStage(ctx context.Context, ensure func(context.Context) model.StageStatus) model.StageStatus {
+	return runStage(ctx, e.Input, func(ctx context.Context) model.StageStatus {
+		return e.ensureWithHooks(ctx, ensure)
+	})
+}
+
+// runStage runs the given stage handler within the timeout of the stage
+// and logs the start and the end of the stage.
+func runStage(ctx context.Context, in executor.Input, ensure func(context.Context) model.StageStatus) model.StageStatus {
+	start := time.Now()
+	in.Logger.Info("start executing kubernetes stage")
+
+	status := ensureWithinTimeout(ctx, in, ensure)
+
+	fields := []zap.Field{
+		zap.String("status", status.String()),
+		zap.Duration("duration", time.Since(start)),
+	}
+	if status == model.StageStatus_STAGE_FAILURE {
+		in.Logger.Error("failed to execute kubernetes stage", fields...)
+	} else {
+		in.Logger.Info("done executing kubernetes stage", fields...)
+	}
+	return status
+}
+
+// newStageLogger returns a logger with the context of the given stage of the deployment.
+func newStageLogger(logger *zap.Logger, d *model.Deployment, stage *model.PipelineStage) *zap.Logger {
+	return logger.With(
+		zap.String("app-name", d.ApplicationName),
+		zap.String("commit", d.Trigger.Commit.Hash),
+		zap.String("stage-id", stage.Id),
+		zap.String("stage-name", stage.Name),
+	)
+}
+
+// loggingProvider logs the changes made to the resources through the wrapped provider
+// so that the resources touched by a stage can be found in the log of piped.
+type loggingProvider struct {
+	provider.Provider
+	logger *zap.Logger
+}
+
+func (p *loggingProvider) ApplyManifest(ctx context.Context, m provider.Manifest) (provider.ApplyAction, error) {
+	action, err := p.Provider.ApplyManifest(ctx, m)
+	if err != nil {
+		p.logger.Error("failed to apply manifest",
+			zap.String("resource", m.Key.String()),
+			zap.Error(err),
+		)
+		return action, err
+	}
+	p.logger.Info("applied manifest",
+		zap.String("resource", m.Key.String()),
+		zap.String("action", string(action)),
+	)
+	return action, nil
+}
+
+func (p *loggingProvider) Delete(ctx context.Context, k provider.ResourceKey) error {
+	err := p.Provider.Delete(ctx, k)
+	switch {
+	case err == nil:
+		p.logger.Info("deleted resource", zap.String("resource", k.String()))
+	case errors.Is(err, provider.ErrNotFound):
+		p.logger.Info("no resource to delete", zap.String("resource", k.String()))
+	default:
+		p.logger.Error("failed to delete resource",
+			zap.String("resource", k.String()),
+			zap.Error(err),
+		)
+	}
+	return err
+}
+
+// ensureWithinTimeout runs the given stage handler with a context bounded by the timeout of the stage
+// so that all of its operations, such as applying manifests and waiting for rollouts,
+// are cancelled at the deadline. The stage fails when the deadline was exceeded.
+// Zero timeout means no limit.
+func ensureWithinTimeout(ctx context.Context, in executor.Input, ensure func(context.Context) model.StageStatus) model.StageStatus {
+	timeout := in.StageConfig.Timeout.Duration()
+	if timeout <= 0 {
+		return ensure(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	status := ensure(ctx)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		in.LogPersister.Errorf("Stage %s was not completed within its timeout %v", in.Stage.Name, timeout)
+		return model.StageStatus_STAGE_FAILURE
+	}
+	return status
+}
+
+// namespaceToCreate returns the namespace which is created before applying manifests
+// if it does not exist, or empty when createNamespace was not configured.
+func (e *deployExecutor) namespaceToCreate() string {
+	if !e.deployCfg.Input.CreateNamespace {
+		return ""
+	}
+	return e.deployCfg.Input.Namespace
+}
+
 func (e *deployExecutor) loadRunningManifests(ctx context.Context) (manifests []provider.Manifest, err error) {
 	commit := e.Deployment.RunningCommitHash
 	if commit == "" {
@@ -200,21 +313,144 @@ func addBuiltinAnnontations(manifests []provider.Manifest, variant, hash, pipedI
 	}
 }
 
-func applyManifests(ctx context.Context, applier provider.Applier, manifests []provider.Manifest, namespace string, lp executor.LogPersister) error {
+// addBuiltinLabels adds the labels used to track the ownership of the applied resources,
+// such as for pruning the ones no longer defined in Git.
+func addBuiltinLabels(manifests []provider.Manifest, hash, appID string) {
+	for i := range manifests {
+		manifests[i].AddLabels(map[string]string{
+			provider.LabelManagedBy:   provider.ManagedByPiped,
+			provider.LabelApplication: appID,
+			provider.LabelCommitHash:  hash,
+		})
+	}
+}
+
+// applyActionPruned is the action taken on the resources deleted since they are no longer defined in Git.
+const applyActionPruned provider.ApplyAction = "pruned"
+
+// The order of the actions in the summary of apply results.
+var applyActionsOrder = []provider.ApplyAction{
+	provider.ApplyActionCreated,
+	provider.ApplyActionConfigured,
+	provider.ApplyActionUnchanged,
+	provider.ApplyActionServerSideApplied,
+	provider.ApplyActionSkipped,
+	applyActionPruned,
+}
+
+// applyResult represents the action taken on a resource while handling a stage.
+type applyResult struct {
+	Key    provider.ResourceKey
+	Action provider.ApplyAction
+}
+
+func makePrunedResults(keys []provider.ResourceKey) []applyResult {
+	results := make([]applyResult, 0, len(keys))
+	for _, k := range keys {
+		results = append(results, applyResult{
+			Key:    k,
+			Action: applyActionPruned,
+		})
+	}
+	return results
+}
+
+// summarizeApplyResults returns a one-line summary of the given results,
+// e.g. "1 created, 2 configured, 1 pruned". The actions not taken on any resource are omitted.
+func summarizeApplyResults(results []applyResult) string {
+	counts := make(map[provider.ApplyAction]int, len(applyActionsOrder))
+	for _, r := range results {
+		counts[r.Action]++
+	}
+	parts := make([]string, 0, len(applyActionsOrder))
+	for _, a := range applyActionsOrder {
+		if counts[a] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[a], a))
+		}
+	}
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// applyManifests applies the given manifests and returns the action taken on each resource.
+func applyManifests(ctx context.Context, applier provider.Applier, manifests []provider.Manifest, namespace string, lp executor.LogPersister) ([]applyResult, error) {
 	if namespace == "" {
 		lp.Infof("Start applying %d manifests", len(manifests))
 	} else {
 		lp.Infof("Start applying %d manifests to %q namespace", len(manifests), namespace)
 	}
-	for _, m := range manifests {
-		if err := applier.ApplyManifest(ctx, m); err != nil {
+	// The CustomResourceDefinitions applied but not confirmed to be established yet,
+	// keyed by the group and kind of their custom resources.
+	pendingCRDs := make(map[string]provider.ResourceKey)
+	results := make([]applyResult, 0, len(manifests))
+
+	for _, m := range sortManifestsForApply(manifests) {
+		gk := resourceGroupKind(m.Key)
+		if crd, ok := pendingCRDs[gk]; ok {
+			lp.Infof("Waiting for %s to be established", crd.ReadableString())
+			if err := waitForCRDEstablished(ctx, applier, crd, defaultCRDEstablishedTimeout); err != nil {
+				lp.Errorf("Failed while waiting for %s to be established (%v)", crd.ReadableString(), err)
+				return nil, err
+			}
+			lp.Successf("- %s has been established", crd.ReadableString())
+			delete(pendingCRDs, gk)
+		}
+
+		action, err := applier.ApplyManifest(ctx, m)
+		if err != nil {
 			lp.Errorf("Failed to apply manifest: %s (%v)", m.Key.ReadableString(), err)
-			return err
+			return nil, err
+		}
+		switch action {
+		case "":
+			lp.Successf("- applied manifest: %s", m.Key.ReadableString())
+		case provider.ApplyActionSkipped:
+			lp.Infof("- skipped applying %s because it has no changes", m.Key.ReadableString())
+		default:
+			lp.Successf("- applied manifest: %s (%s)", m.Key.ReadableString(), action)
+		}
+		results = append(results, applyResult{
+			Key:    m.Key,
+			Action: action,
+		})
+
+		if m.Key.Kind == provider.KindCustomResourceDefinition {
+			kind, err := customResourceKind(m)
+			if err != nil {
+				lp.Errorf("Failed to read the custom resource kind of %s (%v)", m.Key.ReadableString(), err)
+				return nil, err
+			}
+			pendingCRDs[kind] = m.Key
 		}
-		lp.Successf("- applied manifest: %s", m.Key.ReadableString())
 	}
-	lp.Successf("Successfully applied %d manifests", len(manifests))
-	return nil
+	lp.Successf("Successfully applied %d manifests: %s", len(manifests), summarizeApplyResults(results))
+	return results, nil
+}
+
+// storeAddedResources saves the keys of the given manifests into the deployment metadata
+// so that the stages executed later, such as the clean stage, can find the added resources.
+// Since each stage is handled by its own executor, the metadata is the only state shared between them.
+func storeAddedResources(ctx context.Context, store executor.MetadataStore, metadataKey string, manifests []provider.Manifest) error {
+	resources := make([]string, 0, len(manifests))
+	for _, m := range manifests {
+		resources = append(resources, m.Key.String())
+	}
+	return store.Set(ctx, metadataKey, strings.Join(resources, ","))
+}
+
+// loadAddedResources returns the keys of the resources saved by storeAddedResources.
+// errNoAddedResources is returned when nothing was saved at the given key.
+func loadAddedResources(store executor.MetadataStore, metadataKey string) ([]string, error) {
+	value, ok := store.Get(metadataKey)
+	if !ok {
+		return nil, errNoAddedResources
+	}
+	if value == "" {
+		return []string{}, nil
+	}
+	return strings.Split(value, ","), nil
 }
 
 func deleteResources(ctx context.Context, applier provider.Applier, resources []provider.ResourceKey, lp executor.LogPersister) error {
@@ -227,7 +463,7 @@ func deleteResources(ctx context.Context, applier provider.Applier, resources []
 	lp.Infof("Start deleting %d resources", len(resources))
 	var deletedCount int
 
-	for _, k := range resources {
+	for _, k := range sortResourcesForDelete(resources) {
 		err := applier.Delete(ctx, k)
 		if err == nil {
 			lp.Successf("- deleted resource: %s", k.ReadableString())
@@ -251,6 +487,129 @@ func deleteResources(ctx context.Context, applier provider.Applier, resources []
 	return nil
 }
 
+// checkPruneThreshold returns an error when the number of resources to be pruned exceeds the given threshold
+// to prevent a bad diff or a mislabeled resource from wiping all resources out.
+// The threshold in percentage is compared to the number of currently managed resources.
+// Zero threshold means no limit.
+func checkPruneThreshold(pruneCount, managedCount int, threshold config.Replicas) error {
+	if threshold.Number == 0 {
+		return nil
+	}
+	limit := threshold.Number
+	if threshold.IsPercentage {
+		limit = threshold.Number * managedCount / 100
+	}
+	if pruneCount > limit {
+		return fmt.Errorf("%d resources would be pruned which exceeds the prune threshold %s (%d of %d managed resources)", pruneCount, threshold, limit, managedCount)
+	}
+	return nil
+}
+
+// filterOwnedResources returns the keys of the live resources whose annotation
+// at the given key has the given value, e.g. the resources of a specific variant.
+// Resources that do not exist anymore or are not owned are excluded.
+func filterOwnedResources(ctx context.Context, applier provider.Applier, keys []provider.ResourceKey, annotation, value string, lp executor.LogPersister) ([]provider.ResourceKey, error) {
+	return filterLiveResources(ctx, applier, keys, lp, ownedBy(annotation, value))
+}
+
+// liveResourceCheck returns the reason why the given live resource must be excluded,
+// or an empty string to keep it.
+type liveResourceCheck func(live provider.Manifest) string
+
+// ownedBy returns a check keeping the live resources whose annotation
+// at the given key has the given value.
+func ownedBy(annotation, value string) liveResourceCheck {
+	return func(live provider.Manifest) string {
+		if v := live.GetAnnotations()[annotation]; v != value {
+			return fmt.Sprintf("its %s is %q instead of %q", annotation, v, value)
+		}
+		return ""
+	}
+}
+
+// appliedAtCommitOtherThan returns a check keeping the live resources which were applied
+// by piped at a commit other than the given one, e.g. by the previous deployments.
+func appliedAtCommitOtherThan(commit string) liveResourceCheck {
+	return func(live provider.Manifest) string {
+		if !appliedAtOtherCommit(live, commit) {
+			return fmt.Sprintf("it was not applied at a commit other than %s", commit)
+		}
+		return ""
+	}
+}
+
+// filterLiveResources returns the keys of the live resources passing all of the given checks.
+// Resources that do not exist anymore are excluded.
+func filterLiveResources(ctx context.Context, applier provider.Applier, keys []provider.ResourceKey, lp executor.LogPersister, checks ...liveResourceCheck) ([]provider.ResourceKey, error) {
+	out := make([]provider.ResourceKey, 0, len(keys))
+	for _, k := range keys {
+		m, err := applier.GetManifest(ctx, k)
+		if errors.Is(err, provider.ErrNotFound) {
+			lp.Infof("- no resource %s to delete", k.ReadableString())
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to get the live manifest of %s (%w)", k.ReadableString(), err)
+		}
+		if reason := failedCheck(m, checks); reason != "" {
+			lp.Infof("- skipped resource %s because %s", k.ReadableString(), reason)
+			continue
+		}
+		out = append(out, k)
+	}
+	return out, nil
+}
+
+func failedCheck(live provider.Manifest, checks []liveResourceCheck) string {
+	for _, check := range checks {
+		if reason := check(live); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// excludeUnchangedWorkloads returns the given manifests except the workloads whose live resources
+// have already been applied at the given commit, e.g. by the previous attempt of the same stage.
+// Applying them again would not change their pod spec so no rollout would be triggered.
+func excludeUnchangedWorkloads(ctx context.Context, applier provider.Applier, manifests []provider.Manifest, commit string, lp executor.LogPersister) ([]provider.Manifest, error) {
+	out := make([]provider.Manifest, 0, len(manifests))
+	for _, m := range manifests {
+		if !m.Key.IsWorkload() {
+			out = append(out, m)
+			continue
+		}
+		live, err := applier.GetManifest(ctx, m.Key)
+		if errors.Is(err, provider.ErrNotFound) {
+			out = append(out, m)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to get the live manifest of %s (%w)", m.Key.ReadableString(), err)
+		}
+		if hash, ok := appliedCommit(live); ok && hash == commit {
+			lp.Infof("- skipped applying %s because it has already been applied at commit %s", m.Key.ReadableString(), commit)
+			continue
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// appliedCommit returns the hash of the commit at which the given live resource was applied.
+// False is returned when the resource has no commit hash annotation, e.g. it was not applied by piped.
+func appliedCommit(live provider.Manifest) (string, bool) {
+	hash, ok := live.GetAnnotations()[provider.LabelCommitHash]
+	return hash, ok && hash != ""
+}
+
+// appliedAtOtherCommit reports whether the given live resource was applied by piped
+// at a commit other than the given one.
+func appliedAtOtherCommit(live provider.Manifest, commit string) bool {
+	hash, ok := appliedCommit(live)
+	return ok && hash != commit
+}
+
 func findManifests(kind, name string, manifests []provider.Manifest) []provider.Manifest {
 	var out []provider.Manifest
 	for _, m := range manifests {
@@ -350,6 +709,19 @@ func generateVariantServiceManifests(services []provider.Manifest, variant, name
 	return manifests, nil
 }
 
+// makeVariantReplicasCalculator returns a function calculating the number of replicas
+// for a variant workload from the number of replicas of the original workload.
+// Because Kubernetes defaults it to 1, an unspecified number is treated as 1.
+func makeVariantReplicasCalculator(replicas config.Replicas) func(*int32) int32 {
+	return func(cur *int32) int32 {
+		total := 1
+		if cur != nil {
+			total = int(*cur)
+		}
+		return int32(replicas.Calculate(total, 1))
+	}
+}
+
 func generateVariantWorkloadManifests(workloads, configmaps, secrets []provider.Manifest, variant, nameSuffix string, replicasCalculator func(*int32) int32) ([]provider.Manifest, error) {
 	manifests := make([]provider.Manifest, 0, len(workloads))
 
@@ -16,15 +16,22 @@ package kubernetes
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 
 	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
 	"github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes/providertest"
+	"github.com/pipe-cd/pipe/pkg/app/piped/executor"
+	"github.com/pipe-cd/pipe/pkg/config"
+	"github.com/pipe-cd/pipe/pkg/model"
 )
 
 type fakeLogPersister struct{}
@@ -116,6 +123,57 @@ func TestGenerateWorkloadManifests(t *testing.T) {
 	}
 }
 
+func TestMakeVariantReplicasCalculator(t *testing.T) {
+	int32Ptr := func(v int32) *int32 { return &v }
+
+	testcases := []struct {
+		name     string
+		replicas config.Replicas
+		cur      *int32
+		expected int32
+	}{
+		{
+			name:     "default",
+			cur:      int32Ptr(10),
+			expected: 1,
+		},
+		{
+			name:     "fixed number",
+			replicas: config.Replicas{Number: 3},
+			cur:      int32Ptr(10),
+			expected: 3,
+		},
+		{
+			name:     "fixed number without original replicas",
+			replicas: config.Replicas{Number: 3},
+			expected: 3,
+		},
+		{
+			name:     "percentage",
+			replicas: config.Replicas{Number: 20, IsPercentage: true},
+			cur:      int32Ptr(10),
+			expected: 2,
+		},
+		{
+			name:     "percentage rounded up",
+			replicas: config.Replicas{Number: 10, IsPercentage: true},
+			cur:      int32Ptr(3),
+			expected: 1,
+		},
+		{
+			name:     "percentage without original replicas",
+			replicas: config.Replicas{Number: 50, IsPercentage: true},
+			expected: 1,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			calculator := makeVariantReplicasCalculator(tc.replicas)
+			assert.Equal(t, tc.expected, calculator(tc.cur))
+		})
+	}
+}
+
 func TestCheckVariantSelectorInWorkload(t *testing.T) {
 	testcases := []struct {
 		name     string
@@ -323,3 +381,344 @@ func TestDeleteResources(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckPruneThreshold(t *testing.T) {
+	testcases := []struct {
+		name         string
+		pruneCount   int
+		managedCount int
+		threshold    config.Replicas
+		wantErr      bool
+	}{
+		{
+			name:         "no limit",
+			pruneCount:   10,
+			managedCount: 10,
+		},
+		{
+			name:         "under absolute threshold",
+			pruneCount:   2,
+			managedCount: 10,
+			threshold:    config.Replicas{Number: 3},
+		},
+		{
+			name:         "equal to absolute threshold",
+			pruneCount:   3,
+			managedCount: 10,
+			threshold:    config.Replicas{Number: 3},
+		},
+		{
+			name:         "over absolute threshold",
+			pruneCount:   4,
+			managedCount: 10,
+			threshold:    config.Replicas{Number: 3},
+			wantErr:      true,
+		},
+		{
+			name:         "under percentage threshold",
+			pruneCount:   2,
+			managedCount: 10,
+			threshold:    config.Replicas{Number: 25, IsPercentage: true},
+		},
+		{
+			name:         "over percentage threshold rounded down",
+			pruneCount:   3,
+			managedCount: 10,
+			threshold:    config.Replicas{Number: 25, IsPercentage: true},
+			wantErr:      true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkPruneThreshold(tc.pruneCount, tc.managedCount, tc.threshold)
+			assert.Equal(t, tc.wantErr, err != nil)
+		})
+	}
+}
+
+func TestAddBuiltinLabels(t *testing.T) {
+	manifests, err := provider.ParseManifests(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+  labels:
+    app: simple
+    team: backend
+spec:
+  selector:
+    matchLabels:
+      app: simple
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: simple
+`)
+	require.NoError(t, err)
+
+	addBuiltinAnnontations(manifests, primaryVariant, "commit-hash", "piped-id", "app-id")
+	addBuiltinLabels(manifests, "commit-hash", "app-id")
+
+	assert.Equal(t, map[string]string{
+		"app":                    "simple",
+		"team":                   "backend",
+		"pipecd.dev/managed-by":  "piped",
+		"pipecd.dev/application": "app-id",
+		"pipecd.dev/commit-hash": "commit-hash",
+	}, manifests[0].GetLabels())
+	assert.Equal(t, map[string]string{
+		"pipecd.dev/managed-by":  "piped",
+		"pipecd.dev/application": "app-id",
+		"pipecd.dev/commit-hash": "commit-hash",
+	}, manifests[1].GetLabels())
+
+	for _, m := range manifests {
+		assert.Equal(t, "commit-hash", m.GetAnnotations()[provider.LabelCommitHash])
+	}
+
+	// The selector must not be changed.
+	selector, err := manifests[0].GetNestedStringMap("spec", "selector", "matchLabels")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"app": "simple"}, selector)
+}
+
+func TestAppliedCommit(t *testing.T) {
+	testcases := []struct {
+		name         string
+		annotations  map[string]string
+		expectedHash string
+		expectedOK   bool
+	}{
+		{
+			name:         "applied by piped",
+			annotations:  map[string]string{provider.LabelCommitHash: "commit-hash"},
+			expectedHash: "commit-hash",
+			expectedOK:   true,
+		},
+		{
+			name: "no commit hash annotation",
+		},
+		{
+			name:        "empty commit hash",
+			annotations: map[string]string{provider.LabelCommitHash: ""},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := parseManifest(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: simple
+`)
+			if tc.annotations != nil {
+				m.AddAnnotations(tc.annotations)
+			}
+			hash, ok := appliedCommit(m)
+			assert.Equal(t, tc.expectedOK, ok)
+			if ok {
+				assert.Equal(t, tc.expectedHash, hash)
+			}
+		})
+	}
+}
+
+func TestAddedResourcesMetadata(t *testing.T) {
+	manifests, err := provider.ParseManifests(`
+apiVersion: v1
+kind: Service
+metadata:
+  name: simple-canary
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple-canary
+`)
+	require.NoError(t, err)
+
+	store := &fakeValuesMetadataStore{}
+	_, err = loadAddedResources(store, "canary-resources")
+	assert.True(t, errors.Is(err, errNoAddedResources))
+
+	err = storeAddedResources(context.Background(), store, "canary-resources", manifests)
+	require.NoError(t, err)
+	resources, err := loadAddedResources(store, "canary-resources")
+	require.NoError(t, err)
+	assert.Equal(t, []string{manifests[0].Key.String(), manifests[1].Key.String()}, resources)
+
+	err = storeAddedResources(context.Background(), store, "baseline-resources", nil)
+	require.NoError(t, err)
+	resources, err = loadAddedResources(store, "baseline-resources")
+	require.NoError(t, err)
+	assert.Empty(t, resources)
+}
+
+func TestApplyManifestsResults(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	manifests, err := provider.ParseManifests(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: added
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: updated
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: unchanged
+`)
+	require.NoError(t, err)
+	var (
+		added     = manifests[0]
+		updated   = manifests[1]
+		unchanged = manifests[2]
+		pruned    = provider.ResourceKey{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+			Namespace:  "default",
+			Name:       "pruned",
+		}
+	)
+
+	p := providertest.NewMockProvider(ctrl)
+	p.EXPECT().ApplyManifest(gomock.Any(), added).Return(provider.ApplyActionCreated, nil)
+	p.EXPECT().ApplyManifest(gomock.Any(), updated).Return(provider.ApplyActionConfigured, nil)
+	p.EXPECT().ApplyManifest(gomock.Any(), unchanged).Return(provider.ApplyActionUnchanged, nil)
+
+	results, err := applyManifests(context.Background(), p, manifests, "", &fakeLogPersister{})
+	require.NoError(t, err)
+	results = append(results, makePrunedResults([]provider.ResourceKey{pruned})...)
+
+	assert.ElementsMatch(t, []applyResult{
+		{Key: added.Key, Action: provider.ApplyActionCreated},
+		{Key: updated.Key, Action: provider.ApplyActionConfigured},
+		{Key: unchanged.Key, Action: provider.ApplyActionUnchanged},
+		{Key: pruned, Action: applyActionPruned},
+	}, results)
+	assert.Equal(t, "1 created, 1 configured, 1 unchanged, 1 pruned", summarizeApplyResults(results))
+}
+
+func TestSummarizeApplyResults(t *testing.T) {
+	testcases := []struct {
+		name     string
+		results  []applyResult
+		expected string
+	}{
+		{
+			name:     "no results",
+			expected: "no changes",
+		},
+		{
+			name: "omit actions not taken",
+			results: []applyResult{
+				{Action: applyActionPruned},
+				{Action: provider.ApplyActionCreated},
+				{Action: provider.ApplyActionCreated},
+			},
+			expected: "2 created, 1 pruned",
+		},
+		{
+			name: "server-side apply",
+			results: []applyResult{
+				{Action: provider.ApplyActionServerSideApplied},
+			},
+			expected: "1 serverside-applied",
+		},
+		{
+			name: "incremental apply",
+			results: []applyResult{
+				{Action: provider.ApplyActionSkipped},
+				{Action: provider.ApplyActionServerSideApplied},
+				{Action: provider.ApplyActionSkipped},
+			},
+			expected: "1 serverside-applied, 2 skipped",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, summarizeApplyResults(tc.results))
+		})
+	}
+}
+
+func TestEnsureStageLogging(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	applied := provider.ResourceKey{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "simple"}
+	deleted := provider.ResourceKey{APIVersion: "v1", Kind: "ConfigMap", Namespace: "default", Name: "old"}
+	p := providertest.NewMockProvider(ctrl)
+	p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyActionConfigured, nil)
+	p.EXPECT().Delete(gomock.Any(), deleted).Return(errors.New("forbidden"))
+
+	core, logs := observer.New(zap.InfoLevel)
+	d := &model.Deployment{
+		ApplicationName: "app-name",
+		Trigger: &model.DeploymentTrigger{
+			Commit: &model.Commit{Hash: "commit-hash"},
+		},
+	}
+	stage := &model.PipelineStage{
+		Id:   "stage-id",
+		Name: model.StageK8sSync.String(),
+	}
+	logger := newStageLogger(zap.New(core), d, stage)
+	e := &deployExecutor{
+		Input: executor.Input{
+			Deployment:   d,
+			Stage:        stage,
+			LogPersister: &fakeLogPersister{},
+			Logger:       logger,
+		},
+		provider: &loggingProvider{
+			Provider: p,
+			logger:   logger,
+		},
+		deployCfg: &config.KubernetesDeploymentSpec{},
+	}
+
+	status := e.ensureStage(context.Background(), func(ctx context.Context) model.StageStatus {
+		if _, err := e.provider.ApplyManifest(ctx, provider.MakeManifest(applied, nil)); err != nil {
+			return model.StageStatus_STAGE_FAILURE
+		}
+		if err := e.provider.Delete(ctx, deleted); err != nil {
+			return model.StageStatus_STAGE_FAILURE
+		}
+		return model.StageStatus_STAGE_SUCCESS
+	})
+	assert.Equal(t, model.StageStatus_STAGE_FAILURE, status)
+
+	// All entries have the context of the stage.
+	for _, entry := range logs.All() {
+		fields := entry.ContextMap()
+		assert.Equal(t, "app-name", fields["app-name"], entry.Message)
+		assert.Equal(t, "commit-hash", fields["commit"], entry.Message)
+		assert.Equal(t, "stage-id", fields["stage-id"], entry.Message)
+		assert.Equal(t, "K8S_SYNC", fields["stage-name"], entry.Message)
+	}
+
+	require.Equal(t, 1, logs.FilterMessage("start executing kubernetes stage").Len())
+
+	entries := logs.FilterMessage("applied manifest").All()
+	require.Equal(t, 1, len(entries))
+	assert.Equal(t, applied.String(), entries[0].ContextMap()["resource"])
+	assert.Equal(t, "configured", entries[0].ContextMap()["action"])
+
+	entries = logs.FilterMessage("failed to delete resource").All()
+	require.Equal(t, 1, len(entries))
+	assert.Equal(t, zapcore.ErrorLevel, entries[0].Level)
+	assert.Equal(t, deleted.String(), entries[0].ContextMap()["resource"])
+	assert.Equal(t, "forbidden", entries[0].ContextMap()["error"])
+
+	entries = logs.FilterMessage("failed to execute kubernetes stage").All()
+	require.Equal(t, 1, len(entries))
+	assert.Equal(t, "STAGE_FAILURE", entries[0].ContextMap()["status"])
+}
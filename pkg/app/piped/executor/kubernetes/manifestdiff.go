@@ -0,0 +1,141 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/app/piped/diff"
+)
+
+// manifestsDiffResult represents the changes needed to make the live state
+// of an application match the desired manifests.
+type manifestsDiffResult struct {
+	// The resources that do not exist in the cluster yet.
+	Adds []provider.ResourceKey
+	// The live resources that are no longer defined in the desired manifests.
+	Deletes []provider.ResourceKey
+	// The live resources that differ from the desired manifests.
+	Changes []manifestChange
+}
+
+type manifestChange struct {
+	Key provider.ResourceKey
+	// The rendered diff from the live state to the desired manifest.
+	Diff string
+}
+
+// HasChange reports whether applying the desired manifests would change anything.
+func (r manifestsDiffResult) HasChange() bool {
+	return len(r.Adds)+len(r.Deletes)+len(r.Changes) > 0
+}
+
+// Render returns a human-readable summary of all changes.
+func (r manifestsDiffResult) Render() string {
+	if !r.HasChange() {
+		return "No changes were detected"
+	}
+
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("%d added, %d deleted, %d changed resources\n\n", len(r.Adds), len(r.Deletes), len(r.Changes)))
+	for _, k := range r.Adds {
+		b.WriteString(fmt.Sprintf("+ %s\n", k.ReadableString()))
+	}
+	for _, k := range r.Deletes {
+		b.WriteString(fmt.Sprintf("- %s\n", k.ReadableString()))
+	}
+	for _, c := range r.Changes {
+		b.WriteString(fmt.Sprintf("\n* %s\n\n", c.Key.ReadableString()))
+		b.WriteString(c.Diff)
+	}
+	return b.String()
+}
+
+// diffManifests compares the given desired manifests with the live state of their resources.
+// The status and the fields populated by the server, such as defaults, are not treated as changes.
+func (e *deployExecutor) diffManifests(ctx context.Context, manifests []provider.Manifest) (manifestsDiffResult, error) {
+	var result manifestsDiffResult
+	for _, m := range manifests {
+		live, err := e.provider.GetManifest(ctx, m.Key)
+		if errors.Is(err, provider.ErrNotFound) {
+			result.Adds = append(result.Adds, m.Key)
+			continue
+		}
+		if err != nil {
+			return result, fmt.Errorf("unable to get the live manifest of %s (%w)", m.Key.ReadableString(), err)
+		}
+		if live, err = normalizeServerManifest(live); err != nil {
+			return result, err
+		}
+
+		// The keys only existing in the live manifest are ignored
+		// since they are mostly the defaults populated by the server.
+		d, err := provider.Diff(m, live, diff.WithIgnoreAddingMapKeys())
+		if err != nil {
+			return result, fmt.Errorf("unable to diff %s (%w)", m.Key.ReadableString(), err)
+		}
+		if !d.HasDiff() {
+			continue
+		}
+
+		opts := []diff.RenderOption{
+			diff.WithLeftPadding(1),
+		}
+		if m.Key.IsSecret() {
+			opts = append(opts, diff.WithMaskPath("data"))
+		}
+		result.Changes = append(result.Changes, manifestChange{
+			Key:  m.Key,
+			Diff: diff.NewRenderer(opts...).Render(reverseDiffNodes(d.Nodes())),
+		})
+	}
+
+	if liveResources, ok := e.AppLiveResourceLister.ListKubernetesResources(); ok {
+		result.Deletes = findRemoveResources(manifests, liveResources)
+	}
+	return result, nil
+}
+
+// logManifestsDiff reports the changes applying the given manifests would make to the live state
+// so that they can be reviewed in the stage log. When prune is false the live resources
+// no longer defined in the manifests are not reported since they will be left as they are.
+// Failing to find the changes does not fail the stage because they are only informative.
+func (e *deployExecutor) logManifestsDiff(ctx context.Context, manifests []provider.Manifest, prune bool) {
+	result, err := e.diffManifests(ctx, manifests)
+	if err != nil {
+		e.LogPersister.Errorf("Unable to find the changes to the live state (%v)", err)
+		return
+	}
+	if !prune {
+		result.Deletes = nil
+	}
+	e.LogPersister.Infof("Changes to the live state:\n%s", result.Render())
+}
+
+// reverseDiffNodes swaps both sides of the given nodes
+// to render them as the changes from the live state to the desired one.
+func reverseDiffNodes(nodes diff.Nodes) diff.Nodes {
+	out := make(diff.Nodes, 0, len(nodes))
+	for _, n := range nodes {
+		n.TypeX, n.TypeY = n.TypeY, n.TypeX
+		n.ValueX, n.ValueY = n.ValueY, n.ValueX
+		out = append(out, n)
+	}
+	return out
+}
@@ -0,0 +1,218 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes/providertest"
+	"github.com/pipe-cd/pipe/pkg/app/piped/executor"
+)
+
+type fakeAppLiveResourceLister struct {
+	resources []provider.Manifest
+}
+
+func (l *fakeAppLiveResourceLister) ListKubernetesResources() ([]provider.Manifest, bool) {
+	return l.resources, l.resources != nil
+}
+
+func TestDiffManifests(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	desired, err := provider.ParseManifests(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: added
+data:
+  key: value
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: changed
+spec:
+  replicas: 2
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: unchanged
+spec:
+  selector:
+    app: simple
+`)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(desired))
+
+	var (
+		added     = desired[0]
+		changed   = desired[1]
+		unchanged = desired[2]
+		deleted   = parseManifest(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: deleted
+`)
+	)
+
+	p := providertest.NewMockProvider(ctrl)
+	p.EXPECT().GetManifest(gomock.Any(), added.Key).Return(provider.Manifest{}, provider.ErrNotFound)
+	p.EXPECT().GetManifest(gomock.Any(), changed.Key).Return(parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: changed
+  resourceVersion: "10"
+spec:
+  replicas: 1
+  revisionHistoryLimit: 10
+status:
+  replicas: 1
+`), nil)
+	// The server-populated fields and the status must not be treated as changes.
+	p.EXPECT().GetManifest(gomock.Any(), unchanged.Key).Return(parseManifest(t, `
+apiVersion: v1
+kind: Service
+metadata:
+  name: unchanged
+  uid: 1234
+  managedFields:
+  - manager: piped
+spec:
+  selector:
+    app: simple
+  type: ClusterIP
+  clusterIP: 10.0.0.1
+status:
+  loadBalancer: {}
+`), nil)
+
+	e := &deployExecutor{
+		Input: executor.Input{
+			AppLiveResourceLister: &fakeAppLiveResourceLister{
+				resources: []provider.Manifest{changed, unchanged, deleted},
+			},
+		},
+		provider: p,
+	}
+	result, err := e.diffManifests(context.Background(), desired)
+	require.NoError(t, err)
+
+	assert.True(t, result.HasChange())
+	assert.Equal(t, []provider.ResourceKey{added.Key}, result.Adds)
+	assert.Equal(t, []provider.ResourceKey{deleted.Key}, result.Deletes)
+	require.Equal(t, 1, len(result.Changes))
+	assert.Equal(t, changed.Key, result.Changes[0].Key)
+	assert.Equal(t, "  spec:\n    #spec.replicas\n-   replicas: 1\n+   replicas: 2\n\n", result.Changes[0].Diff)
+}
+
+func TestDiffManifestsNoChange(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := parseManifest(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: simple
+data:
+  key: value
+`)
+	p := providertest.NewMockProvider(ctrl)
+	p.EXPECT().GetManifest(gomock.Any(), m.Key).Return(m, nil)
+
+	e := &deployExecutor{
+		Input: executor.Input{
+			AppLiveResourceLister: &fakeAppLiveResourceLister{
+				resources: []provider.Manifest{m},
+			},
+		},
+		provider: p,
+	}
+	result, err := e.diffManifests(context.Background(), []provider.Manifest{m})
+	require.NoError(t, err)
+	assert.False(t, result.HasChange())
+	assert.Equal(t, "No changes were detected", result.Render())
+}
+
+func TestLogManifestsDiff(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		added = parseManifest(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: added
+`)
+		deleted = parseManifest(t, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: deleted
+`)
+	)
+
+	testcases := []struct {
+		name     string
+		prune    bool
+		expected string
+	}{
+		{
+			name:  "report the resources to be pruned",
+			prune: true,
+			expected: "Changes to the live state:\n1 added, 1 deleted, 0 changed resources\n\n" +
+				"+ " + added.Key.ReadableString() + "\n" +
+				"- " + deleted.Key.ReadableString() + "\n",
+		},
+		{
+			name:  "not report the resources left as they are",
+			prune: false,
+			expected: "Changes to the live state:\n1 added, 0 deleted, 0 changed resources\n\n" +
+				"+ " + added.Key.ReadableString() + "\n",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := providertest.NewMockProvider(ctrl)
+			p.EXPECT().GetManifest(gomock.Any(), added.Key).Return(provider.Manifest{}, provider.ErrNotFound)
+
+			lp := &recordingLogPersister{}
+			e := &deployExecutor{
+				Input: executor.Input{
+					LogPersister: lp,
+					AppLiveResourceLister: &fakeAppLiveResourceLister{
+						resources: []provider.Manifest{deleted},
+					},
+				},
+				provider: p,
+			}
+			e.logManifestsDiff(context.Background(), []provider.Manifest{added}, tc.prune)
+			assert.Empty(t, lp.errors)
+			assert.Equal(t, []string{tc.expected}, lp.infos)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"sort"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+)
+
+// kindApplyOrder is the order in which the resources should be applied.
+// Kinds that other resources may depend on come first.
+// Resources of kinds not listed here are applied after all known kinds.
+var kindApplyOrder = []string{
+	"Namespace",
+	"NetworkPolicy",
+	"ResourceQuota",
+	"LimitRange",
+	"PodSecurityPolicy",
+	"PodDisruptionBudget",
+	"ServiceAccount",
+	"Secret",
+	"ConfigMap",
+	"StorageClass",
+	"PersistentVolume",
+	"PersistentVolumeClaim",
+	"CustomResourceDefinition",
+	"ClusterRole",
+	"ClusterRoleBinding",
+	"Role",
+	"RoleBinding",
+	"Service",
+	"DaemonSet",
+	"Pod",
+	"ReplicationController",
+	"ReplicaSet",
+	"Deployment",
+	"HorizontalPodAutoscaler",
+	"StatefulSet",
+	"Job",
+	"CronJob",
+	"Ingress",
+	"APIService",
+}
+
+var kindPriorities = func() map[string]int {
+	m := make(map[string]int, len(kindApplyOrder))
+	for i, k := range kindApplyOrder {
+		m[k] = i
+	}
+	return m
+}()
+
+func kindPriority(kind string) int {
+	if p, ok := kindPriorities[kind]; ok {
+		return p
+	}
+	return len(kindApplyOrder)
+}
+
+// sortManifestsForApply returns a copy of the given manifests
+// sorted in the order they should be applied.
+// The relative order of manifests with the same kind priority is kept.
+func sortManifestsForApply(manifests []provider.Manifest) []provider.Manifest {
+	out := make([]provider.Manifest, len(manifests))
+	copy(out, manifests)
+	sort.SliceStable(out, func(i, j int) bool {
+		return kindPriority(out[i].Key.Kind) < kindPriority(out[j].Key.Kind)
+	})
+	return out
+}
+
+// sortResourcesForDelete returns a copy of the given resource keys
+// sorted in the reverse order of applying.
+func sortResourcesForDelete(keys []provider.ResourceKey) []provider.ResourceKey {
+	out := make([]provider.ResourceKey, len(keys))
+	copy(out, keys)
+	sort.SliceStable(out, func(i, j int) bool {
+		return kindPriority(out[i].Kind) > kindPriority(out[j].Kind)
+	})
+	return out
+}
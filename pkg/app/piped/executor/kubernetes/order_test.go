@@ -0,0 +1,141 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes/providertest"
+)
+
+func TestSortManifestsForApply(t *testing.T) {
+	manifests, err := provider.ParseManifests(`
+apiVersion: example.com/v1
+kind: Custom
+metadata:
+  name: custom
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: simple
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: first
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: simple
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: second
+`)
+	require.NoError(t, err)
+
+	sorted := sortManifestsForApply(manifests)
+	names := make([]string, 0, len(sorted))
+	for _, m := range sorted {
+		names = append(names, m.Key.Kind+"/"+m.Key.Name)
+	}
+	assert.Equal(t, []string{
+		"Namespace/simple",
+		"ConfigMap/first",
+		"ConfigMap/second",
+		"Service/simple",
+		"Deployment/simple",
+		"Custom/custom",
+	}, names)
+
+	// The given slice must not be modified.
+	assert.Equal(t, "Custom", manifests[0].Key.Kind)
+}
+
+func TestSortResourcesForDelete(t *testing.T) {
+	keys := []provider.ResourceKey{
+		{Kind: "Namespace", Name: "simple"},
+		{Kind: "Custom", Name: "custom"},
+		{Kind: "Service", Name: "simple"},
+		{Kind: "Deployment", Name: "simple"},
+	}
+	assert.Equal(t, []provider.ResourceKey{
+		{Kind: "Custom", Name: "custom"},
+		{Kind: "Deployment", Name: "simple"},
+		{Kind: "Service", Name: "simple"},
+		{Kind: "Namespace", Name: "simple"},
+	}, sortResourcesForDelete(keys))
+}
+
+func TestApplyManifestsOrder(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	manifests, err := provider.ParseManifests(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+  namespace: foo
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: foo
+`)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(manifests))
+
+	p := providertest.NewMockProvider(ctrl)
+	gomock.InOrder(
+		p.EXPECT().ApplyManifest(gomock.Any(), manifests[1]).Return(provider.ApplyActionConfigured, nil),
+		p.EXPECT().ApplyManifest(gomock.Any(), manifests[0]).Return(provider.ApplyActionConfigured, nil),
+	)
+
+	_, err = applyManifests(context.Background(), p, manifests, "", &fakeLogPersister{})
+	assert.NoError(t, err)
+}
+
+func TestDeleteResourcesOrder(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		ns     = provider.ResourceKey{APIVersion: "v1", Kind: "Namespace", Name: "foo"}
+		deploy = provider.ResourceKey{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "foo", Name: "simple"}
+	)
+	p := providertest.NewMockProvider(ctrl)
+	gomock.InOrder(
+		p.EXPECT().Delete(gomock.Any(), deploy).Return(nil),
+		p.EXPECT().Delete(gomock.Any(), ns).Return(nil),
+	)
+
+	err := deleteResources(context.Background(), p, []provider.ResourceKey{ns, deploy}, &fakeLogPersister{})
+	assert.NoError(t, err)
+}
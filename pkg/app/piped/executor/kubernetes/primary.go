@@ -17,7 +17,6 @@ package kubernetes
 import (
 	"context"
 	"fmt"
-	"time"
 
 	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
 	"github.com/pipe-cd/pipe/pkg/config"
@@ -53,7 +52,9 @@ func (e *deployExecutor) ensurePrimaryRollout(ctx context.Context) model.StageSt
 
 	routingMethod := config.DetermineKubernetesTrafficRoutingMethod(e.deployCfg.TrafficRouting)
 	var primaryManifests []provider.Manifest
-	if routingMethod == config.KubernetesTrafficRoutingMethodPodSelector {
+	if routingMethod != config.KubernetesTrafficRoutingMethodIstio {
+		// The Service is also used as the root service of TrafficSplit while routing by SMI
+		// so it must be applied as well.
 		primaryManifests = manifests
 	} else {
 		// Find traffic routing manifests and filter out it from primary manifests.
@@ -98,7 +99,7 @@ func (e *deployExecutor) ensurePrimaryRollout(ctx context.Context) model.StageSt
 	}
 	e.LogPersister.Successf("Successfully generated %d manifests for PRIMARY variant", len(primaryManifests))
 
-	// Add builtin annotations for tracking application live state.
+	// Add builtin annotations and labels for tracking application live state.
 	addBuiltinAnnontations(
 		primaryManifests,
 		primaryVariant,
@@ -106,10 +107,32 @@ func (e *deployExecutor) ensurePrimaryRollout(ctx context.Context) model.StageSt
 		e.PipedConfig.PipedID,
 		e.Deployment.ApplicationId,
 	)
+	addBuiltinLabels(primaryManifests, e.commit, e.Deployment.ApplicationId)
+
+	// The workloads already running at this commit are not applied again to avoid no-op rollouts.
+	applyingManifests, err := excludeUnchangedWorkloads(ctx, e.provider, primaryManifests, e.commit, e.LogPersister)
+	if err != nil {
+		e.LogPersister.Errorf("Failed while checking the live workloads (%v)", err)
+		return model.StageStatus_STAGE_FAILURE
+	}
+
+	if options.Validate {
+		if err := validateManifests(ctx, e.provider, applyingManifests, e.namespaceToCreate(), e.LogPersister); err != nil {
+			e.LogPersister.Errorf("Stopped rolling out PRIMARY variant because some manifests are invalid (%v)", err)
+			return model.StageStatus_STAGE_FAILURE
+		}
+	}
 
 	// Start applying all manifests to add or update running resources.
 	e.LogPersister.Info("Start rolling out PRIMARY variant...")
-	if err := applyManifests(ctx, e.provider, primaryManifests, e.deployCfg.Input.Namespace, e.LogPersister); err != nil {
+	results, err := applyManifests(ctx, e.provider, applyingManifests, e.deployCfg.Input.Namespace, e.LogPersister)
+	if err != nil {
+		return model.StageStatus_STAGE_FAILURE
+	}
+
+	// Wait until the PRIMARY workloads are ready to serve.
+	// The skipped ones are also checked since their previous rollout might not have completed yet.
+	if err := waitForRollouts(ctx, e.provider, primaryManifests, e.deployCfg.HealthCheck, defaultRolloutTimeout, e.LogPersister); err != nil {
 		return model.StageStatus_STAGE_FAILURE
 	}
 	e.LogPersister.Success("Successfully rolled out PRIMARY variant")
@@ -119,17 +142,6 @@ func (e *deployExecutor) ensurePrimaryRollout(ctx context.Context) model.StageSt
 		return model.StageStatus_STAGE_SUCCESS
 	}
 
-	// Wait for all applied manifests to be stable.
-	// In theory, we don't need to wait for them to be stable before going to the next step
-	// but waiting for a while reduces the number of Kubernetes changes in a short time.
-	e.LogPersister.Info("Waiting for the applied manifests to be stable")
-	select {
-	case <-time.After(15 * time.Second):
-		break
-	case <-ctx.Done():
-		break
-	}
-
 	// Find the running resources that are not defined in Git.
 	e.LogPersister.Info("Start finding all running PRIMARY resources but no longer defined in Git")
 	runningManifests, err := e.loadRunningManifests(ctx)
@@ -145,12 +157,40 @@ func (e *deployExecutor) ensurePrimaryRollout(ctx context.Context) model.StageSt
 	}
 	e.LogPersister.Infof("Found %d live resources that are no longer defined in Git", len(removeKeys))
 
+	// Make sure that only the resources applied for this application will be deleted.
+	checks := []liveResourceCheck{ownedBy(provider.LabelApplication, e.Deployment.ApplicationId)}
+	if options.PruneMode == config.K8sPruneModeCommit {
+		checks = append(checks, appliedAtCommitOtherThan(e.commit))
+	}
+	removeKeys, err = filterLiveResources(ctx, e.provider, removeKeys, e.LogPersister, checks...)
+	if err != nil {
+		e.LogPersister.Errorf("Failed while checking the live resources to delete (%v)", err)
+		return model.StageStatus_STAGE_FAILURE
+	}
+	if len(removeKeys) == 0 {
+		e.LogPersister.Info("There are no live resources of this application should be removed")
+		return model.StageStatus_STAGE_SUCCESS
+	}
+
+	if err := checkPruneThreshold(len(removeKeys), len(runningManifests), options.PruneThreshold); err != nil {
+		e.LogPersister.Errorf("Refused to prune resources (%v)", err)
+		return model.StageStatus_STAGE_FAILURE
+	}
+
 	// Start deleting all running resources that are not defined in Git.
 	e.LogPersister.Infof("Start deleting %d resources", len(removeKeys))
 	if err := deleteResources(ctx, e.provider, removeKeys, e.LogPersister); err != nil {
 		return model.StageStatus_STAGE_FAILURE
 	}
+	if options.WaitForDeletion {
+		if err := waitForDeletion(ctx, e.provider, removeKeys, deletionTimeout(options.DeletionTimeout), e.LogPersister); err != nil {
+			e.LogPersister.Errorf("Failed while waiting for the pruned resources to be deleted (%v)", err)
+			return model.StageStatus_STAGE_FAILURE
+		}
+	}
 
+	results = append(results, makePrunedResults(removeKeys)...)
+	e.LogPersister.Successf("Successfully synced resources: %s", summarizeApplyResults(results))
 	return model.StageStatus_STAGE_SUCCESS
 }
 
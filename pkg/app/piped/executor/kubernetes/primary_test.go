@@ -18,9 +18,11 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 
@@ -49,7 +51,7 @@ func TestEnsurePrimaryRollout(t *testing.T) {
 				Input: executor.Input{
 					Deployment: &model.Deployment{
 						Trigger: &model.DeploymentTrigger{
-							Commit: &model.Commit{},
+							Commit: &model.Commit{Hash: "target-commit"},
 						},
 					},
 					Stage:        &model.PipelineStage{},
@@ -65,7 +67,7 @@ func TestEnsurePrimaryRollout(t *testing.T) {
 				Input: executor.Input{
 					Deployment: &model.Deployment{
 						Trigger: &model.DeploymentTrigger{
-							Commit: &model.Commit{},
+							Commit: &model.Commit{Hash: "target-commit"},
 						},
 					},
 					LogPersister: &fakeLogPersister{},
@@ -94,7 +96,7 @@ func TestEnsurePrimaryRollout(t *testing.T) {
 				Input: executor.Input{
 					Deployment: &model.Deployment{
 						Trigger: &model.DeploymentTrigger{
-							Commit: &model.Commit{},
+							Commit: &model.Commit{Hash: "target-commit"},
 						},
 					},
 					PipedConfig:  &config.PipedSpec{},
@@ -123,9 +125,19 @@ func TestEnsurePrimaryRollout(t *testing.T) {
 							Object: map[string]interface{}{"spec": map[string]interface{}{}},
 						}),
 					}, nil)
-					p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(nil)
+					p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyActionConfigured, nil)
+					// The live one is got to check its commit before applying and then to check its readiness.
+					p.EXPECT().GetManifest(gomock.Any(), gomock.Any()).Return(parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+status:
+  replicas: 1
+  updatedReplicas: 1
+  availableReplicas: 1
+`), nil).Times(2)
 					return p
 				}(),
+				commit:    "target-commit",
 				deployCfg: &config.KubernetesDeploymentSpec{},
 			},
 		},
@@ -136,7 +148,7 @@ func TestEnsurePrimaryRollout(t *testing.T) {
 				Input: executor.Input{
 					Deployment: &model.Deployment{
 						Trigger: &model.DeploymentTrigger{
-							Commit: &model.Commit{},
+							Commit: &model.Commit{Hash: "target-commit"},
 						},
 					},
 					PipedConfig:  &config.PipedSpec{},
@@ -172,10 +184,20 @@ func TestEnsurePrimaryRollout(t *testing.T) {
 							Object: map[string]interface{}{"spec": map[string]interface{}{}},
 						}),
 					}, nil)
-					p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(nil)
-					p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(nil)
+					p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyActionConfigured, nil)
+					p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyActionConfigured, nil)
+					// The live one is got to check its commit before applying and then to check its readiness.
+					p.EXPECT().GetManifest(gomock.Any(), gomock.Any()).Return(parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+status:
+  replicas: 1
+  updatedReplicas: 1
+  availableReplicas: 1
+`), nil).Times(2)
 					return p
 				}(),
+				commit: "target-commit",
 				deployCfg: &config.KubernetesDeploymentSpec{
 					Service: config.K8sResourceReference{
 						Kind: "Service",
@@ -191,7 +213,7 @@ func TestEnsurePrimaryRollout(t *testing.T) {
 				Input: executor.Input{
 					Deployment: &model.Deployment{
 						Trigger: &model.DeploymentTrigger{
-							Commit: &model.Commit{},
+							Commit: &model.Commit{Hash: "target-commit"},
 						},
 					},
 					PipedConfig:  &config.PipedSpec{},
@@ -222,6 +244,7 @@ func TestEnsurePrimaryRollout(t *testing.T) {
 					}, nil)
 					return p
 				}(),
+				commit: "target-commit",
 				deployCfg: &config.KubernetesDeploymentSpec{
 					TrafficRouting: &config.KubernetesTrafficRouting{
 						Method: config.KubernetesTrafficRoutingMethodIstio,
@@ -236,7 +259,7 @@ func TestEnsurePrimaryRollout(t *testing.T) {
 				Input: executor.Input{
 					Deployment: &model.Deployment{
 						Trigger: &model.DeploymentTrigger{
-							Commit: &model.Commit{},
+							Commit: &model.Commit{Hash: "target-commit"},
 						},
 					},
 					PipedConfig:  &config.PipedSpec{},
@@ -267,6 +290,7 @@ func TestEnsurePrimaryRollout(t *testing.T) {
 					}, nil)
 					return p
 				}(),
+				commit: "target-commit",
 				deployCfg: &config.KubernetesDeploymentSpec{
 					GenericDeploymentSpec: config.GenericDeploymentSpec{
 						Pipeline: &config.DeploymentPipeline{
@@ -293,6 +317,305 @@ func TestEnsurePrimaryRollout(t *testing.T) {
 	}
 }
 
+func TestEnsurePrimaryRolloutWithPrune(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	makeConfigMap := func(name, appID string) provider.Manifest {
+		return parseManifest(t, fmt.Sprintf(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+  annotations:
+    pipecd.dev/application: %s
+`, name, appID))
+	}
+	var (
+		current   = makeConfigMap("simple", "app-id")
+		removed   = makeConfigMap("removed", "app-id")
+		unrelated = makeConfigMap("unrelated", "another-app-id")
+	)
+
+	c := cachetest.NewMockCache(ctrl)
+	c.EXPECT().Get("app-id/target-commit").Return([]provider.Manifest{current}, nil)
+	c.EXPECT().Get("app-id/running-commit").Return([]provider.Manifest{current, removed, unrelated}, nil)
+
+	p := providertest.NewMockProvider(ctrl)
+	p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyActionConfigured, nil)
+	p.EXPECT().GetManifest(gomock.Any(), removed.Key).Return(removed, nil)
+	p.EXPECT().GetManifest(gomock.Any(), unrelated.Key).Return(unrelated, nil)
+	// Only the resource which was applied for this application must be pruned.
+	p.EXPECT().Delete(gomock.Any(), removed.Key).Return(nil)
+
+	e := &deployExecutor{
+		Input: executor.Input{
+			Deployment: &model.Deployment{
+				ApplicationId:     "app-id",
+				RunningCommitHash: "running-commit",
+			},
+			PipedConfig:  &config.PipedSpec{},
+			LogPersister: &fakeLogPersister{},
+			Stage:        &model.PipelineStage{},
+			StageConfig: config.PipelineStage{
+				K8sPrimaryRolloutStageOptions: &config.K8sPrimaryRolloutStageOptions{
+					Prune: true,
+				},
+			},
+			AppManifestsCache: c,
+			Logger:            zap.NewNop(),
+		},
+		provider:  p,
+		deployCfg: &config.KubernetesDeploymentSpec{},
+		commit:    "target-commit",
+	}
+	got := e.ensurePrimaryRollout(context.Background())
+	assert.Equal(t, model.StageStatus_STAGE_SUCCESS, got)
+}
+
+func TestEnsurePrimaryRolloutWithCommitPruneMode(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	makeConfigMap := func(name, commit string) provider.Manifest {
+		return parseManifest(t, fmt.Sprintf(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+  annotations:
+    pipecd.dev/application: app-id
+    pipecd.dev/commit-hash: %s
+`, name, commit))
+	}
+	var (
+		kept    = makeConfigMap("simple", "target-commit")
+		removed = makeConfigMap("removed", "running-commit")
+		current = makeConfigMap("current", "target-commit")
+	)
+
+	c := cachetest.NewMockCache(ctrl)
+	c.EXPECT().Get("app-id/target-commit").Return([]provider.Manifest{kept}, nil)
+	c.EXPECT().Get("app-id/running-commit").Return([]provider.Manifest{kept, removed, current}, nil)
+
+	p := providertest.NewMockProvider(ctrl)
+	p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyActionConfigured, nil)
+	p.EXPECT().GetManifest(gomock.Any(), removed.Key).Return(removed, nil)
+	p.EXPECT().GetManifest(gomock.Any(), current.Key).Return(current, nil)
+	// The resource applied at the target commit by another deployment must be kept.
+	p.EXPECT().Delete(gomock.Any(), removed.Key).Return(nil)
+
+	e := &deployExecutor{
+		Input: executor.Input{
+			Deployment: &model.Deployment{
+				ApplicationId:     "app-id",
+				RunningCommitHash: "running-commit",
+			},
+			PipedConfig:  &config.PipedSpec{},
+			LogPersister: &fakeLogPersister{},
+			Stage:        &model.PipelineStage{},
+			StageConfig: config.PipelineStage{
+				K8sPrimaryRolloutStageOptions: &config.K8sPrimaryRolloutStageOptions{
+					Prune:     true,
+					PruneMode: config.K8sPruneModeCommit,
+				},
+			},
+			AppManifestsCache: c,
+			Logger:            zap.NewNop(),
+		},
+		provider:  p,
+		deployCfg: &config.KubernetesDeploymentSpec{},
+		commit:    "target-commit",
+	}
+	got := e.ensurePrimaryRollout(context.Background())
+	assert.Equal(t, model.StageStatus_STAGE_SUCCESS, got)
+}
+
+func TestEnsurePrimaryRolloutSkipUnchangedWorkloads(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	rolloutCheckInterval = time.Millisecond
+	defer func() {
+		rolloutCheckInterval = 5 * time.Second
+	}()
+
+	makeLive := func(commit string) provider.Manifest {
+		m := parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+status:
+  replicas: 1
+  updatedReplicas: 1
+  availableReplicas: 1
+`)
+		if commit != "" {
+			m.AddAnnotations(map[string]string{provider.LabelCommitHash: commit})
+		}
+		return m
+	}
+	desired := parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+spec:
+  selector:
+    matchLabels:
+      app: simple
+      pipecd.dev/variant: primary
+  template:
+    metadata:
+      labels:
+        app: simple
+        pipecd.dev/variant: primary
+`)
+
+	testcases := []struct {
+		name        string
+		liveCommit  string
+		expectApply bool
+	}{
+		{
+			name:        "applied at another commit",
+			liveCommit:  "running-commit",
+			expectApply: true,
+		},
+		{
+			name:        "applied without commit annotation",
+			expectApply: true,
+		},
+		{
+			name:       "already applied at the deploying commit",
+			liveCommit: "target-commit",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := cachetest.NewMockCache(ctrl)
+			c.EXPECT().Get("app-id/target-commit").Return([]provider.Manifest{desired}, nil)
+
+			p := providertest.NewMockProvider(ctrl)
+			p.EXPECT().GetManifest(gomock.Any(), desired.Key).Return(makeLive(tc.liveCommit), nil).Times(2)
+			if tc.expectApply {
+				p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, m provider.Manifest) (provider.ApplyAction, error) {
+					assert.Equal(t, "target-commit", m.GetAnnotations()[provider.LabelCommitHash])
+					return provider.ApplyActionConfigured, nil
+				})
+			}
+
+			e := &deployExecutor{
+				Input: executor.Input{
+					Deployment: &model.Deployment{
+						ApplicationId: "app-id",
+					},
+					PipedConfig:  &config.PipedSpec{},
+					LogPersister: &fakeLogPersister{},
+					Stage:        &model.PipelineStage{},
+					StageConfig: config.PipelineStage{
+						K8sPrimaryRolloutStageOptions: &config.K8sPrimaryRolloutStageOptions{},
+					},
+					AppManifestsCache: c,
+					Logger:            zap.NewNop(),
+				},
+				provider:  p,
+				deployCfg: &config.KubernetesDeploymentSpec{},
+				commit:    "target-commit",
+			}
+			got := e.ensurePrimaryRollout(context.Background())
+			assert.Equal(t, model.StageStatus_STAGE_SUCCESS, got)
+		})
+	}
+}
+
+func TestEnsurePrimaryRolloutStageTimeout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	rolloutCheckInterval = time.Millisecond
+	defer func() {
+		rolloutCheckInterval = 5 * time.Second
+	}()
+
+	desired := parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+spec:
+  selector:
+    matchLabels:
+      app: simple
+      pipecd.dev/variant: primary
+  template:
+    metadata:
+      labels:
+        app: simple
+        pipecd.dev/variant: primary
+`)
+	// The live one never becomes ready.
+	live := parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: simple
+status:
+  replicas: 2
+  updatedReplicas: 2
+  availableReplicas: 1
+`)
+
+	c := cachetest.NewMockCache(ctrl)
+	c.EXPECT().Get("app-id/target-commit").Return([]provider.Manifest{desired}, nil)
+
+	p := providertest.NewMockProvider(ctrl)
+	p.EXPECT().GetManifest(gomock.Any(), desired.Key).Return(live, nil).MinTimes(2)
+	p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyActionConfigured, nil)
+	p.EXPECT().ListManifests(gomock.Any(), "default", provider.KindPod, map[string]string{"app": "simple"}).Return(nil, nil).MinTimes(1)
+	p.EXPECT().ListEvents(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+
+	lp := &recordingLogPersister{}
+	e := &deployExecutor{
+		Input: executor.Input{
+			Deployment: &model.Deployment{
+				ApplicationId: "app-id",
+			},
+			PipedConfig:  &config.PipedSpec{},
+			LogPersister: lp,
+			Stage: &model.PipelineStage{
+				Name: model.StageK8sPrimaryRollout.String(),
+			},
+			StageConfig: config.PipelineStage{
+				Timeout:                       config.Duration(50 * time.Millisecond),
+				K8sPrimaryRolloutStageOptions: &config.K8sPrimaryRolloutStageOptions{},
+			},
+			AppManifestsCache: c,
+			Logger:            zap.NewNop(),
+		},
+		provider:  p,
+		deployCfg: &config.KubernetesDeploymentSpec{},
+		commit:    "target-commit",
+	}
+
+	start := time.Now()
+	got := ensureWithinTimeout(context.Background(), e.Input, e.ensurePrimaryRollout)
+	assert.Equal(t, model.StageStatus_STAGE_FAILURE, got)
+	assert.Less(t, int64(time.Since(start)), int64(defaultRolloutTimeout))
+
+	// The progress made before the deadline was reported.
+	assert.Contains(t, lp.infos, fmt.Sprintf("Waiting for %s to complete its rollout", desired.Key.ReadableString()))
+	assert.Contains(t, lp.infos, fmt.Sprintf("- %s: 1/2 updated replicas are available, no unready pods", desired.Key.ReadableString()))
+	require.NotEmpty(t, lp.errors)
+	assert.Equal(t, "Stage K8S_PRIMARY_ROLLOUT was not completed within its timeout 50ms", lp.errors[len(lp.errors)-1])
+}
+
 func TestFindRemoveManifests(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -396,3 +719,82 @@ func TestFindRemoveManifests(t *testing.T) {
 		})
 	}
 }
+
+func TestEnsurePrimaryRolloutWithPruneThreshold(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	makeConfigMap := func(name string) provider.Manifest {
+		return parseManifest(t, fmt.Sprintf(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+  annotations:
+    pipecd.dev/application: app-id
+`, name))
+	}
+	var (
+		current  = makeConfigMap("simple")
+		removed1 = makeConfigMap("removed-1")
+		removed2 = makeConfigMap("removed-2")
+	)
+
+	testcases := []struct {
+		name      string
+		threshold config.Replicas
+		want      model.StageStatus
+	}{
+		{
+			name:      "under the threshold",
+			threshold: config.Replicas{Number: 2},
+			want:      model.StageStatus_STAGE_SUCCESS,
+		},
+		{
+			name:      "over the threshold",
+			threshold: config.Replicas{Number: 50, IsPercentage: true},
+			want:      model.StageStatus_STAGE_FAILURE,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := cachetest.NewMockCache(ctrl)
+			c.EXPECT().Get("app-id/target-commit").Return([]provider.Manifest{current}, nil)
+			c.EXPECT().Get("app-id/running-commit").Return([]provider.Manifest{current, removed1, removed2}, nil)
+
+			p := providertest.NewMockProvider(ctrl)
+			p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyActionConfigured, nil)
+			p.EXPECT().GetManifest(gomock.Any(), removed1.Key).Return(removed1, nil)
+			p.EXPECT().GetManifest(gomock.Any(), removed2.Key).Return(removed2, nil)
+			if tc.want == model.StageStatus_STAGE_SUCCESS {
+				p.EXPECT().Delete(gomock.Any(), removed1.Key).Return(nil)
+				p.EXPECT().Delete(gomock.Any(), removed2.Key).Return(nil)
+			}
+
+			e := &deployExecutor{
+				Input: executor.Input{
+					Deployment: &model.Deployment{
+						ApplicationId:     "app-id",
+						RunningCommitHash: "running-commit",
+					},
+					PipedConfig:  &config.PipedSpec{},
+					LogPersister: &fakeLogPersister{},
+					Stage:        &model.PipelineStage{},
+					StageConfig: config.PipelineStage{
+						K8sPrimaryRolloutStageOptions: &config.K8sPrimaryRolloutStageOptions{
+							Prune:          true,
+							PruneThreshold: tc.threshold,
+						},
+					},
+					AppManifestsCache: c,
+					Logger:            zap.NewNop(),
+				},
+				provider:  p,
+				deployCfg: &config.KubernetesDeploymentSpec{},
+				commit:    "target-commit",
+			}
+			got := e.ensurePrimaryRollout(context.Background())
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -16,12 +16,13 @@ package kubernetes
 
 import (
 	"context"
-	"strings"
+	"errors"
 
 	"go.uber.org/zap"
 
 	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
 	"github.com/pipe-cd/pipe/pkg/app/piped/executor"
+	"github.com/pipe-cd/pipe/pkg/config"
 	"github.com/pipe-cd/pipe/pkg/model"
 )
 
@@ -35,10 +36,11 @@ func (e *rollbackExecutor) Execute(sig executor.StopSignal) model.StageStatus {
 		originalStatus = e.Stage.Status
 		status         model.StageStatus
 	)
+	e.Logger = newStageLogger(e.Logger, e.Deployment, e.Stage)
 
 	switch model.Stage(e.Stage.Name) {
 	case model.StageRollback:
-		status = e.ensureRollback(ctx)
+		status = runStage(ctx, e.Input, e.ensureRollback)
 
 	default:
 		e.LogPersister.Errorf("Unsupported stage %s for kubernetes application", e.Stage.Name)
@@ -67,12 +69,18 @@ func (e *rollbackExecutor) ensureRollback(ctx context.Context) model.StageStatus
 		return model.StageStatus_STAGE_FAILURE
 	}
 
-	p := provider.NewProvider(e.Deployment.ApplicationName, ds.AppDir, ds.RepoDir, e.Deployment.GitPath.ConfigFilename, deployCfg.Input, e.Logger)
-	e.Logger.Info("start executing kubernetes stage",
-		zap.String("stage-name", e.Stage.Name),
-		zap.String("app-dir", ds.AppDir),
-	)
+	p := &loggingProvider{
+		Provider: provider.NewProvider(e.Deployment.ApplicationName, ds.AppDir, ds.RepoDir, e.Deployment.GitPath.ConfigFilename, deployCfg.Input, e.Logger),
+		logger:   e.Logger,
+	}
+	e.Logger.Info("prepared kubernetes stage", zap.String("app-dir", ds.AppDir))
+
+	return e.rollback(ctx, p, deployCfg)
+}
 
+// rollback restores the resources to the state at the running commit
+// and removes the resources of CANARY and BASELINE variants.
+func (e *rollbackExecutor) rollback(ctx context.Context, p provider.Provider, deployCfg *config.KubernetesDeploymentSpec) model.StageStatus {
 	// Firstly, we reapply all manifests at running commit
 	// to revert PRIMARY resources and TRAFFIC ROUTING resources.
 
@@ -101,7 +109,7 @@ func (e *rollbackExecutor) ensureRollback(ctx context.Context) model.StageStatus
 		}
 	}
 
-	// Add builtin annotations for tracking application live state.
+	// Add builtin annotations and labels for tracking application live state.
 	addBuiltinAnnontations(
 		manifests,
 		primaryVariant,
@@ -109,18 +117,37 @@ func (e *rollbackExecutor) ensureRollback(ctx context.Context) model.StageStatus
 		e.PipedConfig.PipedID,
 		e.Deployment.ApplicationId,
 	)
+	addBuiltinLabels(manifests, e.Deployment.RunningCommitHash, e.Deployment.ApplicationId)
 
-	// Start applying all manifests to add or update running resources.
-	if err := applyManifests(ctx, p, manifests, deployCfg.Input.Namespace, e.LogPersister); err != nil {
+	// Skip the resources that are already running at the running commit
+	// to make the rollback idempotent.
+	outdated, err := findOutdatedManifests(ctx, p, manifests, e.Deployment.RunningCommitHash)
+	if err != nil {
+		e.LogPersister.Errorf("Failed while checking the live state of resources (%v)", err)
 		return model.StageStatus_STAGE_FAILURE
 	}
 
+	if len(outdated) == 0 {
+		e.LogPersister.Infof("All resources are already at running commit %s", e.Deployment.RunningCommitHash)
+	} else {
+		// Start applying the outdated manifests to add or update running resources.
+		if _, err := applyManifests(ctx, p, outdated, deployCfg.Input.Namespace, e.LogPersister); err != nil {
+			return model.StageStatus_STAGE_FAILURE
+		}
+	}
+
 	var errs []error
 
+	// Wait for the workloads to be ready. The already running ones are checked as well
+	// since they might be still rolling out from the previous attempt of rollback.
+	// The other variants are removed even if they did not become ready.
+	if err := waitForRollouts(ctx, p, manifests, deployCfg.HealthCheck, defaultRolloutTimeout, e.LogPersister); err != nil {
+		errs = append(errs, err)
+	}
+
 	// Next we delete all resources of CANARY variant.
 	e.LogPersister.Info("Start checking to ensure that the CANARY variant should be removed")
-	if value, ok := e.MetadataStore.Get(addedCanaryResourcesMetadataKey); ok {
-		resources := strings.Split(value, ",")
+	if resources, err := loadAddedResources(e.MetadataStore, addedCanaryResourcesMetadataKey); err == nil {
 		if err := removeCanaryResources(ctx, p, resources, e.LogPersister); err != nil {
 			errs = append(errs, err)
 		}
@@ -128,8 +155,7 @@ func (e *rollbackExecutor) ensureRollback(ctx context.Context) model.StageStatus
 
 	// Then delete all resources of BASELINE variant.
 	e.LogPersister.Info("Start checking to ensure that the BASELINE variant should be removed")
-	if value, ok := e.MetadataStore.Get(addedBaselineResourcesMetadataKey); ok {
-		resources := strings.Split(value, ",")
+	if resources, err := loadAddedResources(e.MetadataStore, addedBaselineResourcesMetadataKey); err == nil {
 		if err := removeBaselineResources(ctx, p, resources, e.LogPersister); err != nil {
 			errs = append(errs, err)
 		}
@@ -140,3 +166,23 @@ func (e *rollbackExecutor) ensureRollback(ctx context.Context) model.StageStatus
 	}
 	return model.StageStatus_STAGE_SUCCESS
 }
+
+// findOutdatedManifests returns the manifests whose live resources do not exist
+// or were not applied at the given commit.
+func findOutdatedManifests(ctx context.Context, applier provider.Applier, manifests []provider.Manifest, commit string) ([]provider.Manifest, error) {
+	outdated := make([]provider.Manifest, 0, len(manifests))
+	for _, m := range manifests {
+		live, err := applier.GetManifest(ctx, m.Key)
+		if errors.Is(err, provider.ErrNotFound) {
+			outdated = append(outdated, m)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hash, ok := appliedCommit(live); !ok || hash != commit {
+			outdated = append(outdated, m)
+		}
+	}
+	return outdated, nil
+}
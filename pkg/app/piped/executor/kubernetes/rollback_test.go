@@ -0,0 +1,192 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes/providertest"
+	"github.com/pipe-cd/pipe/pkg/app/piped/executor"
+	"github.com/pipe-cd/pipe/pkg/cache"
+	"github.com/pipe-cd/pipe/pkg/cache/cachetest"
+	"github.com/pipe-cd/pipe/pkg/config"
+	"github.com/pipe-cd/pipe/pkg/model"
+)
+
+type fakeValuesMetadataStore struct {
+	fakeMetadataStore
+	values map[string]string
+}
+
+func (m *fakeValuesMetadataStore) Get(key string) (string, bool) {
+	v, ok := m.values[key]
+	return v, ok
+}
+
+func (m *fakeValuesMetadataStore) Set(_ context.Context, key, value string) error {
+	if m.values == nil {
+		m.values = make(map[string]string)
+	}
+	m.values[key] = value
+	return nil
+}
+
+func TestRollback(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// The Deployment at the running commit, i.e. the last successful deployment.
+	stable := parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: simple
+  template:
+    metadata:
+      labels:
+        app: simple
+    spec:
+      containers:
+      - name: helloworld
+        image: gcr.io/pipecd/helloworld:v0.1.0
+`)
+	makeLive := func(commit, image string) provider.Manifest {
+		return parseManifest(t, fmt.Sprintf(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+  generation: 2
+  annotations:
+    %s: %s
+    %s: %s
+spec:
+  replicas: 2
+  template:
+    spec:
+      containers:
+      - name: helloworld
+        image: %s
+status:
+  observedGeneration: 2
+  replicas: 2
+  updatedReplicas: 2
+  availableReplicas: 2
+`, provider.LabelCommitHash, commit, variantLabel, primaryVariant, image))
+	}
+	canaryKey := provider.ResourceKey{
+		APIVersion: "apps/v1",
+		Kind:       provider.KindDeployment,
+		Namespace:  "default",
+		Name:       "simple-canary",
+	}
+	canary := parseManifest(t, fmt.Sprintf(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple-canary
+  annotations:
+    %s: %s
+`, variantLabel, canaryVariant))
+
+	newExecutor := func(p provider.Provider) *rollbackExecutor {
+		return &rollbackExecutor{
+			Input: executor.Input{
+				Deployment: &model.Deployment{
+					ApplicationId:     "app-id",
+					RunningCommitHash: "running-commit",
+				},
+				PipedConfig:  &config.PipedSpec{},
+				LogPersister: &fakeLogPersister{},
+				MetadataStore: &fakeValuesMetadataStore{
+					values: map[string]string{
+						addedCanaryResourcesMetadataKey: canaryKey.String(),
+					},
+				},
+				AppManifestsCache: func() cache.Cache {
+					c := cachetest.NewMockCache(ctrl)
+					c.EXPECT().Get("app-id/running-commit").Return(nil, fmt.Errorf("not found"))
+					c.EXPECT().Put("app-id/running-commit", gomock.Any()).Return(nil)
+					return c
+				}(),
+				Logger: zap.NewNop(),
+			},
+		}
+	}
+
+	t.Run("restore the stable Deployment after a failed deployment", func(t *testing.T) {
+		var applied provider.Manifest
+		p := providertest.NewMockProvider(ctrl)
+		p.EXPECT().LoadManifests(gomock.Any()).Return([]provider.Manifest{stable}, nil)
+		gomock.InOrder(
+			// The failed deployment left the Deployment at the target commit.
+			p.EXPECT().GetManifest(gomock.Any(), stable.Key).Return(makeLive("target-commit", "gcr.io/pipecd/helloworld:v0.2.0"), nil),
+			p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, m provider.Manifest) (provider.ApplyAction, error) {
+				applied = m
+				return provider.ApplyActionConfigured, nil
+			}),
+			p.EXPECT().GetManifest(gomock.Any(), stable.Key).Return(makeLive("running-commit", "gcr.io/pipecd/helloworld:v0.1.0"), nil),
+			p.EXPECT().GetManifest(gomock.Any(), canaryKey).Return(canary, nil),
+			p.EXPECT().Delete(gomock.Any(), canaryKey).Return(nil),
+		)
+
+		status := newExecutor(p).rollback(context.Background(), p, &config.KubernetesDeploymentSpec{})
+		require.Equal(t, model.StageStatus_STAGE_SUCCESS, status)
+
+		d := &appsv1.Deployment{}
+		require.NoError(t, applied.ConvertToStructuredObject(d))
+		assert.Equal(t, "gcr.io/pipecd/helloworld:v0.1.0", d.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, int32(2), *d.Spec.Replicas)
+		assert.Equal(t, "running-commit", applied.GetAnnotations()[provider.LabelCommitHash])
+	})
+
+	t.Run("nothing to apply when already at the stable revision", func(t *testing.T) {
+		p := providertest.NewMockProvider(ctrl)
+		p.EXPECT().LoadManifests(gomock.Any()).Return([]provider.Manifest{stable}, nil)
+		p.EXPECT().GetManifest(gomock.Any(), stable.Key).Return(makeLive("running-commit", "gcr.io/pipecd/helloworld:v0.1.0"), nil).Times(2)
+		p.EXPECT().GetManifest(gomock.Any(), canaryKey).Return(provider.Manifest{}, provider.ErrNotFound)
+
+		status := newExecutor(p).rollback(context.Background(), p, &config.KubernetesDeploymentSpec{})
+		assert.Equal(t, model.StageStatus_STAGE_SUCCESS, status)
+	})
+
+	t.Run("remove the other variants even if the rollout failed", func(t *testing.T) {
+		p := providertest.NewMockProvider(ctrl)
+		p.EXPECT().LoadManifests(gomock.Any()).Return([]provider.Manifest{stable}, nil)
+		gomock.InOrder(
+			p.EXPECT().GetManifest(gomock.Any(), stable.Key).Return(makeLive("running-commit", "gcr.io/pipecd/helloworld:v0.1.0"), nil),
+			p.EXPECT().GetManifest(gomock.Any(), stable.Key).Return(provider.Manifest{}, fmt.Errorf("unavailable")),
+			p.EXPECT().GetManifest(gomock.Any(), canaryKey).Return(canary, nil),
+			p.EXPECT().Delete(gomock.Any(), canaryKey).Return(nil),
+		)
+
+		status := newExecutor(p).rollback(context.Background(), p, &config.KubernetesDeploymentSpec{})
+		assert.Equal(t, model.StageStatus_STAGE_FAILURE, status)
+	})
+}
@@ -0,0 +1,525 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/app/piped/executor"
+	"github.com/pipe-cd/pipe/pkg/config"
+)
+
+// The interval between checks of the rollout status of workloads.
+var rolloutCheckInterval = 5 * time.Second
+
+// The interval between progress reports of a workload whose rollout status is not changing.
+var rolloutProgressInterval = 30 * time.Second
+
+// The maximum duration to wait for a workload to complete its rollout.
+const defaultRolloutTimeout = 10 * time.Minute
+
+// The number of restarts after which a container in CrashLoopBackOff
+// is regarded as never becoming ready.
+const crashLoopBackOffRestartThreshold = 3
+
+// The duration after which a container continuously failing to pull its image
+// is regarded as never becoming ready.
+var imagePullBackOffThreshold = 2 * time.Minute
+
+// errPodNeverReady is returned when a pod of the workload is failing in a way
+// that it will not become ready without any change, e.g. crash-looping.
+var errPodNeverReady = errors.New("pod will never become ready")
+
+// errJobFailed is returned when a Job has failed and will not be retried anymore.
+var errJobFailed = errors.New("job failed")
+
+// The number of retries of a Job when its backoffLimit is not specified.
+const defaultJobBackoffLimit = 6
+
+// rolloutStatus represents the rollout progress of a workload at a point of time.
+type rolloutStatus struct {
+	done    bool
+	message string
+	// The labels used to find the pods of the workload.
+	selector map[string]string
+}
+
+// waitForRollouts blocks until all Deployments, StatefulSets and DaemonSets
+// in the given manifests complete their rollout and all Jobs complete successfully.
+// After that, it also waits for
+// the Services, Ingresses and custom resources to be healthy when they are enabled
+// in the given health check configuration.
+func waitForRollouts(ctx context.Context, applier provider.Applier, manifests []provider.Manifest, healthCheck config.K8sHealthCheck, timeout time.Duration, lp executor.LogPersister) error {
+	autoscaled := findAutoscaledWorkloads(manifests)
+	for _, m := range manifests {
+		switch m.Key.Kind {
+		case provider.KindDeployment, provider.KindStatefulSet, provider.KindDaemonSet, provider.KindJob:
+		default:
+			continue
+		}
+		lp.Infof("Waiting for %s to complete its rollout", m.Key.ReadableString())
+		_, scaled := autoscaled[scaleTargetKey(m.Key)]
+		if err := waitForRollout(ctx, applier, m, scaled, timeout, lp); err != nil {
+			lp.Errorf("Failed while waiting for %s to complete its rollout (%v)", m.Key.ReadableString(), err)
+			return err
+		}
+		lp.Successf("- %s has completed its rollout", m.Key.ReadableString())
+	}
+
+	// Services and Ingresses become healthy only after their backend pods are ready.
+	for _, m := range manifests {
+		check, err := findHealthChecker(m.Key, healthCheck)
+		if err != nil {
+			lp.Errorf("Unable to check the health of %s (%v)", m.Key.ReadableString(), err)
+			return err
+		}
+		if check == nil {
+			continue
+		}
+		lp.Infof("Waiting for %s to be healthy", m.Key.ReadableString())
+		if err := waitForHealthy(ctx, applier, m, check, timeout); err != nil {
+			lp.Errorf("Failed while waiting for %s to be healthy (%v)", m.Key.ReadableString(), err)
+			return err
+		}
+		lp.Successf("- %s is healthy", m.Key.ReadableString())
+	}
+	return nil
+}
+
+// waitForRollout polls the live state of the given workload until its rollout completes
+// or the timeout elapses. While waiting, the progress and the pods that are not ready
+// are reported whenever the status changes or at least every rolloutProgressInterval.
+// On timeout, the returned error lists the pods that are not ready.
+// It fails fast with errPodNeverReady when a pod is crash-looping or keeps failing to pull its image,
+// or with errJobFailed when the given workload is a Job which has failed.
+// See checkRolloutStatus for how the autoscaled workloads are checked.
+func waitForRollout(ctx context.Context, applier provider.Applier, m provider.Manifest, autoscaled bool, timeout time.Duration, lp executor.LogPersister) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(rolloutCheckInterval)
+	defer ticker.Stop()
+
+	var (
+		lastMessage    string
+		lastReportedAt time.Time
+		// The time since when each container has been failing to pull its image.
+		imagePullFailingSince = make(map[string]time.Time)
+	)
+
+	for {
+		live, err := applier.GetManifest(timeoutCtx, m.Key)
+		if err != nil {
+			return err
+		}
+		status, err := checkRolloutStatus(live, autoscaled)
+		if err != nil {
+			return err
+		}
+		if status.done {
+			return nil
+		}
+
+		pods, podsErr := listPods(timeoutCtx, applier, m.Key.Namespace, status.selector)
+		// The failing pods of a Job are retried up to its backoffLimit
+		// so whether it has failed is left to checkRolloutStatus.
+		if podsErr == nil && m.Key.Kind != provider.KindJob {
+			if err := checkPodsNeverReady(pods, imagePullFailingSince, time.Now()); err != nil {
+				return fmt.Errorf("%s: %w", status.message, err)
+			}
+		}
+
+		if status.message != lastMessage || time.Since(lastReportedAt) >= rolloutProgressInterval {
+			desc := describePods(timeoutCtx, applier, pods)
+			if podsErr != nil {
+				desc = podsErr.Error()
+			}
+			lp.Infof("- %s: %s, %s", m.Key.ReadableString(), status.message, desc)
+			lastMessage = status.message
+			lastReportedAt = time.Now()
+		}
+
+		select {
+		case <-timeoutCtx.Done():
+			return fmt.Errorf("%s, %s: %w", status.message, describeUnreadyPods(ctx, applier, m.Key.Namespace, status.selector), timeoutCtx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkRolloutStatus determines the rollout progress of the given live workload
+// in the same way as "kubectl rollout status" does.
+// When the given workload is a Deployment scaled by a HorizontalPodAutoscaler,
+// its rollout is judged by its current replicas instead of the desired ones
+// since they are changed by the autoscaler at any time.
+func checkRolloutStatus(m provider.Manifest, autoscaled bool) (rolloutStatus, error) {
+	switch m.Key.Kind {
+	case provider.KindDeployment:
+		d := &appsv1.Deployment{}
+		if err := m.ConvertToStructuredObject(d); err != nil {
+			return rolloutStatus{}, err
+		}
+		return checkDeploymentRolloutStatus(d, autoscaled), nil
+
+	case provider.KindStatefulSet:
+		s := &appsv1.StatefulSet{}
+		if err := m.ConvertToStructuredObject(s); err != nil {
+			return rolloutStatus{}, err
+		}
+		return checkStatefulSetRolloutStatus(s), nil
+
+	case provider.KindDaemonSet:
+		d := &appsv1.DaemonSet{}
+		if err := m.ConvertToStructuredObject(d); err != nil {
+			return rolloutStatus{}, err
+		}
+		return checkDaemonSetRolloutStatus(d), nil
+
+	case provider.KindJob:
+		j := &batchv1.Job{}
+		if err := m.ConvertToStructuredObject(j); err != nil {
+			return rolloutStatus{}, err
+		}
+		return checkJobCompletionStatus(j)
+
+	default:
+		return rolloutStatus{}, fmt.Errorf("unsupported kind for checking rollout status: %s", m.Key.Kind)
+	}
+}
+
+func checkDeploymentRolloutStatus(d *appsv1.Deployment, autoscaled bool) rolloutStatus {
+	s := rolloutStatus{selector: selectorLabels(d.Spec.Selector)}
+	desired := desiredReplicas(d.Spec.Replicas)
+	if autoscaled {
+		desired = d.Status.Replicas
+	}
+
+	switch {
+	case d.Status.ObservedGeneration < d.Generation:
+		s.message = "the latest spec has not been observed yet"
+	case d.Status.UpdatedReplicas < desired:
+		s.message = fmt.Sprintf("%d/%d replicas have been updated", d.Status.UpdatedReplicas, desired)
+	case d.Status.Replicas > d.Status.UpdatedReplicas:
+		s.message = fmt.Sprintf("%d old replicas are pending termination", d.Status.Replicas-d.Status.UpdatedReplicas)
+	case d.Status.AvailableReplicas < d.Status.UpdatedReplicas:
+		s.message = fmt.Sprintf("%d/%d updated replicas are available", d.Status.AvailableReplicas, d.Status.UpdatedReplicas)
+	default:
+		s.done = true
+	}
+	return s
+}
+
+func checkStatefulSetRolloutStatus(ss *appsv1.StatefulSet) rolloutStatus {
+	s := rolloutStatus{selector: selectorLabels(ss.Spec.Selector)}
+	desired := desiredReplicas(ss.Spec.Replicas)
+
+	// Only the replicas whose ordinal is greater than or equal to the partition are updated.
+	var partition int32
+	if ru := ss.Spec.UpdateStrategy.RollingUpdate; ru != nil && ru.Partition != nil {
+		partition = *ru.Partition
+	}
+
+	switch {
+	case ss.Status.ObservedGeneration < ss.Generation:
+		s.message = "the latest spec has not been observed yet"
+	case ss.Status.ReadyReplicas < desired:
+		s.message = fmt.Sprintf("%d/%d replicas are ready", ss.Status.ReadyReplicas, desired)
+	case partition > 0 && ss.Status.UpdatedReplicas < desired-partition:
+		s.message = fmt.Sprintf("%d/%d replicas have been updated", ss.Status.UpdatedReplicas, desired-partition)
+	case partition == 0 && ss.Status.UpdateRevision != ss.Status.CurrentRevision:
+		s.message = fmt.Sprintf("%d/%d replicas have been updated", ss.Status.UpdatedReplicas, desired)
+	default:
+		s.done = true
+	}
+	return s
+}
+
+func checkDaemonSetRolloutStatus(d *appsv1.DaemonSet) rolloutStatus {
+	s := rolloutStatus{selector: selectorLabels(d.Spec.Selector)}
+	desired := d.Status.DesiredNumberScheduled
+
+	switch {
+	case d.Status.ObservedGeneration < d.Generation:
+		s.message = "the latest spec has not been observed yet"
+	case d.Status.UpdatedNumberScheduled < desired:
+		s.message = fmt.Sprintf("%d/%d pods have been updated", d.Status.UpdatedNumberScheduled, desired)
+	case d.Status.NumberAvailable < desired:
+		s.message = fmt.Sprintf("%d/%d updated pods are available", d.Status.NumberAvailable, desired)
+	default:
+		s.done = true
+	}
+	return s
+}
+
+// checkJobCompletionStatus determines whether the given Job has succeeded as many times
+// as its completions. errJobFailed is returned when the Job has failed, e.g. its pods
+// failed more times than its backoffLimit, since it will not complete anymore.
+func checkJobCompletionStatus(j *batchv1.Job) (rolloutStatus, error) {
+	s := rolloutStatus{selector: selectorLabels(j.Spec.Selector)}
+	completions := int32(1)
+	if j.Spec.Completions != nil {
+		completions = *j.Spec.Completions
+	}
+	backoffLimit := int32(defaultJobBackoffLimit)
+	if j.Spec.BackoffLimit != nil {
+		backoffLimit = *j.Spec.BackoffLimit
+	}
+
+	for _, c := range j.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case batchv1.JobComplete:
+			s.done = true
+			return s, nil
+		case batchv1.JobFailed:
+			return s, fmt.Errorf("%w: %s (%s)", errJobFailed, c.Reason, c.Message)
+		}
+	}
+
+	switch {
+	case j.Status.Failed > backoffLimit:
+		return s, fmt.Errorf("%w: %d pods have failed, exceeding the backoff limit %d", errJobFailed, j.Status.Failed, backoffLimit)
+	case j.Status.Succeeded < completions:
+		s.message = fmt.Sprintf("%d/%d completions have succeeded", j.Status.Succeeded, completions)
+	default:
+		s.done = true
+	}
+	return s, nil
+}
+
+// findAutoscaledWorkloads returns the keys of the workloads targeted by
+// the HorizontalPodAutoscalers in the given manifests. See scaleTargetKey for the format of the keys.
+func findAutoscaledWorkloads(manifests []provider.Manifest) map[provider.ResourceKey]struct{} {
+	out := make(map[provider.ResourceKey]struct{})
+	for _, m := range manifests {
+		if m.Key.Kind != provider.KindHorizontalPodAutoscaler {
+			continue
+		}
+		// The scale target is the same in all versions of HorizontalPodAutoscaler.
+		hpa := &autoscalingv1.HorizontalPodAutoscaler{}
+		if err := m.ConvertToStructuredObject(hpa); err != nil {
+			continue
+		}
+		ref := hpa.Spec.ScaleTargetRef
+		out[provider.ResourceKey{Kind: ref.Kind, Namespace: m.Key.Namespace, Name: ref.Name}] = struct{}{}
+	}
+	return out
+}
+
+// scaleTargetKey returns the key of the given workload without its apiVersion
+// to be compared with the scale targets of HorizontalPodAutoscalers.
+func scaleTargetKey(k provider.ResourceKey) provider.ResourceKey {
+	k.APIVersion = ""
+	return k
+}
+
+// describeUnreadyPods returns a human-readable list of the pods
+// in the given namespace matching the given labels which are not ready yet.
+func describeUnreadyPods(ctx context.Context, applier provider.Applier, namespace string, selector map[string]string) string {
+	pods, err := listPods(ctx, applier, namespace, selector)
+	if err != nil {
+		return err.Error()
+	}
+	return describePods(ctx, applier, pods)
+}
+
+// listPods returns the live pods in the given namespace matching the given labels.
+func listPods(ctx context.Context, applier provider.Applier, namespace string, selector map[string]string) ([]*corev1.Pod, error) {
+	if len(selector) == 0 {
+		return nil, errors.New("unable to find pods: no selector")
+	}
+	manifests, err := applier.ListManifests(ctx, namespace, provider.KindPod, selector)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pods (%v)", err)
+	}
+
+	pods := make([]*corev1.Pod, 0, len(manifests))
+	for _, m := range manifests {
+		p := &corev1.Pod{}
+		if err := m.ConvertToStructuredObject(p); err != nil {
+			return nil, fmt.Errorf("unable to parse pod %s (%v)", m.Key.Name, err)
+		}
+		pods = append(pods, p)
+	}
+	return pods, nil
+}
+
+// describePods returns a human-readable list of the given pods which are not ready yet.
+func describePods(ctx context.Context, applier provider.Applier, pods []*corev1.Pod) string {
+	unready := make([]string, 0, len(pods))
+	for _, p := range pods {
+		if isPodReady(p) {
+			continue
+		}
+		reason := podNotReadyReason(p)
+		key := provider.ResourceKey{APIVersion: "v1", Kind: provider.KindPod, Namespace: p.Namespace, Name: p.Name}
+		if key.Namespace == "" {
+			key.Namespace = provider.DefaultNamespace
+		}
+		if event := lastWarningEvent(ctx, applier, key); event != "" {
+			reason = fmt.Sprintf("%s, last event: %s", reason, event)
+		}
+		unready = append(unready, fmt.Sprintf("%s (%s)", p.Name, reason))
+	}
+	if len(unready) == 0 {
+		return "no unready pods"
+	}
+	return "unready pods: " + strings.Join(unready, ", ")
+}
+
+// checkPodsNeverReady returns errPodNeverReady when a container of the given pods
+// is crash-looping or has been failing to pull its image for imagePullBackOffThreshold.
+// The given map keeps the time since when each container has been failing to pull its image
+// across the checks, and is updated by this function.
+func checkPodsNeverReady(pods []*corev1.Pod, imagePullFailingSince map[string]time.Time, now time.Time) error {
+	failing := make(map[string]struct{}, len(imagePullFailingSince))
+	for _, p := range pods {
+		for _, cs := range p.Status.ContainerStatuses {
+			if cs.Ready || cs.State.Waiting == nil {
+				continue
+			}
+			switch cs.State.Waiting.Reason {
+			case "CrashLoopBackOff":
+				if cs.RestartCount >= crashLoopBackOffRestartThreshold {
+					return fmt.Errorf("container %s of pod %s is in CrashLoopBackOff after %d restarts, last termination: %s: %w",
+						cs.Name, p.Name, cs.RestartCount, describeLastTermination(cs), errPodNeverReady)
+				}
+
+			case "ImagePullBackOff", "ErrImagePull":
+				id := p.Name + "/" + cs.Name
+				failing[id] = struct{}{}
+				since, ok := imagePullFailingSince[id]
+				if !ok {
+					imagePullFailingSince[id] = now
+					since = now
+				}
+				if now.Sub(since) >= imagePullBackOffThreshold {
+					return fmt.Errorf("container %s of pod %s has been failing to pull image %s for %v (%s): %w",
+						cs.Name, p.Name, cs.Image, now.Sub(since).Round(time.Second), cs.State.Waiting.Message, errPodNeverReady)
+				}
+			}
+		}
+	}
+
+	// Forget the containers which have recovered from pulling failures.
+	for id := range imagePullFailingSince {
+		if _, ok := failing[id]; !ok {
+			delete(imagePullFailingSince, id)
+		}
+	}
+	return nil
+}
+
+func describeLastTermination(cs corev1.ContainerStatus) string {
+	t := cs.LastTerminationState.Terminated
+	if t == nil {
+		return "unknown"
+	}
+	desc := fmt.Sprintf("%s (exit code %d)", t.Reason, t.ExitCode)
+	if t.Message != "" {
+		desc = fmt.Sprintf("%s: %s", desc, t.Message)
+	}
+	return desc
+}
+
+func isPodReady(p *corev1.Pod) bool {
+	for _, c := range p.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podNotReadyReason returns the most descriptive reason why the given pod is not ready,
+// e.g. the reason of a waiting container such as "ImagePullBackOff".
+func podNotReadyReason(p *corev1.Pod) string {
+	for _, cs := range p.Status.ContainerStatuses {
+		if cs.Ready {
+			continue
+		}
+		if cs.State.Waiting != nil && cs.State.Waiting.Reason != "" {
+			return cs.State.Waiting.Reason
+		}
+		if cs.State.Terminated != nil && cs.State.Terminated.Reason != "" {
+			return cs.State.Terminated.Reason
+		}
+	}
+	if p.Status.Reason != "" {
+		return p.Status.Reason
+	}
+	// The pod conditions tell why it is not running yet, e.g. "Unschedulable".
+	for _, c := range p.Status.Conditions {
+		if c.Status == corev1.ConditionFalse && c.Reason != "" {
+			return c.Reason
+		}
+	}
+	return string(p.Status.Phase)
+}
+
+// lastWarningEvent returns the reason and message of the most recent warning event
+// involving the given resource, or an empty string if there is none.
+func lastWarningEvent(ctx context.Context, applier provider.Applier, key provider.ResourceKey) string {
+	events, err := applier.ListEvents(ctx, key)
+	if err != nil {
+		return ""
+	}
+
+	var last *corev1.Event
+	for _, m := range events {
+		e := &corev1.Event{}
+		if err := m.ConvertToStructuredObject(e); err != nil {
+			continue
+		}
+		if e.Type != corev1.EventTypeWarning {
+			continue
+		}
+		if last == nil || !e.LastTimestamp.Before(&last.LastTimestamp) {
+			last = e
+		}
+	}
+	if last == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s: %s", last.Reason, last.Message)
+}
+
+func selectorLabels(s *metav1.LabelSelector) map[string]string {
+	if s == nil {
+		return nil
+	}
+	return s.MatchLabels
+}
+
+func desiredReplicas(replicas *int32) int32 {
+	// Kubernetes defaults the number of replicas to 1.
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
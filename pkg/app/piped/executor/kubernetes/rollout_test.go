@@ -0,0 +1,799 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes/providertest"
+	"github.com/pipe-cd/pipe/pkg/config"
+)
+
+func parseManifest(t *testing.T, data string) provider.Manifest {
+	manifests, err := provider.ParseManifests(data)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(manifests))
+	return manifests[0]
+}
+
+func TestCheckRolloutStatus(t *testing.T) {
+	testcases := []struct {
+		name            string
+		manifest        string
+		expectedDone    bool
+		expectedMessage string
+	}{
+		{
+			name: "deployment: spec not observed",
+			manifest: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+  generation: 2
+spec:
+  replicas: 2
+status:
+  observedGeneration: 1
+  replicas: 2
+  updatedReplicas: 2
+  availableReplicas: 2
+`,
+			expectedMessage: "the latest spec has not been observed yet",
+		},
+		{
+			name: "deployment: replicas being updated",
+			manifest: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+  generation: 2
+spec:
+  replicas: 2
+status:
+  observedGeneration: 2
+  replicas: 3
+  updatedReplicas: 1
+  availableReplicas: 2
+`,
+			expectedMessage: "1/2 replicas have been updated",
+		},
+		{
+			name: "deployment: old replicas pending termination",
+			manifest: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+  generation: 2
+spec:
+  replicas: 2
+status:
+  observedGeneration: 2
+  replicas: 3
+  updatedReplicas: 2
+  availableReplicas: 2
+`,
+			expectedMessage: "1 old replicas are pending termination",
+		},
+		{
+			name: "deployment: updated replicas not available",
+			manifest: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+  generation: 2
+spec:
+  replicas: 2
+status:
+  observedGeneration: 2
+  replicas: 2
+  updatedReplicas: 2
+  availableReplicas: 1
+`,
+			expectedMessage: "1/2 updated replicas are available",
+		},
+		{
+			name: "deployment: completed with default replicas",
+			manifest: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+  generation: 2
+status:
+  observedGeneration: 2
+  replicas: 1
+  updatedReplicas: 1
+  availableReplicas: 1
+`,
+			expectedDone: true,
+		},
+		{
+			name: "statefulset: replicas not ready",
+			manifest: `
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: simple
+spec:
+  replicas: 3
+status:
+  readyReplicas: 1
+`,
+			expectedMessage: "1/3 replicas are ready",
+		},
+		{
+			name: "statefulset: revision being updated",
+			manifest: `
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: simple
+spec:
+  replicas: 3
+status:
+  readyReplicas: 3
+  updatedReplicas: 2
+  currentRevision: simple-1
+  updateRevision: simple-2
+`,
+			expectedMessage: "2/3 replicas have been updated",
+		},
+		{
+			name: "statefulset: partitioned rollout completed",
+			manifest: `
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: simple
+spec:
+  replicas: 3
+  updateStrategy:
+    type: RollingUpdate
+    rollingUpdate:
+      partition: 2
+status:
+  readyReplicas: 3
+  updatedReplicas: 1
+  currentRevision: simple-1
+  updateRevision: simple-2
+`,
+			expectedDone: true,
+		},
+		{
+			name: "daemonset: pods being updated",
+			manifest: `
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: simple
+status:
+  desiredNumberScheduled: 3
+  updatedNumberScheduled: 2
+  numberAvailable: 3
+`,
+			expectedMessage: "2/3 pods have been updated",
+		},
+		{
+			name: "daemonset: updated pods not available",
+			manifest: `
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: simple
+status:
+  desiredNumberScheduled: 3
+  updatedNumberScheduled: 3
+  numberAvailable: 2
+`,
+			expectedMessage: "2/3 updated pods are available",
+		},
+		{
+			name: "daemonset: completed",
+			manifest: `
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: simple
+status:
+  desiredNumberScheduled: 3
+  updatedNumberScheduled: 3
+  numberAvailable: 3
+`,
+			expectedDone: true,
+		},
+		{
+			name: "job: completions in progress",
+			manifest: `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migration
+spec:
+  completions: 3
+status:
+  succeeded: 1
+  failed: 2
+`,
+			expectedMessage: "1/3 completions have succeeded",
+		},
+		{
+			name: "job: completed",
+			manifest: `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migration
+status:
+  succeeded: 1
+  conditions:
+  - type: Complete
+    status: "True"
+`,
+			expectedDone: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			status, err := checkRolloutStatus(parseManifest(t, tc.manifest), false)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedDone, status.done)
+			assert.Equal(t, tc.expectedMessage, status.message)
+		})
+	}
+}
+
+func TestCheckAutoscaledDeploymentRolloutStatus(t *testing.T) {
+	// The HorizontalPodAutoscaler has scaled the Deployment in to 2 replicas
+	// while its spec still has the replicas of the applied manifest.
+	scaledIn := parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+spec:
+  replicas: 4
+status:
+  replicas: 2
+  updatedReplicas: 2
+  availableReplicas: 2
+`)
+	status, err := checkRolloutStatus(scaledIn, true)
+	require.NoError(t, err)
+	assert.True(t, status.done)
+
+	status, err = checkRolloutStatus(scaledIn, false)
+	require.NoError(t, err)
+	assert.False(t, status.done)
+	assert.Equal(t, "2/4 replicas have been updated", status.message)
+
+	// The replicas not updated yet are still waited for.
+	updating := parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+spec:
+  replicas: 4
+status:
+  replicas: 3
+  updatedReplicas: 2
+  availableReplicas: 2
+`)
+	status, err = checkRolloutStatus(updating, true)
+	require.NoError(t, err)
+	assert.False(t, status.done)
+	assert.Equal(t, "2/3 replicas have been updated", status.message)
+}
+
+func TestFindAutoscaledWorkloads(t *testing.T) {
+	manifests, err := provider.ParseManifests(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: fixed
+---
+apiVersion: autoscaling/v2beta2
+kind: HorizontalPodAutoscaler
+metadata:
+  name: simple
+spec:
+  scaleTargetRef:
+    apiVersion: apps/v1
+    kind: Deployment
+    name: simple
+  minReplicas: 1
+  maxReplicas: 10
+  metrics:
+  - type: Resource
+    resource:
+      name: cpu
+      target:
+        type: Utilization
+        averageUtilization: 50
+`)
+	require.NoError(t, err)
+
+	autoscaled := findAutoscaledWorkloads(manifests)
+	assert.Equal(t, 1, len(autoscaled))
+	_, ok := autoscaled[scaleTargetKey(manifests[0].Key)]
+	assert.True(t, ok)
+	_, ok = autoscaled[scaleTargetKey(manifests[1].Key)]
+	assert.False(t, ok)
+}
+
+func TestWaitForRollout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	rolloutCheckInterval = time.Millisecond
+	defer func() {
+		rolloutCheckInterval = 5 * time.Second
+	}()
+
+	makeLiveDeployment := func(observed, updated, available int) provider.Manifest {
+		return parseManifest(t, fmt.Sprintf(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+  generation: 2
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: simple
+status:
+  observedGeneration: %d
+  replicas: 2
+  updatedReplicas: %d
+  availableReplicas: %d
+`, observed, updated, available))
+	}
+	deployment := makeLiveDeployment(2, 2, 2)
+
+	t.Run("completed after several polls", func(t *testing.T) {
+		p := providertest.NewMockProvider(ctrl)
+		gomock.InOrder(
+			p.EXPECT().GetManifest(gomock.Any(), deployment.Key).Return(makeLiveDeployment(1, 0, 0), nil),
+			p.EXPECT().GetManifest(gomock.Any(), deployment.Key).Return(makeLiveDeployment(2, 1, 0), nil),
+			p.EXPECT().GetManifest(gomock.Any(), deployment.Key).Return(makeLiveDeployment(2, 2, 1), nil),
+			p.EXPECT().GetManifest(gomock.Any(), deployment.Key).Return(makeLiveDeployment(2, 2, 2), nil),
+		)
+		p.EXPECT().ListManifests(gomock.Any(), "default", provider.KindPod, map[string]string{"app": "simple"}).Return(nil, nil).AnyTimes()
+		err := waitForRollout(context.Background(), p, deployment, false, time.Minute, &fakeLogPersister{})
+		assert.NoError(t, err)
+	})
+
+	t.Run("failed to get the live manifest", func(t *testing.T) {
+		p := providertest.NewMockProvider(ctrl)
+		p.EXPECT().GetManifest(gomock.Any(), deployment.Key).Return(provider.Manifest{}, provider.ErrNotFound)
+		err := waitForRollout(context.Background(), p, deployment, false, time.Minute, &fakeLogPersister{})
+		assert.True(t, errors.Is(err, provider.ErrNotFound))
+	})
+
+	t.Run("timed out with unready pods", func(t *testing.T) {
+		pods, err := provider.ParseManifests(`
+apiVersion: v1
+kind: Pod
+metadata:
+  name: simple-ready
+status:
+  phase: Running
+  conditions:
+  - type: Ready
+    status: "True"
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: simple-image-error
+status:
+  phase: Pending
+  containerStatuses:
+  - name: helloworld
+    ready: false
+    state:
+      waiting:
+        reason: ImagePullBackOff
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: simple-pending
+status:
+  phase: Pending
+`)
+		require.NoError(t, err)
+
+		p := providertest.NewMockProvider(ctrl)
+		p.EXPECT().GetManifest(gomock.Any(), deployment.Key).Return(makeLiveDeployment(2, 2, 1), nil).MinTimes(1)
+		p.EXPECT().ListManifests(gomock.Any(), "default", provider.KindPod, map[string]string{"app": "simple"}).Return(pods, nil).MinTimes(1)
+		p.EXPECT().ListEvents(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+
+		err = waitForRollout(context.Background(), p, deployment, false, 10*time.Millisecond, &fakeLogPersister{})
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.Equal(t, "1/2 updated replicas are available, unready pods: simple-image-error (ImagePullBackOff), simple-pending (Pending): context deadline exceeded", err.Error())
+	})
+}
+
+type recordingLogPersister struct {
+	fakeLogPersister
+	infos  []string
+	errors []string
+}
+
+func (l *recordingLogPersister) Infof(format string, a ...interface{}) {
+	l.infos = append(l.infos, fmt.Sprintf(format, a...))
+}
+
+func (l *recordingLogPersister) Errorf(format string, a ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprintf(format, a...))
+}
+
+func TestCheckJobCompletionStatusFailed(t *testing.T) {
+	testcases := []struct {
+		name     string
+		manifest string
+		expected string
+	}{
+		{
+			name: "failed condition",
+			manifest: `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migration
+status:
+  failed: 1
+  conditions:
+  - type: Failed
+    status: "True"
+    reason: DeadlineExceeded
+    message: Job was active longer than specified deadline
+`,
+			expected: "job failed: DeadlineExceeded (Job was active longer than specified deadline)",
+		},
+		{
+			name: "exceeded backoff limit",
+			manifest: `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migration
+spec:
+  backoffLimit: 2
+status:
+  failed: 3
+`,
+			expected: "job failed: 3 pods have failed, exceeding the backoff limit 2",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := checkRolloutStatus(parseManifest(t, tc.manifest), false)
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, errJobFailed))
+			assert.Equal(t, tc.expected, err.Error())
+		})
+	}
+}
+
+func TestWaitForJobCompletion(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	rolloutCheckInterval = time.Millisecond
+	defer func() {
+		rolloutCheckInterval = 5 * time.Second
+	}()
+
+	makeLiveJob := func(succeeded, failed int) provider.Manifest {
+		return parseManifest(t, fmt.Sprintf(`
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migration
+spec:
+  backoffLimit: 1
+  selector:
+    matchLabels:
+      job-name: migration
+status:
+  succeeded: %d
+  failed: %d
+`, succeeded, failed))
+	}
+	job := makeLiveJob(0, 0)
+
+	t.Run("succeeded", func(t *testing.T) {
+		p := providertest.NewMockProvider(ctrl)
+		gomock.InOrder(
+			p.EXPECT().GetManifest(gomock.Any(), job.Key).Return(makeLiveJob(0, 0), nil),
+			p.EXPECT().GetManifest(gomock.Any(), job.Key).Return(makeLiveJob(0, 1), nil),
+			p.EXPECT().GetManifest(gomock.Any(), job.Key).Return(makeLiveJob(1, 1), nil),
+		)
+		p.EXPECT().ListManifests(gomock.Any(), "default", provider.KindPod, map[string]string{"job-name": "migration"}).Return(nil, nil).AnyTimes()
+		err := waitForRollouts(context.Background(), p, []provider.Manifest{job}, config.K8sHealthCheck{}, time.Minute, &fakeLogPersister{})
+		assert.NoError(t, err)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		p := providertest.NewMockProvider(ctrl)
+		gomock.InOrder(
+			p.EXPECT().GetManifest(gomock.Any(), job.Key).Return(makeLiveJob(0, 1), nil),
+			p.EXPECT().GetManifest(gomock.Any(), job.Key).Return(makeLiveJob(0, 2), nil),
+		)
+		p.EXPECT().ListManifests(gomock.Any(), "default", provider.KindPod, map[string]string{"job-name": "migration"}).Return(nil, nil).AnyTimes()
+		err := waitForRollouts(context.Background(), p, []provider.Manifest{job}, config.K8sHealthCheck{}, time.Minute, &fakeLogPersister{})
+		assert.True(t, errors.Is(err, errJobFailed), err)
+	})
+}
+
+func TestWaitForRolloutProgress(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	rolloutCheckInterval = time.Millisecond
+	defer func() {
+		rolloutCheckInterval = 5 * time.Second
+	}()
+
+	makeLiveDeployment := func(available int) provider.Manifest {
+		return parseManifest(t, fmt.Sprintf(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: simple
+status:
+  replicas: 2
+  updatedReplicas: 2
+  availableReplicas: %d
+`, available))
+	}
+	deployment := makeLiveDeployment(2)
+
+	pods, err := provider.ParseManifests(`
+apiVersion: v1
+kind: Pod
+metadata:
+  name: simple-1
+status:
+  phase: Running
+  conditions:
+  - type: Ready
+    status: "True"
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: simple-2
+status:
+  phase: Pending
+  conditions:
+  - type: PodScheduled
+    status: "False"
+    reason: Unschedulable
+`)
+	require.NoError(t, err)
+	events, err := provider.ParseManifests(`
+apiVersion: v1
+kind: Event
+metadata:
+  name: simple-2.1
+type: Warning
+reason: FailedScheduling
+message: 0/3 nodes are available
+lastTimestamp: "2020-10-01T00:00:00Z"
+---
+apiVersion: v1
+kind: Event
+metadata:
+  name: simple-2.2
+type: Warning
+reason: FailedScheduling
+message: 0/3 nodes are available, 3 Insufficient cpu
+lastTimestamp: "2020-10-01T00:01:00Z"
+---
+apiVersion: v1
+kind: Event
+metadata:
+  name: simple-2.3
+type: Normal
+reason: Scheduled
+message: Successfully assigned
+lastTimestamp: "2020-10-01T00:00:30Z"
+`)
+	require.NoError(t, err)
+
+	p := providertest.NewMockProvider(ctrl)
+	gomock.InOrder(
+		p.EXPECT().GetManifest(gomock.Any(), deployment.Key).Return(makeLiveDeployment(0), nil),
+		p.EXPECT().GetManifest(gomock.Any(), deployment.Key).Return(makeLiveDeployment(1), nil),
+		p.EXPECT().GetManifest(gomock.Any(), deployment.Key).Return(makeLiveDeployment(2), nil),
+	)
+	gomock.InOrder(
+		p.EXPECT().ListManifests(gomock.Any(), "default", provider.KindPod, map[string]string{"app": "simple"}).Return(nil, nil),
+		p.EXPECT().ListManifests(gomock.Any(), "default", provider.KindPod, map[string]string{"app": "simple"}).Return(pods, nil),
+	)
+	p.EXPECT().ListEvents(gomock.Any(), pods[1].Key).Return(events, nil)
+
+	lp := &recordingLogPersister{}
+	err = waitForRollout(context.Background(), p, deployment, false, time.Minute, lp)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"- " + deployment.Key.ReadableString() + ": 0/2 updated replicas are available, no unready pods",
+		"- " + deployment.Key.ReadableString() + ": 1/2 updated replicas are available, unready pods: simple-2 (Unschedulable, last event: FailedScheduling: 0/3 nodes are available, 3 Insufficient cpu)",
+	}, lp.infos)
+}
+
+func TestWaitForRolloutFailFast(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	rolloutCheckInterval = time.Millisecond
+	imagePullBackOffThreshold = 5 * time.Millisecond
+	defer func() {
+		rolloutCheckInterval = 5 * time.Second
+		imagePullBackOffThreshold = 2 * time.Minute
+	}()
+
+	deployment := parseManifest(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: simple
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: simple
+status:
+  replicas: 1
+  updatedReplicas: 1
+  availableReplicas: 0
+`)
+	makePods := func(reason string, restarts int) []provider.Manifest {
+		pods, err := provider.ParseManifests(fmt.Sprintf(`
+apiVersion: v1
+kind: Pod
+metadata:
+  name: simple-1
+status:
+  phase: Running
+  containerStatuses:
+  - name: helloworld
+    image: gcr.io/pipecd/helloworld:v0.1.0
+    ready: false
+    restartCount: %d
+    state:
+      waiting:
+        reason: %s
+        message: waiting
+    lastState:
+      terminated:
+        reason: OOMKilled
+        exitCode: 137
+`, restarts, reason))
+		require.NoError(t, err)
+		return pods
+	}
+
+	testcases := []struct {
+		name           string
+		pods           []provider.Manifest
+		timeout        time.Duration
+		expectedErr    error
+		expectedErrMsg string
+	}{
+		{
+			name:           "crash-looping pod",
+			pods:           makePods("CrashLoopBackOff", 3),
+			timeout:        time.Minute,
+			expectedErr:    errPodNeverReady,
+			expectedErrMsg: "0/1 updated replicas are available: container helloworld of pod simple-1 is in CrashLoopBackOff after 3 restarts, last termination: OOMKilled (exit code 137): pod will never become ready",
+		},
+		{
+			name:        "failing to pull image for a while",
+			pods:        makePods("ImagePullBackOff", 0),
+			timeout:     time.Minute,
+			expectedErr: errPodNeverReady,
+		},
+		{
+			name:        "crash-looping pod under the restart threshold",
+			pods:        makePods("CrashLoopBackOff", 1),
+			timeout:     10 * time.Millisecond,
+			expectedErr: context.DeadlineExceeded,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := providertest.NewMockProvider(ctrl)
+			p.EXPECT().GetManifest(gomock.Any(), deployment.Key).Return(deployment, nil).MinTimes(1)
+			p.EXPECT().ListManifests(gomock.Any(), "default", provider.KindPod, map[string]string{"app": "simple"}).Return(tc.pods, nil).MinTimes(1)
+			p.EXPECT().ListEvents(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+
+			err := waitForRollout(context.Background(), p, deployment, false, tc.timeout, &fakeLogPersister{})
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, tc.expectedErr))
+			if tc.expectedErrMsg != "" {
+				assert.Equal(t, tc.expectedErrMsg, err.Error())
+			}
+		})
+	}
+}
+
+func TestCheckPodsNeverReady(t *testing.T) {
+	defer func() {
+		imagePullBackOffThreshold = 2 * time.Minute
+	}()
+	imagePullBackOffThreshold = time.Minute
+
+	makePod := func(reason string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "simple-1"},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{
+					{
+						Name:  "helloworld",
+						State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason}},
+					},
+				},
+			},
+		}
+	}
+	var (
+		now   = time.Now()
+		since = make(map[string]time.Time)
+	)
+
+	// The image pull has been failing but not for long enough.
+	assert.NoError(t, checkPodsNeverReady([]*corev1.Pod{makePod("ErrImagePull")}, since, now))
+	assert.NoError(t, checkPodsNeverReady([]*corev1.Pod{makePod("ImagePullBackOff")}, since, now.Add(30*time.Second)))
+
+	// The container recovered once so the failing duration is reset.
+	assert.NoError(t, checkPodsNeverReady([]*corev1.Pod{makePod("ContainerCreating")}, since, now.Add(40*time.Second)))
+	assert.Empty(t, since)
+	assert.NoError(t, checkPodsNeverReady([]*corev1.Pod{makePod("ImagePullBackOff")}, since, now.Add(50*time.Second)))
+	assert.NoError(t, checkPodsNeverReady([]*corev1.Pod{makePod("ImagePullBackOff")}, since, now.Add(100*time.Second)))
+
+	err := checkPodsNeverReady([]*corev1.Pod{makePod("ImagePullBackOff")}, since, now.Add(110*time.Second))
+	assert.True(t, errors.Is(err, errPodNeverReady))
+}
@@ -19,6 +19,7 @@ import (
 	"time"
 
 	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/config"
 	"github.com/pipe-cd/pipe/pkg/model"
 )
 
@@ -55,7 +56,7 @@ func (e *deployExecutor) ensureSync(ctx context.Context) model.StageStatus {
 		}
 	}
 
-	// Add builtin annotations for tracking application live state.
+	// Add builtin annotations and labels for tracking application live state.
 	addBuiltinAnnontations(
 		manifests,
 		primaryVariant,
@@ -63,9 +64,30 @@ func (e *deployExecutor) ensureSync(ctx context.Context) model.StageStatus {
 		e.PipedConfig.PipedID,
 		e.Deployment.ApplicationId,
 	)
+	addBuiltinLabels(manifests, e.commit, e.Deployment.ApplicationId)
+
+	// Only show what would happen without mutating the cluster when dry-run was enabled.
+	if e.deployCfg.QuickSync.DryRun {
+		results, err := dryRunApplyManifests(ctx, e.provider, manifests, e.LogPersister)
+		if err != nil {
+			return model.StageStatus_STAGE_FAILURE
+		}
+		e.LogPersister.Successf("Successfully applied manifests in dry-run mode: %s", summarizeDryRunResults(results))
+		return model.StageStatus_STAGE_SUCCESS
+	}
+
+	if e.deployCfg.QuickSync.Validate {
+		if err := validateManifests(ctx, e.provider, manifests, e.namespaceToCreate(), e.LogPersister); err != nil {
+			e.LogPersister.Errorf("Stopped applying because some manifests are invalid (%v)", err)
+			return model.StageStatus_STAGE_FAILURE
+		}
+	}
+
+	e.logManifestsDiff(ctx, manifests, e.deployCfg.QuickSync.Prune)
 
 	// Start applying all manifests to add or update running resources.
-	if err := applyManifests(ctx, e.provider, manifests, e.deployCfg.Input.Namespace, e.LogPersister); err != nil {
+	results, err := applyManifests(ctx, e.provider, manifests, e.deployCfg.Input.Namespace, e.LogPersister)
+	if err != nil {
 		return model.StageStatus_STAGE_FAILURE
 	}
 
@@ -93,18 +115,31 @@ func (e *deployExecutor) ensureSync(ctx context.Context) model.StageStatus {
 		return model.StageStatus_STAGE_SUCCESS
 	}
 
-	removeKeys := findRemoveResources(manifests, liveResources)
+	pruneCandidates := liveResources
+	if e.deployCfg.QuickSync.PruneMode == config.K8sPruneModeCommit {
+		pruneCandidates = filterResourcesAppliedAtOtherCommits(liveResources, e.commit)
+		e.LogPersister.Infof("Only %d live resources applied at a commit other than %s can be removed", len(pruneCandidates), e.commit)
+	}
+
+	removeKeys := findRemoveResources(manifests, pruneCandidates)
 	if len(removeKeys) == 0 {
 		e.LogPersister.Info("There are no live resources should be removed")
 		return model.StageStatus_STAGE_SUCCESS
 	}
 	e.LogPersister.Infof("Found %d live resources that are no longer defined in Git", len(removeKeys))
 
+	if err := checkPruneThreshold(len(removeKeys), len(liveResources), e.deployCfg.QuickSync.PruneThreshold); err != nil {
+		e.LogPersister.Errorf("Refused to prune resources (%v)", err)
+		return model.StageStatus_STAGE_FAILURE
+	}
+
 	// Start deleting all running resources that are not defined in Git.
 	if err := deleteResources(ctx, e.provider, removeKeys, e.LogPersister); err != nil {
 		return model.StageStatus_STAGE_FAILURE
 	}
 
+	results = append(results, makePrunedResults(removeKeys)...)
+	e.LogPersister.Successf("Successfully synced resources: %s", summarizeApplyResults(results))
 	return model.StageStatus_STAGE_SUCCESS
 }
 
@@ -129,3 +164,15 @@ func findRemoveResources(manifests []provider.Manifest, liveResources []provider
 	}
 	return removeKeys
 }
+
+// filterResourcesAppliedAtOtherCommits returns the live resources whose commit hash annotation
+// is set to a commit other than the given one, e.g. the ones applied by the previous deployments.
+func filterResourcesAppliedAtOtherCommits(liveResources []provider.Manifest, commit string) []provider.Manifest {
+	out := make([]provider.Manifest, 0, len(liveResources))
+	for _, m := range liveResources {
+		if appliedAtOtherCommit(m, commit) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
@@ -85,7 +85,8 @@ func TestEnsureSync(t *testing.T) {
 						c.EXPECT().Put(gomock.Any(), gomock.Any()).Return(nil)
 						return c
 					}(),
-					Logger: zap.NewNop(),
+					AppLiveResourceLister: &fakeAppLiveResourceLister{},
+					Logger:                zap.NewNop(),
 				},
 				provider: func() provider.Provider {
 					p := providertest.NewMockProvider(ctrl)
@@ -97,7 +98,8 @@ func TestEnsureSync(t *testing.T) {
 							Object: map[string]interface{}{"spec": map[string]interface{}{}},
 						}),
 					}, nil)
-					p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(fmt.Errorf("error"))
+					p.EXPECT().GetManifest(gomock.Any(), gomock.Any()).Return(provider.Manifest{}, provider.ErrNotFound)
+					p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyAction(""), fmt.Errorf("error"))
 					return p
 				}(),
 				deployCfg: &config.KubernetesDeploymentSpec{
@@ -125,7 +127,8 @@ func TestEnsureSync(t *testing.T) {
 						c.EXPECT().Put(gomock.Any(), gomock.Any()).Return(nil)
 						return c
 					}(),
-					Logger: zap.NewNop(),
+					AppLiveResourceLister: &fakeAppLiveResourceLister{},
+					Logger:                zap.NewNop(),
 				},
 				provider: func() provider.Provider {
 					p := providertest.NewMockProvider(ctrl)
@@ -137,7 +140,8 @@ func TestEnsureSync(t *testing.T) {
 							Object: map[string]interface{}{"spec": map[string]interface{}{}},
 						}),
 					}, nil)
-					p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(nil)
+					p.EXPECT().GetManifest(gomock.Any(), gomock.Any()).Return(provider.Manifest{}, provider.ErrNotFound)
+					p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyActionConfigured, nil)
 					return p
 				}(),
 				deployCfg: &config.KubernetesDeploymentSpec{
@@ -239,3 +243,109 @@ func TestFindRemoveResources(t *testing.T) {
 		})
 	}
 }
+
+func TestFindRemoveResourcesAppliedAtOtherCommits(t *testing.T) {
+	makeLive := func(name, commit string) provider.Manifest {
+		m := provider.MakeManifest(provider.ResourceKey{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+			Namespace:  "default",
+			Name:       name,
+		}, &unstructured.Unstructured{
+			Object: map[string]interface{}{},
+		})
+		if commit != "" {
+			m.AddAnnotations(map[string]string{provider.LabelCommitHash: commit})
+		}
+		return m
+	}
+	manifests := []provider.Manifest{
+		makeLive("kept", ""),
+	}
+	liveResources := []provider.Manifest{
+		// Still defined in Git.
+		makeLive("kept", "previous-commit"),
+		// Removed from Git since the previous deployment.
+		makeLive("removed", "previous-commit"),
+		// Applied by an older deployment, e.g. skipped by the incremental apply since then.
+		makeLive("older", "older-commit"),
+		// Applied at the current commit by another deployment.
+		makeLive("current", "current-commit"),
+		// Not applied by piped.
+		makeLive("unannotated", ""),
+	}
+
+	candidates := filterResourcesAppliedAtOtherCommits(liveResources, "current-commit")
+	got := make([]string, 0, len(candidates))
+	for _, k := range findRemoveResources(manifests, candidates) {
+		got = append(got, k.Name)
+	}
+	assert.Equal(t, []string{"removed", "older"}, got)
+
+	// All live resources no longer defined in Git are removed in the application prune mode.
+	removeKeys := findRemoveResources(manifests, liveResources)
+	assert.Equal(t, 4, len(removeKeys))
+}
+
+func TestEnsureSyncWithCommitPruneMode(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	makeConfigMap := func(name, commit string) provider.Manifest {
+		return parseManifest(t, fmt.Sprintf(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: %s
+  annotations:
+    pipecd.dev/commit-hash: %s
+`, name, commit))
+	}
+	var (
+		kept    = makeConfigMap("kept", "target-commit")
+		removed = makeConfigMap("removed", "running-commit")
+		older   = makeConfigMap("older", "older-commit")
+		current = makeConfigMap("current", "target-commit")
+	)
+
+	c := cachetest.NewMockCache(ctrl)
+	c.EXPECT().Get("app-id/target-commit").Return([]provider.Manifest{kept}, nil)
+
+	p := providertest.NewMockProvider(ctrl)
+	p.EXPECT().GetManifest(gomock.Any(), kept.Key).Return(kept, nil)
+	p.EXPECT().ApplyManifest(gomock.Any(), gomock.Any()).Return(provider.ApplyActionConfigured, nil)
+	// The resources applied at the previous commits are pruned
+	// while the one applied at the target commit by another deployment is kept.
+	p.EXPECT().Delete(gomock.Any(), removed.Key).Return(nil)
+	p.EXPECT().Delete(gomock.Any(), older.Key).Return(nil)
+
+	e := &deployExecutor{
+		Input: executor.Input{
+			Deployment: &model.Deployment{
+				ApplicationId:     "app-id",
+				RunningCommitHash: "running-commit",
+			},
+			PipedConfig:       &config.PipedSpec{},
+			LogPersister:      &fakeLogPersister{},
+			AppManifestsCache: c,
+			AppLiveResourceLister: &fakeAppLiveResourceLister{
+				resources: []provider.Manifest{kept, removed, older, current},
+			},
+			Logger: zap.NewNop(),
+		},
+		provider: p,
+		deployCfg: &config.KubernetesDeploymentSpec{
+			QuickSync: config.K8sSyncStageOptions{
+				Prune:     true,
+				PruneMode: config.K8sPruneModeCommit,
+			},
+		},
+		commit: "target-commit",
+	}
+
+	// The cancelled context skips waiting for the applied manifests to be stable.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	got := e.ensureSync(ctx)
+	assert.Equal(t, model.StageStatus_STAGE_SUCCESS, got)
+}
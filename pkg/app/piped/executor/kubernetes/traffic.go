@@ -34,6 +34,9 @@ const (
 	primaryMetadataKey  = "primary-percentage"
 	canaryMetadataKey   = "canary-percentage"
 	baselineMetadataKey = "baseline-percentage"
+
+	smiTrafficSplitAPIVersion = "split.smi-spec.io/v1alpha2"
+	smiTrafficSplitKind       = "TrafficSplit"
 )
 
 func (e *deployExecutor) ensureTrafficRouting(ctx context.Context) model.StageStatus {
@@ -118,7 +121,7 @@ func (e *deployExecutor) ensureTrafficRouting(ctx context.Context) model.StageSt
 		return model.StageStatus_STAGE_FAILURE
 	}
 
-	// Add builtin annotations for tracking application live state.
+	// Add builtin annotations and labels for tracking application live state.
 	addBuiltinAnnontations(
 		[]provider.Manifest{trafficRoutingManifest},
 		primaryVariant,
@@ -126,13 +129,14 @@ func (e *deployExecutor) ensureTrafficRouting(ctx context.Context) model.StageSt
 		e.PipedConfig.PipedID,
 		e.Deployment.ApplicationId,
 	)
+	addBuiltinLabels([]provider.Manifest{trafficRoutingManifest}, commitHash, e.Deployment.ApplicationId)
 
 	e.LogPersister.Infof("Start updating traffic routing to be percentages: primary=%d, canary=%d, baseline=%d",
 		primaryPercent,
 		canaryPercent,
 		baselinePercent,
 	)
-	if err := applyManifests(ctx, e.provider, []provider.Manifest{trafficRoutingManifest}, e.deployCfg.Input.Namespace, e.LogPersister); err != nil {
+	if _, err := applyManifests(ctx, e.provider, []provider.Manifest{trafficRoutingManifest}, e.deployCfg.Input.Namespace, e.LogPersister); err != nil {
 		return model.StageStatus_STAGE_FAILURE
 	}
 
@@ -161,12 +165,16 @@ func (e *deployExecutor) generateTrafficRoutingManifest(manifest provider.Manife
 			istioConfig = &config.IstioTrafficRouting{}
 		}
 
-		if strings.HasPrefix(manifest.Key.APIVersion, "v1alpha3") {
+		if strings.HasSuffix(manifest.Key.APIVersion, "/v1alpha3") {
 			return generateVirtualServiceManifestV1Alpha3(manifest, istioConfig.Host, istioConfig.EditableRoutes, int32(canaryPercent), int32(baselinePercent))
 		}
 		return generateVirtualServiceManifest(manifest, istioConfig.Host, istioConfig.EditableRoutes, int32(canaryPercent), int32(baselinePercent))
 	}
 
+	if cfg != nil && cfg.Method == config.KubernetesTrafficRoutingMethodSMI {
+		return generateTrafficSplitManifest(manifest, variantSuffixes(e.deployCfg.Pipeline), primaryPercent, canaryPercent, baselinePercent)
+	}
+
 	// Because the loaded maninests are read-only
 	// so we duplicate them to avoid updating the shared manifests data in cache.
 	manifest = duplicateManifest(manifest, "")
@@ -393,6 +401,80 @@ func generateVirtualServiceManifestV1Alpha3(m provider.Manifest, host string, ed
 	return m, nil
 }
 
+// generateTrafficSplitManifest generates an SMI TrafficSplit splitting the traffic
+// sent to the given root service across the services of all variants,
+// which are named with the given suffixes keyed by variant.
+// The variants receiving no traffic are excluded from the backends.
+func generateTrafficSplitManifest(service provider.Manifest, suffixes map[string]string, primaryPercent, canaryPercent, baselinePercent int) (provider.Manifest, error) {
+	variants := []struct {
+		name    string
+		percent int
+	}{
+		{name: primaryVariant, percent: primaryPercent},
+		{name: canaryVariant, percent: canaryPercent},
+		{name: baselineVariant, percent: baselinePercent},
+	}
+
+	backends := make([]interface{}, 0, len(variants))
+	for _, v := range variants {
+		if v.percent <= 0 {
+			continue
+		}
+		backends = append(backends, map[string]interface{}{
+			"service": makeSuffixedName(service.Key.Name, suffixes[v.name]),
+			"weight":  v.percent,
+		})
+	}
+	if len(backends) == 0 {
+		return provider.Manifest{}, fmt.Errorf("traffic routing by SMI requires at least one variant receiving traffic")
+	}
+
+	metadata := map[string]interface{}{
+		"name": service.Key.Name,
+	}
+	if service.Key.Namespace != provider.DefaultNamespace {
+		metadata["namespace"] = service.Key.Namespace
+	}
+
+	return provider.ParseFromStructuredObject(map[string]interface{}{
+		"apiVersion": smiTrafficSplitAPIVersion,
+		"kind":       smiTrafficSplitKind,
+		"metadata":   metadata,
+		"spec": map[string]interface{}{
+			"service":  service.Key.Name,
+			"backends": backends,
+		},
+	})
+}
+
+// variantSuffixes returns the suffixes used to name the resources of each variant
+// by the rollout stages of the given pipeline, keyed by variant.
+func variantSuffixes(pipeline *config.DeploymentPipeline) map[string]string {
+	suffixes := map[string]string{
+		primaryVariant:  primaryVariant,
+		canaryVariant:   canaryVariant,
+		baselineVariant: baselineVariant,
+	}
+	if pipeline == nil {
+		return suffixes
+	}
+	for _, stage := range pipeline.Stages {
+		var variant, suffix string
+		switch {
+		case stage.K8sPrimaryRolloutStageOptions != nil:
+			variant, suffix = primaryVariant, stage.K8sPrimaryRolloutStageOptions.Suffix
+		case stage.K8sCanaryRolloutStageOptions != nil:
+			variant, suffix = canaryVariant, stage.K8sCanaryRolloutStageOptions.Suffix
+		case stage.K8sBaselineRolloutStageOptions != nil:
+			variant, suffix = baselineVariant, stage.K8sBaselineRolloutStageOptions.Suffix
+		}
+		if suffix != "" {
+			suffixes[variant] = suffix
+		}
+	}
+	return suffixes
+}
+
 func checkVariantSelectorInService(m provider.Manifest, variant string) error {
 	selector, err := m.GetNestedStringMap("spec", "selector")
 	if err != nil {
@@ -15,13 +15,17 @@
 package kubernetes
 
 import (
+	"encoding/json"
 	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	istiov1beta1 "istio.io/api/networking/v1beta1"
 
 	provider "github.com/pipe-cd/pipe/pkg/app/piped/cloudprovider/kubernetes"
+	"github.com/pipe-cd/pipe/pkg/config"
+	"github.com/pipe-cd/pipe/pkg/model"
 )
 
 func TestGenerateVirtualServiceManifest(t *testing.T) {
@@ -66,6 +70,184 @@ func TestGenerateVirtualServiceManifest(t *testing.T) {
 	}
 }
 
+func TestGenerateVirtualServiceManifestWeights(t *testing.T) {
+	manifests, err := provider.LoadManifestsFromYAMLFile("testdata/virtual-service.yaml")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(manifests))
+
+	generators := map[string]func(provider.Manifest, string, []string, int32, int32) (provider.Manifest, error){
+		"v1beta1":  generateVirtualServiceManifest,
+		"v1alpha3": generateVirtualServiceManifestV1Alpha3,
+	}
+	// The percentages of progressive steps.
+	steps := []struct {
+		canary   int32
+		baseline int32
+	}{
+		{canary: 0, baseline: 0},
+		{canary: 10, baseline: 0},
+		{canary: 25, baseline: 25},
+		{canary: 33, baseline: 33},
+		{canary: 100, baseline: 0},
+	}
+
+	for version, generate := range generators {
+		for _, step := range steps {
+			t.Run(fmt.Sprintf("%s canary=%d baseline=%d", version, step.canary, step.baseline), func(t *testing.T) {
+				generated, err := generate(manifests[0], "helloworld", nil, step.canary, step.baseline)
+				require.NoError(t, err)
+
+				spec, err := generated.GetSpec()
+				require.NoError(t, err)
+				data, err := json.Marshal(spec)
+				require.NoError(t, err)
+				vs := istiov1beta1.VirtualService{}
+				require.NoError(t, json.Unmarshal(data, &vs))
+
+				for _, http := range vs.Http {
+					var (
+						total          int32
+						variantWeights = make(map[string]int32)
+					)
+					for _, r := range http.Route {
+						total += r.Weight
+						if r.Destination.Host == "helloworld" {
+							variantWeights[r.Destination.Subset] = r.Weight
+						}
+					}
+					assert.Equal(t, int32(100), total, http.Name)
+					assert.Equal(t, 3, len(variantWeights), http.Name)
+
+					if http.Name == "include-destinations-for-all-variants" {
+						assert.Equal(t, map[string]int32{
+							primaryVariant:  100 - step.canary - step.baseline,
+							canaryVariant:   step.canary,
+							baselineVariant: step.baseline,
+						}, variantWeights)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestGenerateTrafficSplitManifest(t *testing.T) {
+	services, err := provider.ParseManifests(`
+apiVersion: v1
+kind: Service
+metadata:
+  name: helloworld
+  namespace: test-ns
+spec:
+  selector:
+    app: helloworld
+`)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(services))
+
+	testcases := []struct {
+		name             string
+		primary          int
+		canary           int
+		baseline         int
+		pipeline         *config.DeploymentPipeline
+		expectedBackends []interface{}
+		expectedErr      bool
+	}{
+		{
+			name:    "all to primary removes canary backend",
+			primary: 100,
+			expectedBackends: []interface{}{
+				map[string]interface{}{"service": "helloworld-primary", "weight": int64(100)},
+			},
+		},
+		{
+			name:    "split between primary and canary",
+			primary: 80,
+			canary:  20,
+			expectedBackends: []interface{}{
+				map[string]interface{}{"service": "helloworld-primary", "weight": int64(80)},
+				map[string]interface{}{"service": "helloworld-canary", "weight": int64(20)},
+			},
+		},
+		{
+			name:     "split among all variants",
+			primary:  50,
+			canary:   25,
+			baseline: 25,
+			expectedBackends: []interface{}{
+				map[string]interface{}{"service": "helloworld-primary", "weight": int64(50)},
+				map[string]interface{}{"service": "helloworld-canary", "weight": int64(25)},
+				map[string]interface{}{"service": "helloworld-baseline", "weight": int64(25)},
+			},
+		},
+		{
+			name:    "use the suffixes of the rollout stages",
+			primary: 50,
+			canary:  50,
+			pipeline: &config.DeploymentPipeline{
+				Stages: []config.PipelineStage{
+					{
+						Name: model.StageK8sCanaryRollout,
+						K8sCanaryRolloutStageOptions: &config.K8sCanaryRolloutStageOptions{
+							Suffix:        "next",
+							CreateService: true,
+						},
+					},
+					{
+						Name: model.StageK8sPrimaryRollout,
+						K8sPrimaryRolloutStageOptions: &config.K8sPrimaryRolloutStageOptions{
+							CreateService: true,
+						},
+					},
+				},
+			},
+			expectedBackends: []interface{}{
+				map[string]interface{}{"service": "helloworld-primary", "weight": int64(50)},
+				map[string]interface{}{"service": "helloworld-next", "weight": int64(50)},
+			},
+		},
+		{
+			name:        "no variant receives traffic",
+			expectedErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.KubernetesTrafficRouting{
+				Method: config.KubernetesTrafficRoutingMethodSMI,
+			}
+			e := &deployExecutor{
+				deployCfg: &config.KubernetesDeploymentSpec{
+					GenericDeploymentSpec: config.GenericDeploymentSpec{
+						Pipeline: tc.pipeline,
+					},
+				},
+			}
+			generated, err := e.generateTrafficRoutingManifest(services[0], tc.primary, tc.canary, tc.baseline, cfg)
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			assert.Equal(t, provider.ResourceKey{
+				APIVersion: "split.smi-spec.io/v1alpha2",
+				Kind:       "TrafficSplit",
+				Namespace:  "test-ns",
+				Name:       "helloworld",
+			}, generated.Key)
+
+			spec, err := generated.GetSpec()
+			require.NoError(t, err)
+			assert.Equal(t, map[string]interface{}{
+				"service":  "helloworld",
+				"backends": tc.expectedBackends,
+			}, spec)
+		})
+	}
+}
+
 func TestCheckVariantSelectorInService(t *testing.T) {
 	testcases := []struct {
 		name     string
@@ -21,10 +21,11 @@ import (
 )
 
 type exponential struct {
-	base  time.Duration
-	max   time.Duration
-	calls int
-	rand  *rand.Rand
+	base     time.Duration
+	max      time.Duration
+	calls    int
+	noJitter bool
+	rand     *rand.Rand
 }
 
 func NewExponential(base, max time.Duration) Backoff {
@@ -35,6 +36,16 @@ func NewExponential(base, max time.Duration) Backoff {
 	}
 }
 
+// NewExponentialWithoutJitter returns an exponential backoff
+// whose duration is exactly doubled after each call until reaching the max.
+func NewExponentialWithoutJitter(base, max time.Duration) Backoff {
+	return &exponential{
+		base:     base,
+		max:      max,
+		noJitter: true,
+	}
+}
+
 // Implemented FullJitter algorithm
 // https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
 func (b *exponential) Next() time.Duration {
@@ -45,6 +56,9 @@ func (b *exponential) Next() time.Duration {
 		return 0
 	}
 	d := math.Min(float64(b.max), float64(b.base)*math.Pow(2, float64(b.calls-1)))
+	if b.noJitter {
+		return time.Duration(d)
+	}
 	d *= b.rand.Float64()
 	return time.Duration(d)
 }
@@ -59,8 +73,9 @@ func (b *exponential) Reset() {
 
 func (b *exponential) Clone() Backoff {
 	return &exponential{
-		base: b.base,
-		max:  b.max,
-		rand: b.rand,
+		base:     b.base,
+		max:      b.max,
+		noJitter: b.noJitter,
+		rand:     b.rand,
 	}
 }
@@ -40,3 +40,24 @@ func TestExponential(t *testing.T) {
 	eb.Reset()
 	assert.Equal(t, 0, eb.Calls())
 }
+
+func TestExponentialWithoutJitter(t *testing.T) {
+	eb := NewExponentialWithoutJitter(time.Second, 10*time.Second)
+	expected := []time.Duration{
+		0,
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	}
+	for i, e := range expected {
+		assert.Equal(t, e, eb.Next(), fmt.Sprintf("i = %d", i))
+	}
+
+	cb := eb.Clone()
+	assert.Equal(t, 0, cb.Calls())
+	assert.Equal(t, time.Duration(0), cb.Next())
+	assert.Equal(t, time.Second, cb.Next())
+}
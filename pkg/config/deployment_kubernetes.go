@@ -14,6 +14,12 @@
 
 package config
 
+import (
+	"fmt"
+
+	"github.com/pipe-cd/pipe/pkg/model"
+)
+
 // KubernetesDeploymentSpec represents a deployment configuration for Kubernetes application.
 type KubernetesDeploymentSpec struct {
 	GenericDeploymentSpec
@@ -34,10 +40,79 @@ type KubernetesDeploymentSpec struct {
 	Workloads []K8sResourceReference `json:"workloads"`
 	// Which method should be used for traffic routing.
 	TrafficRouting *KubernetesTrafficRouting `json:"trafficRouting"`
+	// Which kinds of resources other than workloads should be healthy
+	// before the applied manifests are considered as ready.
+	HealthCheck K8sHealthCheck `json:"healthCheck"`
+	// List of kubectl commands to be run before and after the stages.
+	// e.g.
+	// - stage: K8S_PRIMARY_ROLLOUT
+	//   post:
+	//     - [rollout, restart, deployment/simple]
+	Hooks []K8sStageHook `json:"hooks"`
 }
 
 // Validate returns an error if any wrong configuration value was found.
 func (s *KubernetesDeploymentSpec) Validate() error {
+	for _, c := range s.HealthCheck.CustomResources {
+		if c.Kind == "" {
+			return fmt.Errorf("kind of custom resource health check must be set")
+		}
+		if c.Path == "" {
+			return fmt.Errorf("path of custom resource health check for %s must be set", c.Kind)
+		}
+	}
+	for _, h := range s.Hooks {
+		if h.Stage == "" {
+			return fmt.Errorf("stage of hook must be set")
+		}
+		for _, commands := range [][][]string{h.Pre, h.Post} {
+			for _, args := range commands {
+				if len(args) == 0 {
+					return fmt.Errorf("command of hook for %s must not be empty", h.Stage)
+				}
+			}
+		}
+	}
+	if err := s.QuickSync.PruneMode.validate(); err != nil {
+		return err
+	}
+	if s.Pipeline != nil {
+		for _, stage := range s.Pipeline.Stages {
+			if stage.K8sPrimaryRolloutStageOptions == nil {
+				continue
+			}
+			if err := stage.K8sPrimaryRolloutStageOptions.PruneMode.validate(); err != nil {
+				return err
+			}
+		}
+		if DetermineKubernetesTrafficRoutingMethod(s.TrafficRouting) == KubernetesTrafficRoutingMethodSMI {
+			if err := s.Pipeline.validateVariantServices(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateVariantServices returns an error if any rollout stage of the pipeline
+// does not create the service of its variant which a TrafficSplit of SMI routes the traffic to.
+func (p *DeploymentPipeline) validateVariantServices() error {
+	for _, stage := range p.Stages {
+		var createService bool
+		switch {
+		case stage.K8sPrimaryRolloutStageOptions != nil:
+			createService = stage.K8sPrimaryRolloutStageOptions.CreateService
+		case stage.K8sCanaryRolloutStageOptions != nil:
+			createService = stage.K8sCanaryRolloutStageOptions.CreateService
+		case stage.K8sBaselineRolloutStageOptions != nil:
+			createService = stage.K8sBaselineRolloutStageOptions.CreateService
+		default:
+			continue
+		}
+		if !createService {
+			return fmt.Errorf("createService of %s stage must be enabled to route traffic by smi", stage.Name)
+		}
+	}
 	return nil
 }
 
@@ -48,6 +123,12 @@ type KubernetesDeploymentInput struct {
 	Manifests []string `json:"manifests"`
 	// Version of kubectl will be used.
 	KubectlVersion string `json:"kubectlVersion"`
+	// The path to the kubeconfig file used to connect to the target cluster.
+	// Empty means the default one of kubectl is used, e.g. $KUBECONFIG or in-cluster.
+	KubeConfigPath string `json:"kubeConfigPath"`
+	// The name of the context in the kubeconfig file used to connect to the target cluster.
+	// Empty means the current context is used.
+	KubeContext string `json:"kubeContext"`
 
 	// Version of kustomize will be used.
 	KustomizeVersion string `json:"kustomizeVersion"`
@@ -63,6 +144,35 @@ type KubernetesDeploymentInput struct {
 
 	// The namespace where manifests will be applied.
 	Namespace string `json:"namespace"`
+	// Whether the namespace of all namespaced resources should be overridden
+	// by the above one even when they specify another namespace.
+	// Cluster-scoped resources are left as they are.
+	ForceNamespace bool `json:"forceNamespace"`
+	// Whether the above namespace should be created when it does not exist.
+	// Keep this disabled when the namespaces are managed outside of piped.
+	// Default is false.
+	CreateNamespace bool `json:"createNamespace"`
+	// Whether the manifests should be applied by using server-side apply
+	// to not clobber the fields managed by the other controllers.
+	// Default is false.
+	ServerSideApply bool `json:"serverSideApply"`
+	// Whether the ownership of the fields owned by the other managers should be taken
+	// when server-side apply reports conflicts. Otherwise the apply fails on conflicts.
+	// Default is false.
+	ForceConflicts bool `json:"forceConflicts"`
+	// The name of the field manager used by server-side apply, e.g. "piped-production",
+	// to scope the ownership of the applied fields when several pipeds manage the same cluster.
+	// Default is "piped".
+	FieldManager string `json:"fieldManager"`
+	// Whether only the resources whose live state differs from their manifests should be applied.
+	// The unchanged resources are skipped, so they keep the commit hash of their last change.
+	// Default is false.
+	IncrementalApply bool `json:"incrementalApply"`
+	// The image tags or digests overriding the ones in the manifests, keyed by image name
+	// without tag and digest, e.g. "gcr.io/pipecd/helloworld": "v0.2.0".
+	// A digest value must be prefixed with "sha256:". It is applied to the containers
+	// and initContainers of all workloads, the other containers are left as they are.
+	ImageOverrides map[string]string `json:"imageOverrides"`
 
 	// Automatically reverts all deployment changes on failure.
 	// Default is true.
@@ -92,6 +202,8 @@ type InputHelmOptions struct {
 	ValueFiles []string `json:"valueFiles"`
 	// List of file path for values.
 	SetFiles map[string]string
+	// List of values to override the ones in the value files, e.g. "image.tag": "v1.0.0".
+	SetValues map[string]string `json:"setValues"`
 }
 
 type KubernetesTrafficRoutingMethod string
@@ -131,17 +243,93 @@ type IstioTrafficRouting struct {
 	VirtualService K8sResourceReference `json:"virtualService"`
 }
 
+// K8sHealthCheck configures the health checks of the applied resources other than workloads.
+type K8sHealthCheck struct {
+	// Whether the applied Services should have at least one ready endpoint.
+	// Default is false.
+	Services bool `json:"services"`
+	// Whether the applied Ingresses should have an assigned address.
+	// Default is false.
+	Ingresses bool `json:"ingresses"`
+	// List of conditions for the applied custom resources to be considered ready.
+	// The custom resources not matching any of them are considered ready once applied.
+	CustomResources []K8sCustomResourceHealthCheck `json:"customResources"`
+}
+
+// K8sCustomResourceHealthCheck represents a status condition
+// the custom resources of a kind must satisfy to be considered ready.
+type K8sCustomResourceHealthCheck struct {
+	// The apiVersion of the custom resources.
+	// Empty means all versions of the kind.
+	APIVersion string `json:"apiVersion"`
+	// The kind of the custom resources.
+	Kind string `json:"kind"`
+	// The JSONPath to the field of the live resource to be evaluated.
+	// e.g. {.status.phase} or status.phase
+	Path string `json:"path"`
+	// The value the field must have to be considered ready.
+	// e.g. Running
+	Value string `json:"value"`
+}
+
+// K8sStageHook represents the kubectl commands run before and after a stage.
+// The commands are run against the cluster and namespace of the application.
+type K8sStageHook struct {
+	// The name of the stage, e.g. K8S_PRIMARY_ROLLOUT.
+	Stage model.Stage `json:"stage"`
+	// List of the arguments of kubectl commands run in order before the stage.
+	Pre [][]string `json:"pre"`
+	// List of the arguments of kubectl commands run in order after the stage completed successfully.
+	Post [][]string `json:"post"`
+}
+
 type K8sResourceReference struct {
 	Kind string `json:"kind"`
 	Name string `json:"name"`
 }
 
+type K8sPruneMode string
+
+const (
+	// K8sPruneModeApplication prunes all live resources of the application
+	// that are no longer defined in Git.
+	K8sPruneModeApplication K8sPruneMode = "application"
+	// K8sPruneModeCommit prunes only the live resources that are no longer defined in Git
+	// and whose commit hash annotation is set to a commit other than the deploying one.
+	// The resources not applied by piped and the ones applied at the deploying commit,
+	// e.g. by the other deployments sharing the same application label, are kept.
+	K8sPruneModeCommit K8sPruneMode = "commit"
+)
+
+func (m K8sPruneMode) validate() error {
+	switch m {
+	case "", K8sPruneModeApplication, K8sPruneModeCommit:
+		return nil
+	default:
+		return fmt.Errorf("unsupported prune mode %q, must be %q or %q", m, K8sPruneModeApplication, K8sPruneModeCommit)
+	}
+}
+
 // K8sSyncStageOptions contains all configurable values for a K8S_SYNC stage.
 type K8sSyncStageOptions struct {
 	// Whether the PRIMARY variant label should be added to manifests if they were missing.
 	AddVariantLabelToSelector bool `json:"addVariantLabelToSelector"`
 	// Whether the resources that are no longer defined in Git should be removed or not.
 	Prune bool `json:"prune"`
+	// The maximum number of resources that can be removed at once while pruning.
+	// An integer value can be specified to indicate an absolute number of resources.
+	// Or a string suffixed by "%" to indicate a percentage value (rounded down) compared to the number of currently managed resources.
+	// Pruning is refused when more resources would be removed. Default is no limit.
+	PruneThreshold Replicas `json:"pruneThreshold"`
+	// How the resources to be pruned are determined.
+	// Default is "application".
+	PruneMode K8sPruneMode `json:"pruneMode"`
+	// Whether the manifests should be applied in server-side dry-run mode
+	// to only show what would be changed without mutating the cluster.
+	DryRun bool `json:"dryRun"`
+	// Whether the manifests should be validated against the schema of the cluster
+	// before applying them to fail without changing anything when some are invalid.
+	Validate bool `json:"validate"`
 }
 
 // K8sPrimaryRolloutStageOptions contains all configurable values for a K8S_PRIMARY_ROLLOUT stage.
@@ -155,6 +343,22 @@ type K8sPrimaryRolloutStageOptions struct {
 	AddVariantLabelToSelector bool `json:"addVariantLabelToSelector"`
 	// Whether the resources that are no longer defined in Git should be removed or not.
 	Prune bool `json:"prune"`
+	// The maximum number of resources that can be removed at once while pruning.
+	// An integer value can be specified to indicate an absolute number of resources.
+	// Or a string suffixed by "%" to indicate a percentage value (rounded down) compared to the number of currently managed resources.
+	// Pruning is refused when more resources would be removed. Default is no limit.
+	PruneThreshold Replicas `json:"pruneThreshold"`
+	// How the resources to be pruned are determined.
+	// Default is "application".
+	PruneMode K8sPruneMode `json:"pruneMode"`
+	// Whether to wait until the pruned resources are completely removed, e.g. their finalizers have run.
+	WaitForDeletion bool `json:"waitForDeletion"`
+	// The maximum duration to wait for the pruned resources to be removed.
+	// Default is 5m.
+	DeletionTimeout Duration `json:"deletionTimeout"`
+	// Whether the manifests should be validated against the schema of the cluster
+	// before applying them to fail without changing anything when some are invalid.
+	Validate bool `json:"validate"`
 }
 
 // K8sCanaryRolloutStageOptions contains all configurable values for a K8S_CANARY_ROLLOUT stage.
@@ -169,6 +373,21 @@ type K8sCanaryRolloutStageOptions struct {
 	Suffix string `json:"suffix"`
 	// Whether the CANARY service should be created.
 	CreateService bool `json:"createService"`
+	// The metrics to be checked after rolling out the CANARY variant.
+	// The stage fails when any of them is out of its expected range.
+	// Empty means the stage completes once the CANARY variant is ready.
+	Analysis *K8sCanaryAnalysis `json:"analysis"`
+}
+
+// K8sCanaryAnalysis contains the metrics of the CANARY variant
+// which must be within their expected ranges before going to the next stage.
+type K8sCanaryAnalysis struct {
+	// How long the metrics are sampled.
+	// Default is 5m.
+	Duration Duration `json:"duration"`
+	// List of the queries against the analysis providers configured in piped
+	// and their expected ranges, e.g. the error rate and the latency of the CANARY variant.
+	Metrics []AnalysisMetrics `json:"metrics"`
 }
 
 // K8sCanaryCleanStageOptions contains all configurable values for a K8S_CANARY_CLEAN stage.
@@ -187,10 +406,19 @@ type K8sBaselineRolloutStageOptions struct {
 	Suffix string `json:"suffix"`
 	// Whether the BASELINE service should be created.
 	CreateService bool `json:"createService"`
+	// Which workloads should be mirrored by the BASELINE variant.
+	// Empty means the workloads of the application. When they were not specified either,
+	// the application must contain exactly one Deployment.
+	Workloads []K8sResourceReference `json:"workloads"`
 }
 
 // K8sBaselineCleanStageOptions contains all configurable values for a K8S_BASELINE_CLEAN stage.
 type K8sBaselineCleanStageOptions struct {
+	// Whether to wait until the BASELINE resources are completely removed, e.g. their finalizers have run.
+	WaitForDeletion bool `json:"waitForDeletion"`
+	// The maximum duration to wait for the BASELINE resources to be removed.
+	// Default is 5m.
+	DeletionTimeout Duration `json:"deletionTimeout"`
 }
 
 // K8sTrafficRoutingStageOptions contains all configurable values for a K8S_TRAFFIC_ROUTING stage.
@@ -125,3 +125,172 @@ func TestKubernetesDeploymentConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestKubernetesDeploymentSpecValidate(t *testing.T) {
+	testcases := []struct {
+		name        string
+		spec        KubernetesDeploymentSpec
+		expectedErr bool
+	}{
+		{
+			name: "empty",
+			spec: KubernetesDeploymentSpec{},
+		},
+		{
+			name: "valid custom resource health check",
+			spec: KubernetesDeploymentSpec{
+				HealthCheck: K8sHealthCheck{
+					CustomResources: []K8sCustomResourceHealthCheck{
+						{Kind: "PostgresCluster", Path: "{.status.phase}", Value: "Running"},
+					},
+				},
+			},
+		},
+		{
+			name: "missing kind",
+			spec: KubernetesDeploymentSpec{
+				HealthCheck: K8sHealthCheck{
+					CustomResources: []K8sCustomResourceHealthCheck{
+						{Path: "{.status.phase}", Value: "Running"},
+					},
+				},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "missing path",
+			spec: KubernetesDeploymentSpec{
+				HealthCheck: K8sHealthCheck{
+					CustomResources: []K8sCustomResourceHealthCheck{
+						{Kind: "PostgresCluster", Value: "Running"},
+					},
+				},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "valid hook",
+			spec: KubernetesDeploymentSpec{
+				Hooks: []K8sStageHook{
+					{
+						Stage: model.StageK8sPrimaryRollout,
+						Post:  [][]string{{"rollout", "restart", "deployment/simple"}},
+					},
+				},
+			},
+		},
+		{
+			name: "missing hook stage",
+			spec: KubernetesDeploymentSpec{
+				Hooks: []K8sStageHook{
+					{
+						Post: [][]string{{"rollout", "restart", "deployment/simple"}},
+					},
+				},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "empty hook command",
+			spec: KubernetesDeploymentSpec{
+				Hooks: []K8sStageHook{
+					{
+						Stage: model.StageK8sPrimaryRollout,
+						Pre:   [][]string{{}},
+					},
+				},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "commit prune mode",
+			spec: KubernetesDeploymentSpec{
+				QuickSync: K8sSyncStageOptions{
+					PruneMode: K8sPruneModeCommit,
+				},
+			},
+		},
+		{
+			name: "unsupported prune mode",
+			spec: KubernetesDeploymentSpec{
+				QuickSync: K8sSyncStageOptions{
+					PruneMode: "label",
+				},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "unsupported prune mode of primary rollout",
+			spec: KubernetesDeploymentSpec{
+				GenericDeploymentSpec: GenericDeploymentSpec{
+					Pipeline: &DeploymentPipeline{
+						Stages: []PipelineStage{
+							{
+								Name: model.StageK8sPrimaryRollout,
+								K8sPrimaryRolloutStageOptions: &K8sPrimaryRolloutStageOptions{
+									PruneMode: "label",
+								},
+							},
+						},
+					},
+				},
+			},
+			expectedErr: true,
+		},
+		{
+			name: "smi with the services of all variants",
+			spec: KubernetesDeploymentSpec{
+				GenericDeploymentSpec: GenericDeploymentSpec{
+					Pipeline: &DeploymentPipeline{
+						Stages: []PipelineStage{
+							{
+								Name:                         model.StageK8sCanaryRollout,
+								K8sCanaryRolloutStageOptions: &K8sCanaryRolloutStageOptions{CreateService: true},
+							},
+							{
+								Name:                          model.StageK8sTrafficRouting,
+								K8sTrafficRoutingStageOptions: &K8sTrafficRoutingStageOptions{},
+							},
+							{
+								Name:                          model.StageK8sPrimaryRollout,
+								K8sPrimaryRolloutStageOptions: &K8sPrimaryRolloutStageOptions{CreateService: true},
+							},
+						},
+					},
+				},
+				TrafficRouting: &KubernetesTrafficRouting{
+					Method: KubernetesTrafficRoutingMethodSMI,
+				},
+			},
+		},
+		{
+			name: "smi without the service of primary variant",
+			spec: KubernetesDeploymentSpec{
+				GenericDeploymentSpec: GenericDeploymentSpec{
+					Pipeline: &DeploymentPipeline{
+						Stages: []PipelineStage{
+							{
+								Name:                         model.StageK8sCanaryRollout,
+								K8sCanaryRolloutStageOptions: &K8sCanaryRolloutStageOptions{CreateService: true},
+							},
+							{
+								Name:                          model.StageK8sPrimaryRollout,
+								K8sPrimaryRolloutStageOptions: &K8sPrimaryRolloutStageOptions{},
+							},
+						},
+					},
+				},
+				TrafficRouting: &KubernetesTrafficRouting{
+					Method: KubernetesTrafficRoutingMethodSMI,
+				},
+			},
+			expectedErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.spec.Validate()
+			assert.Equal(t, tc.expectedErr, err != nil)
+		})
+	}
+}
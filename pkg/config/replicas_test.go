@@ -125,3 +125,48 @@ func TestReplicasUnmarshal(t *testing.T) {
 		})
 	}
 }
+
+func TestReplicasCalculate(t *testing.T) {
+	testcases := []struct {
+		name     string
+		replicas Replicas
+		total    int
+		expected int
+	}{
+		{
+			name:     "unspecified",
+			total:    10,
+			expected: 1,
+		},
+		{
+			name:     "absolute number",
+			replicas: Replicas{Number: 3},
+			total:    10,
+			expected: 3,
+		},
+		{
+			name:     "exact percentage",
+			replicas: Replicas{Number: 20, IsPercentage: true},
+			total:    10,
+			expected: 2,
+		},
+		{
+			name:     "percentage rounded up",
+			replicas: Replicas{Number: 25, IsPercentage: true},
+			total:    10,
+			expected: 3,
+		},
+		{
+			name:     "small percentage rounded up to one",
+			replicas: Replicas{Number: 1, IsPercentage: true},
+			total:    10,
+			expected: 1,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := tc.replicas.Calculate(tc.total, 1)
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
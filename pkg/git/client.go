@@ -15,59 +15,240 @@
 package git
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"go.uber.org/zap"
+
+	"github.com/pipe-cd/pipe/pkg/backoff"
+)
+
+// sleep is replaceable in tests to avoid waiting in real time.
+var sleep = sleepContext
+
+// sleepContext waits for the given duration
+// or returns the error of the given context when it is done before that.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+const (
+	// defaultRateLimitDelay is the delay before retrying a rate-limited command
+	// when the remote did not tell how long to wait.
+	defaultRateLimitDelay = 30 * time.Second
+	// maxRateLimitDelay is the longest delay to wait for a rate limit to be reset.
+	// Longer ones are left to the caller by returning ErrRateLimited.
+	maxRateLimitDelay = 5 * time.Minute
+)
+
+const (
+	sshAskpassFilename  = ".ssh-askpass"
+	sshKeyPassphraseEnv = "PIPED_GIT_SSH_KEY_PASSPHRASE"
+	sshAskpassScript    = "#!/bin/sh\nprintf '%s\\n' \"$" + sshKeyPassphraseEnv + "\"\n"
+)
+
+var (
+	// ErrDestinationNotEmpty is returned when the destination given to Clone
+	// already exists and is not empty, or is used by another call of Clone.
+	ErrDestinationNotEmpty = errors.New("destination is not empty")
+	// ErrDestinationNotAllowed is returned when the destination is outside of
+	// the workspace root given by WithWorkspaceRoot.
+	ErrDestinationNotAllowed = errors.New("destination is not allowed")
+	// ErrUnsignedCommit is returned when the checked out commit has no valid signature
+	// of an allowed key while WithRequireSignedCommit is configured.
+	ErrUnsignedCommit = errors.New("commit is not signed by an allowed key")
 )
 
 // Client is a git client for cloning/fetching git repo.
 // It keeps a local cache for faster future cloning.
 type Client interface {
 	// Clone clones a specific git repository to the given destination.
+	// The destination must be an empty or non-existent directory and must not be
+	// shared by concurrent calls, otherwise ErrDestinationNotEmpty is returned.
+	// A temporary directory is used when the destination is empty.
 	Clone(ctx context.Context, repoID, remote, branch, destination string) (Repo, error)
+	// CleanRepo removes the cache of a specific repository
+	// to force cloning it from the remote again.
+	CleanRepo(repoID string) error
+	// GetLatestRemoteHashesForBranches returns the hashes of the latest commits
+	// of the given remote branches keyed by branch name.
+	// The branches not found in the remote are not included.
+	GetLatestRemoteHashesForBranches(ctx context.Context, remote string, branches []string) (map[string]string, error)
+	// GetLatestRemoteHashForTag returns the hash of the commit a remote tag points to.
+	// ErrTagNotFound is returned when the tag does not exist in the remote.
+	GetLatestRemoteHashForTag(ctx context.Context, remote, tag string) (string, error)
+	// GitVersion returns the version of git used by this client.
+	GitVersion() string
+	// CacheStats returns the number of repositories held in the cache directory
+	// and the total size of the directory in bytes.
+	CacheStats() (repos int, totalBytes int64, err error)
 	// Clean removes all cache data.
+	// When the cache directory was given by WithCacheDir only the repositories
+	// cloned by this client are removed.
 	Clean() error
 }
 
 type client struct {
-	username  string
-	email     string
-	gitPath   string
-	cacheDir  string
-	mu        sync.Mutex
-	repoLocks map[string]*sync.Mutex
-	logger    *zap.Logger
+	username         string
+	email            string
+	sshKeyFile       string
+	sshKeyPassphrase string
+	token            string
+	secrets          []string
+	retries          int
+	retryInterval    time.Duration
+	commandTimeout   time.Duration
+	maxConcurrency   int
+	backoff          func() backoff.Backoff
+	metrics          MetricsRecorder
+	gitPath          string
+	gitVersion       gitVersion
+	minGitVersion    string
+	gitEnvs          []string
+	envs             map[string]string
+	gitConfigs       map[string]string
+	upstreams        map[string]string
+	gitConfigArgs    []string
+	runner           commandRunner
+	cacheDir         string
+	workspaceRoot    string
+	persistentCache  bool
+	depth            int
+	shallowSince     time.Time
+	sparsePaths      []string
+	singleBranch     bool
+	submodules       bool
+	lfs              bool
+	signedCommit     bool
+	allowedSigners   string
+	prune            bool
+	fetchTags        bool
+	cacheLimit       int64
+	repoAccessTimes  map[string]time.Time
+	busyRepos        map[string]int
+	clonedRepos      map[string]struct{}
+	destinations     map[string]struct{}
+	mu               sync.Mutex
+	repoLocks        map[string]chan struct{}
+	commandSlots     chan struct{}
+	logger           *zap.Logger
 }
 
 // NewClient creates a new CLient instance for cloning git repositories.
 // After using Clean should be called to delete cache data.
-func NewClient(username, email string, logger *zap.Logger) (Client, error) {
+func NewClient(username, email string, logger *zap.Logger, opts ...Option) (Client, error) {
 	gitPath, err := exec.LookPath("git")
 	if err != nil {
 		return nil, fmt.Errorf("unable to find the path of git: %v", err)
 	}
 
-	cacheDir, err := ioutil.TempDir("", "gitcache")
-	if err != nil {
-		return nil, fmt.Errorf("unable to create a temporary directory for git cache: %v", err)
+	c := &client{
+		username:        username,
+		email:           email,
+		retries:         3,
+		retryInterval:   time.Second,
+		prune:           true,
+		fetchTags:       true,
+		envs:            map[string]string{"GIT_TERMINAL_PROMPT": "0"},
+		minGitVersion:   defaultMinGitVersion,
+		metrics:         nopMetricsRecorder{},
+		gitPath:         gitPath,
+		clonedRepos:     make(map[string]struct{}),
+		destinations:    make(map[string]struct{}),
+		repoAccessTimes: make(map[string]time.Time),
+		busyRepos:       make(map[string]int),
+		repoLocks:       make(map[string]chan struct{}),
+		logger:          logger,
+	}
+	c.backoff = func() backoff.Backoff {
+		return backoff.NewConstant(c.retryInterval)
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.retries < 1 {
+		return nil, fmt.Errorf("the number of attempts must be at least 1 but got %d", c.retries)
+	}
+	// The git commands run before preparing the environment variables below
+	// do not need them so they are run without them unless a runner was given.
+	probeRunner := c.runner
+	if probeRunner == nil {
+		probeRunner = execRunner{gitPath: c.gitPath}
+	}
+	if err := c.validateGitVersion(probeRunner); err != nil {
+		return nil, err
+	}
+	if len(c.sparsePaths) > 0 && c.gitVersion.lessThan(gitVersion{major: 2, minor: 25}) {
+		return nil, fmt.Errorf("sparse checkout requires git 2.25 or later but got %s", c.gitVersion)
+	}
+	if c.signedCommit && c.gitVersion.lessThan(gitVersion{major: 2, minor: 34}) {
+		return nil, fmt.Errorf("verifying commit signatures requires git 2.34 or later but got %s", c.gitVersion)
+	}
+	c.gitConfigArgs = buildGitConfigArgs(c.gitConfigs)
+	c.gitEnvs = buildGitEnvs(c.envs)
+	if c.lfs {
+		if out, err := probeRunner.Run(context.Background(), "", "lfs", "version"); err != nil {
+			return nil, fmt.Errorf("git-lfs is required to fetch LFS files but was not available: %v", formatCommandError(err, out))
+		}
+	}
+
+	if c.persistentCache {
+		if err := os.MkdirAll(c.cacheDir, os.ModePerm); err != nil {
+			return nil, fmt.Errorf("unable to create the directory %s for git cache: %v", c.cacheDir, err)
+		}
+	} else {
+		cacheDir, err := ioutil.TempDir("", "gitcache")
+		if err != nil {
+			return nil, fmt.Errorf("unable to create a temporary directory for git cache: %v", err)
+		}
+		c.cacheDir = cacheDir
+	}
+
+	if c.sshKeyFile != "" {
+		if err := c.configureSSHKey(); err != nil {
+			c.Clean()
+			return nil, err
+		}
+	}
+	if c.token != "" {
+		if err := c.configureToken(); err != nil {
+			c.Clean()
+			return nil, err
+		}
+	}
+	if c.runner == nil {
+		c.runner = execRunner{
+			gitPath: c.gitPath,
+			envs:    c.gitEnvs,
+		}
+	}
+	if c.maxConcurrency > 0 {
+		c.commandSlots = make(chan struct{}, c.maxConcurrency)
 	}
 
-	return &client{
-		username:  username,
-		email:     email,
-		gitPath:   gitPath,
-		cacheDir:  cacheDir,
-		repoLocks: make(map[string]*sync.Mutex),
-		logger:    logger,
-	}, nil
+	return c, nil
 }
 
 // Clone clones a specific git repository to the given destination.
@@ -76,48 +257,136 @@ func (c *client) Clone(ctx context.Context, repoID, remote, branch, destination
 		repoCachePath = filepath.Join(c.cacheDir, repoID)
 		logger        = c.logger.With(
 			zap.String("repo-id", repoID),
-			zap.String("remote", remote),
+			zap.String("remote", c.redact(remote)),
 			zap.String("repo-cache-path", repoCachePath),
 		)
 	)
 
-	c.lockRepo(repoID)
+	// A local remote is validated here since retrying or fetching it would not help.
+	if path, ok := localRemotePath(remote); ok {
+		if _, err := os.Stat(path); err != nil {
+			logger.Error("failed to access the local repository", zap.Error(err))
+			return nil, fmt.Errorf("%w: unable to access the local repository: %v", ErrRepoNotFound, c.redact(err.Error()))
+		}
+	}
+
+	if destination != "" {
+		if err := c.validateDestination(destination); err != nil {
+			return nil, err
+		}
+		if err := c.reserveDestination(destination); err != nil {
+			return nil, err
+		}
+		defer c.releaseDestination(destination)
+	}
+
+	if err := c.lockRepo(ctx, repoID); err != nil {
+		return nil, fmt.Errorf("failed to lock the repository: %w", err)
+	}
 	defer c.unlockRepo(repoID)
 
+	c.mu.Lock()
+	c.repoAccessTimes[repoID] = time.Now()
+	c.mu.Unlock()
+
 	_, err := os.Stat(repoCachePath)
 	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
 
-	if os.IsNotExist(err) {
+	cached := !os.IsNotExist(err)
+	if cached {
+		// Cache hit. Do a git fetch to keep updated.
+		c.logger.Info(fmt.Sprintf("fetching %s to update the cache", repoID))
+		c.metrics.CacheHit(repoID)
+		args := []string{"fetch"}
+		if c.singleBranch && branch != "" {
+			// The mirror is configured to fetch all refs
+			// so we have to specify the branch explicitly.
+			// Only the tags pointing into the branch are followed in that case
+			// so all tags are fetched explicitly to keep them fresh.
+			if c.prune {
+				args = append(args, "--prune")
+			}
+			if c.fetchTags {
+				args = append(args, "--tags")
+			} else {
+				args = append(args, "--no-tags")
+			}
+			args = append(args, "origin", fmt.Sprintf("+refs/heads/%s:refs/heads/%s", branch, branch))
+		} else if c.prune {
+			args = append(args, "--prune", "--prune-tags")
+		}
+		out, err := c.retryRemoteCommand(ctx, OperationFetch, remote, c.logger, func() ([]byte, error) {
+			return c.runGitCommand(ctx, repoCachePath, args...)
+		})
+		switch {
+		case err == nil:
+		case isCorruptedRepoOutput(out):
+			// The cache was broken, e.g. a previous fetch was killed,
+			// so we remove it and clone from the remote again.
+			logger.Warn("the cached repository is corrupted, going to clone again",
+				zap.String("out", c.redact(string(out))),
+				zap.Error(err),
+			)
+			if err := os.RemoveAll(repoCachePath); err != nil {
+				return nil, err
+			}
+			c.mu.Lock()
+			delete(c.clonedRepos, repoCachePath)
+			c.mu.Unlock()
+			cached = false
+		default:
+			logger.Error("failed to fetch from remote",
+				zap.String("out", c.redact(string(out))),
+				zap.Error(err),
+			)
+			return nil, fmt.Errorf("failed to fetch: %w", wrapCommandError(err, out))
+		}
+	}
+
+	if !cached {
 		// Cache miss, clone for the first time.
 		logger.Info(fmt.Sprintf("cloning %s for the first time", repoID))
+		c.metrics.CacheMiss(repoID)
+		c.evictCache()
 		if err := os.MkdirAll(filepath.Dir(repoCachePath), os.ModePerm); err != nil && !os.IsExist(err) {
 			return nil, err
 		}
-		out, err := retryCommand(3, time.Second, logger, func() ([]byte, error) {
-			return c.runGitCommand(ctx, "", "clone", "--mirror", remote, repoCachePath)
-		})
-		if err != nil {
-			logger.Error("failed to clone from remote",
-				zap.String("out", string(out)),
-				zap.Error(err),
-			)
-			return nil, fmt.Errorf("failed to clone from remote: %v", err)
+		args := []string{"clone", "--mirror"}
+		if c.singleBranch && branch != "" {
+			args = append(args, "--single-branch", "--branch", branch)
 		}
-	} else {
-		// Cache hit. Do a git fetch to keep updated.
-		c.logger.Info(fmt.Sprintf("fetching %s to update the cache", repoID))
-		out, err := retryCommand(3, time.Second, c.logger, func() ([]byte, error) {
-			return c.runGitCommand(ctx, repoCachePath, "fetch")
+		if upstream, ok := c.upstreams[repoID]; ok {
+			// Borrow the objects from the upstream to reduce the amount of data transferred.
+			// They are copied into the cache with --dissociate so the cache does not
+			// depend on the reference which may be updated concurrently.
+			referencePath, err := c.updateReferenceRepo(ctx, upstream)
+			if err != nil {
+				logger.Warn("failed to update the reference repository, going to clone without it", zap.Error(err))
+			} else {
+				args = append(args, "--reference-if-able", referencePath, "--dissociate")
+			}
+		}
+		args = append(args, remote, repoCachePath)
+		out, err := c.retryRemoteCommand(ctx, OperationClone, remote, logger, func() ([]byte, error) {
+			out, err := c.runGitCommand(ctx, "", args...)
+			if err != nil {
+				// Remove the partially-created cache to not be treated as a cache hit.
+				os.RemoveAll(repoCachePath)
+			}
+			return out, err
 		})
 		if err != nil {
-			logger.Error("failed to fetch from remote",
-				zap.String("out", string(out)),
+			logger.Error("failed to clone from remote",
+				zap.String("out", c.redact(string(out))),
 				zap.Error(err),
 			)
-			return nil, fmt.Errorf("failed to fetch: %v", err)
+			return nil, fmt.Errorf("failed to clone from remote: %w", wrapCommandError(err, out))
 		}
+		c.mu.Lock()
+		c.clonedRepos[repoCachePath] = struct{}{}
+		c.mu.Unlock()
 	}
 
 	if destination != "" {
@@ -133,21 +402,65 @@ func (c *client) Clone(ctx context.Context, repoID, remote, branch, destination
 	}
 
 	args := []string{"clone"}
+	if c.lfs {
+		// LFS files can not be downloaded from the cache
+		// so we skip them here and pull them from the remote later.
+		args = []string{
+			"-c", "filter.lfs.smudge=git-lfs smudge --skip -- %f",
+			"-c", "filter.lfs.process=git-lfs filter-process --skip",
+			"clone",
+		}
+	}
 	if branch != "" {
 		args = append(args, "-b", branch)
 	}
-	args = append(args, repoCachePath, destination)
+	source := repoCachePath
+	if c.depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(c.depth))
+	}
+	if !c.shallowSince.IsZero() {
+		// Git treats a number with more than 8 digits as seconds since the epoch.
+		args = append(args, "--shallow-since", strconv.FormatInt(c.shallowSince.Unix(), 10))
+	}
+	if c.depth > 0 || !c.shallowSince.IsZero() {
+		// The shallow options are ignored in local clones unless the file:// protocol is used.
+		source = "file://" + repoCachePath
+	}
+	if len(c.sparsePaths) > 0 {
+		// Only the files at the top level are checked out here,
+		// the configured directories are added after cloning.
+		args = append(args, "--sparse")
+	}
+	args = append(args, source, destination)
 	if out, err := c.runGitCommand(ctx, "", args...); err != nil {
 		logger.Error("failed to clone from local",
-			zap.String("out", string(out)),
+			zap.String("out", c.redact(string(out))),
 			zap.String("branch", branch),
 			zap.String("repo-path", destination),
 			zap.Error(err),
 		)
-		return nil, fmt.Errorf("failed to clone from local: %v", err)
+		return nil, fmt.Errorf("failed to clone from local: %w", wrapCommandError(err, out))
 	}
 
 	r := NewRepo(destination, c.gitPath, remote, branch)
+	r.gitEnvs = c.gitEnvs
+	r.gitConfigArgs = c.gitConfigArgs
+	r.runner = c.runner
+
+	// The signature is verified before anything else, e.g. submodules,
+	// is fetched according to the content of the commit.
+	if c.signedCommit {
+		if err := r.verifyCommitSignature(ctx, "HEAD", c.allowedSigners); err != nil {
+			logger.Error("failed to verify the commit signature",
+				zap.String("branch", branch),
+				zap.Error(err),
+			)
+			// Remove the checkout to not let the unverified content be used by mistake.
+			r.Clean()
+			return nil, err
+		}
+	}
+
 	if c.username != "" || c.email != "" {
 		if err := r.setUser(ctx, c.username, c.email); err != nil {
 			return nil, fmt.Errorf("failed to set user: %v", err)
@@ -161,65 +474,646 @@ func (c *client) Clone(ctx context.Context, repoID, remote, branch, destination
 		return nil, fmt.Errorf("failed to set remote: %v", err)
 	}
 
+	if len(c.sparsePaths) > 0 {
+		if err := r.setSparseCheckout(ctx, c.sparsePaths); err != nil {
+			return nil, fmt.Errorf("failed to set sparse checkout: %w", err)
+		}
+	}
+
+	// Submodules are initialized after correcting the remote
+	// because their relative urls are resolved from the remote url of origin.
+	if c.submodules {
+		if err := r.updateSubmodules(ctx); err != nil {
+			return nil, fmt.Errorf("failed to update submodules: %w", err)
+		}
+	}
+
+	if c.lfs {
+		if err := r.pullLFS(ctx); err != nil {
+			return nil, fmt.Errorf("failed to pull LFS files: %w", err)
+		}
+	}
+
 	return r, nil
 }
 
+// CleanRepo removes the cache of a specific repository
+// to force cloning it from the remote again.
+func (c *client) CleanRepo(repoID string) error {
+	if err := c.lockRepo(context.Background(), repoID); err != nil {
+		return err
+	}
+	defer c.unlockRepo(repoID)
+
+	repoCachePath := filepath.Join(c.cacheDir, repoID)
+	if err := os.RemoveAll(repoCachePath); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	delete(c.repoAccessTimes, repoID)
+	delete(c.clonedRepos, repoCachePath)
+	c.mu.Unlock()
+	return nil
+}
+
+// GitVersion returns the version of git used by this client.
+func (c *client) GitVersion() string {
+	return c.gitVersion.String()
+}
+
+// CacheStats returns the number of repositories held in the cache directory
+// and the total size of the directory in bytes.
+// The reference repositories are included in the size but not in the number of repositories.
+// The lock is not held while walking to not block the other operations, and repositories
+// may be cloned, fetched or evicted concurrently, so the result is an approximation.
+func (c *client) CacheStats() (repos int, totalBytes int64, err error) {
+	c.mu.Lock()
+	cacheDir := c.cacheDir
+	c.mu.Unlock()
+
+	err = filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The file might be removed by a concurrent command, e.g. git gc.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			totalBytes += info.Size()
+			return nil
+		}
+		if path != cacheDir && isBareRepo(path) && !isReferencePath(cacheDir, path) {
+			repos++
+		}
+		return nil
+	})
+	return
+}
+
+// isBareRepo reports whether the given directory looks like a bare repository
+// such as the mirrors stored in the cache.
+func isBareRepo(dir string) bool {
+	if info, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil || info.IsDir() {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(dir, "objects"))
+	return err == nil && info.IsDir()
+}
+
+func isReferencePath(cacheDir, path string) bool {
+	rel, err := filepath.Rel(cacheDir, path)
+	if err != nil {
+		return false
+	}
+	return rel == referencesDirName || strings.HasPrefix(rel, referencesDirName+string(filepath.Separator))
+}
+
 // Clean removes all cache data.
+// When the cache directory was given by WithCacheDir only the repositories
+// cloned by this client are removed.
 func (c *client) Clean() error {
-	return os.RemoveAll(c.cacheDir)
+	if !c.persistentCache {
+		return os.RemoveAll(c.cacheDir)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	paths := []string{filepath.Join(c.cacheDir, sshAskpassFilename)}
+	for p := range c.clonedRepos {
+		paths = append(paths, p)
+	}
+	for _, p := range paths {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	c.clonedRepos = make(map[string]struct{})
+	return nil
 }
 
 // getLatestRemoteHashForBranch returns the hash of the latest commit of a remote branch.
 func (c *client) getLatestRemoteHashForBranch(ctx context.Context, remote, branch string) (string, error) {
 	ref := "refs/heads/" + branch
-	out, err := retryCommand(3, time.Second, c.logger, func() ([]byte, error) {
-		return c.runGitCommand(ctx, "", "ls-remote", ref)
+	out, err := c.retryRemoteCommand(ctx, OperationLsRemote, remote, c.logger, func() ([]byte, error) {
+		return c.runGitCommand(ctx, "", "ls-remote", remote, ref)
 	})
 	if err != nil {
 		c.logger.Error("failed to get latest remote hash for branch",
-			zap.String("remote", remote),
+			zap.String("remote", c.redact(remote)),
 			zap.String("branch", branch),
-			zap.String("out", string(out)),
+			zap.String("out", c.redact(string(out))),
+			zap.Error(err),
+		)
+		return "", wrapCommandError(err, out)
+	}
+
+	hash, ok := parseLsRemoteOutput(string(out))[ref]
+	if !ok {
+		// A freshly created repository has no refs at all,
+		// tell it apart from a missing branch.
+		if empty, err := c.isEmptyRemote(ctx, remote); err == nil && empty {
+			return "", fmt.Errorf("%w: %s has no commits yet", ErrEmptyRepository, c.redact(remote))
+		}
+		return "", fmt.Errorf("%w: %s was not found in remote %s", ErrBranchNotFound, branch, c.redact(remote))
+	}
+	return hash, nil
+}
+
+// isEmptyRemote reports whether the remote repository has no refs.
+func (c *client) isEmptyRemote(ctx context.Context, remote string) (bool, error) {
+	out, err := c.retryRemoteCommand(ctx, OperationLsRemote, remote, c.logger, func() ([]byte, error) {
+		return c.runGitCommand(ctx, "", "ls-remote", remote)
+	})
+	if err != nil {
+		return false, wrapCommandError(err, out)
+	}
+	return len(parseLsRemoteOutput(string(out))) == 0, nil
+}
+
+// GetLatestRemoteHashesForBranches returns the hashes of the latest commits
+// of the given remote branches by running a single ls-remote.
+// The branches not found in the remote are not included in the returned map.
+func (c *client) GetLatestRemoteHashesForBranches(ctx context.Context, remote string, branches []string) (map[string]string, error) {
+	hashes := make(map[string]string, len(branches))
+	if len(branches) == 0 {
+		return hashes, nil
+	}
+
+	args := []string{"ls-remote", "--heads", remote}
+	for _, b := range branches {
+		args = append(args, "refs/heads/"+b)
+	}
+	out, err := c.retryRemoteCommand(ctx, OperationLsRemote, remote, c.logger, func() ([]byte, error) {
+		return c.runGitCommand(ctx, "", args...)
+	})
+	if err != nil {
+		c.logger.Error("failed to get latest remote hashes for branches",
+			zap.String("remote", c.redact(remote)),
+			zap.Strings("branches", branches),
+			zap.String("out", c.redact(string(out))),
 			zap.Error(err),
 		)
+		return nil, wrapCommandError(err, out)
+	}
+
+	refs := parseLsRemoteOutput(string(out))
+	for _, b := range branches {
+		if hash, ok := refs["refs/heads/"+b]; ok {
+			hashes[b] = hash
+		}
+	}
+	return hashes, nil
+}
+
+// GetLatestRemoteHashForTag returns the hash of the commit a remote tag points to.
+// Annotated tags are dereferenced to the tagged commit.
+func (c *client) GetLatestRemoteHashForTag(ctx context.Context, remote, tag string) (string, error) {
+	var (
+		ref      = "refs/tags/" + tag
+		derefRef = ref + "^{}"
+	)
+	out, err := c.retryRemoteCommand(ctx, OperationLsRemote, remote, c.logger, func() ([]byte, error) {
+		return c.runGitCommand(ctx, "", "ls-remote", remote, ref, derefRef)
+	})
+	if err != nil {
+		c.logger.Error("failed to get latest remote hash for tag",
+			zap.String("remote", c.redact(remote)),
+			zap.String("tag", tag),
+			zap.String("out", c.redact(string(out))),
+			zap.Error(err),
+		)
+		return "", wrapCommandError(err, out)
+	}
+
+	// The output of an annotated tag contains both the tag object
+	// and the dereferenced commit, we prefer the commit one.
+	hashes := parseLsRemoteOutput(string(out))
+	if hash, ok := hashes[derefRef]; ok {
+		return hash, nil
+	}
+	if hash, ok := hashes[ref]; ok {
+		return hash, nil
+	}
+	return "", fmt.Errorf("%w: %s was not found in remote %s", ErrTagNotFound, tag, c.redact(remote))
+}
+
+// parseLsRemoteOutput returns a map from ref name to its hash
+// from the output of ls-remote command.
+func parseLsRemoteOutput(out string) map[string]string {
+	hashes := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.Split(strings.TrimSpace(line), "\t")
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		hashes[parts[1]] = parts[0]
+	}
+	return hashes
+}
+
+// evictCache removes the least recently used repositories from the cache
+// until its total size is under the limit.
+// Repositories being used or waited for by other goroutines are never removed.
+func (c *client) evictCache() {
+	if c.cacheLimit <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var (
+		total   int64
+		sizes   = make(map[string]int64, len(c.repoAccessTimes))
+		repoIDs = make([]string, 0, len(c.repoAccessTimes))
+	)
+	for repoID := range c.repoAccessTimes {
+		size, err := dirSize(filepath.Join(c.cacheDir, repoID))
+		if err != nil {
+			continue
+		}
+		sizes[repoID] = size
+		total += size
+		repoIDs = append(repoIDs, repoID)
+	}
+	sort.Slice(repoIDs, func(i, j int) bool {
+		return c.repoAccessTimes[repoIDs[i]].Before(c.repoAccessTimes[repoIDs[j]])
+	})
+
+	for _, repoID := range repoIDs {
+		if total <= c.cacheLimit {
+			return
+		}
+		if c.busyRepos[repoID] > 0 {
+			continue
+		}
+		repoCachePath := filepath.Join(c.cacheDir, repoID)
+		if err := os.RemoveAll(repoCachePath); err != nil {
+			c.logger.Error("failed to evict repository from cache",
+				zap.String("repo-id", repoID),
+				zap.Error(err),
+			)
+			continue
+		}
+		c.logger.Info(fmt.Sprintf("evicted %s from cache to keep the cache size under the limit", repoID))
+		total -= sizes[repoID]
+		delete(c.repoAccessTimes, repoID)
+		delete(c.clonedRepos, repoCachePath)
+	}
+}
+
+// validateDestination makes sure that the given destination is inside the workspace root
+// when it was specified. Symbolic links are resolved so they can not be used to escape.
+func (c *client) validateDestination(destination string) error {
+	if c.workspaceRoot == "" {
+		return nil
+	}
+	root, err := resolvePath(c.workspaceRoot)
+	if err != nil {
+		return fmt.Errorf("unable to resolve the workspace root %s: %v", c.workspaceRoot, err)
+	}
+	dest, err := resolvePath(destination)
+	if err != nil {
+		return fmt.Errorf("unable to resolve the destination %s: %v", destination, err)
+	}
+	rel, err := filepath.Rel(root, dest)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %s is not inside the workspace root %s", ErrDestinationNotAllowed, destination, c.workspaceRoot)
+	}
+	return nil
+}
+
+// resolvePath returns the absolute path of the given one with all symbolic links resolved.
+// The path may not exist, in that case the links in its deepest existing ancestor are resolved.
+func resolvePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
 		return "", err
 	}
-	parts := strings.Split(string(out), "\t")
-	return parts[0], nil
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(path)}, rest...)
+		path = parent
+	}
+}
+
+// reserveDestination marks the given destination as being cloned into
+// after making sure that it is empty and not being used by others.
+func (c *client) reserveDestination(destination string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.destinations[destination]; ok {
+		return fmt.Errorf("%w: %s is being cloned into by another", ErrDestinationNotEmpty, destination)
+	}
+	empty, err := isEmptyDir(destination)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("%w: %s", ErrDestinationNotEmpty, destination)
+	}
+	c.destinations[destination] = struct{}{}
+	return nil
+}
+
+func (c *client) releaseDestination(destination string) {
+	c.mu.Lock()
+	delete(c.destinations, destination)
+	c.mu.Unlock()
 }
 
-func (c *client) lockRepo(repoID string) {
+// lockRepo acquires the lock of the given repository.
+// It gives up and returns the context error when the context is done before acquiring.
+func (c *client) lockRepo(ctx context.Context, repoID string) error {
 	c.mu.Lock()
 	if _, ok := c.repoLocks[repoID]; !ok {
-		c.repoLocks[repoID] = &sync.Mutex{}
+		c.repoLocks[repoID] = make(chan struct{}, 1)
 	}
-	mu := c.repoLocks[repoID]
+	lock := c.repoLocks[repoID]
+	c.busyRepos[repoID]++
 	c.mu.Unlock()
 
-	mu.Lock()
+	select {
+	case lock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		c.busyRepos[repoID]--
+		c.mu.Unlock()
+		return ctx.Err()
+	}
 }
 
 func (c *client) unlockRepo(repoID string) {
 	c.mu.Lock()
-	c.repoLocks[repoID].Unlock()
+	<-c.repoLocks[repoID]
+	c.busyRepos[repoID]--
 	c.mu.Unlock()
 }
 
+// isEmptyDir reports whether the given directory is empty or does not exist.
+func isEmptyDir(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// configureSSHKey validates the specified private SSH key and prepares
+// the environment variables to make git use that key for all commands.
+// Unlike AddSSHConfig, which appends a host entry to the shared ssh config file of piped,
+// this keeps the key and its passphrase scoped to the git commands run by this client.
+func (c *client) configureSSHKey() error {
+	if _, err := os.Stat(c.sshKeyFile); err != nil {
+		return fmt.Errorf("unable to access the private SSH key at %s: %v", c.sshKeyFile, err)
+	}
+
+	sshCommand := fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes", shellQuote(c.sshKeyFile))
+	c.gitEnvs = append(c.gitEnvs, "GIT_SSH_COMMAND="+sshCommand)
+	if c.sshKeyPassphrase == "" {
+		return nil
+	}
+
+	// ssh does not accept the passphrase from the command line
+	// so we give it via an askpass program which prints the passphrase
+	// stored in an environment variable of the git process.
+	askpassPath := filepath.Join(c.cacheDir, sshAskpassFilename)
+	if err := ioutil.WriteFile(askpassPath, []byte(sshAskpassScript), 0700); err != nil {
+		return fmt.Errorf("unable to create ssh askpass program: %v", err)
+	}
+	c.gitEnvs = append(c.gitEnvs,
+		"SSH_ASKPASS="+askpassPath,
+		"SSH_ASKPASS_REQUIRE=force",
+		"DISPLAY=:0",
+		sshKeyPassphraseEnv+"="+c.sshKeyPassphrase,
+	)
+	c.secrets = append(c.secrets, c.sshKeyPassphrase)
+	return nil
+}
+
+// shellQuote quotes the given string to be passed as a single word to the shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// validateGitVersion detects the version of git run by the given runner
+// and makes sure that it is not older than the required one.
+func (c *client) validateGitVersion(runner commandRunner) error {
+	min, err := parseGitVersion(c.minGitVersion)
+	if err != nil {
+		return fmt.Errorf("invalid minimum git version: %v", err)
+	}
+	c.gitVersion, err = getGitVersion(context.Background(), runner)
+	if err != nil {
+		return fmt.Errorf("unable to detect the version of git: %v", err)
+	}
+	if c.gitVersion.lessThan(min) {
+		return fmt.Errorf("git %s is older than the required version %s", c.gitVersion, min)
+	}
+	return nil
+}
+
+// configureToken prepares the environment variables to make git send
+// the access token in the Authorization header of all HTTP requests.
+// This requires git 2.31 or later to support GIT_CONFIG_COUNT.
+func (c *client) configureToken() error {
+	if c.gitVersion.lessThan(gitVersion{major: 2, minor: 31}) {
+		return fmt.Errorf("authentication with token requires git 2.31 or later but got %s", c.gitVersion)
+	}
+	credential := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + c.token))
+	c.gitEnvs = append(c.gitEnvs,
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic "+credential,
+	)
+	c.secrets = append(c.secrets, c.token, credential)
+	return nil
+}
+
+// redact masks all credentials including the configured ones in the given text.
+func (c *client) redact(s string) string {
+	return redact(s, c.secrets...)
+}
+
 func (c *client) runGitCommand(ctx context.Context, dir string, args ...string) ([]byte, error) {
-	cmd := exec.CommandContext(ctx, c.gitPath, args...)
-	cmd.Dir = dir
-	return cmd.CombinedOutput()
+	if c.commandSlots != nil {
+		select {
+		case c.commandSlots <- struct{}{}:
+			defer func() { <-c.commandSlots }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if c.commandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.commandTimeout)
+		defer cancel()
+	}
+	return c.runner.Run(ctx, dir, append(c.gitConfigArgs, args...)...)
+}
+
+// buildGitConfigArgs returns the "-c key=value" flags for the given configs
+// sorted by key to keep the command line stable.
+// Each flag is passed as a separate argument so values containing spaces are safe.
+func buildGitConfigArgs(configs map[string]string) []string {
+	if len(configs) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(configs))
+	for k := range configs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	args := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		args = append(args, "-c", k+"="+configs[k])
+	}
+	return args
+}
+
+// buildGitEnvs returns the "KEY=value" environment variables for the given map
+// sorted by key to keep the command environment stable.
+func buildGitEnvs(envs map[string]string) []string {
+	if len(envs) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(envs))
+	for k := range envs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, k+"="+envs[k])
+	}
+	return out
+}
+
+// runCommand runs the given command in its own process group and returns
+// its combined output. When the context is done the whole group is killed
+// to ensure that no subprocess spawned by git is left behind.
+func runCommand(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return out.Bytes(), err
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return out.Bytes(), ctx.Err()
+	}
+}
+
+// retryRemoteCommand retries a command communicating with the remote
+// based on the retry configuration of the client and records its metrics.
+// Commands against a local remote are run only once because their failures are not transient.
+func (c *client) retryRemoteCommand(ctx context.Context, op Operation, remote string, logger *zap.Logger, commander func() ([]byte, error)) ([]byte, error) {
+	var (
+		start   = time.Now()
+		calls   int
+		retries = c.retries
+	)
+	if _, ok := localRemotePath(remote); ok {
+		retries = 1
+	}
+	out, err := retryCommand(ctx, retries, c.backoff(), logger, func() ([]byte, error) {
+		calls++
+		if calls > 1 {
+			c.metrics.Retry(op)
+		}
+		return commander()
+	})
+	c.metrics.ObserveDuration(op, time.Since(start), err)
+	return out, err
 }
 
-// retryCommand retries a command a few times with a constant backoff.
-func retryCommand(retries int, interval time.Duration, logger *zap.Logger, commander func() ([]byte, error)) (out []byte, err error) {
+// retryCommand retries a command a few times with the given backoff.
+// When the remote rate-limits the requests it waits at least for the delay
+// requested by the remote, or stops retrying if that is too long to wait.
+// Waiting is stopped when the given context is done.
+func retryCommand(ctx context.Context, retries int, bo backoff.Backoff, logger *zap.Logger, commander func() ([]byte, error)) (out []byte, err error) {
+	var minDelay time.Duration
 	for i := 0; i < retries; i++ {
+		// The first call of Next always returns zero.
+		d := bo.Next()
+		if i > 0 && d < minDelay {
+			d = minDelay
+		}
+		if d > 0 {
+			logger.Warn(fmt.Sprintf("command was failed %d times, sleep %v before retrying command", i, d))
+			if err := sleep(ctx, d); err != nil {
+				return nil, err
+			}
+		}
 		out, err = commander()
 		if err == nil {
 			return
 		}
-		logger.Warn(fmt.Sprintf("command was failed %d times, sleep %v before retrying command", i+1, interval))
-		time.Sleep(interval)
+		if classifyError(out) != ErrRateLimited {
+			minDelay = 0
+			continue
+		}
+		minDelay = parseRetryAfter(out)
+		if minDelay == 0 {
+			minDelay = defaultRateLimitDelay
+		}
+		if minDelay > maxRateLimitDelay {
+			logger.Warn(fmt.Sprintf("command was rate limited and asked to wait %v, stop retrying", minDelay))
+			return
+		}
 	}
 	return
 }
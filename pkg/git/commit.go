@@ -23,11 +23,13 @@ import (
 const (
 	separator       = "__GIT_LOG_SEPARATOR__"
 	delimiter       = "__GIT_LOG_DELIMITER__"
-	fieldNum        = 7
+	fieldNum        = 9
 	commitLogFormat = separator +
 		"%an" + delimiter +
+		"%ae" + delimiter +
 		"%cn" + delimiter +
 		"%at" + delimiter +
+		"%ct" + delimiter +
 		"%H" + delimiter +
 		"%h" + delimiter +
 		"%s" + delimiter +
@@ -36,8 +38,10 @@ const (
 
 type Commit struct {
 	Author          string
+	AuthorEmail     string
 	Committer       string
 	CreatedAt       int
+	CommittedAt     int
 	Hash            string
 	AbbreviatedHash string
 	Message         string
@@ -68,17 +72,23 @@ func parseCommit(log string) (Commit, error) {
 	if len(fields) != fieldNum {
 		return Commit{}, fmt.Errorf("invalid log: log line should contain %d fields but got %d", fieldNum, len(fields))
 	}
-	createdAt, err := strconv.Atoi(fields[2])
+	createdAt, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return Commit{}, err
+	}
+	committedAt, err := strconv.Atoi(fields[4])
 	if err != nil {
 		return Commit{}, err
 	}
 	return Commit{
 		Author:          fields[0],
-		Committer:       fields[1],
+		AuthorEmail:     fields[1],
+		Committer:       fields[2],
 		CreatedAt:       createdAt,
-		Hash:            fields[3],
-		AbbreviatedHash: fields[4],
-		Message:         fields[5],
-		Body:            strings.TrimSpace(fields[6]),
+		CommittedAt:     committedAt,
+		Hash:            fields[5],
+		AbbreviatedHash: fields[6],
+		Message:         fields[7],
+		Body:            strings.TrimSpace(fields[8]),
 	}, nil
 }
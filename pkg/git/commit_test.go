@@ -30,16 +30,20 @@ func TestParseCommit(t *testing.T) {
 	expected := []Commit{
 		Commit{
 			Author:          "nghialv",
+			AuthorEmail:     "nghialv@example.com",
 			Committer:       "kapetanios-robot",
 			CreatedAt:       1565752022,
+			CommittedAt:     1565752100,
 			Hash:            "74e20ede0242fdc7fd75b5be56e8d7fa72060707",
 			AbbreviatedHash: "74e20ed",
 			Message:         "wip",
 		},
 		Commit{
 			Author:          "Le Van Nghia",
+			AuthorEmail:     "levannghia@example.com",
 			Committer:       "kapetanios-robot",
 			CreatedAt:       1565749682,
+			CommittedAt:     1565749700,
 			Hash:            "c9a7596e7e92ea5e3f03eeb951f632acb02b88a3",
 			AbbreviatedHash: "c9a7596",
 			Message:         `Add implementation of inplug service (#648)`,
@@ -61,8 +65,10 @@ This PR was merged by Kapetanios.`,
 		},
 		Commit{
 			Author:          "nghialv",
+			AuthorEmail:     "nghialv@example.com",
 			Committer:       "kapetanios-robot",
 			CreatedAt:       2565752022,
+			CommittedAt:     2565752022,
 			Hash:            "24e20ede0242fdc7fd75b5be56e8d7fa72060707",
 			AbbreviatedHash: "24e20ed",
 			Message:         `Added commands to "kapectl" for creating, updating project secret (#475)`,
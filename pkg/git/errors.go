@@ -0,0 +1,177 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrRepoNotFound is returned when the repository does not exist in the remote.
+	ErrRepoNotFound = errors.New("repository not found")
+	// ErrAuthFailed is returned when the remote rejected the given credentials.
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrBranchNotFound is returned when the branch does not exist in the remote.
+	ErrBranchNotFound = errors.New("branch not found")
+	// ErrTagNotFound is returned when the tag does not exist in the remote.
+	ErrTagNotFound = errors.New("tag not found")
+	// ErrNetwork is returned when the remote could not be reached.
+	ErrNetwork = errors.New("network error")
+	// ErrRateLimited is returned when the remote refused the request
+	// because too many requests were sent.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrEmptyRepository is returned when the remote repository has no commits yet.
+	ErrEmptyRepository = errors.New("repository is empty")
+)
+
+// The well-known messages printed by git for each kind of failure.
+// They are checked in order so the more specific ones must come first.
+var errorMessages = []struct {
+	err      error
+	messages []string
+	// The messages which can not be told by a fixed string,
+	// e.g. since the same words are also printed for other failures.
+	patterns []*regexp.Regexp
+}{
+	{
+		// GitHub responds 403 when the rate limit is exceeded
+		// so this must be checked before the authentication failure.
+		err: ErrRateLimited,
+		messages: []string{
+			"the requested url returned error: 429",
+			"too many requests",
+			"rate limit",
+		},
+	},
+	{
+		err: ErrAuthFailed,
+		messages: []string{
+			"authentication failed",
+			"could not read username",
+			"could not read password",
+			"permission denied (publickey",
+			"terminal prompts disabled",
+			"invalid username or password",
+			"the requested url returned error: 401",
+			"the requested url returned error: 403",
+		},
+	},
+	{
+		err: ErrRepoNotFound,
+		messages: []string{
+			"repository not found",
+			"does not appear to be a git repository",
+			"the requested url returned error: 404",
+		},
+		// Only the repositories are checked since git also says a local path
+		// such as a file at a commit "does not exist".
+		patterns: []*regexp.Regexp{
+			regexp.MustCompile(`(?m)^(fatal: repository '[^']*'|remote: .*repository.*) does not exist`),
+		},
+	},
+	{
+		err: ErrBranchNotFound,
+		messages: []string{
+			"not found in upstream",
+			"couldn't find remote ref",
+		},
+	},
+	{
+		err: ErrNetwork,
+		messages: []string{
+			"could not resolve host",
+			"connection timed out",
+			"connection refused",
+			"network is unreachable",
+			"operation timed out",
+			"early eof",
+			"the remote end hung up unexpectedly",
+		},
+	},
+}
+
+// classifyError returns the error describing the kind of failure
+// based on the output of git command, or nil if it was unknown.
+func classifyError(out []byte) error {
+	msg := strings.ToLower(string(out))
+	for _, em := range errorMessages {
+		for _, m := range em.messages {
+			if strings.Contains(msg, m) {
+				return em.err
+			}
+		}
+		for _, p := range em.patterns {
+			if p.MatchString(msg) {
+				return em.err
+			}
+		}
+	}
+	return nil
+}
+
+// wrapCommandError wraps the error of a git command with the classified one
+// to allow callers checking the kind of failure by errors.Is.
+func wrapCommandError(err error, out []byte) error {
+	if cerr := classifyError(out); cerr != nil {
+		return fmt.Errorf("%w: %v", cerr, err)
+	}
+	return err
+}
+
+// retryAfterPattern matches the delay requested by the remote in seconds,
+// e.g. "Retry-After: 60" or "retry after 60 seconds".
+var retryAfterPattern = regexp.MustCompile(`(?i)retry[- ]after:?\s*(\d+)`)
+
+// parseRetryAfter returns the delay the remote asked to wait before retrying
+// from the output of git command, or zero if it was not found.
+func parseRetryAfter(out []byte) time.Duration {
+	m := retryAfterPattern.FindSubmatch(out)
+	if m == nil {
+		return 0
+	}
+	secs, err := strconv.Atoi(string(m[1]))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// The messages printed by git when the local repository is broken,
+// e.g. a previous command was killed while writing to it.
+var corruptedRepoMessages = []string{
+	"not a git repository",
+	"bad object",
+	"object file is empty",
+	"loose object is corrupt",
+	"packfile is truncated",
+	"index file corrupt",
+}
+
+// isCorruptedRepoOutput reports whether the output of git command
+// indicates that the local repository is corrupted.
+func isCorruptedRepoOutput(out []byte) bool {
+	msg := strings.ToLower(string(out))
+	for _, m := range corruptedRepoMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyError(t *testing.T) {
+	testcases := []struct {
+		name     string
+		out      string
+		expected error
+	}{
+		{
+			name:     "https authentication failed",
+			out:      "remote: Invalid username or password.\nfatal: Authentication failed for 'https://github.com/org/repo.git/'\n",
+			expected: ErrAuthFailed,
+		},
+		{
+			name:     "ssh permission denied",
+			out:      "git@github.com: Permission denied (publickey).\nfatal: Could not read from remote repository.\n",
+			expected: ErrAuthFailed,
+		},
+		{
+			name:     "https without credentials",
+			out:      "fatal: could not read Username for 'https://github.com': terminal prompts disabled\n",
+			expected: ErrAuthFailed,
+		},
+		{
+			name:     "https repository not found",
+			out:      "remote: Repository not found.\nfatal: repository 'https://github.com/org/not-found.git/' not found\n",
+			expected: ErrRepoNotFound,
+		},
+		{
+			name:     "ssh repository not found",
+			out:      "ERROR: Repository not found.\nfatal: Could not read from remote repository.\n",
+			expected: ErrRepoNotFound,
+		},
+		{
+			name:     "local repository not found",
+			out:      "fatal: repository '/tmp/not-found' does not exist\n",
+			expected: ErrRepoNotFound,
+		},
+		{
+			name:     "remote repository does not exist",
+			out:      "remote: TF401019: The Git repository with name or identifier not-found does not exist or you do not have permissions for the operation you are attempting.\nfatal: repository 'https://dev.azure.com/org/project/_git/not-found/' not found\n",
+			expected: ErrRepoNotFound,
+		},
+		{
+			name:     "local path does not exist",
+			out:      "fatal: path 'app.pipecd.yaml' does not exist in 'HEAD'\n",
+			expected: nil,
+		},
+		{
+			name:     "branch not found while cloning",
+			out:      "Cloning into '/tmp/repo'...\nfatal: Remote branch not-found not found in upstream origin\n",
+			expected: ErrBranchNotFound,
+		},
+		{
+			name:     "branch not found while fetching",
+			out:      "fatal: couldn't find remote ref refs/heads/not-found\n",
+			expected: ErrBranchNotFound,
+		},
+		{
+			name:     "unresolvable host",
+			out:      "fatal: unable to access 'https://github.com/org/repo.git/': Could not resolve host: github.com\n",
+			expected: ErrNetwork,
+		},
+		{
+			name:     "connection refused",
+			out:      "ssh: connect to host github.com port 22: Connection refused\nfatal: Could not read from remote repository.\n",
+			expected: ErrNetwork,
+		},
+		{
+			name:     "http 429",
+			out:      "fatal: unable to access 'https://github.com/org/repo.git/': The requested URL returned error: 429\n",
+			expected: ErrRateLimited,
+		},
+		{
+			name:     "rate limit with 403",
+			out:      "remote: API rate limit exceeded for user.\nfatal: unable to access 'https://github.com/org/repo.git/': The requested URL returned error: 403\n",
+			expected: ErrRateLimited,
+		},
+		{
+			name:     "unknown error",
+			out:      "fatal: something went wrong\n",
+			expected: nil,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := classifyError([]byte(tc.out))
+			assert.Equal(t, tc.expected, err)
+
+			wrapped := wrapCommandError(errors.New("exit status 128"), []byte(tc.out))
+			if tc.expected != nil {
+				assert.True(t, errors.Is(wrapped, tc.expected))
+			}
+		})
+	}
+}
+
+func TestIsCorruptedRepoOutput(t *testing.T) {
+	testcases := []struct {
+		name     string
+		out      string
+		expected bool
+	}{
+		{
+			name:     "not a git repository",
+			out:      "fatal: not a git repository: '/tmp/cache/repo'\n",
+			expected: true,
+		},
+		{
+			name:     "bad object",
+			out:      "fatal: bad object HEAD\n",
+			expected: true,
+		},
+		{
+			name:     "network error",
+			out:      "fatal: unable to access 'https://github.com/org/repo.git/': Could not resolve host: github.com\n",
+			expected: false,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, isCorruptedRepoOutput([]byte(tc.out)))
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	testcases := []struct {
+		name     string
+		out      string
+		expected time.Duration
+	}{
+		{
+			name:     "header",
+			out:      "< HTTP/2 429\n< Retry-After: 60\n",
+			expected: time.Minute,
+		},
+		{
+			name:     "message",
+			out:      "remote: Too many requests, please retry after 120 seconds.\n",
+			expected: 2 * time.Minute,
+		},
+		{
+			name:     "not found",
+			out:      "fatal: The requested URL returned error: 429\n",
+			expected: 0,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, parseRetryAfter([]byte(tc.out)))
+		})
+	}
+}
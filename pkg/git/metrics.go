@@ -0,0 +1,49 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"time"
+)
+
+// Operation is the kind of git operation communicating with the remote.
+type Operation string
+
+const (
+	OperationClone    Operation = "clone"
+	OperationFetch    Operation = "fetch"
+	OperationLsRemote Operation = "ls-remote"
+)
+
+// MetricsRecorder records the metrics of git operations.
+// It is implemented by the caller so this package does not depend on
+// any specific metrics library.
+type MetricsRecorder interface {
+	// CacheHit is called when the repository was found in the cache.
+	CacheHit(repoID string)
+	// CacheMiss is called when the repository was not found in the cache.
+	CacheMiss(repoID string)
+	// ObserveDuration is called with the time spent by an operation including its retries.
+	ObserveDuration(op Operation, d time.Duration, err error)
+	// Retry is called each time an operation is retried.
+	Retry(op Operation)
+}
+
+type nopMetricsRecorder struct{}
+
+func (nopMetricsRecorder) CacheHit(string)                                 {}
+func (nopMetricsRecorder) CacheMiss(string)                                {}
+func (nopMetricsRecorder) ObserveDuration(Operation, time.Duration, error) {}
+func (nopMetricsRecorder) Retry(Operation)                                 {}
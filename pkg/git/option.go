@@ -0,0 +1,286 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"math"
+	"time"
+
+	"github.com/pipe-cd/pipe/pkg/backoff"
+)
+
+// Option configures optional behaviors of the client created by NewClient.
+// The default behavior of each option is described in its comment.
+type Option func(*client)
+
+// WithSSHKey configures the client to authenticate with the given private SSH key
+// while communicating with the remote. The passphrase can be empty.
+func WithSSHKey(path, passphrase string) Option {
+	return func(c *client) {
+		c.sshKeyFile = path
+		c.sshKeyPassphrase = passphrase
+	}
+}
+
+// WithToken configures the client to authenticate with the given access token
+// while communicating with the remote over HTTPS.
+// The token is passed to git through an extra HTTP header so that
+// it is never written into the remote URL or the on-disk git config.
+func WithToken(token string) Option {
+	return func(c *client) {
+		c.token = token
+	}
+}
+
+// WithRetry configures the number of attempts and the constant interval between them
+// for the git commands communicating with the remote.
+// Default is 3 attempts with one second interval. The count must be at least 1.
+func WithRetry(count int, interval time.Duration) Option {
+	return func(c *client) {
+		c.retries = count
+		c.retryInterval = interval
+	}
+}
+
+// WithCommandTimeout specifies the maximum duration of each git command.
+// A command exceeding this is killed and then retried if possible,
+// while the deadline of the given context is still respected.
+// Zero means no timeout.
+func WithCommandTimeout(timeout time.Duration) Option {
+	return func(c *client) {
+		c.commandTimeout = timeout
+	}
+}
+
+// WithMaxConcurrency limits the number of git commands run by the client at once
+// across all repositories, e.g. to avoid being rate-limited by the git host.
+// Waiting for a slot respects the given context and does not count toward
+// the timeout given by WithCommandTimeout.
+// The commands run on the cloned repositories are not limited.
+// Zero means no limit.
+func WithMaxConcurrency(n int) Option {
+	return func(c *client) {
+		c.maxConcurrency = n
+	}
+}
+
+// WithExponentialBackoff makes the client double the interval between retries of
+// the git commands communicating with the remote, starting from the given base.
+// The interval is capped at max unless it is zero. When jitter is enabled
+// the actual interval is randomly chosen between zero and the computed one
+// to avoid many clients retrying at the same time.
+func WithExponentialBackoff(base, max time.Duration, jitter bool) Option {
+	if max <= 0 {
+		max = time.Duration(math.MaxInt64)
+	}
+	return func(c *client) {
+		c.backoff = func() backoff.Backoff {
+			if jitter {
+				return backoff.NewExponential(base, max)
+			}
+			return backoff.NewExponentialWithoutJitter(base, max)
+		}
+	}
+}
+
+// WithCacheDir specifies the directory to store the cached repositories.
+// The directory is created if it does not exist, and unlike the default temporary
+// directory its data is kept after Clean to be reused across restarts.
+func WithCacheDir(path string) Option {
+	return func(c *client) {
+		c.cacheDir = path
+		c.persistentCache = true
+	}
+}
+
+// WithWorkspaceRoot restricts the destinations given to Clone to be inside the given directory
+// after resolving symbolic links, to prevent a caller from writing to an arbitrary path.
+// The temporary directories used for the empty destination are not restricted.
+func WithWorkspaceRoot(root string) Option {
+	return func(c *client) {
+		c.workspaceRoot = root
+	}
+}
+
+// WithDepth makes the client create shallow checkouts
+// whose history is truncated to the specified number of commits.
+// The cache is still a full mirror of the remote.
+func WithDepth(depth int) Option {
+	return func(c *client) {
+		c.depth = depth
+	}
+}
+
+// WithShallowSince makes the client create shallow checkouts
+// whose history is truncated to the commits committed after the given time.
+// It can be combined with WithDepth and WithSingleBranch.
+// The cache is still a full mirror of the remote.
+func WithShallowSince(since time.Time) Option {
+	return func(c *client) {
+		c.shallowSince = since
+	}
+}
+
+// WithSparseCheckout makes the client create checkouts which only materialize
+// the given directories in the working tree by using sparse-checkout in cone mode.
+// The files at the top level of the repository are always materialized.
+// The history is not affected so the whole tree can still be read from commits.
+// This requires git 2.25 or later.
+func WithSparseCheckout(paths ...string) Option {
+	return func(c *client) {
+		c.sparsePaths = paths
+	}
+}
+
+// WithCacheLimit specifies the maximum total size in bytes of the cached repositories.
+// When the limit is exceeded the least recently used repositories are evicted
+// before cloning a new one. Zero means no limit.
+func WithCacheLimit(bytes int64) Option {
+	return func(c *client) {
+		c.cacheLimit = bytes
+	}
+}
+
+// WithSingleBranch restricts the cache to only the branches given to Clone
+// instead of mirroring all branches of the remote.
+// This has no effect on the calls of Clone without branch.
+func WithSingleBranch() Option {
+	return func(c *client) {
+		c.singleBranch = true
+	}
+}
+
+// WithSubmodules makes the client initialize all submodules recursively
+// after cloning, using the same credentials with the repository.
+func WithSubmodules() Option {
+	return func(c *client) {
+		c.submodules = true
+	}
+}
+
+// WithLFS makes the client download the content of Git LFS files after cloning
+// instead of leaving their pointer files. git-lfs must be installed.
+func WithLFS() Option {
+	return func(c *client) {
+		c.lfs = true
+	}
+}
+
+// WithRequireSignedCommit makes Clone verify the signature of the checked out commit
+// and fail with ErrUnsignedCommit when it is not signed or not signed by an allowed key.
+// The allowed SSH keys are given by the file at allowedSigners in the format of
+// the allowed signers file of ssh-keygen(1), while GPG signatures must be made by
+// a fully trusted key of the keyring used by git.
+// This requires git 2.34 or later.
+func WithRequireSignedCommit(allowedSigners string) Option {
+	return func(c *client) {
+		c.signedCommit = true
+		c.allowedSigners = allowedSigners
+	}
+}
+
+// WithMetrics specifies the recorder to record the metrics of git operations.
+func WithMetrics(recorder MetricsRecorder) Option {
+	return func(c *client) {
+		c.metrics = recorder
+	}
+}
+
+// WithPrune specifies whether the cache should remove the branches and tags
+// which no longer exist on the remote while fetching. Default is true.
+func WithPrune(prune bool) Option {
+	return func(c *client) {
+		c.prune = prune
+	}
+}
+
+// WithFetchTags specifies whether the tags of the remote should be fetched
+// while updating the cache of a single branch given by WithSingleBranch.
+// The cache mirroring all branches always fetches tags. Default is true.
+func WithFetchTags(fetchTags bool) Option {
+	return func(c *client) {
+		c.fetchTags = fetchTags
+	}
+}
+
+// WithMinGitVersion specifies the minimum version of git required by the client,
+// e.g. "2.17.0". Default is the oldest version supporting all features of this client.
+func WithMinGitVersion(version string) Option {
+	return func(c *client) {
+		c.minGitVersion = version
+	}
+}
+
+// WithGitConfig specifies the git config entries, e.g. "http.postBuffer",
+// applied to every git command run by the client and its repositories.
+// It can be used multiple times and the latter value wins for the same key.
+func WithGitConfig(configs map[string]string) Option {
+	return func(c *client) {
+		if c.gitConfigs == nil {
+			c.gitConfigs = make(map[string]string, len(configs))
+		}
+		for k, v := range configs {
+			c.gitConfigs[k] = v
+		}
+	}
+}
+
+// WithEnv specifies the environment variables set for every git command
+// run by the client and its repositories in addition to the ones of the process.
+// GIT_TERMINAL_PROMPT is set to 0 by default to make a missing credential
+// fail fast instead of blocking on a prompt, it can be overridden here.
+// It can be used multiple times and the latter value wins for the same key.
+func WithEnv(envs map[string]string) Option {
+	return func(c *client) {
+		if c.envs == nil {
+			c.envs = make(map[string]string, len(envs))
+		}
+		for k, v := range envs {
+			c.envs[k] = v
+		}
+	}
+}
+
+// WithUpstreams specifies the upstream remotes keyed by repository ID, e.g. for forks.
+// The client keeps a shared mirror of each upstream and borrows its objects
+// while cloning the repository to speed up cloning many forks of the same upstream.
+func WithUpstreams(upstreams map[string]string) Option {
+	return func(c *client) {
+		if c.upstreams == nil {
+			c.upstreams = make(map[string]string, len(upstreams))
+		}
+		for repoID, upstream := range upstreams {
+			c.upstreams[repoID] = upstream
+		}
+	}
+}
+
+// WithProxy specifies the url of the proxy used by git to access the remote
+// over HTTP(S), e.g. "http://proxy.example.com:3128".
+// It is configured as http.proxy of every git command run by this client
+// so the environment shared with other components is not affected.
+func WithProxy(url string) Option {
+	return WithGitConfig(map[string]string{
+		"http.proxy": url,
+	})
+}
+
+// withCommandRunner replaces the runner executing all git commands of the client,
+// including the ones detecting the version of git and git-lfs, e.g. with a fake one in tests.
+func withCommandRunner(runner commandRunner) Option {
+	return func(c *client) {
+		c.runner = runner
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNewClientWithOptions(t *testing.T) {
+	c, err := NewClient("test-user", "test@example.com", zap.NewNop())
+	require.NoError(t, err)
+	defer c.Clean()
+
+	dc := c.(*client)
+	assert.Equal(t, "test-user", dc.username)
+	assert.Equal(t, "test@example.com", dc.email)
+	assert.Equal(t, 3, dc.retries)
+	assert.Equal(t, time.Second, dc.retryInterval)
+	assert.Equal(t, 0, dc.depth)
+	assert.True(t, dc.shallowSince.IsZero())
+	assert.Equal(t, int64(0), dc.cacheLimit)
+	assert.True(t, dc.prune)
+	assert.True(t, dc.fetchTags)
+	assert.Empty(t, dc.sparsePaths)
+	assert.False(t, dc.persistentCache)
+	assert.Equal(t, []string{"GIT_TERMINAL_PROMPT=0"}, dc.gitEnvs)
+	assert.Empty(t, dc.gitConfigArgs)
+
+	cacheDir := filepath.Join(dc.cacheDir, "persistent")
+	c, err = NewClient("", "", zap.NewNop(),
+		WithToken("test-token"),
+		WithRetry(5, time.Millisecond),
+		WithCommandTimeout(time.Minute),
+		WithCacheDir(cacheDir),
+		WithDepth(1),
+		WithShallowSince(time.Unix(1600000000, 0)),
+		WithSingleBranch(),
+		WithPrune(false),
+		WithFetchTags(false),
+		WithSparseCheckout("deploy/serviceA"),
+		WithCacheLimit(1024),
+		WithMinGitVersion("2.0.0"),
+		WithGitConfig(map[string]string{"http.postBuffer": "524288000"}),
+		WithGitConfig(map[string]string{"core.compression": "0"}),
+	)
+	require.NoError(t, err)
+	defer c.Clean()
+
+	oc := c.(*client)
+	assert.Equal(t, "test-token", oc.token)
+	assert.Equal(t, 5, oc.retries)
+	assert.Equal(t, time.Millisecond, oc.retryInterval)
+	assert.Equal(t, time.Minute, oc.commandTimeout)
+	assert.Equal(t, cacheDir, oc.cacheDir)
+	assert.True(t, oc.persistentCache)
+	assert.Equal(t, 1, oc.depth)
+	assert.Equal(t, time.Unix(1600000000, 0), oc.shallowSince)
+	assert.True(t, oc.singleBranch)
+	assert.False(t, oc.prune)
+	assert.False(t, oc.fetchTags)
+	assert.Equal(t, []string{"deploy/serviceA"}, oc.sparsePaths)
+	assert.Equal(t, int64(1024), oc.cacheLimit)
+	assert.Equal(t, "2.0.0", oc.minGitVersion)
+	assert.NotEmpty(t, oc.gitEnvs)
+	assert.Equal(t, []string{
+		"-c", "core.compression=0",
+		"-c", "http.postBuffer=524288000",
+	}, oc.gitConfigArgs)
+}
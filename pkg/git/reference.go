@@ -0,0 +1,82 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// The directory under the cache directory to store the reference repositories.
+const referencesDirName = ".references"
+
+// updateReferenceRepo mirrors or fetches the given upstream remote into
+// the cache directory to be used as the reference while cloning its forks.
+// The reference is shared by all forks of the same upstream.
+func (c *client) updateReferenceRepo(ctx context.Context, upstream string) (string, error) {
+	sum := sha256.Sum256([]byte(upstream))
+	var (
+		referenceID   = filepath.Join(referencesDirName, hex.EncodeToString(sum[:]))
+		referencePath = filepath.Join(c.cacheDir, referenceID)
+		logger        = c.logger.With(
+			zap.String("upstream", c.redact(upstream)),
+			zap.String("reference-path", referencePath),
+		)
+	)
+
+	if err := c.lockRepo(ctx, referenceID); err != nil {
+		return "", err
+	}
+	defer c.unlockRepo(referenceID)
+
+	_, err := os.Stat(referencePath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if err == nil {
+		out, err := c.retryRemoteCommand(ctx, OperationFetch, upstream, logger, func() ([]byte, error) {
+			return c.runGitCommand(ctx, referencePath, "fetch", "--prune")
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to fetch the reference repository: %w", wrapCommandError(err, out))
+		}
+		return referencePath, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(referencePath), os.ModePerm); err != nil {
+		return "", err
+	}
+	out, err := c.retryRemoteCommand(ctx, OperationClone, upstream, logger, func() ([]byte, error) {
+		out, err := c.runGitCommand(ctx, "", "clone", "--mirror", upstream, referencePath)
+		if err != nil {
+			os.RemoveAll(referencePath)
+		}
+		return out, err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to clone the reference repository: %w", wrapCommandError(err, out))
+	}
+	c.mu.Lock()
+	c.clonedRepos[referencePath] = struct{}{}
+	c.mu.Unlock()
+	return referencePath, nil
+}
@@ -15,6 +15,7 @@
 package git
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -26,33 +27,62 @@ import (
 )
 
 var (
-	ErrNoChange = errors.New("no change")
+	ErrNoChange     = errors.New("no change")
+	ErrRefNotFound  = errors.New("reference not found")
+	ErrFileNotFound = errors.New("file not found")
+	ErrBranchExists = errors.New("branch already exists")
+	// ErrNotFastForward is returned when the local branch can not be updated
+	// without merging because it has diverged from the remote one.
+	ErrNotFastForward = errors.New("not fast-forward")
+	// ErrMergeConflict is returned when a merge stopped due to conflicts.
+	// The repository is left in the merging state so ResetHard should be used to abort it.
+	ErrMergeConflict = errors.New("merge conflict")
+	// ErrNoMergeBase is returned when two commits have no common ancestor,
+	// e.g. they belong to unrelated histories.
+	ErrNoMergeBase = errors.New("no merge base")
 )
 
 // Repo provides functions to get and handle git data.
 type Repo interface {
 	GetPath() string
+	GetRemote() string
 	GetClonedBranch() string
 	Copy(dest string) (Repo, error)
 
 	ListCommits(ctx context.Context, visionRange string) ([]Commit, error)
+	GetCommitsBetween(ctx context.Context, from, to string) ([]Commit, error)
 	GetLatestCommit(ctx context.Context) (Commit, error)
 	GetCommitHashForRev(ctx context.Context, rev string) (string, error)
+	ResolveRevision(ctx context.Context, rev string) (string, error)
+	GetMergeBase(ctx context.Context, a, b string) (string, error)
 	ChangedFiles(ctx context.Context, from, to string) ([]string, error)
+	GetFileAtCommit(ctx context.Context, path, ref string) ([]byte, error)
+	ListTags(ctx context.Context) ([]string, error)
+	ListBranches(ctx context.Context) ([]string, error)
 	Checkout(ctx context.Context, commitish string) error
 	CheckoutPullRequest(ctx context.Context, number int, branch string) error
+	CreateBranch(ctx context.Context, name, baseRef string) error
+	DeleteBranch(ctx context.Context, name string) error
+	Merge(ctx context.Context, ref string) error
+	ResetHard(ctx context.Context, ref string) error
 	Clean() error
 
 	Pull(ctx context.Context, branch string) error
+	FastForward(ctx context.Context, branch string) error
+	Commit(ctx context.Context, message string, paths ...string) error
+	CommitAs(ctx context.Context, name, email, message string, paths ...string) error
 	Push(ctx context.Context, branch string) error
 	CommitChanges(ctx context.Context, branch, message string, newBranch bool, changes map[string][]byte) error
 }
 
 type repo struct {
-	dir          string
-	gitPath      string
-	remote       string
-	clonedBranch string
+	dir           string
+	gitPath       string
+	gitEnvs       []string
+	gitConfigArgs []string
+	runner        commandRunner
+	remote        string
+	clonedBranch  string
 }
 
 // NewRepo creates a new Repo instance.
@@ -70,24 +100,49 @@ func (r *repo) GetPath() string {
 	return r.dir
 }
 
+// GetRemote returns the remote url of this repository.
+func (r *repo) GetRemote() string {
+	return r.remote
+}
+
 // GetClonedBranch returns the name of cloned branch.
 func (r *repo) GetClonedBranch() string {
 	return r.clonedBranch
 }
 
 // Copy does copying the repository to the given destination.
+// The whole working tree including the uncommitted changes and the git config,
+// e.g. the remote and the user, is copied so the returned Repo is independent of this one.
+// The destination must be an empty or non-existent directory.
 func (r *repo) Copy(dest string) (Repo, error) {
-	cmd := exec.Command("cp", "-rf", r.dir, dest)
+	empty, err := isEmptyDir(dest)
+	if err != nil {
+		return nil, err
+	}
+	if !empty {
+		return nil, fmt.Errorf("%w: %s", ErrDestinationNotEmpty, dest)
+	}
+	if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	// Copy the content instead of the directory itself to not create
+	// a nested directory when the destination already exists.
+	// The file attributes are preserved to avoid git treating all files as modified.
+	cmd := exec.Command("cp", "-a", r.dir+"/.", dest)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return nil, formatCommandError(err, out)
 	}
 
 	return &repo{
-		dir:          dest,
-		gitPath:      r.gitPath,
-		remote:       r.remote,
-		clonedBranch: r.clonedBranch,
+		dir:           dest,
+		gitPath:       r.gitPath,
+		gitEnvs:       r.gitEnvs,
+		gitConfigArgs: r.gitConfigArgs,
+		runner:        r.runner,
+		remote:        r.remote,
+		clonedBranch:  r.clonedBranch,
 	}, nil
 }
 
@@ -110,6 +165,16 @@ func (r *repo) ListCommits(ctx context.Context, revisionRange string) ([]Commit,
 	return parseCommits(string(out))
 }
 
+// GetCommitsBetween returns a list of commits those are reachable from "to"
+// but not from "from", ordered from the newest to the oldest.
+// All commits reachable from "to" are returned when "from" is empty.
+func (r *repo) GetCommitsBetween(ctx context.Context, from, to string) ([]Commit, error) {
+	if from == "" {
+		return r.ListCommits(ctx, to)
+	}
+	return r.ListCommits(ctx, fmt.Sprintf("%s..%s", from, to))
+}
+
 // GetLatestCommit returns the most recent commit of current branch.
 func (r *repo) GetLatestCommit(ctx context.Context) (Commit, error) {
 	commits, err := r.ListCommits(ctx, "-1")
@@ -134,9 +199,61 @@ func (r *repo) GetCommitHashForRev(ctx context.Context, rev string) (string, err
 	return strings.TrimSpace(string(out)), nil
 }
 
+// ResolveRevision returns the full hash of the commit the given revspec points to,
+// e.g. a short hash, "HEAD~3" or "main@{yesterday}". Annotated tags are peeled to their commits.
+// ErrRefNotFound is returned when the revspec can not be resolved to a commit.
+func (r *repo) ResolveRevision(ctx context.Context, rev string) (string, error) {
+	// Do not let the revspec be interpreted as an option.
+	if rev == "" || strings.HasPrefix(rev, "-") {
+		return "", fmt.Errorf("%w: %q", ErrRefNotFound, rev)
+	}
+	out, err := r.runGitCommand(ctx, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil {
+		// With --quiet nothing is printed when the revspec is not a valid commit.
+		if len(bytes.TrimSpace(out)) == 0 {
+			return "", fmt.Errorf("%w: %s", ErrRefNotFound, rev)
+		}
+		return "", formatCommandError(err, out)
+	}
+	// The hash is printed last, after the warnings if any,
+	// e.g. when the reflog does not go back to the given date.
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1]), nil
+}
+
+// GetMergeBase returns the hash of the best common ancestor of the given two commits,
+// e.g. where a feature branch diverged from the base branch.
+// ErrNoMergeBase is returned when they do not share any history.
+func (r *repo) GetMergeBase(ctx context.Context, a, b string) (string, error) {
+	// Do not let the refs be interpreted as options.
+	for _, ref := range []string{a, b} {
+		if ref == "" || strings.HasPrefix(ref, "-") {
+			return "", fmt.Errorf("%w: %q", ErrRefNotFound, ref)
+		}
+	}
+	out, err := r.runGitCommand(ctx, "merge-base", a, b)
+	if err != nil {
+		// Nothing is printed when the commits have no common ancestor.
+		if len(bytes.TrimSpace(out)) == 0 {
+			return "", fmt.Errorf("%w: %s and %s", ErrNoMergeBase, a, b)
+		}
+		if strings.Contains(string(out), "Not a valid object name") || strings.Contains(string(out), "Not a valid commit name") {
+			return "", fmt.Errorf("%w: %s", ErrRefNotFound, strings.TrimSpace(string(out)))
+		}
+		return "", formatCommandError(err, out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
 // ChangedFiles returns a list of files those were touched between two commits.
+// All files at the "to" commit are returned when "from" is empty.
+// A renamed file is reported as both its old and new paths.
 func (r *repo) ChangedFiles(ctx context.Context, from, to string) ([]string, error) {
-	out, err := r.runGitCommand(ctx, "diff", "--name-only", from, to)
+	args := []string{"diff", "--name-only", "--no-renames", from, to}
+	if from == "" {
+		args = []string{"ls-tree", "-r", "--name-only", to}
+	}
+	out, err := r.runGitCommand(ctx, args...)
 	if err != nil {
 		return nil, formatCommandError(err, out)
 	}
@@ -155,10 +272,64 @@ func (r *repo) ChangedFiles(ctx context.Context, from, to string) ([]string, err
 	return files, nil
 }
 
+// GetFileAtCommit returns the content of a file at a given ref without changing the working tree.
+// The path is relative to the root of the repository.
+// ErrFileNotFound is returned when the file does not exist at that ref
+// and ErrRefNotFound is returned when the ref does not exist.
+func (r *repo) GetFileAtCommit(ctx context.Context, path, ref string) ([]byte, error) {
+	path = filepath.ToSlash(filepath.Clean(path))
+	out, err := r.runGitCommand(ctx, "show", fmt.Sprintf("%s:%s", ref, path))
+	if err != nil {
+		switch msg := string(out); {
+		case isFileNotFoundOutput(msg):
+			return nil, fmt.Errorf("%w: %s at %s", ErrFileNotFound, path, ref)
+		case strings.Contains(msg, "invalid object name"):
+			return nil, fmt.Errorf("%w: %s", ErrRefNotFound, ref)
+		}
+		return nil, formatCommandError(err, out)
+	}
+	return out, nil
+}
+
+// ListTags returns the tags of this repository.
+// The tags looking like semver, e.g. v1.2.3, are sorted by their versions
+// and followed by the other tags sorted lexically.
+func (r *repo) ListTags(ctx context.Context) ([]string, error) {
+	out, err := r.runGitCommand(ctx, "tag", "--list")
+	if err != nil {
+		return nil, formatCommandError(err, out)
+	}
+	tags := strings.Fields(string(out))
+	sortTags(tags)
+	return tags, nil
+}
+
+// ListBranches returns the local branches of this repository sorted lexically.
+func (r *repo) ListBranches(ctx context.Context) ([]string, error) {
+	out, err := r.runGitCommand(ctx, "branch", "--list", "--format=%(refname:short)")
+	if err != nil {
+		return nil, formatCommandError(err, out)
+	}
+	var branches []string
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		// Skip the empty lines and the detached HEAD like "(HEAD detached at 1a2b3c4)".
+		if line == "" || strings.HasPrefix(line, "(") {
+			continue
+		}
+		branches = append(branches, line)
+	}
+	return branches, nil
+}
+
 // Checkout checkouts to a given commitish.
+// ErrRefNotFound is returned when the commitish does not exist.
 func (r *repo) Checkout(ctx context.Context, commitish string) error {
 	out, err := r.runGitCommand(ctx, "checkout", commitish)
 	if err != nil {
+		if isRefNotFoundOutput(string(out)) {
+			return fmt.Errorf("%w: %s", ErrRefNotFound, commitish)
+		}
 		return formatCommandError(err, out)
 	}
 	return nil
@@ -174,6 +345,37 @@ func (r *repo) CheckoutPullRequest(ctx context.Context, number int, branch strin
 	return r.Checkout(ctx, branch)
 }
 
+// CreateBranch creates a new local branch starting from the given base ref
+// without switching to it. The current HEAD is used when baseRef is empty.
+// ErrBranchExists is returned when the branch already exists.
+func (r *repo) CreateBranch(ctx context.Context, name, baseRef string) error {
+	args := []string{"branch", name}
+	if baseRef != "" {
+		args = append(args, baseRef)
+	}
+	out, err := r.runGitCommand(ctx, args...)
+	if err != nil {
+		if strings.Contains(string(out), "already exists") {
+			return fmt.Errorf("%w: %s", ErrBranchExists, name)
+		}
+		return formatCommandError(err, out)
+	}
+	return nil
+}
+
+// DeleteBranch deletes a local branch even if it was not merged.
+// ErrBranchNotFound is returned when the branch does not exist.
+func (r *repo) DeleteBranch(ctx context.Context, name string) error {
+	out, err := r.runGitCommand(ctx, "branch", "-D", name)
+	if err != nil {
+		if strings.Contains(string(out), "not found") {
+			return fmt.Errorf("%w: %s", ErrBranchNotFound, name)
+		}
+		return formatCommandError(err, out)
+	}
+	return nil
+}
+
 // Pull fetches from and integrate with a local branch.
 func (r *repo) Pull(ctx context.Context, branch string) error {
 	out, err := r.runGitCommand(ctx, "pull", r.remote, branch)
@@ -183,6 +385,63 @@ func (r *repo) Pull(ctx context.Context, branch string) error {
 	return nil
 }
 
+// FastForward fetches the given branch from the remote and fast-forwards the current branch
+// in place to its latest commit, so the repository does not need to be cloned again.
+// Unlike Pull it never merges, ErrNotFastForward is returned when the histories have diverged.
+func (r *repo) FastForward(ctx context.Context, branch string) error {
+	out, err := r.runGitCommand(ctx, "pull", "--ff-only", r.remote, branch)
+	if err != nil {
+		if strings.Contains(string(out), "Not possible to fast-forward") {
+			return fmt.Errorf("%w: unable to update to the latest of %s", ErrNotFastForward, branch)
+		}
+		return formatCommandError(err, out)
+	}
+	return nil
+}
+
+// Commit records the changes of the given paths into the current branch.
+// All changes in the working tree are committed when no path is given.
+// ErrNoChange is returned when there is nothing to commit.
+func (r *repo) Commit(ctx context.Context, message string, paths ...string) error {
+	return r.commit(ctx, "", message, paths...)
+}
+
+// CommitAs works like Commit but records the given name and email as the author of
+// the commit instead of the identity configured for this repository, e.g. to attribute
+// an automated commit to the user who triggered it.
+// The configured identity is used when either the name or the email is empty.
+func (r *repo) CommitAs(ctx context.Context, name, email, message string, paths ...string) error {
+	var author string
+	if name != "" && email != "" {
+		author = fmt.Sprintf("%s <%s>", name, email)
+	}
+	return r.commit(ctx, author, message, paths...)
+}
+
+func (r *repo) commit(ctx context.Context, author, message string, paths ...string) error {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	args := append([]string{"add", "--"}, paths...)
+	out, err := r.runGitCommand(ctx, args...)
+	if err != nil {
+		return formatCommandError(err, out)
+	}
+	args = []string{"commit", "-m", message}
+	if author != "" {
+		args = append(args, "--author", author)
+	}
+	out, err = r.runGitCommand(ctx, args...)
+	if err != nil {
+		msg := string(out)
+		if strings.Contains(msg, "nothing to commit") || strings.Contains(msg, "no changes added to commit") {
+			return ErrNoChange
+		}
+		return formatCommandError(err, out)
+	}
+	return nil
+}
+
 // Push pushes local changes of a given branch to the remote.
 func (r *repo) Push(ctx context.Context, branch string) error {
 	out, err := r.runGitCommand(ctx, "push", r.remote, branch)
@@ -236,47 +495,130 @@ func (r *repo) checkoutNewBranch(ctx context.Context, branch string) error {
 	return nil
 }
 
-func (r repo) addCommit(ctx context.Context, message string) error {
-	out, err := r.runGitCommand(ctx, "add", ".")
+func (r *repo) addCommit(ctx context.Context, message string) error {
+	return r.Commit(ctx, message)
+}
+
+// setUser configures username and email for local user of this repo.
+func (r *repo) setUser(ctx context.Context, username, email string) error {
+	if out, err := r.runGitCommand(ctx, "config", "user.name", username); err != nil {
+		return formatCommandError(err, out)
+	}
+	if out, err := r.runGitCommand(ctx, "config", "user.email", email); err != nil {
+		return formatCommandError(err, out)
+	}
+	return nil
+}
+
+func (r *repo) setRemote(ctx context.Context, remote string) error {
+	out, err := r.runGitCommand(ctx, "remote", "set-url", "origin", remote)
 	if err != nil {
 		return formatCommandError(err, out)
 	}
-	out, err = r.runGitCommand(ctx, "commit", "-m", message)
+	return nil
+}
+
+func (r *repo) setSparseCheckout(ctx context.Context, paths []string) error {
+	args := append([]string{"sparse-checkout", "set", "--"}, paths...)
+	out, err := r.runGitCommand(ctx, args...)
 	if err != nil {
-		msg := string(out)
-		if strings.Contains(msg, "nothing to commit, working tree clean") {
-			return ErrNoChange
-		}
 		return formatCommandError(err, out)
 	}
 	return nil
 }
 
-// setUser configures username and email for local user of this repo.
-func (r *repo) setUser(ctx context.Context, username, email string) error {
-	if out, err := r.runGitCommand(ctx, "config", "user.name", username); err != nil {
+// verifyCommitSignature returns ErrUnsignedCommit when the given commit is not signed,
+// or signed by a key neither listed in the given allowed signers file nor fully trusted by GPG.
+func (r *repo) verifyCommitSignature(ctx context.Context, rev, allowedSignersFile string) error {
+	out, err := r.runGitCommand(ctx,
+		"-c", "gpg.ssh.allowedSignersFile="+allowedSignersFile,
+		// Otherwise the GPG signatures made by any key in the keyring are accepted.
+		"-c", "gpg.minTrustLevel=fully",
+		"verify-commit", rev,
+	)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w: %s", ErrUnsignedCommit, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (r *repo) updateSubmodules(ctx context.Context) error {
+	out, err := r.runGitCommand(ctx, "submodule", "update", "--init", "--recursive")
+	if err != nil {
 		return formatCommandError(err, out)
 	}
-	if out, err := r.runGitCommand(ctx, "config", "user.email", email); err != nil {
+	return nil
+}
+
+func (r *repo) pullLFS(ctx context.Context) error {
+	out, err := r.runGitCommand(ctx, "lfs", "pull")
+	if err != nil {
 		return formatCommandError(err, out)
 	}
 	return nil
 }
 
-func (r *repo) setRemote(ctx context.Context, remote string) error {
-	out, err := r.runGitCommand(ctx, "remote", "set-url", "origin", remote)
+// Merge merges the given ref into the current branch.
+// ErrMergeConflict is returned when the merge could not be completed due to conflicts.
+func (r *repo) Merge(ctx context.Context, ref string) error {
+	out, err := r.runGitCommand(ctx, "merge", "--no-edit", ref)
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(string(out), "not something we can merge") {
+		return fmt.Errorf("%w: %s", ErrRefNotFound, ref)
+	}
+
+	conflicts, cerr := r.runGitCommand(ctx, "diff", "--name-only", "--diff-filter=U")
+	if cerr == nil {
+		if files := strings.Fields(string(conflicts)); len(files) > 0 {
+			return fmt.Errorf("%w: %s", ErrMergeConflict, strings.Join(files, ", "))
+		}
+	}
+	return formatCommandError(err, out)
+}
+
+// ResetHard resets the current branch and the working tree to the given ref.
+// All local changes, including untracked files and an in-progress merge, are discarded.
+func (r *repo) ResetHard(ctx context.Context, ref string) error {
+	out, err := r.runGitCommand(ctx, "reset", "--hard", ref)
 	if err != nil {
+		if strings.Contains(string(out), "unknown revision") {
+			return fmt.Errorf("%w: %s", ErrRefNotFound, ref)
+		}
+		return formatCommandError(err, out)
+	}
+	if out, err := r.runGitCommand(ctx, "clean", "-fd"); err != nil {
 		return formatCommandError(err, out)
 	}
 	return nil
 }
 
 func (r *repo) runGitCommand(ctx context.Context, args ...string) ([]byte, error) {
-	cmd := exec.CommandContext(ctx, r.gitPath, args...)
-	cmd.Dir = r.dir
-	return cmd.CombinedOutput()
+	runner := r.runner
+	if runner == nil {
+		runner = execRunner{
+			gitPath: r.gitPath,
+			envs:    r.gitEnvs,
+		}
+	}
+	return runner.Run(ctx, r.dir, append(r.gitConfigArgs, args...)...)
+}
+
+func isRefNotFoundOutput(out string) bool {
+	return strings.Contains(out, "did not match any file(s) known to git") ||
+		strings.Contains(out, "reference is not a tree") ||
+		strings.Contains(out, "invalid reference")
+}
+
+func isFileNotFoundOutput(out string) bool {
+	return strings.Contains(out, "does not exist in") ||
+		strings.Contains(out, "exists on disk, but not in")
 }
 
 func formatCommandError(err error, out []byte) error {
-	return fmt.Errorf("err: %w, out: %s", err, string(out))
+	return fmt.Errorf("err: %w, out: %s", err, redact(string(out)))
 }
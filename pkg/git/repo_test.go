@@ -16,14 +16,18 @@ package git
 
 import (
 	"context"
+	"errors"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 func TestGetCommitHashForRev(t *testing.T) {
@@ -53,6 +57,75 @@ func TestGetCommitHashForRev(t *testing.T) {
 	assert.Equal(t, commits[0].Hash, latestCommitHash)
 }
 
+func TestResolveRevision(t *testing.T) {
+	faker, err := newFaker()
+	require.NoError(t, err)
+	defer faker.clean()
+
+	var (
+		org      = "test-repo-org"
+		repoName = "repo-resolve-revision"
+		ctx      = context.Background()
+	)
+
+	err = faker.makeRepo(org, repoName)
+	require.NoError(t, err)
+	r := &repo{
+		dir:     faker.repoDir(org, repoName),
+		gitPath: faker.gitPath,
+	}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		err = ioutil.WriteFile(filepath.Join(r.dir, name), []byte(name), os.ModePerm)
+		require.NoError(t, err)
+		err = r.addCommit(ctx, "Added "+name)
+		require.NoError(t, err)
+	}
+	commits, err := r.ListCommits(ctx, "")
+	require.NoError(t, err)
+	require.Equal(t, 4, len(commits))
+	out, err := r.runGitCommand(ctx, "tag", "-a", "v0.1.0", "-m", "Annotated tag", commits[1].Hash)
+	require.NoError(t, err, string(out))
+
+	testcases := []struct {
+		name     string
+		rev      string
+		expected string
+	}{
+		{
+			name:     "short hash",
+			rev:      commits[2].AbbreviatedHash,
+			expected: commits[2].Hash,
+		},
+		{
+			name:     "ancestor of HEAD",
+			rev:      "HEAD~3",
+			expected: commits[3].Hash,
+		},
+		{
+			name:     "annotated tag",
+			rev:      "v0.1.0",
+			expected: commits[1].Hash,
+		},
+		{
+			name:     "reflog",
+			rev:      "master@{0}",
+			expected: commits[0].Hash,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			hash, err := r.ResolveRevision(ctx, tc.rev)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, hash)
+		})
+	}
+
+	for _, rev := range []string{"HEAD~10", "unknown-branch", "--all", "", "HEAD^{tree}:README.md"} {
+		_, err := r.ResolveRevision(ctx, rev)
+		assert.True(t, errors.Is(err, ErrRefNotFound), "%s: %v", rev, err)
+	}
+}
+
 func TestChangedFiles(t *testing.T) {
 	faker, err := newFaker()
 	require.NoError(t, err)
@@ -102,6 +175,34 @@ func TestChangedFiles(t *testing.T) {
 
 	require.NoError(t, err)
 	assert.Equal(t, expectedChangedFiles, changedFiles)
+
+	// Delete and rename files.
+	err = os.Remove(readmeFilePath)
+	require.NoError(t, err)
+	err = os.Rename(path, filepath.Join(r.dir, "new-dir", "renamed-file.txt"))
+	require.NoError(t, err)
+	err = r.addCommit(ctx, "Deleted and renamed files")
+	require.NoError(t, err)
+
+	changedFiles, err = r.ChangedFiles(ctx, headCommitHash, "HEAD")
+	require.NoError(t, err)
+	sort.Strings(changedFiles)
+	expectedChangedFiles = []string{
+		"README.md",
+		"new-dir/new-file.txt",
+		"new-dir/renamed-file.txt",
+	}
+	assert.Equal(t, expectedChangedFiles, changedFiles)
+
+	// Compare against the empty tree when from is empty.
+	changedFiles, err = r.ChangedFiles(ctx, "", headCommitHash)
+	require.NoError(t, err)
+	sort.Strings(changedFiles)
+	expectedChangedFiles = []string{
+		"README.md",
+		"new-dir/new-file.txt",
+	}
+	assert.Equal(t, expectedChangedFiles, changedFiles)
 }
 
 func TestAddCommit(t *testing.T) {
@@ -184,3 +285,729 @@ func TestCommitChanges(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, string(changes["a/b/c/new.txt"]), string(bytes))
 }
+
+func TestCheckout(t *testing.T) {
+	faker, err := newFaker()
+	require.NoError(t, err)
+	defer faker.clean()
+
+	var (
+		org      = "test-repo-org"
+		repoName = "repo-checkout"
+		ctx      = context.Background()
+	)
+
+	err = faker.makeRepo(org, repoName)
+	require.NoError(t, err)
+	r := &repo{
+		dir:     faker.repoDir(org, repoName),
+		gitPath: faker.gitPath,
+	}
+
+	firstCommitHash, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+	out, err := r.runGitCommand(ctx, "tag", "v0.1.0")
+	require.NoError(t, err, string(out))
+
+	err = r.CommitChanges(ctx, "master", "Second commit", false, map[string][]byte{
+		"new-file.txt": []byte("content"),
+	})
+	require.NoError(t, err)
+	secondCommitHash, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+	require.NotEqual(t, firstCommitHash, secondCommitHash)
+
+	// Checkout by SHA.
+	err = r.Checkout(ctx, firstCommitHash)
+	require.NoError(t, err)
+	head, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, firstCommitHash, head)
+
+	// Checkout by branch.
+	err = r.Checkout(ctx, "master")
+	require.NoError(t, err)
+	head, err = r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, secondCommitHash, head)
+
+	// Checkout by tag.
+	err = r.Checkout(ctx, "v0.1.0")
+	require.NoError(t, err)
+	head, err = r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, firstCommitHash, head)
+
+	// Checkout an unknown ref.
+	err = r.Checkout(ctx, "unknown-ref")
+	assert.True(t, errors.Is(err, ErrRefNotFound))
+	err = r.Checkout(ctx, "0123456789abcdef0123456789abcdef01234567")
+	assert.True(t, errors.Is(err, ErrRefNotFound))
+}
+
+func TestGetCommitsBetween(t *testing.T) {
+	faker, err := newFaker()
+	require.NoError(t, err)
+	defer faker.clean()
+
+	var (
+		org      = "test-repo-org"
+		repoName = "repo-get-commits-between"
+		ctx      = context.Background()
+	)
+
+	err = faker.makeRepo(org, repoName)
+	require.NoError(t, err)
+	r := &repo{
+		dir:     faker.repoDir(org, repoName),
+		gitPath: faker.gitPath,
+	}
+
+	firstCommitHash, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+
+	message := "Second commit\n\nFirst paragraph.\n\nSecond paragraph."
+	err = r.CommitChanges(ctx, "master", message, false, map[string][]byte{
+		"a.txt": []byte("a"),
+	})
+	require.NoError(t, err)
+	err = r.CommitChanges(ctx, "master", "Third commit", false, map[string][]byte{
+		"b.txt": []byte("b"),
+	})
+	require.NoError(t, err)
+
+	commits, err := r.GetCommitsBetween(ctx, firstCommitHash, "HEAD")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(commits))
+	assert.Equal(t, "Third commit", commits[0].Message)
+	assert.Equal(t, "Second commit", commits[1].Message)
+	assert.Equal(t, "First paragraph.\n\nSecond paragraph.", commits[1].Body)
+	assert.Equal(t, "test-user", commits[1].Author)
+	assert.Equal(t, "test@gmail.com", commits[1].AuthorEmail)
+	assert.NotZero(t, commits[1].CreatedAt)
+
+	commits, err = r.GetCommitsBetween(ctx, "", "HEAD")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(commits))
+	assert.Equal(t, firstCommitHash, commits[2].Hash)
+}
+
+func TestCommitAndPush(t *testing.T) {
+	faker, err := newFaker()
+	require.NoError(t, err)
+	defer faker.clean()
+
+	var (
+		org      = "test-repo-org"
+		repoName = "repo-commit-and-push"
+		ctx      = context.Background()
+	)
+	err = faker.makeRepo(org, repoName)
+	require.NoError(t, err)
+
+	// Make a bare remote to be able to push.
+	remote := filepath.Join(faker.dir, "bare", repoName)
+	out, err := exec.Command(faker.gitPath, "clone", "--bare", faker.repoDir(org, repoName), remote).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	c, err := NewClient("piped-user", "piped@example.com", zap.NewNop())
+	require.NoError(t, err)
+	defer c.Clean()
+
+	r, err := c.Clone(ctx, repoName, remote, "master", "")
+	require.NoError(t, err)
+	defer r.Clean()
+
+	err = r.Commit(ctx, "No change")
+	assert.Equal(t, ErrNoChange, err)
+
+	err = ioutil.WriteFile(filepath.Join(r.GetPath(), "a.txt"), []byte("a"), os.ModePerm)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(r.GetPath(), "b.txt"), []byte("b"), os.ModePerm)
+	require.NoError(t, err)
+
+	// Commit only the given path.
+	err = r.Commit(ctx, "Added a.txt", "a.txt")
+	require.NoError(t, err)
+	changedFiles, err := r.ChangedFiles(ctx, "HEAD~1", "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.txt"}, changedFiles)
+
+	// Commit all remaining changes.
+	err = r.Commit(ctx, "Added b.txt")
+	require.NoError(t, err)
+
+	err = r.Push(ctx, "master")
+	require.NoError(t, err)
+
+	remoteRepo := &repo{
+		dir:     remote,
+		gitPath: faker.gitPath,
+	}
+	commits, err := remoteRepo.ListCommits(ctx, "master")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(commits))
+	assert.Equal(t, "Added b.txt", commits[0].Message)
+	assert.Equal(t, "Added a.txt", commits[1].Message)
+	assert.Equal(t, "piped-user", commits[0].Author)
+	assert.Equal(t, "piped@example.com", commits[0].AuthorEmail)
+}
+
+func TestCommitAs(t *testing.T) {
+	faker, err := newFaker()
+	require.NoError(t, err)
+	defer faker.clean()
+
+	var (
+		org      = "test-repo-org"
+		repoName = "repo-commit-as"
+		ctx      = context.Background()
+	)
+	err = faker.makeRepo(org, repoName)
+	require.NoError(t, err)
+
+	c, err := NewClient("piped-user", "piped@example.com", zap.NewNop())
+	require.NoError(t, err)
+	defer c.Clean()
+
+	r, err := c.Clone(ctx, repoName, faker.repoDir(org, repoName), "master", "")
+	require.NoError(t, err)
+	defer r.Clean()
+
+	// The given author overrides the configured identity only for this commit.
+	err = ioutil.WriteFile(filepath.Join(r.GetPath(), "a.txt"), []byte("a"), os.ModePerm)
+	require.NoError(t, err)
+	err = r.CommitAs(ctx, "deploy-user", "deploy@example.com", "Added a.txt")
+	require.NoError(t, err)
+	commit, err := r.GetLatestCommit(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "deploy-user", commit.Author)
+	assert.Equal(t, "deploy@example.com", commit.AuthorEmail)
+	assert.Equal(t, "piped-user", commit.Committer)
+
+	// The configured identity is used when no author is given.
+	err = ioutil.WriteFile(filepath.Join(r.GetPath(), "b.txt"), []byte("b"), os.ModePerm)
+	require.NoError(t, err)
+	err = r.CommitAs(ctx, "", "", "Added b.txt")
+	require.NoError(t, err)
+	commit, err = r.GetLatestCommit(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "piped-user", commit.Author)
+	assert.Equal(t, "piped@example.com", commit.AuthorEmail)
+
+	err = r.CommitAs(ctx, "deploy-user", "deploy@example.com", "No change")
+	assert.Equal(t, ErrNoChange, err)
+}
+
+func TestCreateAndDeleteBranch(t *testing.T) {
+	faker, err := newFaker()
+	require.NoError(t, err)
+	defer faker.clean()
+
+	var (
+		org      = "test-repo-org"
+		repoName = "repo-create-and-delete-branch"
+		ctx      = context.Background()
+	)
+
+	err = faker.makeRepo(org, repoName)
+	require.NoError(t, err)
+	r := &repo{
+		dir:     faker.repoDir(org, repoName),
+		gitPath: faker.gitPath,
+	}
+
+	firstCommitHash, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(r.dir, "a.txt"), []byte("a"), os.ModePerm)
+	require.NoError(t, err)
+	err = r.addCommit(ctx, "Added a.txt")
+	require.NoError(t, err)
+	headCommitHash, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+
+	// Create from the current HEAD.
+	err = r.CreateBranch(ctx, "from-head", "")
+	require.NoError(t, err)
+	hash, err := r.GetCommitHashForRev(ctx, "from-head")
+	require.NoError(t, err)
+	assert.Equal(t, headCommitHash, hash)
+
+	// Create from an explicit base ref.
+	err = r.CreateBranch(ctx, "from-base", firstCommitHash)
+	require.NoError(t, err)
+	hash, err = r.GetCommitHashForRev(ctx, "from-base")
+	require.NoError(t, err)
+	assert.Equal(t, firstCommitHash, hash)
+
+	// Create an existing one.
+	err = r.CreateBranch(ctx, "from-base", "")
+	assert.True(t, errors.Is(err, ErrBranchExists))
+
+	// Delete.
+	err = r.DeleteBranch(ctx, "from-base")
+	require.NoError(t, err)
+	_, err = r.GetCommitHashForRev(ctx, "from-base")
+	assert.Error(t, err)
+
+	err = r.DeleteBranch(ctx, "from-base")
+	assert.True(t, errors.Is(err, ErrBranchNotFound))
+}
+
+func TestMerge(t *testing.T) {
+	faker, err := newFaker()
+	require.NoError(t, err)
+	defer faker.clean()
+
+	var (
+		org      = "test-repo-org"
+		repoName = "repo-merge"
+		ctx      = context.Background()
+	)
+
+	err = faker.makeRepo(org, repoName)
+	require.NoError(t, err)
+	r := &repo{
+		dir:     faker.repoDir(org, repoName),
+		gitPath: faker.gitPath,
+	}
+
+	// Prepare a branch which can be merged cleanly and one conflicting with master.
+	err = r.CreateBranch(ctx, "clean", "")
+	require.NoError(t, err)
+	err = r.Checkout(ctx, "clean")
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(r.dir, "clean.txt"), []byte("clean"), os.ModePerm)
+	require.NoError(t, err)
+	err = r.addCommit(ctx, "Added clean.txt")
+	require.NoError(t, err)
+
+	err = r.CreateBranch(ctx, "conflict", "master")
+	require.NoError(t, err)
+	err = r.Checkout(ctx, "conflict")
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(r.dir, "README.md"), []byte("conflict"), os.ModePerm)
+	require.NoError(t, err)
+	err = r.addCommit(ctx, "Updated README.md")
+	require.NoError(t, err)
+
+	err = r.Checkout(ctx, "master")
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(r.dir, "README.md"), []byte("master"), os.ModePerm)
+	require.NoError(t, err)
+	err = r.addCommit(ctx, "Updated README.md on master")
+	require.NoError(t, err)
+	masterHash, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+
+	// Merge cleanly.
+	err = r.Merge(ctx, "clean")
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(r.dir, "clean.txt"))
+	assert.NoError(t, err)
+	mergedHash, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+	assert.NotEqual(t, masterHash, mergedHash)
+
+	// Merge with conflicts.
+	err = r.Merge(ctx, "conflict")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrMergeConflict))
+	assert.Contains(t, err.Error(), "README.md")
+
+	// Abort the conflicting merge.
+	err = r.ResetHard(ctx, "HEAD")
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(r.dir, "README.md"))
+	require.NoError(t, err)
+	assert.Equal(t, "master", string(data))
+
+	// Merge a non-existent ref.
+	err = r.Merge(ctx, "not-found")
+	assert.True(t, errors.Is(err, ErrRefNotFound))
+}
+
+func TestGetMergeBase(t *testing.T) {
+	faker, err := newFaker()
+	require.NoError(t, err)
+	defer faker.clean()
+
+	var (
+		org      = "test-repo-org"
+		repoName = "repo-merge-base"
+		ctx      = context.Background()
+	)
+
+	err = faker.makeRepo(org, repoName)
+	require.NoError(t, err)
+	r := &repo{
+		dir:     faker.repoDir(org, repoName),
+		gitPath: faker.gitPath,
+	}
+	baseHash, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+
+	// Prepare a feature branch diverged from master and a branch with an unrelated history.
+	err = r.CreateBranch(ctx, "feature", "")
+	require.NoError(t, err)
+	err = r.Checkout(ctx, "feature")
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(r.dir, "feature.txt"), []byte("feature"), os.ModePerm)
+	require.NoError(t, err)
+	err = r.addCommit(ctx, "Added feature.txt")
+	require.NoError(t, err)
+
+	err = r.Checkout(ctx, "master")
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(r.dir, "master.txt"), []byte("master"), os.ModePerm)
+	require.NoError(t, err)
+	err = r.addCommit(ctx, "Added master.txt")
+	require.NoError(t, err)
+
+	_, err = r.runGitCommand(ctx, "checkout", "--orphan", "unrelated")
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(r.dir, "unrelated.txt"), []byte("unrelated"), os.ModePerm)
+	require.NoError(t, err)
+	err = r.addCommit(ctx, "Added unrelated.txt")
+	require.NoError(t, err)
+	err = r.Checkout(ctx, "master")
+	require.NoError(t, err)
+
+	// Shared history.
+	hash, err := r.GetMergeBase(ctx, "master", "feature")
+	require.NoError(t, err)
+	assert.Equal(t, baseHash, hash)
+
+	hash, err = r.GetMergeBase(ctx, "feature", "master")
+	require.NoError(t, err)
+	assert.Equal(t, baseHash, hash)
+
+	// One is the ancestor of the other.
+	featureHash, err := r.GetCommitHashForRev(ctx, "feature")
+	require.NoError(t, err)
+	hash, err = r.GetMergeBase(ctx, "feature", "feature~1")
+	require.NoError(t, err)
+	assert.Equal(t, baseHash, hash)
+	hash, err = r.GetMergeBase(ctx, featureHash, "feature")
+	require.NoError(t, err)
+	assert.Equal(t, featureHash, hash)
+
+	// Unrelated histories.
+	_, err = r.GetMergeBase(ctx, "master", "unrelated")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrNoMergeBase))
+
+	// Non-existent refs.
+	for _, ref := range []string{"not-found", "", "--all"} {
+		_, err = r.GetMergeBase(ctx, "master", ref)
+		assert.True(t, errors.Is(err, ErrRefNotFound), ref)
+	}
+}
+
+func TestResetHard(t *testing.T) {
+	faker, err := newFaker()
+	require.NoError(t, err)
+	defer faker.clean()
+
+	var (
+		org      = "test-repo-org"
+		repoName = "repo-reset-hard"
+		ctx      = context.Background()
+	)
+
+	err = faker.makeRepo(org, repoName)
+	require.NoError(t, err)
+	r := &repo{
+		dir:     faker.repoDir(org, repoName),
+		gitPath: faker.gitPath,
+	}
+	firstCommitHash, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(r.dir, "a.txt"), []byte("a"), os.ModePerm)
+	require.NoError(t, err)
+	err = r.addCommit(ctx, "Added a.txt")
+	require.NoError(t, err)
+
+	// Make the working tree dirty.
+	err = ioutil.WriteFile(filepath.Join(r.dir, "README.md"), []byte("modified"), os.ModePerm)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(r.dir, "untracked.txt"), []byte("untracked"), os.ModePerm)
+	require.NoError(t, err)
+
+	err = r.ResetHard(ctx, firstCommitHash)
+	require.NoError(t, err)
+
+	hash, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, firstCommitHash, hash)
+	data, err := ioutil.ReadFile(filepath.Join(r.dir, "README.md"))
+	require.NoError(t, err)
+	assert.Equal(t, "Hello, test-repo-org/repo-reset-hard.\n", string(data))
+	for _, name := range []string{"a.txt", "untracked.txt"} {
+		_, err = os.Stat(filepath.Join(r.dir, name))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	err = r.ResetHard(ctx, "not-found")
+	assert.True(t, errors.Is(err, ErrRefNotFound))
+}
+
+func TestGetLatestCommit(t *testing.T) {
+	faker, err := newFaker()
+	require.NoError(t, err)
+	defer faker.clean()
+
+	var (
+		org      = "test-repo-org"
+		repoName = "repo-get-latest-commit"
+		ctx      = context.Background()
+	)
+
+	err = faker.makeRepo(org, repoName)
+	require.NoError(t, err)
+	r := &repo{
+		dir:     faker.repoDir(org, repoName),
+		gitPath: faker.gitPath,
+		gitEnvs: []string{
+			"GIT_AUTHOR_DATE=1600000000 +0000",
+			"GIT_COMMITTER_DATE=1600000600 +0000",
+		},
+	}
+
+	err = ioutil.WriteFile(filepath.Join(r.dir, "a.txt"), []byte("a"), os.ModePerm)
+	require.NoError(t, err)
+	err = r.addCommit(ctx, "Added a.txt\n\nThe details of the change.")
+	require.NoError(t, err)
+	hash, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+
+	commit, err := r.GetLatestCommit(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, Commit{
+		Author:          "test-user",
+		AuthorEmail:     "test@gmail.com",
+		Committer:       "test-user",
+		CreatedAt:       1600000000,
+		CommittedAt:     1600000600,
+		Hash:            hash,
+		AbbreviatedHash: commit.AbbreviatedHash,
+		Message:         "Added a.txt",
+		Body:            "The details of the change.",
+	}, commit)
+	assert.True(t, strings.HasPrefix(hash, commit.AbbreviatedHash))
+}
+
+func TestGetFileAtCommit(t *testing.T) {
+	faker, err := newFaker()
+	require.NoError(t, err)
+	defer faker.clean()
+
+	var (
+		org      = "test-repo-org"
+		repoName = "repo-get-file-at-commit"
+		ctx      = context.Background()
+	)
+
+	err = faker.makeRepo(org, repoName)
+	require.NoError(t, err)
+	r := &repo{
+		dir:     faker.repoDir(org, repoName),
+		gitPath: faker.gitPath,
+	}
+
+	firstCommitHash, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+
+	err = os.MkdirAll(filepath.Join(r.dir, "config"), os.ModePerm)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(r.dir, "config", "app.yaml"), []byte("replicas: 1\n"), os.ModePerm)
+	require.NoError(t, err)
+	err = r.addCommit(ctx, "Added config")
+	require.NoError(t, err)
+	secondCommitHash, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(filepath.Join(r.dir, "config", "app.yaml"), []byte("replicas: 2\n"), os.ModePerm)
+	require.NoError(t, err)
+	err = r.addCommit(ctx, "Updated config")
+	require.NoError(t, err)
+	thirdCommitHash, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+
+	// Leave the working tree at the first commit to make sure it is not used.
+	err = r.Checkout(ctx, firstCommitHash)
+	require.NoError(t, err)
+
+	second, err := r.GetFileAtCommit(ctx, "config/app.yaml", secondCommitHash)
+	require.NoError(t, err)
+	assert.Equal(t, "replicas: 1\n", string(second))
+
+	third, err := r.GetFileAtCommit(ctx, "./config/app.yaml", thirdCommitHash)
+	require.NoError(t, err)
+	assert.Equal(t, "replicas: 2\n", string(third))
+
+	_, err = os.Stat(filepath.Join(r.dir, "config", "app.yaml"))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = r.GetFileAtCommit(ctx, "config/app.yaml", firstCommitHash)
+	assert.True(t, errors.Is(err, ErrFileNotFound), err)
+
+	_, err = r.GetFileAtCommit(ctx, "config/app.yaml", "unknown-ref")
+	assert.True(t, errors.Is(err, ErrRefNotFound), err)
+}
+
+func TestFastForward(t *testing.T) {
+	faker, err := newFaker()
+	require.NoError(t, err)
+	defer faker.clean()
+
+	var (
+		ctx       = context.Background()
+		org       = "test-repo-org"
+		repoName  = "repo-fast-forward"
+		remote    = faker.repoDir(org, repoName)
+		commander = gitCommander{
+			gitPath: faker.gitPath,
+			dir:     faker.dir,
+			org:     org,
+			repo:    repoName,
+		}
+	)
+	err = faker.makeRepo(org, repoName)
+	require.NoError(t, err)
+
+	c, err := NewClient("test-user", "test@example.com", zap.NewNop())
+	require.NoError(t, err)
+	defer c.Clean()
+
+	r, err := c.Clone(ctx, repoName, remote, "master", "")
+	require.NoError(t, err)
+	defer r.Clean()
+
+	// Fast-forward to the new commit of the remote.
+	err = commander.addCommit("a.txt", "a")
+	require.NoError(t, err)
+	err = r.FastForward(ctx, "master")
+	require.NoError(t, err)
+	commit, err := r.GetLatestCommit(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Added a.txt", commit.Message)
+	content, err := ioutil.ReadFile(filepath.Join(r.GetPath(), "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(content))
+
+	// Unable to fast-forward because the histories have diverged.
+	err = ioutil.WriteFile(filepath.Join(r.GetPath(), "b.txt"), []byte("b"), os.ModePerm)
+	require.NoError(t, err)
+	err = r.Commit(ctx, "Added b.txt")
+	require.NoError(t, err)
+	err = commander.addCommit("c.txt", "c")
+	require.NoError(t, err)
+	err = r.FastForward(ctx, "master")
+	assert.True(t, errors.Is(err, ErrNotFastForward), err)
+
+	commit, err = r.GetLatestCommit(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Added b.txt", commit.Message)
+}
+
+func TestListTagsAndBranches(t *testing.T) {
+	faker, err := newFaker()
+	require.NoError(t, err)
+	defer faker.clean()
+
+	var (
+		org      = "test-repo-org"
+		repoName = "repo-list-tags-and-branches"
+		ctx      = context.Background()
+	)
+
+	err = faker.makeRepo(org, repoName)
+	require.NoError(t, err)
+	r := &repo{
+		dir:     faker.repoDir(org, repoName),
+		gitPath: faker.gitPath,
+	}
+
+	for _, tag := range []string{"v0.10.0", "v0.2.0", "v0.2.0-rc.1", "v0.9.0", "latest"} {
+		out, err := r.runGitCommand(ctx, "tag", tag)
+		require.NoError(t, err, string(out))
+	}
+	tags, err := r.ListTags(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v0.2.0-rc.1", "v0.2.0", "v0.9.0", "v0.10.0", "latest"}, tags)
+
+	for _, branch := range []string{"feature-b", "feature-a", "release/v0.1"} {
+		err = r.CreateBranch(ctx, branch, "")
+		require.NoError(t, err)
+	}
+	// The detached HEAD must not be listed.
+	err = r.Checkout(ctx, "v0.9.0")
+	require.NoError(t, err)
+	branches, err := r.ListBranches(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"feature-a", "feature-b", "master", "release/v0.1"}, branches)
+}
+
+func TestCopy(t *testing.T) {
+	faker, err := newFaker()
+	require.NoError(t, err)
+	defer faker.clean()
+
+	var (
+		org      = "test-repo-org"
+		repoName = "repo-copy"
+		ctx      = context.Background()
+	)
+	err = faker.makeRepo(org, repoName)
+	require.NoError(t, err)
+
+	c, err := NewClient("piped-user", "piped@example.com", zap.NewNop())
+	require.NoError(t, err)
+	defer c.Clean()
+
+	r, err := c.Clone(ctx, repoName, faker.repoDir(org, repoName), "master", "")
+	require.NoError(t, err)
+	defer r.Clean()
+	headHash, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+
+	// The destination must be empty.
+	_, err = r.Copy(faker.repoDir(org, repoName))
+	assert.True(t, errors.Is(err, ErrDestinationNotEmpty))
+
+	dest := filepath.Join(faker.dir, "copy")
+	cr, err := r.Copy(dest)
+	require.NoError(t, err)
+	defer cr.Clean()
+
+	assert.Equal(t, dest, cr.GetPath())
+	assert.Equal(t, r.GetRemote(), cr.GetRemote())
+	assert.Equal(t, r.GetClonedBranch(), cr.GetClonedBranch())
+	for key, expected := range map[string]string{
+		"remote.origin.url": faker.repoDir(org, repoName),
+		"user.name":         "piped-user",
+		"user.email":        "piped@example.com",
+	} {
+		out, err := cr.(*repo).runGitCommand(ctx, "config", "--get", key)
+		require.NoError(t, err)
+		assert.Equal(t, expected, strings.TrimSpace(string(out)), key)
+	}
+
+	// Modify the copy.
+	err = ioutil.WriteFile(filepath.Join(dest, "README.md"), []byte("modified"), os.ModePerm)
+	require.NoError(t, err)
+	err = cr.Commit(ctx, "Modified README.md")
+	require.NoError(t, err)
+
+	// The original must not be changed.
+	hash, err := r.GetCommitHashForRev(ctx, "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, headHash, hash)
+	data, err := ioutil.ReadFile(filepath.Join(r.GetPath(), "README.md"))
+	require.NoError(t, err)
+	assert.Equal(t, "Hello, test-repo-org/repo-copy.\n", string(data))
+	out, err := r.(*repo).runGitCommand(ctx, "status", "--porcelain")
+	require.NoError(t, err)
+	assert.Empty(t, string(out))
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"context"
+	"os"
+	"os/exec"
+)
+
+// commandRunner runs a git command with the given arguments in the given directory
+// and returns its combined output.
+// It is the only place executing git so tests can replace it with a fake one.
+type commandRunner interface {
+	Run(ctx context.Context, dir string, args ...string) ([]byte, error)
+}
+
+// execRunner runs git commands as subprocesses.
+type execRunner struct {
+	gitPath string
+	envs    []string
+}
+
+func (r execRunner) Run(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command(r.gitPath, args...)
+	cmd.Dir = dir
+	if len(r.envs) > 0 {
+		cmd.Env = append(os.Environ(), r.envs...)
+	}
+	return runCommand(ctx, cmd)
+}
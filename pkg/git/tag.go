@@ -0,0 +1,128 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var semverTagRegex = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+type semver struct {
+	numbers    [3]int
+	prerelease []string
+}
+
+// parseSemverTag parses a tag like "v1.2.3" or "1.2.3-rc.1".
+// The second returned value is false when the tag does not look like semver.
+func parseSemverTag(tag string) (semver, bool) {
+	matches := semverTagRegex.FindStringSubmatch(tag)
+	if matches == nil {
+		return semver{}, false
+	}
+	var v semver
+	for i := 0; i < 3; i++ {
+		n, err := strconv.Atoi(matches[i+1])
+		if err != nil {
+			return semver{}, false
+		}
+		v.numbers[i] = n
+	}
+	if matches[4] != "" {
+		v.prerelease = strings.Split(matches[4], ".")
+	}
+	return v, true
+}
+
+// compare returns -1, 0 or 1 when v is lower than, equal to or higher than o
+// following the precedence rules of semantic versioning.
+func (v semver) compare(o semver) int {
+	for i := range v.numbers {
+		if v.numbers[i] != o.numbers[i] {
+			return compareInt(v.numbers[i], o.numbers[i])
+		}
+	}
+
+	// A version without pre-release has higher precedence.
+	switch {
+	case len(v.prerelease) == 0 && len(o.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(o.prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.prerelease) && i < len(o.prerelease); i++ {
+		if c := comparePrereleaseIdentifier(v.prerelease[i], o.prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInt(len(v.prerelease), len(o.prerelease))
+}
+
+func comparePrereleaseIdentifier(a, b string) int {
+	an, aerr := strconv.Atoi(a)
+	bn, berr := strconv.Atoi(b)
+	switch {
+	case aerr == nil && berr == nil:
+		return compareInt(an, bn)
+	case aerr == nil:
+		// Numeric identifiers have lower precedence than alphanumeric ones.
+		return -1
+	case berr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func compareInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// sortTags sorts the given tags in ascending order.
+// The tags looking like semver are ordered by their versions and placed before
+// the other tags which are ordered lexically.
+func sortTags(tags []string) {
+	versions := make(map[string]semver, len(tags))
+	for _, t := range tags {
+		if v, ok := parseSemverTag(t); ok {
+			versions[t] = v
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		vi, iok := versions[tags[i]]
+		vj, jok := versions[tags[j]]
+		switch {
+		case iok && jok:
+			if c := vi.compare(vj); c != 0 {
+				return c < 0
+			}
+		case iok:
+			return true
+		case jok:
+			return false
+		}
+		return tags[i] < tags[j]
+	})
+}
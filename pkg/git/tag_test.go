@@ -0,0 +1,56 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortTags(t *testing.T) {
+	testcases := []struct {
+		name     string
+		tags     []string
+		expected []string
+	}{
+		{
+			name:     "empty",
+			tags:     []string{},
+			expected: []string{},
+		},
+		{
+			name:     "semver",
+			tags:     []string{"v1.10.0", "v1.2.0", "v1.2.0-rc.10", "v1.2.0-rc.2", "v1.2.0-alpha", "1.9.1"},
+			expected: []string{"v1.2.0-alpha", "v1.2.0-rc.2", "v1.2.0-rc.10", "v1.2.0", "1.9.1", "v1.10.0"},
+		},
+		{
+			name:     "non semver",
+			tags:     []string{"release-b", "release-a", "latest"},
+			expected: []string{"latest", "release-a", "release-b"},
+		},
+		{
+			name:     "mixed",
+			tags:     []string{"stable", "v0.10.0", "v0.9.0", "beta"},
+			expected: []string{"v0.9.0", "v0.10.0", "beta", "stable"},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			sortTags(tc.tags)
+			assert.Equal(t, tc.expected, tc.tags)
+		})
+	}
+}
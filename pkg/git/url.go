@@ -17,6 +17,7 @@ package git
 import (
 	"fmt"
 	"net/url"
+	"path/filepath"
 	"regexp"
 	"strings"
 )
@@ -139,6 +140,23 @@ var (
 	scpRegex = regexp.MustCompile(`^([a-zA-Z0-9_]+@)?([a-zA-Z0-9._-]+):(.*)$`)
 )
 
+// localRemotePath returns the path of the repository on the local filesystem
+// when the given remote is a file:// URL or an absolute or explicitly relative path,
+// e.g. a bare repository synced by other means in an air-gapped environment.
+func localRemotePath(remote string) (string, bool) {
+	if strings.HasPrefix(remote, "file://") {
+		u, err := url.Parse(remote)
+		if err != nil {
+			return "", false
+		}
+		return u.Path, true
+	}
+	if filepath.IsAbs(remote) || strings.HasPrefix(remote, "./") || strings.HasPrefix(remote, "../") {
+		return remote, true
+	}
+	return "", false
+}
+
 // parseGitURL parses git url into a URL structure.
 func parseGitURL(rawURL string) (u *url.URL, err error) {
 	u, err = parseTransport(rawURL)
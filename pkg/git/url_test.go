@@ -384,3 +384,49 @@ func TestParseGitURL(t *testing.T) {
 		})
 	}
 }
+
+func TestLocalRemotePath(t *testing.T) {
+	tests := []struct {
+		name     string
+		remote   string
+		wantPath string
+		wantOK   bool
+	}{
+		{
+			name:     "file URL",
+			remote:   "file:///var/repos/org/repo.git",
+			wantPath: "/var/repos/org/repo.git",
+			wantOK:   true,
+		},
+		{
+			name:     "absolute path",
+			remote:   "/var/repos/org/repo.git",
+			wantPath: "/var/repos/org/repo.git",
+			wantOK:   true,
+		},
+		{
+			name:     "relative path",
+			remote:   "../repos/org/repo.git",
+			wantPath: "../repos/org/repo.git",
+			wantOK:   true,
+		},
+		{
+			name:   "https URL",
+			remote: "https://github.com/org/repo.git",
+		},
+		{
+			name:   "SCP-like URL",
+			remote: "git@github.com:org/repo.git",
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, ok := localRemotePath(tt.remote)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantPath, path)
+		})
+	}
+}
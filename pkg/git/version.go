@@ -0,0 +1,82 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// defaultMinGitVersion is the oldest git supporting all flags we are using, e.g. --prune-tags.
+const defaultMinGitVersion = "2.17.0"
+
+var gitVersionRegex = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+type gitVersion struct {
+	major int
+	minor int
+	patch int
+}
+
+func (v gitVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+}
+
+// lessThan reports whether v is older than the given version.
+func (v gitVersion) lessThan(o gitVersion) bool {
+	if v.major != o.major {
+		return v.major < o.major
+	}
+	if v.minor != o.minor {
+		return v.minor < o.minor
+	}
+	return v.patch < o.patch
+}
+
+// parseGitVersion parses a version string like "2.17.0"
+// or the output of "git --version" like "git version 2.24.3 (Apple Git-128)".
+func parseGitVersion(s string) (gitVersion, error) {
+	matches := gitVersionRegex.FindStringSubmatch(s)
+	if matches == nil {
+		return gitVersion{}, fmt.Errorf("unable to parse git version from %q", s)
+	}
+	var (
+		v   gitVersion
+		err error
+	)
+	if v.major, err = strconv.Atoi(matches[1]); err != nil {
+		return gitVersion{}, err
+	}
+	if v.minor, err = strconv.Atoi(matches[2]); err != nil {
+		return gitVersion{}, err
+	}
+	if matches[3] != "" {
+		if v.patch, err = strconv.Atoi(matches[3]); err != nil {
+			return gitVersion{}, err
+		}
+	}
+	return v, nil
+}
+
+// getGitVersion returns the version of the git run by the given runner.
+func getGitVersion(ctx context.Context, runner commandRunner) (gitVersion, error) {
+	out, err := runner.Run(ctx, "", "--version")
+	if err != nil {
+		return gitVersion{}, formatCommandError(err, out)
+	}
+	return parseGitVersion(string(out))
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 The PipeCD Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package git
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGitVersion(t *testing.T) {
+	testcases := []struct {
+		input       string
+		expected    gitVersion
+		expectedErr bool
+	}{
+		{
+			input:    "git version 2.39.5\n",
+			expected: gitVersion{major: 2, minor: 39, patch: 5},
+		},
+		{
+			input:    "git version 2.24.3 (Apple Git-128)\n",
+			expected: gitVersion{major: 2, minor: 24, patch: 3},
+		},
+		{
+			input:    "git version 2.30.0.windows.1\n",
+			expected: gitVersion{major: 2, minor: 30, patch: 0},
+		},
+		{
+			input:    "2.17",
+			expected: gitVersion{major: 2, minor: 17, patch: 0},
+		},
+		{
+			input:       "unknown",
+			expectedErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.input, func(t *testing.T) {
+			v, err := parseGitVersion(tc.input)
+			assert.Equal(t, tc.expectedErr, err != nil)
+			assert.Equal(t, tc.expected, v)
+		})
+	}
+}
+
+func TestGitVersionLessThan(t *testing.T) {
+	v := gitVersion{major: 2, minor: 17, patch: 1}
+	assert.True(t, v.lessThan(gitVersion{major: 3}))
+	assert.True(t, v.lessThan(gitVersion{major: 2, minor: 18}))
+	assert.True(t, v.lessThan(gitVersion{major: 2, minor: 17, patch: 2}))
+	assert.False(t, v.lessThan(gitVersion{major: 2, minor: 17, patch: 1}))
+	assert.False(t, v.lessThan(gitVersion{major: 2, minor: 9, patch: 5}))
+	assert.False(t, v.lessThan(gitVersion{major: 1, minor: 99}))
+}
+
+func TestValidateGitVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fake-git")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	testcases := []struct {
+		name          string
+		output        string
+		minGitVersion string
+		expectedErr   bool
+	}{
+		{
+			name:          "newer than the default",
+			output:        "git version 2.39.5",
+			minGitVersion: defaultMinGitVersion,
+		},
+		{
+			name:          "same as the minimum",
+			output:        "git version 2.20.0",
+			minGitVersion: "2.20.0",
+		},
+		{
+			name:          "older than the default",
+			output:        "git version 2.7.4",
+			minGitVersion: defaultMinGitVersion,
+			expectedErr:   true,
+		},
+		{
+			name:          "invalid minimum",
+			output:        "git version 2.39.5",
+			minGitVersion: "latest",
+			expectedErr:   true,
+		},
+		{
+			name:          "unparsable output",
+			output:        "command not found",
+			minGitVersion: defaultMinGitVersion,
+			expectedErr:   true,
+		},
+	}
+	for i, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			gitPath := filepath.Join(dir, fmt.Sprintf("git-%d", i))
+			script := fmt.Sprintf("#!/bin/sh\necho %q\n", tc.output)
+			err := ioutil.WriteFile(gitPath, []byte(script), 0700)
+			require.NoError(t, err)
+
+			c := &client{
+				minGitVersion: tc.minGitVersion,
+			}
+			err = c.validateGitVersion(execRunner{gitPath: gitPath})
+			assert.Equal(t, tc.expectedErr, err != nil)
+		})
+	}
+
+	v, err := getGitVersion(context.Background(), execRunner{gitPath: filepath.Join(dir, "git-0")})
+	require.NoError(t, err)
+	assert.Equal(t, "2.39.5", v.String())
+}